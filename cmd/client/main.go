@@ -2,11 +2,15 @@ package main
 
 import (
 	"anytls/proxy"
+	"anytls/proxy/session"
 	"anytls/util"
 	"context"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
+	"math"
 	"net"
 	"net/url"
 	"os"
@@ -21,8 +25,12 @@ func main() {
 	listen := flag.String("l", "127.0.0.1:1080", "socks5 listen port")
 	serverAddr := flag.String("s", "", "Server address or anytls:// link")
 	sni := flag.String("sni", "", "Server Name Indication")
+	fingerprint := flag.String("fingerprint", "", "Pin the server certificate by its SHA-256 fingerprint")
 	password := flag.String("p", "", "Password")
 	minIdleSession := flag.Int("m", 5, "Reserved min idle session")
+	heartbeat := flag.Duration("heartbeat", 0, "Session heartbeat interval, 0 to disable")
+	heartbeatMaxMiss := flag.Int("heartbeat-miss", 3, "Close the session after this many unanswered heartbeats")
+	streamWindow := flag.Int("window", 256*1024, "Per-stream receive window in bytes (16KiB to 16MiB), 0 to disable flow control")
 	flag.Parse()
 
 	if serverURL, err := url.Parse(*serverAddr); err == nil {
@@ -33,6 +41,9 @@ func main() {
 			}
 			query := serverURL.Query()
 			*sni = query.Get("sni")
+			if query.Has("fingerprint") {
+				*fingerprint = query.Get("fingerprint")
+			}
 		}
 	}
 
@@ -48,6 +59,10 @@ func main() {
 		logrus.Fatalln("error server address:", *serverAddr, err)
 	}
 
+	if *streamWindow < 0 || int64(*streamWindow) > math.MaxUint32 {
+		logrus.Fatalln("error stream window:", *streamWindow)
+	}
+
 	logLevel, err := logrus.ParseLevel(os.Getenv("LOG_LEVEL"))
 	if err != nil {
 		logLevel = logrus.InfoLevel
@@ -74,6 +89,16 @@ func main() {
 		// disable the SNI
 		tlsConfig.ServerName = "127.0.0.1"
 	}
+	if *fingerprint != "" {
+		// Accept only the pinned certificate, e.g. the server's persisted self-signed one.
+		pinned := util.NormalizeFingerprint(*fingerprint)
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || util.CertificateFingerprint(rawCerts[0]) != pinned {
+				return errors.New("server certificate does not match the pinned fingerprint")
+			}
+			return nil
+		}
+	}
 
 	path := strings.TrimSpace(os.Getenv("TLS_KEY_LOG"))
 	if path != "" {
@@ -91,7 +116,10 @@ func main() {
 		}
 		conn = tls.Client(conn, tlsConfig)
 		return conn, nil
-	}, *minIdleSession)
+	}, *minIdleSession,
+		session.WithHeartbeat(*heartbeat, *heartbeatMaxMiss),
+		session.WithStreamWindow(uint32(*streamWindow)),
+	)
 
 	for {
 		c, err := listener.Accept()
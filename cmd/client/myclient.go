@@ -18,11 +18,11 @@ type myClient struct {
 	sessionClient *session.Client
 }
 
-func NewMyClient(ctx context.Context, dialOut util.DialOutFunc, minIdleSession int) *myClient {
+func NewMyClient(ctx context.Context, dialOut util.DialOutFunc, minIdleSession int, sessionOptions ...session.Option) *myClient {
 	s := &myClient{
 		dialOut: dialOut,
 	}
-	s.sessionClient = session.NewClient(ctx, s.createOutboundConnection, &padding.DefaultPaddingFactory, time.Second*30, time.Second*30, minIdleSession)
+	s.sessionClient = session.NewClient(ctx, s.createOutboundConnection, &padding.DefaultPaddingFactory, time.Second*30, time.Second*30, minIdleSession, sessionOptions...)
 	return s
 }
 
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/internal/ledger"
+)
+
+// runLedger 实现 ledger 子命令：查询独立模式的流量账本
+// 以只读方式加载账本文件，服务运行时也可以使用
+func runLedger(args []string) {
+	fs := flag.NewFlagSet("ledger", flag.ExitOnError)
+	configPath := fs.String("c", "/etc/anytls/config.yaml", "配置文件路径，读取 ledger.path 和 ledger.reset_day")
+	path := fs.String("f", "", "账本文件路径（覆盖配置文件）")
+	resetDay := fs.Int("reset-day", 0, "每月流量重置日（覆盖配置文件）")
+	userID := fs.Int("user", 0, "用户 ID，0 表示所有用户")
+	from := fs.String("from", "", "起始日期 YYYY-MM-DD，默认为当前计费周期第一天")
+	to := fs.String("to", "", "结束日期 YYYY-MM-DD（含），默认为当前计费周期最后一天")
+	daily := fs.Bool("daily", false, "按天列出，默认只显示每个用户的合计")
+	jsonOutput := fs.Bool("json", false, "以 JSON 格式输出每天的记录")
+	fs.Parse(args)
+
+	if *path == "" || *resetDay == 0 {
+		cfg, err := config.LoadConfig(*configPath)
+		if err != nil && *path == "" {
+			fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+			os.Exit(1)
+		}
+		if err == nil {
+			if *path == "" {
+				*path = cfg.Ledger.Path
+			}
+			if *resetDay == 0 {
+				*resetDay = cfg.Ledger.ResetDay
+			}
+		}
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "未配置流量账本: 请在配置文件中设置 ledger.path 或使用 -f <path>")
+		os.Exit(1)
+	}
+
+	rangeFrom, rangeTo, err := ledger.ParseRange(*from, *to, time.Now(), *resetDay)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	l, err := ledger.Load(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	entries := l.Query(*userID, rangeFrom, rangeTo)
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+
+	fmt.Printf("%s ~ %s\n\n", rangeFrom, rangeTo)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if *daily {
+		fmt.Fprintln(w, "USER\tDATE\tUPLOAD\tDOWNLOAD")
+		for _, e := range entries {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.UserID, e.Date, formatBytes(e.Upload), formatBytes(e.Download))
+		}
+	} else {
+		fmt.Fprintln(w, "USER\tUPLOAD\tDOWNLOAD\tTOTAL")
+		totals := ledger.Sum(entries)
+		// entries 已按用户 ID 排序
+		for i, e := range entries {
+			if i > 0 && entries[i-1].UserID == e.UserID {
+				continue
+			}
+			t := totals[e.UserID]
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", e.UserID, formatBytes(t[0]), formatBytes(t[1]), formatBytes(t[0]+t[1]))
+		}
+	}
+	w.Flush()
+}
+
+// formatBytes 以二进制单位格式化字节数
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
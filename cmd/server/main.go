@@ -16,38 +16,60 @@ import (
 	"anytls/util"
 )
 
-const trafficPersistPath = "/tmp/anytls-traffic.json"
-
 func main() {
+	// 子命令
+	if len(os.Args) > 1 && os.Args[1] == "ledger" {
+		runLedger(os.Args[2:])
+		return
+	}
+
 	configPath := flag.String("c", "/etc/anytls/config.yaml", "配置文件路径")
 	standalone := flag.Bool("standalone", false, "独立运行模式（不依赖 Xboard）")
 	password := flag.String("p", "", "独立模式密码")
+	usersFile := flag.String("users", "", "独立模式用户文件（YAML/JSON），设置后忽略 -p")
 	listen := flag.String("l", "", "监听地址（覆盖配置文件）")
-	sni := flag.String("sni", "", "TLS SNI（用于生成分享链接）")
+	sni := flag.String("sni", "", "TLS SNI（用于生成分享链接，独立模式下同时写入自签名证书）")
+	drainTimeout := flag.Duration("drain-timeout", 30*time.Second, "平滑升级时旧进程等待现有连接结束的最长时间")
 	flag.Parse()
 
+	// 平滑升级时以同样的参数启动新的可执行文件；先记下路径，升级时文件可能已被替换
+	executable, err := os.Executable()
+	if err != nil {
+		executable = os.Args[0]
+	}
+
 	var cfg *config.Config
 
 	if *standalone {
 		// 独立模式：不需要配置文件
-		if *password == "" {
-			fmt.Fprintln(os.Stderr, "独立模式需要指定密码: -p <password>")
+		if *password == "" && *usersFile == "" {
+			fmt.Fprintln(os.Stderr, "独立模式需要指定密码或用户文件: -p <password> 或 -users <path>")
 			os.Exit(1)
 		}
 		listenAddr := "0.0.0.0:8443"
 		if *listen != "" {
 			listenAddr = *listen
 		}
+		selfSigned := config.SelfSignedConfig{
+			CertFile: config.DefaultSelfSignedCertFile,
+			KeyFile:  config.DefaultSelfSignedKeyFile,
+			Validity: config.DefaultSelfSignedValidity,
+		}
+		if *sni != "" {
+			selfSigned.Names = []string{*sni}
+		}
 		cfg = &config.Config{
 			Listen:     listenAddr,
 			Standalone: true,
 			Password:   *password,
+			UsersFile:  *usersFile,
 			NodeType:   "anytls",
+			TLS:        config.TLSConfig{SelfSigned: selfSigned},
 			Log:        config.LogConfig{Level: "info"},
+			Traffic:    config.TrafficConfig{PersistPath: config.DefaultTrafficPersistPath},
 		}
 	} else {
 		// Xboard 模式：从配置文件加载
-		var err error
 		cfg, err = config.LoadConfig(*configPath)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
@@ -67,15 +89,29 @@ func main() {
 
 	logger.WithField("version", util.ProgramVersionName).Info("AnytlsServer 启动中")
 
+	// 由平滑升级启动时，等待旧进程交出 listener 和流量状态后再打开持久化文件
+	handoff, err := server.InheritedHandoff()
+	if err != nil {
+		logger.WithError(err).Fatal("平滑升级接管失败")
+	}
+
 	// 创建 Server
 	srv, err := server.NewServer(cfg)
 	if err != nil {
 		logger.WithError(err).Fatal("创建服务失败")
 	}
-
-	// 加载持久化流量数据
-	if err := srv.LoadTrafficData(trafficPersistPath); err != nil {
-		logger.WithError(err).Warn("加载持久化流量数据失败")
+	if handoff != nil {
+		srv.Inherit(handoff)
+	}
+	if cfg.Path != "" {
+		// 热重载时保留命令行参数对配置文件的覆盖
+		srv.SetConfigLoader(func() (*config.Config, error) {
+			reloaded, err := config.LoadConfig(*configPath)
+			if err == nil && *listen != "" {
+				reloaded.Listen = *listen
+			}
+			return reloaded, err
+		})
 	}
 
 	// 启动服务
@@ -87,25 +123,53 @@ func main() {
 		errCh <- srv.Start(ctx)
 	}()
 
-	// 独立模式：打印分享链接
-	if cfg.Standalone {
+	// 独立模式：打印分享链接（用户文件模式下每个用户的密码不同，不打印）
+	if cfg.Standalone && cfg.UsersFile == "" && handoff == nil {
 		// 等一小会让 listener 启动
 		time.Sleep(200 * time.Millisecond)
-		printShareLink(cfg, *sni)
+		printShareLink(cfg, *sni, srv.SelfSignedFingerprint())
 	}
 
 	// 处理信号
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
+	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP, syscall.SIGUSR2)
 
-	select {
-	case sig := <-sigCh:
-		logger.WithField("signal", sig.String()).Info("收到关闭信号")
-	case err := <-errCh:
-		if err != nil {
-			logger.WithError(err).Fatal("服务异常退出")
+wait:
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig == syscall.SIGHUP {
+				// SIGHUP 重新加载配置文件和独立模式的用户文件，现有会话不受影响
+				if cfg.Path != "" {
+					if err := srv.ReloadConfig(); err != nil {
+						logger.WithError(err).Error("重新加载配置文件失败，保留当前配置")
+					}
+				}
+				if err := srv.ReloadUsers(); err != nil {
+					logger.WithError(err).Error("重新加载用户文件失败，保留当前用户")
+				}
+				continue
+			}
+			if sig == syscall.SIGUSR2 {
+				// SIGUSR2 平滑升级：启动新的可执行文件接管 listener，当前进程排空现有连接后退出
+				drainCtx, drainCancel := context.WithTimeout(context.Background(), *drainTimeout)
+				err := srv.Upgrade(drainCtx, executable, os.Args[1:]...)
+				drainCancel()
+				if err != nil {
+					logger.WithError(err).Error("平滑升级失败")
+					continue
+				}
+				logger.Info("平滑升级完成，旧进程退出")
+				return
+			}
+			logger.WithField("signal", sig.String()).Info("收到关闭信号")
+			break wait
+		case err := <-errCh:
+			if err != nil {
+				logger.WithError(err).Fatal("服务异常退出")
+			}
+			return
 		}
-		return
 	}
 
 	// 优雅关闭
@@ -122,7 +186,8 @@ func main() {
 }
 
 // printShareLink 打印 anytls:// 分享链接
-func printShareLink(cfg *config.Config, sni string) {
+// 使用自签名证书时 fingerprint 为证书的 SHA-256 指纹，链接中携带指纹供客户端固定证书，不再需要 insecure
+func printShareLink(cfg *config.Config, sni, fingerprint string) {
 	_, port, _ := net.SplitHostPort(cfg.Listen)
 
 	// 尝试获取公网 IP
@@ -142,13 +207,20 @@ func printShareLink(cfg *config.Config, sni string) {
 	if sni != "" {
 		q.Set("sni", sni)
 	}
-	q.Set("insecure", "1") // 自签名证书需要 insecure
+	if fingerprint != "" {
+		q.Set("fingerprint", fingerprint)
+	} else {
+		q.Set("insecure", "1") // 使用配置的证书时无法确定客户端能否验证，保持 insecure
+	}
 	u.RawQuery = q.Encode()
 
 	fmt.Println()
 	fmt.Println("========== AnyTLS 分享链接 ==========")
 	fmt.Println(u.String())
 	fmt.Println("======================================")
+	if fingerprint != "" {
+		fmt.Println("证书 SHA-256 指纹:", fingerprint)
+	}
 	fmt.Println()
 	fmt.Println("FlClash/Clash.Meta 配置:")
 	fmt.Printf(`
@@ -158,8 +230,12 @@ func printShareLink(cfg *config.Config, sni string) {
     port: %s
     password: "%s"
     udp: true
-    skip-cert-verify: true
 `, host, port, cfg.Password)
+	if fingerprint != "" {
+		fmt.Printf("    fingerprint: \"%s\"\n", fingerprint)
+	} else {
+		fmt.Println("    skip-cert-verify: true")
+	}
 	if sni != "" {
 		fmt.Printf("    sni: \"%s\"\n", sni)
 	}
@@ -26,6 +26,8 @@ CONFIG_DIR="/etc/anytls"
 CONFIG_FILE="${CONFIG_DIR}/config.yaml"
 CERT_FILE="${CONFIG_DIR}/cert.pem"
 KEY_FILE="${CONFIG_DIR}/key.pem"
+# 服务端首次启动时生成并保存的自签名证书（tls.self_signed.cert_file 的默认值）
+SELF_SIGNED_CERT_FILE="/var/lib/anytls/self-signed.crt"
 
 # 日志路径
 LOG_DIR="/var/log/anytls"
@@ -211,7 +213,8 @@ Description=AnytlsServer - AnyTLS Proxy Server
 After=network.target
 
 [Service]
-Type=simple
+Type=notify
+NotifyAccess=all
 ExecStart=${BINARY_PATH} -c ${CONFIG_FILE}
 Restart=on-failure
 RestartSec=5
@@ -587,6 +590,13 @@ setup_config() {
     choose_install_mode
 }
 
+# 自签名证书的 SHA-256 指纹（小写十六进制），证书尚未生成或没有 openssl 时输出为空
+self_signed_fingerprint() {
+    if [[ -f "${SELF_SIGNED_CERT_FILE}" ]] && command -v openssl >/dev/null 2>&1; then
+        openssl x509 -in "${SELF_SIGNED_CERT_FILE}" -noout -fingerprint -sha256 | cut -d= -f2 | tr -d ':' | tr 'A-F' 'a-f'
+    fi
+}
+
 # 显示分享链接
 show_share_link() {
     local password="$1"
@@ -602,11 +612,27 @@ show_share_link() {
         sni_param="&sni=${domain}"
         sni_line="    sni: \"${domain}\""
     fi
+    # 使用自签名证书时客户端固定证书指纹，不再跳过证书验证
+    local fingerprint=""
+    if [[ -z "${domain}" ]]; then
+        fingerprint=$(self_signed_fingerprint)
+    fi
+    local verify_param="insecure=1"
+    local verify_line="    skip-cert-verify: true"
+    if [[ -n "${fingerprint}" ]]; then
+        verify_param="fingerprint=${fingerprint}"
+        verify_line="    fingerprint: \"${fingerprint}\""
+    fi
 
     echoContent red "\n=============================================================="
     echoContent green "========== AnyTLS 分享链接 =========="
-    echoContent skyBlue "anytls://${password}@${host}:${port}/?insecure=1${sni_param}"
+    echoContent skyBlue "anytls://${password}@${host}:${port}/?${verify_param}${sni_param}"
     echoContent green "======================================"
+    if [[ -n "${fingerprint}" ]]; then
+        echoContent green "证书 SHA-256 指纹：${fingerprint}"
+    elif [[ -z "${domain}" ]]; then
+        echoContent yellow "自签名证书在服务首次启动时生成，启动后可通过「查看配置/分享链接」获取带证书指纹的链接"
+    fi
     echoContent green ""
     echoContent green "FlClash / Clash.Meta 配置片段："
     echoContent yellow "  - name: \"anytls-node\""
@@ -615,7 +641,7 @@ show_share_link() {
     echoContent yellow "    port: ${port}"
     echoContent yellow "    password: \"${password}\""
     echoContent yellow "    udp: true"
-    echoContent yellow "    skip-cert-verify: true"
+    echoContent yellow "${verify_line}"
     if [[ -n "${sni_line}" ]]; then
         echoContent yellow "${sni_line}"
     fi
@@ -840,13 +866,30 @@ show_log() {
 update_binary() {
     echoContent skyBlue "正在更新 AnytlsServer..."
 
+    # 服务文件为 Type=notify 时正在运行的版本支持平滑升级：替换文件后发送 SIGUSR2，现有连接不断开
+    if systemctl is-active "${SERVICE_NAME}" >/dev/null 2>&1 && grep -q "^Type=notify" "${SERVICE_FILE}"; then
+        local old_pid
+        old_pid=$(systemctl show -p MainPID --value "${SERVICE_NAME}")
+        download_binary
+        systemctl kill -s SIGUSR2 --kill-who=main "${SERVICE_NAME}"
+        # 新进程就绪后 systemd 的主进程切换为新进程
+        sleep 5
+        if [[ "$(systemctl show -p MainPID --value "${SERVICE_NAME}")" != "${old_pid}" ]]; then
+            echoContent green "AnytlsServer 已平滑升级，旧版本会在现有连接结束后退出"
+        else
+            echoContent red "AnytlsServer 平滑升级失败，仍在运行旧版本，请查看日志"
+        fi
+        return
+    fi
+
     # 停止服务
     if systemctl is-active "${SERVICE_NAME}" >/dev/null 2>&1; then
         systemctl stop "${SERVICE_NAME}"
     fi
 
-    # 下载新版本
+    # 下载新版本，并更新服务文件以支持之后的平滑升级
     download_binary
+    setup_systemd
 
     # 重启服务
     systemctl start "${SERVICE_NAME}"
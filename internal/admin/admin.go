@@ -0,0 +1,227 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrUnavailable 当前运行模式不支持该操作（如独立模式下的 pull/push）
+var ErrUnavailable = errors.New("当前模式不支持该操作")
+
+// Backend 管理接口操作的服务端
+type Backend interface {
+	// OnlineUsers 返回当前在线用户及其 IP
+	OnlineUsers() []OnlineUser
+	// KickUser 关闭用户的所有会话，返回关闭的会话数
+	KickUser(userID int) int
+	// BannedIPs 返回当前被封禁的 IP
+	BannedIPs() []BannedIP
+	// Unban 解除 IP 封禁，返回该 IP 此前是否处于封禁状态
+	Unban(ip string) bool
+	// Traffic 返回每个用户的流量计数
+	Traffic() []UserTraffic
+	// Ledger 查询流量账本，userID 为 0 时查询所有用户
+	// from/to 为闭区间日期（YYYY-MM-DD），为空时取当前计费周期的起止日期
+	Ledger(userID int, from, to string) (LedgerReport, error)
+	// Pull 立即执行一次 pull 周期
+	Pull() error
+	// Push 立即执行一次 push 周期
+	Push() error
+	// LogLevel 返回当前日志级别
+	LogLevel() string
+	// SetLogLevel 修改日志级别
+	SetLogLevel(level string) error
+}
+
+// OnlineUser 在线用户
+type OnlineUser struct {
+	UserID   int      `json:"user_id"`
+	IPs      []string `json:"ips"`
+	Sessions int      `json:"sessions"`
+}
+
+// BannedIP 被封禁的 IP
+type BannedIP struct {
+	IP        string    `json:"ip"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UserTraffic 用户流量，Pending 为尚未上报的流量，Total 为进程启动以来的累计流量
+type UserTraffic struct {
+	UserID          int   `json:"user_id"`
+	PendingUpload   int64 `json:"pending_upload"`
+	PendingDownload int64 `json:"pending_download"`
+	TotalUpload     int64 `json:"total_upload"`
+	TotalDownload   int64 `json:"total_download"`
+}
+
+// LedgerEntry 某用户某天的流量
+type LedgerEntry struct {
+	UserID   int    `json:"user_id"`
+	Date     string `json:"date"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+// LedgerTotal 某用户在查询范围内的流量合计
+type LedgerTotal struct {
+	UserID   int   `json:"user_id"`
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// LedgerReport 流量账本查询结果，From/To 为实际使用的日期范围（闭区间）
+type LedgerReport struct {
+	From    string        `json:"from"`
+	To      string        `json:"to"`
+	Entries []LedgerEntry `json:"entries"`
+	Totals  []LedgerTotal `json:"totals"`
+}
+
+// NewHandler 创建管理接口的 HTTP handler，所有请求需携带 "Authorization: Bearer <token>"
+func NewHandler(backend Backend, token string) http.Handler {
+	h := &handler{backend: backend}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", h.listUsers)
+	mux.HandleFunc("POST /users/{id}/kick", h.kickUser)
+	mux.HandleFunc("GET /bans", h.listBans)
+	mux.HandleFunc("DELETE /bans/{ip}", h.unban)
+	mux.HandleFunc("GET /traffic", h.traffic)
+	mux.HandleFunc("GET /ledger", h.ledger)
+	mux.HandleFunc("POST /sync/pull", h.pull)
+	mux.HandleFunc("POST /sync/push", h.push)
+	mux.HandleFunc("GET /log/level", h.getLogLevel)
+	mux.HandleFunc("PUT /log/level", h.setLogLevel)
+	return requireToken(token, mux)
+}
+
+type handler struct {
+	backend Backend
+}
+
+// requireToken 校验 Bearer token
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if token == "" || subtle.ConstantTimeCompare(got, expected) != 1 {
+			writeError(w, http.StatusUnauthorized, "认证失败")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) listUsers(w http.ResponseWriter, r *http.Request) {
+	users := h.backend.OnlineUsers()
+	sort.Slice(users, func(i, j int) bool { return users[i].UserID < users[j].UserID })
+	writeJSON(w, http.StatusOK, users)
+}
+
+func (h *handler) kickUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "用户 ID 格式错误")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"closed": h.backend.KickUser(userID)})
+}
+
+func (h *handler) listBans(w http.ResponseWriter, r *http.Request) {
+	bans := h.backend.BannedIPs()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].IP < bans[j].IP })
+	writeJSON(w, http.StatusOK, bans)
+}
+
+func (h *handler) unban(w http.ResponseWriter, r *http.Request) {
+	if !h.backend.Unban(r.PathValue("ip")) {
+		writeError(w, http.StatusNotFound, "该 IP 未被封禁")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) traffic(w http.ResponseWriter, r *http.Request) {
+	traffic := h.backend.Traffic()
+	sort.Slice(traffic, func(i, j int) bool { return traffic[i].UserID < traffic[j].UserID })
+	writeJSON(w, http.StatusOK, traffic)
+}
+
+func (h *handler) ledger(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userID := 0
+	if v := query.Get("user_id"); v != "" {
+		var err error
+		if userID, err = strconv.Atoi(v); err != nil || userID <= 0 {
+			writeError(w, http.StatusBadRequest, "用户 ID 格式错误")
+			return
+		}
+	}
+	report, err := h.backend.Ledger(userID, query.Get("from"), query.Get("to"))
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, ErrUnavailable) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (h *handler) pull(w http.ResponseWriter, r *http.Request) {
+	h.runSync(w, h.backend.Pull)
+}
+
+func (h *handler) push(w http.ResponseWriter, r *http.Request) {
+	h.runSync(w, h.backend.Push)
+}
+
+func (h *handler) runSync(w http.ResponseWriter, f func() error) {
+	if err := f(); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrUnavailable) {
+			status = http.StatusConflict
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type logLevel struct {
+	Level string `json:"level"`
+}
+
+func (h *handler) getLogLevel(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, logLevel{Level: h.backend.LogLevel()})
+}
+
+func (h *handler) setLogLevel(w http.ResponseWriter, r *http.Request) {
+	var req logLevel
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "请求格式错误")
+		return
+	}
+	if err := h.backend.SetLogLevel(strings.TrimSpace(req.Level)); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, logLevel{Level: h.backend.LogLevel()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
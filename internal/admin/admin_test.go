@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeBackend struct {
+	kicked   []int
+	unbanned []string
+	pulls    int
+	pullErr  error
+	level    string
+	ledgerQ  []string
+}
+
+func (b *fakeBackend) OnlineUsers() []OnlineUser {
+	return []OnlineUser{
+		{UserID: 2, IPs: []string{"10.0.0.2"}, Sessions: 1},
+		{UserID: 1, IPs: []string{"10.0.0.1", "10.0.0.3"}, Sessions: 3},
+	}
+}
+
+func (b *fakeBackend) KickUser(userID int) int {
+	b.kicked = append(b.kicked, userID)
+	return 3
+}
+
+func (b *fakeBackend) BannedIPs() []BannedIP {
+	return []BannedIP{{IP: "192.0.2.1", ExpiresAt: time.Unix(1700000000, 0).UTC()}}
+}
+
+func (b *fakeBackend) Unban(ip string) bool {
+	b.unbanned = append(b.unbanned, ip)
+	return ip == "192.0.2.1"
+}
+
+func (b *fakeBackend) Traffic() []UserTraffic {
+	return []UserTraffic{{UserID: 1, PendingUpload: 10, PendingDownload: 20, TotalUpload: 100, TotalDownload: 200}}
+}
+
+func (b *fakeBackend) Ledger(userID int, from, to string) (LedgerReport, error) {
+	b.ledgerQ = append(b.ledgerQ, fmt.Sprintf("%d:%s:%s", userID, from, to))
+	if from == "bad" {
+		return LedgerReport{}, errors.New("起始日期格式错误: bad")
+	}
+	return LedgerReport{From: "2026-10-01", To: "2026-10-31"}, nil
+}
+
+func (b *fakeBackend) Pull() error {
+	b.pulls++
+	return b.pullErr
+}
+
+func (b *fakeBackend) Push() error { return ErrUnavailable }
+
+func (b *fakeBackend) LogLevel() string { return b.level }
+
+func (b *fakeBackend) SetLogLevel(level string) error {
+	if level != "debug" && level != "info" {
+		return errors.New("日志级别无效")
+	}
+	b.level = level
+	return nil
+}
+
+// do 发送带 token 的请求
+func do(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHandler_Auth(t *testing.T) {
+	h := NewHandler(&fakeBackend{}, "secret")
+	for _, header := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/users", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", header, rec.Code)
+		}
+	}
+
+	// 未配置 token 时拒绝所有请求
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	NewHandler(&fakeBackend{}, "").ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("empty token: status = %d, want 401", rec.Code)
+	}
+}
+
+func TestHandler_Endpoints(t *testing.T) {
+	backend := &fakeBackend{level: "info"}
+	h := NewHandler(backend, "secret")
+
+	rec := do(t, h, http.MethodGet, "/users", "")
+	var users []OnlineUser
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].UserID != 1 || users[0].Sessions != 3 {
+		t.Errorf("users = %+v, want sorted by user_id", users)
+	}
+
+	rec = do(t, h, http.MethodPost, "/users/7/kick", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"closed":3}` {
+		t.Errorf("kick: %d %s", rec.Code, rec.Body)
+	}
+	if len(backend.kicked) != 1 || backend.kicked[0] != 7 {
+		t.Errorf("kicked = %v, want [7]", backend.kicked)
+	}
+	if rec := do(t, h, http.MethodPost, "/users/abc/kick", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("kick invalid id: status = %d, want 400", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodGet, "/bans", "")
+	if !strings.Contains(rec.Body.String(), `"ip":"192.0.2.1"`) {
+		t.Errorf("bans = %s", rec.Body)
+	}
+	if rec := do(t, h, http.MethodDelete, "/bans/192.0.2.1", ""); rec.Code != http.StatusNoContent {
+		t.Errorf("unban: status = %d, want 204", rec.Code)
+	}
+	if rec := do(t, h, http.MethodDelete, "/bans/192.0.2.9", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("unban unknown: status = %d, want 404", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodGet, "/traffic", "")
+	if !strings.Contains(rec.Body.String(), `"total_download":200`) {
+		t.Errorf("traffic = %s", rec.Body)
+	}
+
+	rec = do(t, h, http.MethodGet, "/ledger?user_id=3&from=2026-10-01", "")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"to":"2026-10-31"`) {
+		t.Errorf("ledger: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, http.MethodGet, "/ledger?from=bad", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("ledger invalid range: status = %d, want 400", rec.Code)
+	}
+	if rec := do(t, h, http.MethodGet, "/ledger?user_id=x", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("ledger invalid user: status = %d, want 400", rec.Code)
+	}
+	if want := []string{"3:2026-10-01:", "0:bad:"}; fmt.Sprint(backend.ledgerQ) != fmt.Sprint(want) {
+		t.Errorf("ledger queries = %v, want %v", backend.ledgerQ, want)
+	}
+
+	if rec := do(t, h, http.MethodPost, "/sync/pull", ""); rec.Code != http.StatusNoContent || backend.pulls != 1 {
+		t.Errorf("pull: status = %d, pulls = %d", rec.Code, backend.pulls)
+	}
+	backend.pullErr = fmt.Errorf("拉取用户列表失败: %w", errors.New("timeout"))
+	if rec := do(t, h, http.MethodPost, "/sync/pull", ""); rec.Code != http.StatusBadGateway {
+		t.Errorf("pull error: status = %d, want 502", rec.Code)
+	}
+	if rec := do(t, h, http.MethodPost, "/sync/push", ""); rec.Code != http.StatusConflict {
+		t.Errorf("push unavailable: status = %d, want 409", rec.Code)
+	}
+
+	rec = do(t, h, http.MethodPut, "/log/level", `{"level":"debug"}`)
+	if rec.Code != http.StatusOK || backend.level != "debug" {
+		t.Errorf("set log level: %d %s", rec.Code, rec.Body)
+	}
+	if rec := do(t, h, http.MethodPut, "/log/level", `{"level":"verbose"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid log level: status = %d, want 400", rec.Code)
+	}
+	rec = do(t, h, http.MethodGet, "/log/level", "")
+	if strings.TrimSpace(rec.Body.String()) != `{"level":"debug"}` {
+		t.Errorf("log level = %s", rec.Body)
+	}
+
+	if rec := do(t, h, http.MethodGet, "/users/1/kick", ""); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("wrong method: status = %d, want 405", rec.Code)
+	}
+}
+
+func TestValidateAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:9091", "[::1]:9091", "localhost:9091", "unix:/run/anytls/admin.sock"} {
+		if err := ValidateAddress(addr); err != nil {
+			t.Errorf("%s: unexpected error %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"0.0.0.0:9091", ":9091", "203.0.113.1:9091", "example.com:9091", "unix:", "127.0.0.1"} {
+		if err := ValidateAddress(addr); err == nil {
+			t.Errorf("%s: expected error", addr)
+		}
+	}
+}
+
+func TestListen_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "admin.sock")
+	// 残留的 socket 文件会被替换
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket mode = %o, want 600", perm)
+	}
+
+	srv := &http.Server{Handler: NewHandler(&fakeBackend{level: "info"}, "secret")}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodGet, "http://admin/log/level", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
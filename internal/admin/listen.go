@@ -0,0 +1,58 @@
+package admin
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix Unix socket 地址前缀，如 "unix:/run/anytls/admin.sock"
+const unixPrefix = "unix:"
+
+// ValidateAddress 检查管理接口地址：只允许 Unix socket 或回环地址
+func ValidateAddress(address string) error {
+	if path, ok := strings.CutPrefix(address, unixPrefix); ok {
+		if path == "" {
+			return errors.New("unix socket 路径不能为空")
+		}
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("地址格式错误: %w", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("只允许监听 unix socket 或回环地址，当前为 %s", host)
+	}
+	return nil
+}
+
+// Listen 监听管理接口地址
+// Unix socket 会先删除残留的 socket 文件，并将权限设为 0600
+func Listen(address string) (net.Listener, error) {
+	if err := ValidateAddress(address); err != nil {
+		return nil, err
+	}
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -6,54 +6,96 @@ import (
 	"time"
 )
 
-// Tracker 在线设备追踪器
+// idleRetention 已断开的 IP 最多保留的时长，用于从未上报（如独立模式）时清理
+const idleRetention = 10 * time.Minute
+
+// Tracker 在线设备追踪器，同时负责设备数限制
+// 同一用户同一 IP 的多个会话按引用计数，最后一个会话断开后该 IP 才下线；
+// 下线的 IP 保留到下一次成功上报之后，上报周期内出现过的 IP 即使已断开也会上报
+// 用户的在线设备数 = 面板下发的全局在线数 - 本节点已上报给面板的 IP 数 + 本节点当前在线的 IP 数，
+// 即其他节点的设备加上本节点实时的设备；独立模式没有面板数据，只计本节点
 type Tracker struct {
 	mu     sync.RWMutex
-	online map[int]map[string]time.Time // user_id -> {ip -> last_seen}
-	nodeID int                          // 当前节点 ID，用于生成 "ip_nodeId" 格式
+	online map[int]map[string]*ipState // user_id -> {ip -> state}
+	nodeID int                         // 当前节点 ID，用于生成 "ip_nodeId" 格式
+
+	remote     map[int]int // 面板下发的全局在线设备数，每个 pull 周期更新
+	reported   map[int]int // 最近一次成功上报给面板的本节点在线 IP 数，已包含在 remote 中
+	snapshotAt time.Time   // 最近一次 Snapshot 的时间
+}
+
+// ipState 单个用户单个 IP 的在线状态
+type ipState struct {
+	refs     int       // 当前在线的会话数，为 0 表示已断开但尚未上报
+	lastSeen time.Time // 最近一次会话建立或断开的时间
 }
 
 // NewTracker 创建在线设备追踪器
 func NewTracker(nodeID int) *Tracker {
 	return &Tracker{
-		online: make(map[int]map[string]time.Time),
-		nodeID: nodeID,
+		online:   make(map[int]map[string]*ipState),
+		nodeID:   nodeID,
+		remote:   make(map[int]int),
+		reported: make(map[int]int),
 	}
 }
 
-// Track 记录用户在线
+// Track 记录用户的一个会话上线，每次调用需对应一次 Remove
 func (t *Tracker) Track(userID int, ip string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
+	t.track(userID, ip)
+}
 
-	if t.online[userID] == nil {
-		t.online[userID] = make(map[string]time.Time)
+// track 记录用户的一个会话上线，调用方需持有写锁
+func (t *Tracker) track(userID int, ip string) {
+	ips := t.online[userID]
+	if ips == nil {
+		ips = make(map[string]*ipState)
+		t.online[userID] = ips
+	}
+	state := ips[ip]
+	if state == nil {
+		state = &ipState{}
+		ips[ip] = state
 	}
-	t.online[userID][ip] = time.Now()
+	state.refs++
+	state.lastSeen = time.Now()
 }
 
-// Remove 移除用户连接
+// Remove 记录用户的一个会话断开，该 IP 的会话全部断开后下线，但保留到下一次上报
 func (t *Tracker) Remove(userID int, ip string) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
 	ips := t.online[userID]
-	if ips == nil {
+	state := ips[ip]
+	if state == nil || state.refs == 0 {
 		return
 	}
-	delete(ips, ip)
+	now := time.Now()
+	state.refs--
+	state.lastSeen = now
+	// 顺便清理该用户长时间未上报的已断开 IP
+	for ip, state := range ips {
+		if state.refs == 0 && now.Sub(state.lastSeen) > idleRetention {
+			delete(ips, ip)
+		}
+	}
 	if len(ips) == 0 {
 		delete(t.online, userID)
 	}
 }
 
-// Snapshot 获取当前在线用户快照
+// Snapshot 获取用于上报的在线用户快照：当前在线的 IP，以及上次成功上报以来断开的 IP
 // 返回格式: map[user_id][]string，IP 已附加 "_{nodeID}" 后缀
 // 如: {1: ["192.168.1.1_42", "10.0.0.1_42"]}
+// 上报成功后应调用 MarkReported，清理已上报的断开 IP
 func (t *Tracker) Snapshot() map[int][]string {
-	t.mu.RLock()
-	defer t.mu.RUnlock()
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
+	t.snapshotAt = time.Now()
 	result := make(map[int][]string, len(t.online))
 	suffix := fmt.Sprintf("_%d", t.nodeID)
 	for userID, ips := range t.online {
@@ -66,16 +108,102 @@ func (t *Tracker) Snapshot() map[int][]string {
 	return result
 }
 
-// CheckDeviceLimit 检查设备限制
-// aliveList 为从 API 获取的全局在线设备数量 map[user_id]count
-// 当 deviceLimit=0 直接返回 true（不限制）
-// 当全局在线数 >= deviceLimit 时返回 false（拒绝连接）
-func (t *Tracker) CheckDeviceLimit(userID int, deviceLimit int, aliveList map[int]int) bool {
-	if deviceLimit == 0 {
-		return true
+// Online 返回当前在线用户及其 IP（不带节点后缀），不含已断开的 IP
+func (t *Tracker) Online() map[int][]string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	result := make(map[int][]string, len(t.online))
+	for userID, ips := range t.online {
+		var list []string
+		for ip, state := range ips {
+			if state.refs > 0 {
+				list = append(list, ip)
+			}
+		}
+		if len(list) > 0 {
+			result[userID] = list
+		}
+	}
+	return result
+}
+
+// LastSeen 返回用户某个 IP 最近一次会话建立或断开的时间，以及该 IP 当前是否在线
+func (t *Tracker) LastSeen(userID int, ip string) (time.Time, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	state := t.online[userID][ip]
+	if state == nil {
+		return time.Time{}, false
 	}
-	if aliveList[userID] >= deviceLimit {
+	return state.lastSeen, state.refs > 0
+}
+
+// SetRemote 更新面板下发的全局在线设备数 map[user_id]count，获取失败时保留上一次的数据
+func (t *Tracker) SetRemote(aliveList map[int]int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remote = aliveList
+}
+
+// MarkReported 记录已成功上报给面板的在线快照（最近一次 Snapshot 的返回值），并清理快照之前已断开的 IP
+// 面板的全局在线数包含这些 IP，检查设备限制时减去，避免与本节点的实时在线 IP 重复计算
+func (t *Tracker) MarkReported(snapshot map[int][]string) {
+	reported := make(map[int]int, len(snapshot))
+	for userID, ips := range snapshot {
+		reported[userID] = len(ips)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reported = reported
+	for userID, ips := range t.online {
+		for ip, state := range ips {
+			// 快照之后才断开的 IP 在下一个上报周期内也出现过，保留到下一次上报
+			if state.refs == 0 && !state.lastSeen.After(t.snapshotAt) {
+				delete(ips, ip)
+			}
+		}
+		if len(ips) == 0 {
+			delete(t.online, userID)
+		}
+	}
+}
+
+// CheckDeviceLimit 检查来自 ip 的新连接是否在设备限制之内
+// 当 deviceLimit=0 直接返回 true（不限制）；已在本节点在线的 IP 不算新设备，总是允许
+func (t *Tracker) CheckDeviceLimit(userID int, deviceLimit int, ip string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.allowed(userID, deviceLimit, ip)
+}
+
+// Acquire 检查设备限制，允许时记录用户在线，检查和记录在同一把锁内完成
+// 同一用户的多个新 IP 同时连接时不会一起越过限制；返回 true 时调用方需在连接结束时调用 Remove
+func (t *Tracker) Acquire(userID int, deviceLimit int, ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.allowed(userID, deviceLimit, ip) {
 		return false
 	}
+	t.track(userID, ip)
 	return true
 }
+
+// allowed 判断设备限制，调用方需持有锁
+func (t *Tracker) allowed(userID int, deviceLimit int, ip string) bool {
+	if deviceLimit == 0 {
+		return true
+	}
+	live := 0
+	for addr, state := range t.online[userID] {
+		if state.refs == 0 {
+			continue
+		}
+		if addr == ip {
+			return true
+		}
+		live++
+	}
+	others := max(t.remote[userID]-t.reported[userID], 0)
+	return others+live < deviceLimit
+}
@@ -2,6 +2,7 @@ package alive
 
 import (
 	"fmt"
+	"reflect"
 	"sort"
 	"testing"
 
@@ -57,8 +58,8 @@ func TestProperty5_AliveTracker(t *testing.T) {
 		gen.IntRange(1, 10),
 	))
 
-	// Sub-property: Remove then Snapshot does not contain removed IP
-	properties.Property("Removed IPs are not in Snapshot", prop.ForAll(
+	// Sub-property: Removed IP is dropped from Snapshot after the next report
+	properties.Property("Removed IPs are not in Snapshot after the next report", prop.ForAll(
 		func(nodeID int, userID int) bool {
 			tracker := NewTracker(nodeID)
 			tracker.Track(userID, "1.2.3.4")
@@ -66,6 +67,7 @@ func TestProperty5_AliveTracker(t *testing.T) {
 
 			tracker.Remove(userID, "1.2.3.4")
 
+			tracker.MarkReported(tracker.Snapshot())
 			snap := tracker.Snapshot()
 			for _, ip := range snap[userID] {
 				if ip == fmt.Sprintf("1.2.3.4_%d", nodeID) {
@@ -85,8 +87,8 @@ func TestProperty5_AliveTracker(t *testing.T) {
 		gen.IntRange(1, 10000),
 	))
 
-	// Sub-property: Remove all IPs for a user removes the user from snapshot
-	properties.Property("Removing all IPs removes user from snapshot", prop.ForAll(
+	// Sub-property: Remove all IPs for a user removes the user from snapshot after the next report
+	properties.Property("Removing all IPs removes user from snapshot after the next report", prop.ForAll(
 		func(nodeID int, userID int, ipCount int) bool {
 			tracker := NewTracker(nodeID)
 			ips := make([]string, ipCount)
@@ -99,6 +101,7 @@ func TestProperty5_AliveTracker(t *testing.T) {
 				tracker.Remove(userID, ip)
 			}
 
+			tracker.MarkReported(tracker.Snapshot())
 			snap := tracker.Snapshot()
 			_, exists := snap[userID]
 			return !exists
@@ -112,8 +115,8 @@ func TestProperty5_AliveTracker(t *testing.T) {
 	properties.Property("CheckDeviceLimit returns true when deviceLimit=0", prop.ForAll(
 		func(userID int, aliveCount int) bool {
 			tracker := NewTracker(1)
-			aliveList := map[int]int{userID: aliveCount}
-			return tracker.CheckDeviceLimit(userID, 0, aliveList)
+			tracker.SetRemote(map[int]int{userID: aliveCount})
+			return tracker.CheckDeviceLimit(userID, 0, "203.0.113.1")
 		},
 		gen.IntRange(1, 10000),
 		gen.IntRange(0, 100),
@@ -124,8 +127,8 @@ func TestProperty5_AliveTracker(t *testing.T) {
 		func(userID int, deviceLimit int, extra int) bool {
 			tracker := NewTracker(1)
 			aliveCount := deviceLimit + extra // always >= deviceLimit
-			aliveList := map[int]int{userID: aliveCount}
-			return !tracker.CheckDeviceLimit(userID, deviceLimit, aliveList)
+			tracker.SetRemote(map[int]int{userID: aliveCount})
+			return !tracker.CheckDeviceLimit(userID, deviceLimit, "203.0.113.1")
 		},
 		gen.IntRange(1, 10000),
 		gen.IntRange(1, 50),
@@ -137,8 +140,8 @@ func TestProperty5_AliveTracker(t *testing.T) {
 		func(userID int, deviceLimit int) bool {
 			tracker := NewTracker(1)
 			aliveCount := deviceLimit - 1 // always < deviceLimit
-			aliveList := map[int]int{userID: aliveCount}
-			return tracker.CheckDeviceLimit(userID, deviceLimit, aliveList)
+			tracker.SetRemote(map[int]int{userID: aliveCount})
+			return tracker.CheckDeviceLimit(userID, deviceLimit, "203.0.113.1")
 		},
 		gen.IntRange(1, 10000),
 		gen.IntRange(2, 50), // min 2 so aliveCount >= 1
@@ -156,6 +159,7 @@ func TestProperty5_AliveTracker(t *testing.T) {
 
 			tracker.Remove(userA, "1.1.1.1")
 
+			tracker.MarkReported(tracker.Snapshot())
 			snap := tracker.Snapshot()
 			// userA should be gone
 			if _, exists := snap[userA]; exists {
@@ -174,3 +178,100 @@ func TestProperty5_AliveTracker(t *testing.T) {
 
 	properties.TestingRun(t)
 }
+
+func TestCheckDeviceLimit_Local(t *testing.T) {
+	tracker := NewTracker(1)
+	tracker.Track(1, "1.1.1.1")
+	tracker.Track(1, "2.2.2.2")
+
+	if !tracker.CheckDeviceLimit(1, 0, "3.3.3.3") {
+		t.Error("device_limit 0 should not limit")
+	}
+	if tracker.CheckDeviceLimit(1, 2, "3.3.3.3") {
+		t.Error("third IP should be rejected with device_limit 2")
+	}
+	if !tracker.CheckDeviceLimit(1, 2, "1.1.1.1") {
+		t.Error("an IP already online should not count as a new device")
+	}
+	if !tracker.CheckDeviceLimit(2, 1, "3.3.3.3") {
+		t.Error("other users should be tracked independently")
+	}
+}
+
+// TestCheckDeviceLimit_Merged 测试面板在线数与本节点实时在线 IP 合并计算，已上报的本节点 IP 不重复计算
+func TestCheckDeviceLimit_Merged(t *testing.T) {
+	tracker := NewTracker(1)
+	if !tracker.Acquire(1, 3, "1.1.1.1") {
+		t.Fatal("first device should be allowed")
+	}
+	tracker.MarkReported(tracker.Snapshot())
+	// 面板统计到 2 个设备：本节点上报的 1.1.1.1 和其他节点的 1 个设备
+	tracker.SetRemote(map[int]int{1: 2})
+
+	if !tracker.Acquire(1, 3, "2.2.2.2") {
+		t.Fatal("third device overall should be allowed with device_limit 3")
+	}
+	if tracker.Acquire(1, 3, "3.3.3.3") {
+		t.Error("fourth device should be rejected with device_limit 3")
+	}
+	if !tracker.Acquire(1, 3, "2.2.2.2") {
+		t.Error("an IP already online should always be allowed")
+	}
+
+	// 本节点的设备下线后腾出名额，即使面板的数据还没更新
+	tracker.Remove(1, "2.2.2.2")
+	tracker.Remove(1, "2.2.2.2")
+	if !tracker.CheckDeviceLimit(1, 3, "3.3.3.3") {
+		t.Error("a slot freed on this node should be usable before the next pull")
+	}
+}
+
+// TestTracker_RefCount 测试同一 IP 的多个会话按引用计数，最后一个会话断开后才下线
+func TestTracker_RefCount(t *testing.T) {
+	tracker := NewTracker(42)
+	tracker.Track(1, "1.1.1.1")
+	tracker.Track(1, "1.1.1.1")
+	tracker.Remove(1, "1.1.1.1")
+	if got := tracker.Online()[1]; len(got) != 1 {
+		t.Fatalf("Online after closing one of two sessions = %v, want the IP still online", got)
+	}
+	if _, live := tracker.LastSeen(1, "1.1.1.1"); !live {
+		t.Error("LastSeen should report the IP as live")
+	}
+
+	tracker.Remove(1, "1.1.1.1")
+	if got := tracker.Online(); len(got) != 0 {
+		t.Errorf("Online after closing all sessions = %v, want empty", got)
+	}
+	// 多余的 Remove 不会让计数变为负数
+	tracker.Remove(1, "1.1.1.1")
+	tracker.Track(1, "1.1.1.1")
+	if got := tracker.Online()[1]; len(got) != 1 {
+		t.Errorf("Online after reconnecting = %v, want the IP online", got)
+	}
+}
+
+// TestTracker_ReportsDisconnectedInInterval 测试上报周期内断开的 IP 仍会上报一次
+func TestTracker_ReportsDisconnectedInInterval(t *testing.T) {
+	tracker := NewTracker(42)
+	tracker.Track(1, "1.1.1.1")
+	tracker.Track(2, "2.2.2.2")
+	tracker.Remove(1, "1.1.1.1")
+
+	snap := tracker.Snapshot()
+	if !reflect.DeepEqual(snap, map[int][]string{1: {"1.1.1.1_42"}, 2: {"2.2.2.2_42"}}) {
+		t.Fatalf("Snapshot = %v, want the disconnected IP included", snap)
+	}
+	if _, live := tracker.LastSeen(1, "1.1.1.1"); live {
+		t.Error("disconnected IP should not be live")
+	}
+	// 设备限制只计实时在线的 IP
+	if !tracker.CheckDeviceLimit(1, 1, "3.3.3.3") {
+		t.Error("a disconnected IP should not occupy a device slot")
+	}
+
+	tracker.MarkReported(snap)
+	if snap := tracker.Snapshot(); !reflect.DeepEqual(snap, map[int][]string{2: {"2.2.2.2_42"}}) {
+		t.Errorf("Snapshot after report = %v, want only the live IP", snap)
+	}
+}
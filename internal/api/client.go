@@ -39,6 +39,15 @@ func NewClient(baseURL, token string, nodeID int, nodeType string, logger *logru
 // 自动拼接 URL: {baseURL}/api/v1/server/UniProxy/{path}?token=&node_id=&node_type=
 // POST 请求自动设置 Content-Type: application/json
 func (c *Client) doRequest(method, path string, body []byte) (*http.Response, error) {
+	req, err := c.newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	return c.httpClient.Do(req)
+}
+
+// newRequest 创建带认证参数的请求，调用方可以在发送前追加请求头
+func (c *Client) newRequest(method, path string, body []byte) (*http.Request, error) {
 	fullURL := fmt.Sprintf("%s/api/v1/server/UniProxy/%s", c.baseURL, path)
 
 	params := url.Values{}
@@ -60,6 +69,5 @@ func (c *Client) doRequest(method, path string, body []byte) (*http.Response, er
 	if method == http.MethodPost {
 		req.Header.Set("Content-Type", "application/json")
 	}
-
-	return c.httpClient.Do(req)
+	return req, nil
 }
@@ -75,6 +75,86 @@ func TestFetchConfig(t *testing.T) {
 	}
 }
 
+// TestFetchConfig_Routes verifies that routes with array or comma-separated match are both parsed.
+func TestFetchConfig_Routes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"server_port": 8443,
+			"routes": [
+				{"id": 1, "match": ["regexp:^tracker\\.", "port:25"], "action": "block", "action_value": null},
+				{"id": 2, "match": "domain:example.com, keyword:ads", "action": "direct"},
+				{"id": 3, "match": null, "action": "dns", "action_value": "1.1.1.1"}
+			]
+		}`))
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "test-token", 42, "anytls", newTestLogger())
+	cfg, err := client.FetchConfig()
+	if err != nil {
+		t.Fatalf("FetchConfig failed: %v", err)
+	}
+
+	if len(cfg.Routes) != 3 {
+		t.Fatalf("Routes length = %d, want 3", len(cfg.Routes))
+	}
+	if got := cfg.Routes[0].Match; len(got) != 2 || got[0] != `regexp:^tracker\.` || got[1] != "port:25" {
+		t.Errorf("Routes[0].Match = %q", got)
+	}
+	if got := cfg.Routes[1].Match; len(got) != 2 || got[0] != "domain:example.com" || got[1] != "keyword:ads" {
+		t.Errorf("Routes[1].Match = %q", got)
+	}
+	if cfg.Routes[1].Action != "direct" {
+		t.Errorf("Routes[1].Action = %q, want direct", cfg.Routes[1].Action)
+	}
+	if cfg.Routes[2].Match != nil || cfg.Routes[2].ActionValue != "1.1.1.1" {
+		t.Errorf("Routes[2] = %+v", cfg.Routes[2])
+	}
+}
+
+// TestRequestObserver verifies that every HTTP attempt, including retries, is reported to the observer.
+func TestRequestObserver(t *testing.T) {
+	var calls int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	type observation struct {
+		endpoint   string
+		statusCode int
+		err        error
+	}
+	var observed []observation
+	client := NewClient(srv.URL, "test-token", 1, "anytls", newTestLogger())
+	client.SetRequestObserver(func(endpoint string, statusCode int, duration time.Duration, err error) {
+		observed = append(observed, observation{endpoint, statusCode, err})
+	})
+
+	origDelays := retryDelays
+	retryDelays = []time.Duration{time.Millisecond}
+	defer func() { retryDelays = origDelays }()
+
+	if err := client.PushStatus(&NodeStatus{}); err != nil {
+		t.Fatalf("PushStatus failed: %v", err)
+	}
+	if len(observed) != 2 {
+		t.Fatalf("observed %d requests, want 2", len(observed))
+	}
+	if observed[0] != (observation{"status", http.StatusBadGateway, nil}) {
+		t.Errorf("first observation = %+v", observed[0])
+	}
+	if observed[1] != (observation{"status", http.StatusOK, nil}) {
+		t.Errorf("second observation = %+v", observed[1])
+	}
+}
+
 // TestFetchUsers verifies that FetchUsers correctly parses a user list JSON response.
 func TestFetchUsers(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -243,6 +323,28 @@ func TestPushTraffic(t *testing.T) {
 	}
 }
 
+// TestPushTrafficBatch_IdempotencyKey verifies the batch ID is sent on every retry of the same batch.
+func TestPushTrafficBatch_IdempotencyKey(t *testing.T) {
+	var keys []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get("Idempotency-Key"))
+		if len(keys) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	client := NewClient(srv.URL, "test-token", 42, "anytls", newTestLogger())
+	if err := client.PushTrafficBatch("1700000000000000001", map[int][2]int64{1: {1, 2}}); err != nil {
+		t.Fatalf("PushTrafficBatch failed: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "1700000000000000001" || keys[1] != keys[0] {
+		t.Errorf("Idempotency-Key = %q, want the batch ID on both attempts", keys)
+	}
+}
+
 // TestPushAlive verifies the POST body format for alive push.
 func TestPushAlive(t *testing.T) {
 	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/netip"
 	"strings"
 
 	"anytls/proxy/padding"
@@ -19,6 +20,70 @@ type NodeConfig struct {
 		PushInterval int `json:"push_interval"`
 		PullInterval int `json:"pull_interval"`
 	} `json:"base_config"`
+	Routes []Route `json:"routes"`
+}
+
+// Route 面板下发的路由规则
+// action: block（拒绝）、direct（直连）、dns（指定 DNS 服务器，action_value 为 DNS 地址）
+type Route struct {
+	ID          int        `json:"id"`
+	Match       RouteMatch `json:"match"`
+	Action      string     `json:"action"`
+	ActionValue string     `json:"action_value"`
+}
+
+// RouteMatch 路由匹配条件
+// Xboard 新版本返回数组，旧版本返回逗号分隔的字符串，两种格式都接受
+type RouteMatch []string
+
+// UnmarshalJSON 兼容数组和逗号分隔字符串两种格式
+func (m *RouteMatch) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*m = list
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("无效的路由匹配条件: %s", data)
+	}
+	// 旧版本中同一类型的多个值也用逗号分隔（如 "port:25,465,587"），
+	// 不带类型前缀的项沿用前一项的前缀，而不是作为新的无前缀条件
+	*m = nil
+	prefix := ""
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if p, ok := matchPrefix(item); ok {
+			prefix = p
+		} else if prefix != "" {
+			item = prefix + item
+		}
+		*m = append(*m, item)
+	}
+	return nil
+}
+
+// matchPrefix 返回匹配条件的类型前缀（含冒号），如 "port:"
+// IP/CIDR（含 IPv6）不视为带前缀
+func matchPrefix(item string) (string, bool) {
+	name, _, ok := strings.Cut(item, ":")
+	if !ok || name == "" {
+		return "", false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return "", false
+		}
+	}
+	if _, err := netip.ParseAddr(item); err == nil {
+		return "", false
+	}
+	if _, err := netip.ParsePrefix(item); err == nil {
+		return "", false
+	}
+	return name + ":", true
 }
 
 // User 用户信息
@@ -28,6 +93,15 @@ type User struct {
 	UUID        string `json:"uuid"`
 	SpeedLimit  *int   `json:"speed_limit"`  // Mbps, nil 或 0=不限
 	DeviceLimit *int   `json:"device_limit"` // nil 或 0=不限
+	// UploadLimit/DownloadLimit 单独限制上传/下载速率（Mbps），未设置时使用 speed_limit
+	// Xboard 不下发这两个字段，供扩展面板和本地用户使用
+	UploadLimit   *int `json:"upload_limit,omitempty"`
+	DownloadLimit *int `json:"download_limit,omitempty"`
+	// TransferEnable/U/D 用户总流量和已用上传/下载流量（字节），用于节点本地执行配额
+	// Xboard 默认不下发，面板下发时生效
+	TransferEnable *int64 `json:"transfer_enable,omitempty"`
+	U              *int64 `json:"u,omitempty"`
+	D              *int64 `json:"d,omitempty"`
 }
 
 // PaddingSchemeToBytes 将 Xboard 返回的 padding_scheme 数组转换为换行分隔格式
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"net/http"
+	"path"
+	"time"
+)
+
+// RequestObserver 观察每一次发往面板的 HTTP 请求（每次重试单独记录）
+// endpoint 为接口名（如 "user"、"push"），请求失败时 statusCode 为 0
+type RequestObserver func(endpoint string, statusCode int, duration time.Duration, err error)
+
+// SetRequestObserver 设置请求观察者，需在发起请求前调用
+func (c *Client) SetRequestObserver(observer RequestObserver) {
+	base := c.httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.httpClient.Transport = &observedTransport{base: base, observer: observer}
+}
+
+type observedTransport struct {
+	base     http.RoundTripper
+	observer RequestObserver
+}
+
+func (t *observedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	var statusCode int
+	if resp != nil {
+		statusCode = resp.StatusCode
+	}
+	t.observer(path.Base(req.URL.Path), statusCode, time.Since(start), err)
+	return resp, err
+}
@@ -27,6 +27,13 @@ type ResourceUsage struct {
 // 上报原始字节数，Xboard 自动乘以节点 rate 倍率
 // 使用 json.Marshal 序列化后作为 raw JSON body 发送
 func (c *Client) PushTraffic(data map[int][2]int64) error {
+	return c.PushTrafficBatch("", data)
+}
+
+// PushTrafficBatch 上报一批流量，batchID 非空时通过 Idempotency-Key 请求头发送
+// 同一批次重试时使用相同的 batchID，支持该请求头的面板可以据此丢弃重复的上报
+// 原版 Xboard 忽略该请求头，响应丢失后的重试仍会被重复计费
+func (c *Client) PushTrafficBatch(batchID string, data map[int][2]int64) error {
 	if len(data) == 0 {
 		return nil
 	}
@@ -43,7 +50,14 @@ func (c *Client) PushTraffic(data map[int][2]int64) error {
 	}
 
 	resp, err := doWithRetry(func() (*http.Response, error) {
-		return c.doRequest(http.MethodPost, "push", body)
+		req, err := c.newRequest(http.MethodPost, "push", body)
+		if err != nil {
+			return nil, err
+		}
+		if batchID != "" {
+			req.Header.Set("Idempotency-Key", batchID)
+		}
+		return c.httpClient.Do(req)
 	})
 	if err != nil {
 		return fmt.Errorf("上报流量失败: %w", err)
@@ -2,29 +2,229 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
+	"net/netip"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 // Config 服务端配置结构
 type Config struct {
-	Listen     string    `yaml:"listen"`    // 监听地址，如 "0.0.0.0:8443"
-	APIHost    string    `yaml:"api_host"`  // Xboard API 地址
-	APIToken   string    `yaml:"api_token"` // 通信 token
-	NodeID     int       `yaml:"node_id"`   // 节点 ID
-	NodeType   string    `yaml:"node_type"` // 节点类型，默认 "anytls"
-	TLS        TLSConfig `yaml:"tls"`
-	Log        LogConfig `yaml:"log"`
-	Fallback   string    `yaml:"fallback"`   // fallback 目标地址
-	Standalone bool      `yaml:"standalone"` // 独立运行模式（不依赖 Xboard）
-	Password   string    `yaml:"password"`   // 独立模式密码
+	Listen     string          `yaml:"listen"`    // 监听地址，如 "0.0.0.0:8443"
+	APIHost    string          `yaml:"api_host"`  // Xboard API 地址
+	APIToken   string          `yaml:"api_token"` // 通信 token
+	NodeID     int             `yaml:"node_id"`   // 节点 ID
+	NodeType   string          `yaml:"node_type"` // 节点类型，默认 "anytls"
+	TLS        TLSConfig       `yaml:"tls"`
+	Log        LogConfig       `yaml:"log"`
+	Fallback   string          `yaml:"fallback"`   // fallback 目标地址
+	Standalone bool            `yaml:"standalone"` // 独立运行模式（不依赖 Xboard）
+	Password   string          `yaml:"password"`   // 独立模式密码
+	UsersFile  string          `yaml:"users_file"` // 独立模式本地用户文件（YAML/JSON），设置后忽略 password
+	Heartbeat  HeartbeatConfig `yaml:"heartbeat"`
+	// KickAlert 用户被面板移除或 UUID 变更而断开会话时，向客户端发送 cmdAlert 说明原因
+	KickAlert bool `yaml:"kick_alert"`
+	// StreamWindow 每个 Stream 的接收窗口（字节），用于协议 v3 流量控制
+	// 0=默认 256KB，StreamWindowDisabled=关闭流量控制（按 v2 运行）
+	StreamWindow int              `yaml:"stream_window"`
+	Outbounds    []OutboundConfig `yaml:"outbounds,omitempty"` // 出站列表，第一个为默认出站
+	Route        RouteConfig      `yaml:"route"`
+	DNS          DNSConfig        `yaml:"dns"`
+	Bandwidth    BandwidthConfig  `yaml:"bandwidth"`
+	Quota        QuotaConfig      `yaml:"quota"`
+	AuthBan      AuthBanConfig    `yaml:"auth_ban"`
+	Ledger       LedgerConfig     `yaml:"ledger"`
+	Traffic      TrafficConfig    `yaml:"traffic"`
+	Metrics      MetricsConfig    `yaml:"metrics"`
+	Admin        AdminConfig      `yaml:"admin"`
+
+	// Path 配置文件路径，由 LoadConfig 填写，用于热重载
+	Path string `yaml:"-"`
 }
 
 // TLSConfig TLS 证书配置
+// 证书文件修改后自动重新加载；配置多个证书时按客户端 SNI 匹配证书中的域名，未匹配时使用第一个证书
 type TLSConfig struct {
 	CertFile string `yaml:"cert_file"` // 证书文件路径
 	KeyFile  string `yaml:"key_file"`  // 私钥文件路径
+	// Certificates 更多证书，排在 cert_file 之后
+	Certificates []CertificateConfig `yaml:"certificates,omitempty"`
+	ACME         ACMEConfig          `yaml:"acme"`
+	SelfSigned   SelfSignedConfig    `yaml:"self_signed"`
+}
+
+// CertificateConfig 一对证书和私钥文件
+type CertificateConfig struct {
+	CertFile string `yaml:"cert_file"` // 证书文件路径
+	KeyFile  string `yaml:"key_file"`  // 私钥文件路径
+}
+
+// Pairs 返回所有配置的证书，cert_file 在前
+func (t TLSConfig) Pairs() []CertificateConfig {
+	var pairs []CertificateConfig
+	if t.CertFile != "" && t.KeyFile != "" {
+		pairs = append(pairs, CertificateConfig{CertFile: t.CertFile, KeyFile: t.KeyFile})
+	}
+	return append(pairs, t.Certificates...)
+}
+
+// 自签名证书的默认保存路径和有效期（天）
+const (
+	DefaultSelfSignedCertFile = "/var/lib/anytls/self-signed.crt"
+	DefaultSelfSignedKeyFile  = "/var/lib/anytls/self-signed.key"
+	DefaultSelfSignedValidity = 3650
+)
+
+// SelfSignedConfig 没有可用证书时使用的自签名证书
+// 生成后保存到文件，之后启动时继续使用，客户端可以固定证书指纹而不必跳过证书验证
+type SelfSignedConfig struct {
+	Names    []string `yaml:"names,omitempty"` // 证书中的域名或 IP（SAN），修改后重新生成证书
+	CertFile string   `yaml:"cert_file"`       // 证书保存路径，默认 DefaultSelfSignedCertFile，为空时不保存
+	KeyFile  string   `yaml:"key_file"`        // 私钥保存路径，默认 DefaultSelfSignedKeyFile，为空时不保存
+	Validity int      `yaml:"validity"`        // 有效期（天），默认 DefaultSelfSignedValidity
+}
+
+// DefaultACMEDir ACME 账户密钥和证书的默认保存目录
+const DefaultACMEDir = "/var/lib/anytls/acme"
+
+// StreamWindowDisabled 用于 stream_window，表示关闭流量控制
+const StreamWindowDisabled = -1
+
+// ACMEDisabled 用于 http_listen，表示不监听 HTTP 端口，只使用 TLS-ALPN-01 验证
+const ACMEDisabled = "off"
+
+// ACMEConfig 内置 ACME 客户端配置，domains 非空时启用，自动申请证书并在到期前续期
+// TLS-ALPN-01 验证在服务端口上完成，HTTP-01 验证在 http_listen 上完成
+type ACMEConfig struct {
+	Domains      []string `yaml:"domains,omitempty"` // 申请证书的域名，不支持通配符
+	Email        string   `yaml:"email"`             // 账户联系邮箱，用于接收到期提醒，可选
+	Dir          string   `yaml:"dir"`               // 账户密钥和证书的保存目录，默认 DefaultACMEDir
+	DirectoryURL string   `yaml:"directory_url"`     // ACME 服务的目录地址，默认 Let's Encrypt
+	HTTPListen   string   `yaml:"http_listen"`       // HTTP-01 验证的监听地址，默认 ":80"，"off" 表示只使用 TLS-ALPN-01
+	RenewBefore  int      `yaml:"renew_before"`      // 到期前多少天续期，默认 30
+}
+
+// HeartbeatConfig 会话心跳配置
+// 仅对 v2 及以上版本的客户端生效
+type HeartbeatConfig struct {
+	Interval int `yaml:"interval"` // 心跳间隔（秒），0=关闭
+	MaxMiss  int `yaml:"max_miss"` // 连续未响应次数上限，超过后关闭会话，默认 3
+}
+
+// OutboundConfig 出站配置
+type OutboundConfig struct {
+	Name string `yaml:"name"` // 出站名称
+	Type string `yaml:"type"` // direct, socks5, http, block
+
+	// direct
+	BindInterface string `yaml:"bind_interface"` // 绑定网卡
+	SourceIP      string `yaml:"source_ip"`      // 绑定源 IP
+
+	// socks5 / http
+	Server   string `yaml:"server"`   // 上游代理地址，如 "127.0.0.1:1080"
+	Username string `yaml:"username"` // 上游代理用户名
+	Password string `yaml:"password"` // 上游代理密码
+	Detour   string `yaml:"detour"`   // 通过另一个出站连接上游代理
+}
+
+// RouteConfig 路由配置
+type RouteConfig struct {
+	Rules []RouteRule `yaml:"rules,omitempty"` // 路由规则，按顺序匹配
+}
+
+// RouteRule 路由规则
+// 同一字段内的多个条件为"或"关系，不同字段之间为"与"关系
+type RouteRule struct {
+	Domain        []string `yaml:"domain,omitempty"`         // 完整域名匹配
+	DomainSuffix  []string `yaml:"domain_suffix,omitempty"`  // 域名后缀匹配
+	DomainKeyword []string `yaml:"domain_keyword,omitempty"` // 域名关键字匹配
+	DomainRegex   []string `yaml:"domain_regex,omitempty"`   // 域名正则匹配
+	IPCIDR        []string `yaml:"ip_cidr,omitempty"`        // 目标 IP 段
+	Port          []string `yaml:"port,omitempty"`           // 目标端口，如 "25"、"6881-6889"
+	Network       string   `yaml:"network,omitempty"`        // tcp 或 udp
+	UserID        []int    `yaml:"user_id,omitempty"`        // 用户 ID
+	Outbound      string   `yaml:"outbound"`                 // 出站名称，"reject" 表示拒绝
+}
+
+// DNSConfig 内置 DNS 解析器配置，servers 为空时使用系统 DNS
+type DNSConfig struct {
+	Servers      []string            `yaml:"servers,omitempty"`   // 上游服务器，如 "8.8.8.8"、"tcp://8.8.8.8"、"tls://1.1.1.1"、"https://1.1.1.1/dns-query"
+	Strategy     string              `yaml:"strategy,omitempty"`  // prefer_ipv4（默认）、prefer_ipv6、ipv4_only、ipv6_only
+	Hosts        map[string][]string `yaml:"hosts,omitempty"`     // 静态解析，域名 → IP 列表
+	Overrides    []DNSOverride       `yaml:"overrides,omitempty"` // 按域名指定上游服务器
+	Timeout      int                 `yaml:"timeout"`             // 单次查询超时（秒），默认 5
+	DisableCache bool                `yaml:"disable_cache"`       // 关闭缓存
+}
+
+// DNSOverride 按域名指定上游服务器
+type DNSOverride struct {
+	Domain        []string `yaml:"domain,omitempty"`         // 完整域名匹配
+	DomainSuffix  []string `yaml:"domain_suffix,omitempty"`  // 域名后缀匹配
+	DomainKeyword []string `yaml:"domain_keyword,omitempty"` // 域名关键字匹配
+	DomainRegex   []string `yaml:"domain_regex,omitempty"`   // 域名正则匹配
+	Servers       []string `yaml:"servers"`                  // 上游服务器
+}
+
+// BandwidthConfig 节点总带宽限制，在活跃用户之间公平分配
+// 上传指客户端发往节点的数据，下载指节点发往客户端的数据
+type BandwidthConfig struct {
+	Upload   int `yaml:"upload"`   // 上传总带宽（Mbps），0=不限
+	Download int `yaml:"download"` // 下载总带宽（Mbps），0=不限
+}
+
+// AuthBanConfig 认证失败封禁阈值，防止暴力破解，0 表示使用默认值
+type AuthBanConfig struct {
+	MaxFailures int `yaml:"max_failures"` // 窗口内最大失败次数，超过后封禁 IP，默认 10
+	Window      int `yaml:"window"`       // 失败计数窗口（秒），默认 60
+	Duration    int `yaml:"duration"`     // 封禁时长（秒），默认 300
+}
+
+// QuotaConfig 节点本地流量配额
+type QuotaConfig struct {
+	Enabled bool          `yaml:"enabled"`         // 在节点本地执行流量配额，超出后拒绝认证并断开会话
+	Users   map[int]int64 `yaml:"users,omitempty"` // 本地配置的用户配额（字节），优先于面板下发的剩余流量
+}
+
+// LedgerConfig 独立模式本地流量账本，按用户、按天记录流量
+type LedgerConfig struct {
+	Path          string `yaml:"path"`           // 账本文件路径，为空时不启用
+	FlushInterval int    `yaml:"flush_interval"` // 写入账本的间隔（秒），默认 60
+	ResetDay      int    `yaml:"reset_day"`      // 每月流量重置日（1-31），默认 1，超过当月天数时取最后一天
+}
+
+// DefaultTrafficPersistPath 流量持久化文件的默认路径
+const DefaultTrafficPersistPath = "/var/lib/anytls/traffic.json"
+
+// 流量计费模式
+const (
+	AccountingWire         = "wire"          // 统计 TLS 之前的原始 TCP 字节，包括 TLS 握手和记录开销
+	AccountingTLSPlaintext = "tls_plaintext" // 统计 TLS 解密后的字节，包括会话帧头和 padding
+	AccountingPayload      = "payload"       // 只统计流中收发的数据（cmdPSH 的内容）
+)
+
+// TrafficConfig 流量统计和持久化
+type TrafficConfig struct {
+	// Accounting 计费模式：wire、tls_plaintext 或 payload，默认 tls_plaintext
+	Accounting string `yaml:"accounting"`
+	// PersistPath 未上报流量的持久化文件，预写日志为 <persist_path>.wal，默认 DefaultTrafficPersistPath
+	PersistPath string `yaml:"persist_path"`
+	// OutboxMaxBatches 待上报批次数上限，面板长时间不可用时超过上限的批次合并为一个，默认 60
+	OutboxMaxBatches int `yaml:"outbox_max_batches"`
+}
+
+// MetricsConfig Prometheus 指标接口配置
+type MetricsConfig struct {
+	Listen string `yaml:"listen"` // 监听地址，如 "127.0.0.1:9100"，为空则不启用
+	Path   string `yaml:"path"`   // 指标路径，默认 "/metrics"
+}
+
+// AdminConfig 本地管理接口配置
+type AdminConfig struct {
+	Listen string `yaml:"listen"` // "unix:/run/anytls/admin.sock" 或回环地址如 "127.0.0.1:9091"，为空则不启用
+	Token  string `yaml:"token"`  // 访问令牌，请求需携带 "Authorization: Bearer <token>"
 }
 
 // LogConfig 日志配置
@@ -55,6 +255,7 @@ func LoadConfig(path string) (*Config, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, err
 	}
+	cfg.Path = path
 
 	return cfg, nil
 }
@@ -62,9 +263,9 @@ func LoadConfig(path string) (*Config, error) {
 // Validate 验证配置完整性
 func (c *Config) Validate() error {
 	if c.Standalone {
-		// 独立模式只需要密码
-		if c.Password == "" {
-			return fmt.Errorf("配置错误: standalone 模式下 password 不能为空")
+		// 独立模式只需要密码或用户文件
+		if c.Password == "" && c.UsersFile == "" {
+			return fmt.Errorf("配置错误: standalone 模式下 password 和 users_file 不能同时为空")
 		}
 	} else {
 		// Xboard 模式需要 API 配置
@@ -78,6 +279,52 @@ func (c *Config) Validate() error {
 			return fmt.Errorf("配置错误: node_id 必须大于 0")
 		}
 	}
+	for i, cert := range c.TLS.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("配置错误: tls.certificates[%d] 的 cert_file 和 key_file 不能为空", i)
+		}
+	}
+	for _, domain := range c.TLS.ACME.Domains {
+		if domain == "" || strings.Contains(domain, "*") {
+			return fmt.Errorf("配置错误: tls.acme.domains 中的域名不能为空或包含通配符")
+		}
+	}
+	if c.TLS.SelfSigned.Validity < 0 {
+		return fmt.Errorf("配置错误: tls.self_signed.validity 不能为负数")
+	}
+	if c.TLS.ACME.RenewBefore < 0 {
+		return fmt.Errorf("配置错误: tls.acme.renew_before 不能为负数")
+	}
+	if c.StreamWindow < StreamWindowDisabled || int64(c.StreamWindow) > math.MaxUint32 {
+		return fmt.Errorf("配置错误: stream_window 必须为 -1（关闭流量控制）、0（默认）或不超过 %d 的字节数", uint32(math.MaxUint32))
+	}
+	if c.Admin.Listen != "" && c.Admin.Token == "" {
+		return fmt.Errorf("配置错误: 启用 admin.listen 时 admin.token 不能为空")
+	}
+	for userID, quota := range c.Quota.Users {
+		if quota < 0 {
+			return fmt.Errorf("配置错误: quota.users 中用户 %d 的配额不能为负数", userID)
+		}
+	}
+	if c.Standalone && c.Quota.Enabled && len(c.Quota.Users) > 0 && c.Ledger.Path == "" {
+		return fmt.Errorf("配置错误: 独立模式下 quota.users 按流量账本计算用量，需要配置 ledger.path")
+	}
+	switch c.Traffic.Accounting {
+	case "":
+		c.Traffic.Accounting = AccountingTLSPlaintext
+	case AccountingWire, AccountingTLSPlaintext, AccountingPayload:
+	default:
+		return fmt.Errorf("配置错误: traffic.accounting 必须为 wire、tls_plaintext 或 payload")
+	}
+	if c.AuthBan.MaxFailures < 0 || c.AuthBan.Window < 0 || c.AuthBan.Duration < 0 {
+		return fmt.Errorf("配置错误: auth_ban 中的阈值不能为负数")
+	}
+	if c.Traffic.OutboxMaxBatches < 0 {
+		return fmt.Errorf("配置错误: traffic.outbox_max_batches 不能为负数")
+	}
+	if c.Ledger.ResetDay < 0 || c.Ledger.ResetDay > 31 {
+		return fmt.Errorf("配置错误: ledger.reset_day 必须在 1-31 之间")
+	}
 	if c.Listen == "" {
 		c.Listen = "0.0.0.0:8443"
 	}
@@ -87,5 +334,56 @@ func (c *Config) Validate() error {
 	if c.Log.Level == "" {
 		c.Log.Level = "info"
 	}
+	if c.Traffic.PersistPath == "" {
+		c.Traffic.PersistPath = DefaultTrafficPersistPath
+	}
+	if c.TLS.SelfSigned.CertFile == "" && c.TLS.SelfSigned.KeyFile == "" {
+		c.TLS.SelfSigned.CertFile = DefaultSelfSignedCertFile
+		c.TLS.SelfSigned.KeyFile = DefaultSelfSignedKeyFile
+	}
+	if c.TLS.SelfSigned.Validity == 0 {
+		c.TLS.SelfSigned.Validity = DefaultSelfSignedValidity
+	}
+	if len(c.TLS.ACME.Domains) > 0 {
+		if c.TLS.ACME.Dir == "" {
+			c.TLS.ACME.Dir = DefaultACMEDir
+		}
+		if c.TLS.ACME.HTTPListen == "" {
+			c.TLS.ACME.HTTPListen = ":80"
+		}
+		if c.TLS.ACME.RenewBefore == 0 {
+			c.TLS.ACME.RenewBefore = 30
+		}
+		if fallbackOnHTTPListen(c.TLS.ACME.HTTPListen, c.Fallback) {
+			return fmt.Errorf("配置错误: fallback %s 与 tls.acme.http_listen %s 是本机同一端口，HTTP 端口上的请求会转发回自身；请把 fallback 网站改到其他端口，或设置 http_listen: \"off\"", c.Fallback, c.TLS.ACME.HTTPListen)
+		}
+	}
 	return nil
 }
+
+// fallbackOnHTTPListen 判断 fallback 是否指向 ACME HTTP-01 监听的本机端口
+func fallbackOnHTTPListen(httpListen, fallback string) bool {
+	if httpListen == ACMEDisabled || fallback == "" {
+		return false
+	}
+	listenHost, listenPort, err := net.SplitHostPort(httpListen)
+	if err != nil {
+		return false
+	}
+	host, port, err := net.SplitHostPort(fallback)
+	if err != nil || port != listenPort {
+		return false
+	}
+	if host == listenHost {
+		return true
+	}
+	if ip, err := netip.ParseAddr(listenHost); listenHost != "" && (err != nil || !ip.IsUnspecified()) {
+		return false
+	}
+	// 监听所有地址时，localhost 和回环地址也指向监听端口
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"reflect"
 	"testing"
@@ -262,4 +263,111 @@ node_id: 1
 	if cfg.Log.Level != "info" {
 		t.Errorf("default Log.Level = %q, want %q", cfg.Log.Level, "info")
 	}
+	if cfg.Traffic.PersistPath != DefaultTrafficPersistPath {
+		t.Errorf("default Traffic.PersistPath = %q, want %q", cfg.Traffic.PersistPath, DefaultTrafficPersistPath)
+	}
+	if cfg.Traffic.Accounting != AccountingTLSPlaintext {
+		t.Errorf("default Traffic.Accounting = %q, want %q", cfg.Traffic.Accounting, AccountingTLSPlaintext)
+	}
+	if cfg.TLS.SelfSigned.CertFile != DefaultSelfSignedCertFile || cfg.TLS.SelfSigned.KeyFile != DefaultSelfSignedKeyFile {
+		t.Errorf("default TLS.SelfSigned files = %q, %q", cfg.TLS.SelfSigned.CertFile, cfg.TLS.SelfSigned.KeyFile)
+	}
+	if cfg.TLS.SelfSigned.Validity != DefaultSelfSignedValidity {
+		t.Errorf("default TLS.SelfSigned.Validity = %d, want %d", cfg.TLS.SelfSigned.Validity, DefaultSelfSignedValidity)
+	}
+}
+
+func TestLoadConfig_ACMEHTTPListenFallbackClash(t *testing.T) {
+	cases := []struct {
+		httpListen string
+		fallback   string
+		wantErr    bool
+	}{
+		{"", "127.0.0.1:80", true},
+		{":80", "localhost:80", true},
+		{"0.0.0.0:80", "[::1]:80", true},
+		{"203.0.113.10:80", "203.0.113.10:80", true},
+		{"", "127.0.0.1:8080", false},
+		{"203.0.113.10:80", "127.0.0.1:80", false},
+		{"off", "127.0.0.1:80", false},
+	}
+	for _, c := range cases {
+		content := fmt.Sprintf(`
+standalone: true
+password: "secret"
+fallback: %q
+tls:
+  acme:
+    domains: ["node.example.com"]
+    http_listen: %q
+`, c.fallback, c.httpListen)
+		f, err := os.CreateTemp("", "config-acme-*.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		f.WriteString(content)
+		f.Close()
+
+		_, err = LoadConfig(f.Name())
+		if (err != nil) != c.wantErr {
+			t.Errorf("http_listen %q, fallback %q: err = %v, wantErr %v", c.httpListen, c.fallback, err, c.wantErr)
+		}
+	}
+}
+
+func TestLoadConfig_StandaloneQuotaNeedsLedger(t *testing.T) {
+	content := `
+standalone: true
+password: "secret"
+quota:
+  enabled: true
+  users:
+    1: 1000
+`
+	f, err := os.CreateTemp("", "config-quota-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+
+	if _, err := LoadConfig(f.Name()); err == nil {
+		t.Error("expected error for quota.users without ledger.path in standalone mode, got nil")
+	}
+	os.WriteFile(f.Name(), []byte(content+"ledger:\n  path: /tmp/ledger.jsonl\n"), 0600)
+	if _, err := LoadConfig(f.Name()); err != nil {
+		t.Errorf("expected no error with ledger.path, got: %v", err)
+	}
+}
+
+func TestLoadConfig_StreamWindowRange(t *testing.T) {
+	f, err := os.CreateTemp("", "config-window-*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	for _, tc := range []struct {
+		window string
+		valid  bool
+	}{
+		{"0", true},
+		{"-1", true},
+		{"1048576", true},
+		{"4294967295", true},
+		{"-2", false},
+		{"4294967296", false},
+	} {
+		os.WriteFile(f.Name(), []byte("standalone: true\npassword: \"secret\"\nstream_window: "+tc.window+"\n"), 0600)
+		_, err := LoadConfig(f.Name())
+		if tc.valid && err != nil {
+			t.Errorf("stream_window %s: unexpected error: %v", tc.window, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("stream_window %s: expected error, got nil", tc.window)
+		}
+	}
 }
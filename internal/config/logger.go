@@ -17,27 +17,51 @@ func SetupLogger(cfg LogConfig) (*logrus.Logger, error) {
 		TimestampFormat: "2006-01-02 15:04:05",
 	})
 
+	if err := ConfigureLogger(logger, cfg); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// logOutput 同时写入标准输出和日志文件，保留文件句柄以便重新配置时关闭
+type logOutput struct {
+	io.Writer
+	file *os.File
+}
+
+// ConfigureLogger 按配置修改已有 logger 的级别和输出，用于热重载
+// 打开日志文件失败时不修改 logger；之前打开的日志文件在切换输出后关闭
+func ConfigureLogger(logger *logrus.Logger, cfg LogConfig) error {
 	// 设置日志级别
 	level, err := logrus.ParseLevel(cfg.Level)
 	if err != nil {
 		level = logrus.InfoLevel
 	}
-	logger.SetLevel(level)
 
 	// 设置输出：同时输出到文件和标准输出
 	if cfg.FilePath != "" {
 		dir := filepath.Dir(cfg.FilePath)
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			return nil, err
+			return err
 		}
 		f, err := os.OpenFile(cfg.FilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		logger.SetOutput(io.MultiWriter(os.Stdout, f))
+		setOutput(logger, &logOutput{Writer: io.MultiWriter(os.Stdout, f), file: f})
 	} else {
-		logger.SetOutput(os.Stdout)
+		setOutput(logger, os.Stdout)
 	}
+	logger.SetLevel(level)
+	return nil
+}
 
-	return logger, nil
+// setOutput 切换 logger 的输出并关闭之前由 ConfigureLogger 打开的日志文件
+// logrus 写日志时持有同一把锁，SetOutput 返回后不会再有写入旧文件的操作
+func setOutput(logger *logrus.Logger, out io.Writer) {
+	prev, _ := logger.Out.(*logOutput)
+	logger.SetOutput(out)
+	if prev != nil {
+		prev.file.Close()
+	}
 }
@@ -3,7 +3,9 @@ package config
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/leanovate/gopter"
@@ -122,6 +124,34 @@ func TestSetupLogger_WithFile(t *testing.T) {
 	}
 }
 
+// TestConfigureLogger_ClosesPreviousFile 测试重新配置日志时关闭之前打开的日志文件
+func TestConfigureLogger_ClosesPreviousFile(t *testing.T) {
+	dir := t.TempDir()
+	logger, err := SetupLogger(LogConfig{Level: "info", FilePath: filepath.Join(dir, "a.log")})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first, ok := logger.Out.(*logOutput)
+	if !ok {
+		t.Fatalf("output = %T, want *logOutput", logger.Out)
+	}
+
+	if err := ConfigureLogger(logger, LogConfig{Level: "warn", FilePath: filepath.Join(dir, "b.log")}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := first.file.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("previous log file still open: write error = %v", err)
+	}
+	second := logger.Out.(*logOutput)
+
+	if err := ConfigureLogger(logger, LogConfig{Level: "info"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := second.file.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("previous log file still open: write error = %v", err)
+	}
+}
+
 func TestSetupLogger_InvalidLevel(t *testing.T) {
 	logger, err := SetupLogger(LogConfig{Level: "invalid_level"})
 	if err != nil {
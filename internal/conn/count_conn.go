@@ -0,0 +1,75 @@
+package conn
+
+import (
+	"net"
+	"sync"
+
+	"anytls/internal/traffic"
+)
+
+// CountConn 只统计流量、不限速的连接包装器，用于 wire 和 payload 计费模式
+// 计数方向与 TrafficConn 相同，按客户端视角：Read 计入上传，Write 计入下载
+// 绑定用户之前的流量先暂存，Bind 时一并计入该用户；始终没有绑定（例如认证失败）的流量不计入
+type CountConn struct {
+	net.Conn
+	counter *traffic.Counter
+
+	mu      sync.Mutex
+	userID  int
+	bound   bool
+	pending [2]int64 // 绑定前的上传和下载字节数
+}
+
+// NewCountConn 创建流量统计包装器，userID 为 0 时需要在认证后调用 Bind
+func NewCountConn(conn net.Conn, userID int, counter *traffic.Counter) *CountConn {
+	return &CountConn{Conn: conn, counter: counter, userID: userID, bound: userID != 0}
+}
+
+// Bind 将连接的流量归属到用户，之前暂存的流量一并计入
+func (c *CountConn) Bind(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.bound {
+		return
+	}
+	c.userID = userID
+	c.bound = true
+	if c.pending != [2]int64{} {
+		c.counter.Add(userID, c.pending[0], c.pending[1])
+		c.pending = [2]int64{}
+	}
+}
+
+// Read 读取客户端发来的数据，计入上传流量
+func (c *CountConn) Read(b []byte) (n int, err error) {
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.add(int64(n), 0)
+	}
+	return
+}
+
+// Write 向客户端写入数据，计入下载流量
+func (c *CountConn) Write(b []byte) (n int, err error) {
+	n, err = c.Conn.Write(b)
+	if n > 0 {
+		c.add(0, int64(n))
+	}
+	return
+}
+
+func (c *CountConn) add(upload, download int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.bound {
+		c.pending[0] += upload
+		c.pending[1] += download
+		return
+	}
+	c.counter.Add(c.userID, upload, download)
+}
+
+// Upstream 返回被包装的连接，使 N.ReportHandshakeSuccess 等能找到底层的 session.Stream
+func (c *CountConn) Upstream() any {
+	return c.Conn
+}
@@ -0,0 +1,30 @@
+package conn
+
+import (
+	"io"
+	"testing"
+
+	"anytls/internal/traffic"
+)
+
+// TestCountConn_Bind 测试绑定用户前的流量暂存，绑定后一并计入；未绑定的连接不计入任何用户
+func TestCountConn_Bind(t *testing.T) {
+	client, server := tcpPair(t)
+	counter := traffic.NewCounter()
+	cc := NewCountConn(server, 0, counter)
+
+	go client.Write(make([]byte, 100))
+	if _, err := io.ReadFull(cc, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	cc.Write(make([]byte, 30))
+	if len(counter.Totals()) != 0 {
+		t.Fatalf("unbound traffic counted: %v", counter.Totals())
+	}
+
+	cc.Bind(1)
+	cc.Write(make([]byte, 20))
+	if got := counter.Total(1); got != [2]int64{100, 50} {
+		t.Errorf("Total(1) = %v, want [100 50]", got)
+	}
+}
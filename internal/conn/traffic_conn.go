@@ -4,50 +4,81 @@ import (
 	"context"
 	"net"
 
+	"anytls/internal/ratelimit"
 	"anytls/internal/traffic"
-
-	"golang.org/x/time/rate"
 )
 
 // TrafficConn 带流量统计和限速的连接包装器
 // 包装传递给 session.NewServerSession() 的 TLS 连接，统计包括协议开销和 padding 在内的全部流量
+// 计数和限速都按客户端视角，与面板的 u/d 含义一致：
+// Read（客户端发往节点）计入上传并受上传限速约束，Write（节点发往客户端）计入下载并受下载限速约束
+// 使用 wire 或 payload 计费模式时由 CountConn 在其他层统计，counter 为 nil，只限速不计数
 type TrafficConn struct {
 	net.Conn
 	userID  int
 	counter *traffic.Counter
-	limiter *rate.Limiter // nil 表示不限速
+	// limiters 每次读写时查询用户当前的限速器和节点总带宽，限速修改后对已有连接立即生效
+	limiters *ratelimit.SpeedLimiter
+	// ctx 在连接关闭或服务退出时取消，中断正在进行的限速等待
+	ctx    context.Context
+	cancel context.CancelFunc
 }
 
 // NewTrafficConn 创建带流量统计和限速的连接包装器
-func NewTrafficConn(conn net.Conn, userID int, counter *traffic.Counter, limiter *rate.Limiter) *TrafficConn {
+func NewTrafficConn(ctx context.Context, conn net.Conn, userID int, counter *traffic.Counter, limiters *ratelimit.SpeedLimiter) *TrafficConn {
+	ctx, cancel := context.WithCancel(ctx)
 	return &TrafficConn{
-		Conn:    conn,
-		userID:  userID,
-		counter: counter,
-		limiter: limiter,
+		Conn:     conn,
+		userID:   userID,
+		counter:  counter,
+		limiters: limiters,
+		ctx:      ctx,
+		cancel:   cancel,
 	}
 }
 
-// Read 读取数据并统计下载流量
+// Read 读取客户端发来的数据，计入上传流量
+// 限速时单次读取不超过 burst，读取后按实际字节数等待令牌
 func (c *TrafficConn) Read(b []byte) (n int, err error) {
+	b = b[:c.limiters.ChunkSize(c.userID, ratelimit.Upload, len(b))]
 	n, err = c.Conn.Read(b)
 	if n > 0 {
-		c.counter.Add(c.userID, 0, int64(n))
-		if c.limiter != nil {
-			_ = c.limiter.WaitN(context.Background(), n)
+		if c.counter != nil {
+			c.counter.Add(c.userID, int64(n), 0)
+		}
+		if waitErr := c.limiters.Wait(c.ctx, c.userID, ratelimit.Upload, n); waitErr != nil && err == nil {
+			err = waitErr
 		}
 	}
 	return
 }
 
-// Write 写入数据并统计上传流量
+// Write 向客户端写入数据，计入下载流量
+// 限速时按 burst 分段，每段先等待令牌再写入
 func (c *TrafficConn) Write(b []byte) (n int, err error) {
-	n, err = c.Conn.Write(b)
-	if n > 0 {
-		c.counter.Add(c.userID, int64(n), 0)
-		if c.limiter != nil {
-			_ = c.limiter.WaitN(context.Background(), n)
+	for len(b) > 0 {
+		chunk := c.limiters.ChunkSize(c.userID, ratelimit.Download, len(b))
+		if err = c.limiters.Wait(c.ctx, c.userID, ratelimit.Download, chunk); err != nil {
+			return
+		}
+		var written int
+		written, err = c.Conn.Write(b[:chunk])
+		if written > 0 {
+			n += written
+			if c.counter != nil {
+				c.counter.Add(c.userID, 0, int64(written))
+			}
 		}
+		if err != nil {
+			return
+		}
+		b = b[chunk:]
 	}
 	return
 }
+
+// Close 关闭连接并中断正在进行的限速等待
+func (c *TrafficConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
@@ -0,0 +1,184 @@
+package conn
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"anytls/internal/ratelimit"
+	"anytls/internal/traffic"
+)
+
+// tcpPair 返回一对已连接的本地 TCP 连接
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+const mbps = 125000 // 1 Mbps 对应的字节数
+
+// TestTrafficConn_DirectionalThroughput 测试上传和下载限速互相独立，且实际吞吐量符合限速
+// 令牌桶初始为满 burst（128KB/Mbps），传输量为 burst + 0.5 秒的量，耗时应约为 0.5 秒
+func TestTrafficConn_DirectionalThroughput(t *testing.T) {
+	client, server := tcpPair(t)
+	limiters := ratelimit.NewSpeedLimiter()
+	limiters.GetLimiter(1, ratelimit.Limits{Upload: 16, Download: 8})
+	counter := traffic.NewCounter()
+	tc := NewTrafficConn(context.Background(), server, 1, counter, limiters)
+
+	uploadSize := 16*128*1024 + 16*mbps/2
+	downloadSize := 8*128*1024 + 8*mbps/2
+
+	type result struct {
+		elapsed time.Duration
+		err     error
+	}
+	upload := make(chan result, 1)
+	download := make(chan result, 1)
+
+	go func() {
+		start := time.Now()
+		_, err := io.CopyN(io.Discard, tc, int64(uploadSize))
+		upload <- result{time.Since(start), err}
+	}()
+	go func() {
+		start := time.Now()
+		// 单次写入远大于 burst，需要分段等待
+		_, err := tc.Write(make([]byte, downloadSize))
+		download <- result{time.Since(start), err}
+	}()
+	go client.Write(make([]byte, uploadSize))
+	go io.CopyN(io.Discard, client, int64(downloadSize))
+
+	for name, ch := range map[string]chan result{"upload": upload, "download": download} {
+		r := <-ch
+		if r.err != nil {
+			t.Fatalf("%s failed: %v", name, r.err)
+		}
+		if r.elapsed < 400*time.Millisecond || r.elapsed > 900*time.Millisecond {
+			t.Errorf("%s took %v, want about 500ms", name, r.elapsed)
+		}
+	}
+
+	// 客户端视角：客户端发往节点的计入上传，节点发往客户端的计入下载
+	totals := counter.Totals()[1]
+	if totals != [2]int64{int64(uploadSize), int64(downloadSize)} {
+		t.Errorf("counted traffic = %v, want [%d %d]", totals, uploadSize, downloadSize)
+	}
+}
+
+// TestTrafficConn_UploadLimitThrottlesClientToServer 测试上传限速只约束客户端发往节点的数据
+func TestTrafficConn_UploadLimitThrottlesClientToServer(t *testing.T) {
+	client, server := tcpPair(t)
+	limiters := ratelimit.NewSpeedLimiter()
+	limiters.GetLimiter(1, ratelimit.Limits{Upload: 1})
+	counter := traffic.NewCounter()
+	tc := NewTrafficConn(context.Background(), server, 1, counter, limiters)
+
+	// 节点发往客户端不受上传限速影响
+	const downloadSize = 1024 * 1024
+	go io.CopyN(io.Discard, client, downloadSize)
+	start := time.Now()
+	if _, err := tc.Write(make([]byte, downloadSize)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("server->client took %v, should not be throttled by upload_limit", elapsed)
+	}
+
+	// 客户端发往节点：burst 之外的 0.25 秒的量需要等待
+	uploadSize := 128*1024 + mbps/4
+	go client.Write(make([]byte, uploadSize))
+	start = time.Now()
+	if _, err := io.CopyN(io.Discard, tc, int64(uploadSize)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("client->server took %v, want throttled to about 250ms", elapsed)
+	}
+	if got := counter.Total(1); got != [2]int64{int64(uploadSize), downloadSize} {
+		t.Errorf("Total(1) = %v, want [%d %d]", got, uploadSize, downloadSize)
+	}
+}
+
+// TestTrafficConn_LimitChangeAppliesLive 测试限速变更对已有连接立即生效
+func TestTrafficConn_LimitChangeAppliesLive(t *testing.T) {
+	client, server := tcpPair(t)
+	limiters := ratelimit.NewSpeedLimiter()
+	limiters.GetLimiter(1, ratelimit.Limits{Download: 1})
+	tc := NewTrafficConn(context.Background(), server, 1, traffic.NewCounter(), limiters)
+	go io.Copy(io.Discard, client)
+
+	// 1 Mbps 下写 1MB 需要约 8 秒，改为不限速后，当前分段的等待结束即不再限速
+	done := make(chan error, 1)
+	go func() {
+		_, err := tc.Write(make([]byte, 1024*1024))
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	limiters.UpdateLimit(1, ratelimit.Limits{})
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Write did not speed up after the limit was removed")
+	}
+}
+
+// TestTrafficConn_CloseInterruptsWait 测试关闭连接或取消 ctx 会中断限速等待
+func TestTrafficConn_CloseInterruptsWait(t *testing.T) {
+	for _, cancelByCtx := range []bool{false, true} {
+		client, server := tcpPair(t)
+		limiters := ratelimit.NewSpeedLimiter()
+		limiters.GetLimiter(1, ratelimit.Limits{Download: 1})
+		ctx, cancel := context.WithCancel(context.Background())
+		tc := NewTrafficConn(ctx, server, 1, traffic.NewCounter(), limiters)
+		go io.Copy(io.Discard, client)
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := tc.Write(make([]byte, 1024*1024))
+			done <- err
+		}()
+		time.Sleep(100 * time.Millisecond)
+		if cancelByCtx {
+			cancel()
+		} else {
+			tc.Close()
+		}
+
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("cancelByCtx=%v: Write should fail after cancellation", cancelByCtx)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("cancelByCtx=%v: Write still blocked after cancellation", cancelByCtx)
+		}
+		cancel()
+	}
+}
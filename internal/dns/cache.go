@@ -0,0 +1,96 @@
+package dns
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxCacheTTL 缓存时间上限，避免上游返回过大的 TTL
+	maxCacheTTL = time.Hour
+	// negativeCacheTTL 域名不存在或无对应记录时的缓存时间
+	negativeCacheTTL = 30 * time.Second
+	// maxCacheEntries 缓存条目上限
+	maxCacheEntries = 4096
+)
+
+type cacheKey struct {
+	domain string
+	qtype  dnsmessage.Type
+}
+
+type cacheEntry struct {
+	addrs  []netip.Addr
+	err    error
+	expire time.Time
+}
+
+// cache 按 (域名, 记录类型) 缓存解析结果，条目在 TTL 到期后失效
+type cache struct {
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+func newCache() *cache {
+	return &cache{entries: make(map[cacheKey]cacheEntry)}
+}
+
+// get 返回未过期的缓存结果
+func (c *cache) get(key cacheKey) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	if time.Now().After(entry.expire) {
+		delete(c.entries, key)
+		return cacheEntry{}, false
+	}
+	return entry, true
+}
+
+// set 写入缓存，ttl 为 0 时不缓存
+func (c *cache) set(key cacheKey, entry cacheEntry, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	entry.expire = time.Now().Add(min(ttl, maxCacheTTL))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		c.evictLocked()
+	}
+	c.entries[key] = entry
+}
+
+// removeFunc 删除域名满足 match 的条目
+func (c *cache) removeFunc(match func(domain string) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if match(key.domain) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// evictLocked 清理过期条目，仍然超限时随机淘汰一部分
+func (c *cache) evictLocked() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.expire) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < maxCacheEntries*3/4 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,401 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/internal/router"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// ErrNotFound 域名不存在或没有符合解析策略的地址
+var ErrNotFound = errors.New("no such host")
+
+// defaultTimeout 默认单次查询超时
+const defaultTimeout = 5 * time.Second
+
+// Strategy 解析策略
+type Strategy uint8
+
+const (
+	StrategyPreferIPv4 Strategy = iota
+	StrategyPreferIPv6
+	StrategyIPv4Only
+	StrategyIPv6Only
+)
+
+// ParseStrategy 解析配置中的策略名称，空字符串为 prefer_ipv4
+func ParseStrategy(s string) (Strategy, error) {
+	switch s {
+	case "", "prefer_ipv4":
+		return StrategyPreferIPv4, nil
+	case "prefer_ipv6":
+		return StrategyPreferIPv6, nil
+	case "ipv4_only":
+		return StrategyIPv4Only, nil
+	case "ipv6_only":
+		return StrategyIPv6Only, nil
+	default:
+		return 0, fmt.Errorf("未知的 DNS 解析策略 %q", s)
+	}
+}
+
+// override 按域名指定的上游服务器
+type override struct {
+	matcher *router.DomainMatcher
+	servers []Upstream
+}
+
+// Resolver 内置 DNS 解析器
+// 查询顺序：IP 字面量 → hosts → 缓存 → 上游（面板覆盖 → 本地覆盖 → 默认上游，依次尝试直到成功）
+type Resolver struct {
+	servers        []Upstream
+	overrides      []override
+	panelOverrides atomic.Pointer[[]override]
+	hosts          map[string][]netip.Addr
+	strategy       Strategy
+	timeout        time.Duration
+	cache          *cache
+}
+
+// NewResolver 根据配置创建解析器，未配置上游服务器时返回 nil（使用系统 DNS）
+func NewResolver(cfg config.DNSConfig) (*Resolver, error) {
+	if len(cfg.Servers) == 0 {
+		if len(cfg.Hosts) > 0 || len(cfg.Overrides) > 0 {
+			return nil, fmt.Errorf("DNS 配置错误: 使用 hosts 或 overrides 时 servers 不能为空")
+		}
+		return nil, nil
+	}
+
+	strategy, err := ParseStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, fmt.Errorf("DNS 配置错误: %w", err)
+	}
+	servers, err := newUpstreams(cfg.Servers)
+	if err != nil {
+		return nil, fmt.Errorf("DNS 配置错误: %w", err)
+	}
+	overrides, err := newOverrides(cfg.Overrides)
+	if err != nil {
+		return nil, fmt.Errorf("DNS 配置错误: %w", err)
+	}
+
+	r := &Resolver{
+		servers:   servers,
+		overrides: overrides,
+		hosts:     make(map[string][]netip.Addr, len(cfg.Hosts)),
+		strategy:  strategy,
+		timeout:   defaultTimeout,
+	}
+	if cfg.Timeout > 0 {
+		r.timeout = time.Duration(cfg.Timeout) * time.Second
+	}
+	if !cfg.DisableCache {
+		r.cache = newCache()
+	}
+	for domain, ips := range cfg.Hosts {
+		for _, ip := range ips {
+			addr, err := netip.ParseAddr(ip)
+			if err != nil {
+				return nil, fmt.Errorf("DNS 配置错误: hosts 中 %q 的地址 %q 无效", domain, ip)
+			}
+			key := normalize(domain)
+			r.hosts[key] = append(r.hosts[key], addr.Unmap())
+		}
+	}
+	r.panelOverrides.Store(&[]override{})
+	return r, nil
+}
+
+func newUpstreams(addresses []string) ([]Upstream, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("servers 不能为空")
+	}
+	upstreams := make([]Upstream, 0, len(addresses))
+	for _, address := range addresses {
+		upstream, err := NewUpstream(address)
+		if err != nil {
+			return nil, err
+		}
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+func newOverrides(configs []config.DNSOverride) ([]override, error) {
+	overrides := make([]override, 0, len(configs))
+	for _, c := range configs {
+		matcher, err := router.NewDomainMatcher(c.Domain, c.DomainSuffix, c.DomainKeyword, c.DomainRegex)
+		if err != nil {
+			return nil, err
+		}
+		if matcher == nil {
+			return nil, errors.New("overrides 中的规则缺少域名条件")
+		}
+		servers, err := newUpstreams(c.Servers)
+		if err != nil {
+			return nil, err
+		}
+		overrides = append(overrides, override{matcher: matcher, servers: servers})
+	}
+	return overrides, nil
+}
+
+// UpdatePanelOverrides 原子替换面板下发的按域名上游配置，优先于本地 overrides
+// 上游因此改变的域名的缓存结果随之清除，未改变的保留
+func (r *Resolver) UpdatePanelOverrides(configs []config.DNSOverride) error {
+	overrides, err := newOverrides(configs)
+	if err != nil {
+		return err
+	}
+	old := *r.panelOverrides.Swap(&overrides)
+	if r.cache != nil {
+		r.cache.removeFunc(func(domain string) bool {
+			return !sameUpstreams(r.selectFrom(old, domain), r.selectFrom(overrides, domain))
+		})
+	}
+	return nil
+}
+
+// Lookup 解析域名，返回按策略排序的地址列表
+func (r *Resolver) Lookup(ctx context.Context, domain string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(domain); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	domain = normalize(domain)
+	if addrs, ok := r.hosts[domain]; ok {
+		if addrs = r.sort(addrs, nil); len(addrs) > 0 {
+			return addrs, nil
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, domain)
+	}
+
+	servers := r.selectServers(domain)
+	var addrs []netip.Addr
+	var err error
+	switch r.strategy {
+	case StrategyIPv4Only:
+		addrs, err = r.lookupType(ctx, domain, dnsmessage.TypeA, servers)
+	case StrategyIPv6Only:
+		addrs, err = r.lookupType(ctx, domain, dnsmessage.TypeAAAA, servers)
+	default:
+		addrs, err = r.lookupDual(ctx, domain, servers)
+	}
+	if errors.Is(err, ErrNotFound) || err == nil && len(addrs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, domain)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return addrs, nil
+}
+
+// lookupDual 并发查询 A 和 AAAA 记录，任一成功即返回
+func (r *Resolver) lookupDual(ctx context.Context, domain string, servers []Upstream) ([]netip.Addr, error) {
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	aaaa := make(chan result, 1)
+	go func() {
+		addrs, err := r.lookupType(ctx, domain, dnsmessage.TypeAAAA, servers)
+		aaaa <- result{addrs, err}
+	}()
+	v4, err4 := r.lookupType(ctx, domain, dnsmessage.TypeA, servers)
+	v6 := <-aaaa
+	if err4 != nil && v6.err != nil {
+		return nil, err4
+	}
+	return r.sort(v4, v6.addrs), nil
+}
+
+// sort 按策略过滤并排序地址
+func (r *Resolver) sort(a, b []netip.Addr) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, list := range [][]netip.Addr{a, b} {
+		for _, addr := range list {
+			if addr.Is4() {
+				v4 = append(v4, addr)
+			} else {
+				v6 = append(v6, addr)
+			}
+		}
+	}
+	switch r.strategy {
+	case StrategyIPv4Only:
+		return v4
+	case StrategyIPv6Only:
+		return v6
+	case StrategyPreferIPv6:
+		return append(v6, v4...)
+	default:
+		return append(v4, v6...)
+	}
+}
+
+// selectServers 选择域名对应的上游服务器
+func (r *Resolver) selectServers(domain string) []Upstream {
+	return r.selectFrom(*r.panelOverrides.Load(), domain)
+}
+
+// selectFrom 按给定的面板覆盖配置选择域名对应的上游服务器
+func (r *Resolver) selectFrom(panel []override, domain string) []Upstream {
+	for _, overrides := range [...][]override{panel, r.overrides} {
+		for _, o := range overrides {
+			if o.matcher.Match(domain) {
+				return o.servers
+			}
+		}
+	}
+	return r.servers
+}
+
+// sameUpstreams 判断两组上游的地址是否依次相同
+func sameUpstreams(a, b []Upstream) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].String() != b[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupType 查询单一类型的记录，优先使用缓存
+func (r *Resolver) lookupType(ctx context.Context, domain string, qtype dnsmessage.Type, servers []Upstream) ([]netip.Addr, error) {
+	key := cacheKey{domain: domain, qtype: qtype}
+	if r.cache != nil {
+		if entry, ok := r.cache.get(key); ok {
+			return entry.addrs, entry.err
+		}
+	}
+
+	var errs []error
+	for _, server := range servers {
+		addrs, ttl, err := r.exchange(ctx, server, domain, qtype)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		if r.cache != nil {
+			r.cache.set(key, cacheEntry{addrs: addrs, err: err}, ttl)
+		}
+		return addrs, err
+	}
+	return nil, fmt.Errorf("解析 %s 失败: %w", domain, errors.Join(errs...))
+}
+
+// exchange 向单个上游发送查询并解析响应
+func (r *Resolver) exchange(ctx context.Context, server Upstream, domain string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	query, err := buildQuery(id, domain, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	response, err := server.Exchange(ctx, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseResponse(response, id, qtype)
+}
+
+func buildQuery(id uint16, domain string, qtype dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(domain + ".")
+	if err != nil {
+		return nil, fmt.Errorf("无效的域名 %q: %w", domain, err)
+	}
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	if err := b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(maxUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err := b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseResponse 解析响应中的 A/AAAA 记录，返回地址和缓存时间
+// 域名不存在时返回 ErrNotFound，无对应记录时返回空列表
+func parseResponse(response []byte, id uint16, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+	}
+	if header.ID != id {
+		return nil, 0, errors.New("响应 ID 不匹配")
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, negativeCacheTTL, ErrNotFound
+	default:
+		return nil, 0, fmt.Errorf("上游返回 %s", header.RCode)
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+	}
+
+	var addrs []netip.Addr
+	ttl := uint32(maxCacheTTL / time.Second)
+	for {
+		rh, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+		}
+		switch {
+		case rh.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+			}
+			addrs = append(addrs, netip.AddrFrom4(r.A))
+			ttl = min(ttl, rh.TTL)
+		case rh.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+			}
+			addrs = append(addrs, netip.AddrFrom16(r.AAAA))
+			ttl = min(ttl, rh.TTL)
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return nil, 0, fmt.Errorf("解析响应失败: %w", err)
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, negativeCacheTTL, nil
+	}
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+func normalize(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
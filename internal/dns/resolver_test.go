@@ -0,0 +1,420 @@
+package dns
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/util"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubServer 本地 DNS 桩服务器，同时监听 UDP 和 TCP
+type stubServer struct {
+	records  map[string][]netip.Addr // 域名（不带末尾点）→ 地址
+	truncate atomic.Bool             // UDP 响应设置 TC 位且不带记录
+	queries  atomic.Int32
+	addr     string
+}
+
+func newStubServer(t *testing.T, records map[string][]netip.Addr) *stubServer {
+	t.Helper()
+	s := &stubServer{records: records}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addr = pc.LocalAddr().String()
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		pc.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		pc.Close()
+		ln.Close()
+	})
+
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(s.answer(buffer[:n], s.truncate.Load()), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s.serveStream(conn)
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *stubServer) serveStream(conn net.Conn) {
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return
+	}
+	query := make([]byte, length)
+	if _, err := io.ReadFull(conn, query); err != nil {
+		return
+	}
+	response := s.answer(query, false)
+	out := make([]byte, 2+len(response))
+	binary.BigEndian.PutUint16(out, uint16(len(response)))
+	copy(out[2:], response)
+	conn.Write(out)
+}
+
+// answer 根据 records 构造响应，未知域名返回 NXDOMAIN
+func (s *stubServer) answer(query []byte, truncate bool) []byte {
+	s.queries.Add(1)
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil
+	}
+	question, err := parser.Question()
+	if err != nil {
+		return nil
+	}
+	domain := strings.TrimSuffix(question.Name.String(), ".")
+	addrs, ok := s.records[domain]
+
+	responseHeader := dnsmessage.Header{ID: header.ID, Response: true, RecursionAvailable: true, Truncated: truncate}
+	if !ok {
+		responseHeader.RCode = dnsmessage.RCodeNameError
+	}
+	b := dnsmessage.NewBuilder(nil, responseHeader)
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	if !truncate {
+		for _, addr := range addrs {
+			rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 60}
+			switch {
+			case addr.Is4() && question.Type == dnsmessage.TypeA:
+				b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+			case addr.Is6() && question.Type == dnsmessage.TypeAAAA:
+				b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+			}
+		}
+	}
+	response, _ := b.Finish()
+	return response
+}
+
+func addrs(ips ...string) []netip.Addr {
+	result := make([]netip.Addr, len(ips))
+	for i, ip := range ips {
+		result[i] = netip.MustParseAddr(ip)
+	}
+	return result
+}
+
+func mustResolver(t *testing.T, cfg config.DNSConfig) *Resolver {
+	t.Helper()
+	r, err := NewResolver(cfg)
+	if err != nil {
+		t.Fatalf("NewResolver failed: %v", err)
+	}
+	return r
+}
+
+func assertAddrs(t *testing.T, got []netip.Addr, want ...string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestResolver_Strategy(t *testing.T) {
+	stub := newStubServer(t, map[string][]netip.Addr{
+		"dual.test": addrs("1.2.3.4", "2001:db8::1"),
+	})
+
+	cases := map[string][]string{
+		"":            {"1.2.3.4", "2001:db8::1"},
+		"prefer_ipv4": {"1.2.3.4", "2001:db8::1"},
+		"prefer_ipv6": {"2001:db8::1", "1.2.3.4"},
+		"ipv4_only":   {"1.2.3.4"},
+		"ipv6_only":   {"2001:db8::1"},
+	}
+	for strategy, want := range cases {
+		r := mustResolver(t, config.DNSConfig{Servers: []string{stub.addr}, Strategy: strategy})
+		got, err := r.Lookup(context.Background(), "Dual.Test.")
+		if err != nil {
+			t.Fatalf("%s: Lookup failed: %v", strategy, err)
+		}
+		assertAddrs(t, got, want...)
+	}
+}
+
+func TestResolver_Cache(t *testing.T) {
+	stub := newStubServer(t, map[string][]netip.Addr{"cached.test": addrs("1.2.3.4")})
+	r := mustResolver(t, config.DNSConfig{Servers: []string{"udp://" + stub.addr}, Strategy: "ipv4_only"})
+
+	for i := 0; i < 3; i++ {
+		got, err := r.Lookup(context.Background(), "cached.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAddrs(t, got, "1.2.3.4")
+	}
+	if n := stub.queries.Load(); n != 1 {
+		t.Errorf("upstream queries = %d, want 1", n)
+	}
+
+	// 域名不存在的结果同样被缓存
+	for i := 0; i < 2; i++ {
+		if _, err := r.Lookup(context.Background(), "missing.test"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("expected ErrNotFound, got %v", err)
+		}
+	}
+	if n := stub.queries.Load(); n != 2 {
+		t.Errorf("upstream queries = %d, want 2", n)
+	}
+
+	// 关闭缓存后每次都查询上游
+	r = mustResolver(t, config.DNSConfig{Servers: []string{stub.addr}, Strategy: "ipv4_only", DisableCache: true})
+	r.Lookup(context.Background(), "cached.test")
+	r.Lookup(context.Background(), "cached.test")
+	if n := stub.queries.Load(); n != 4 {
+		t.Errorf("upstream queries = %d, want 4", n)
+	}
+}
+
+func TestResolver_HostsAndOverrides(t *testing.T) {
+	main := newStubServer(t, map[string][]netip.Addr{
+		"a.corp.test": addrs("1.1.1.1"),
+		"b.corp.test": addrs("1.1.1.2"),
+	})
+	corp := newStubServer(t, map[string][]netip.Addr{"a.corp.test": addrs("10.0.0.1")})
+
+	r := mustResolver(t, config.DNSConfig{
+		Servers:  []string{main.addr},
+		Strategy: "ipv4_only",
+		Hosts: map[string][]string{
+			"static.test": {"192.0.2.1", "2001:db8::2"},
+		},
+		Overrides: []config.DNSOverride{
+			{DomainSuffix: []string{"corp.test"}, Servers: []string{corp.addr}},
+		},
+	})
+
+	got, err := r.Lookup(context.Background(), "static.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "192.0.2.1")
+
+	got, err = r.Lookup(context.Background(), "a.corp.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "10.0.0.1")
+
+	// 面板下发的覆盖配置优先于本地配置
+	if err := r.UpdatePanelOverrides([]config.DNSOverride{
+		{Domain: []string{"b.corp.test"}, Servers: []string{main.addr}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got, err = r.Lookup(context.Background(), "b.corp.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "1.1.1.2")
+	if main.queries.Load() != 1 || corp.queries.Load() != 1 {
+		t.Errorf("queries main=%d corp=%d, want 1/1", main.queries.Load(), corp.queries.Load())
+	}
+
+	got, err = r.Lookup(context.Background(), "203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "203.0.113.5")
+}
+
+// TestResolver_PanelOverridesInvalidateCache 测试面板覆盖配置改变上游后不再使用旧上游的缓存结果，
+// 上游未改变的域名继续使用缓存
+func TestResolver_PanelOverridesInvalidateCache(t *testing.T) {
+	main := newStubServer(t, map[string][]netip.Addr{
+		"moved.test": addrs("1.1.1.1"),
+		"other.test": addrs("1.1.1.2"),
+	})
+	corp := newStubServer(t, map[string][]netip.Addr{"moved.test": addrs("10.0.0.1")})
+	r := mustResolver(t, config.DNSConfig{Servers: []string{main.addr}, Strategy: "ipv4_only"})
+
+	lookup := func(domain, want string) {
+		t.Helper()
+		got, err := r.Lookup(context.Background(), domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAddrs(t, got, want)
+	}
+	lookup("moved.test", "1.1.1.1")
+	lookup("other.test", "1.1.1.2")
+
+	moved := []config.DNSOverride{{Domain: []string{"moved.test"}, Servers: []string{corp.addr}}}
+	if err := r.UpdatePanelOverrides(moved); err != nil {
+		t.Fatal(err)
+	}
+	lookup("moved.test", "10.0.0.1")
+	lookup("other.test", "1.1.1.2")
+	if main.queries.Load() != 2 || corp.queries.Load() != 1 {
+		t.Errorf("queries main=%d corp=%d, want 2/1", main.queries.Load(), corp.queries.Load())
+	}
+
+	// 重复下发相同的配置不清除缓存
+	if err := r.UpdatePanelOverrides(moved); err != nil {
+		t.Fatal(err)
+	}
+	lookup("moved.test", "10.0.0.1")
+	if corp.queries.Load() != 1 {
+		t.Errorf("corp queries = %d, want 1", corp.queries.Load())
+	}
+
+	// 移除覆盖后回到默认上游
+	if err := r.UpdatePanelOverrides(nil); err != nil {
+		t.Fatal(err)
+	}
+	lookup("moved.test", "1.1.1.1")
+	if main.queries.Load() != 3 {
+		t.Errorf("main queries = %d, want 3", main.queries.Load())
+	}
+}
+
+func TestResolver_TruncatedFallsBackToTCP(t *testing.T) {
+	stub := newStubServer(t, map[string][]netip.Addr{"big.test": addrs("1.2.3.4")})
+	stub.truncate.Store(true)
+	r := mustResolver(t, config.DNSConfig{Servers: []string{stub.addr}, Strategy: "ipv4_only"})
+	got, err := r.Lookup(context.Background(), "big.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "1.2.3.4")
+}
+
+func TestResolver_FailoverToNextServer(t *testing.T) {
+	stub := newStubServer(t, map[string][]netip.Addr{"ok.test": addrs("1.2.3.4")})
+	// 第一个上游是无人监听的 TCP 端口
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := ln.Addr().String()
+	ln.Close()
+
+	r := mustResolver(t, config.DNSConfig{
+		Servers:  []string{"tcp://" + dead, "tcp://" + stub.addr},
+		Strategy: "ipv4_only",
+		Timeout:  1,
+	})
+	got, err := r.Lookup(context.Background(), "ok.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertAddrs(t, got, "1.2.3.4")
+}
+
+func TestResolver_DoTAndDoH(t *testing.T) {
+	stub := newStubServer(t, map[string][]netip.Addr{"secure.test": addrs("1.2.3.4")})
+	cert, err := util.GenerateKeyPair(time.Now, time.Hour, "dns.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// DoT
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{*cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				stub.serveStream(conn)
+			}()
+		}
+	}()
+
+	// DoH
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(stub.answer(query, false))
+	}))
+	defer doh.Close()
+
+	for _, server := range []string{"tls://" + ln.Addr().String(), doh.URL + "/dns-query"} {
+		r := mustResolver(t, config.DNSConfig{Servers: []string{server}, Strategy: "ipv4_only"})
+		switch u := r.servers[0].(type) {
+		case *tlsUpstream:
+			u.config.InsecureSkipVerify = true
+		case *httpsUpstream:
+			u.client = doh.Client()
+		}
+		got, err := r.Lookup(context.Background(), "secure.test")
+		if err != nil {
+			t.Fatalf("%s: Lookup failed: %v", server, err)
+		}
+		assertAddrs(t, got, "1.2.3.4")
+	}
+}
+
+func TestNewResolver_Config(t *testing.T) {
+	r, err := NewResolver(config.DNSConfig{})
+	if r != nil || err != nil {
+		t.Errorf("empty config: got (%v, %v), want (nil, nil)", r, err)
+	}
+
+	invalid := map[string]config.DNSConfig{
+		"hosts without servers": {Hosts: map[string][]string{"a.test": {"1.1.1.1"}}},
+		"bad strategy":          {Servers: []string{"1.1.1.1"}, Strategy: "ipv5_only"},
+		"bad scheme":            {Servers: []string{"quic://1.1.1.1"}},
+		"bad host ip":           {Servers: []string{"1.1.1.1"}, Hosts: map[string][]string{"a.test": {"x"}}},
+		"override no domain":    {Servers: []string{"1.1.1.1"}, Overrides: []config.DNSOverride{{Servers: []string{"8.8.8.8"}}}},
+		"override no servers":   {Servers: []string{"1.1.1.1"}, Overrides: []config.DNSOverride{{Domain: []string{"a.test"}}}},
+	}
+	for name, cfg := range invalid {
+		if _, err := NewResolver(cfg); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
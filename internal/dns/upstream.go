@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxUDPSize UDP 查询通告的最大响应长度（EDNS0）
+const maxUDPSize = 1232
+
+// Upstream 上游 DNS 服务器
+type Upstream interface {
+	// Exchange 发送一条 DNS 查询报文并返回响应报文
+	Exchange(ctx context.Context, query []byte) ([]byte, error)
+	String() string
+}
+
+// NewUpstream 根据地址创建上游服务器
+// 支持 "8.8.8.8"、"udp://8.8.8.8:53"、"tcp://8.8.8.8"、"tls://dns.google"、"https://dns.google/dns-query"
+// 上游地址为域名时，通过系统 DNS 解析
+func NewUpstream(address string) (Upstream, error) {
+	if !strings.Contains(address, "://") {
+		address = "udp://" + address
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("无效的 DNS 服务器地址 %q: %w", address, err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("无效的 DNS 服务器地址 %q", address)
+	}
+	switch u.Scheme {
+	case "udp":
+		return &udpUpstream{address: withDefaultPort(u, "53")}, nil
+	case "tcp":
+		return &tcpUpstream{address: withDefaultPort(u, "53")}, nil
+	case "tls":
+		return &tlsUpstream{
+			address: withDefaultPort(u, "853"),
+			config:  &tls.Config{ServerName: u.Hostname()},
+		}, nil
+	case "https":
+		if u.Path == "" {
+			u.Path = "/dns-query"
+		}
+		return &httpsUpstream{
+			url: u.String(),
+			client: &http.Client{
+				Transport: &http.Transport{
+					ForceAttemptHTTP2:   true,
+					MaxIdleConnsPerHost: 4,
+					IdleConnTimeout:     90 * time.Second,
+				},
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("不支持的 DNS 服务器协议 %q", u.Scheme)
+	}
+}
+
+func withDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// udpUpstream 普通 UDP 上游，响应被截断时改用 TCP 重试
+type udpUpstream struct {
+	address string
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.address
+}
+
+func (u *udpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	id := binary.BigEndian.Uint16(query)
+	buffer := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		// 丢弃 ID 不匹配的响应（迟到的旧响应或伪造响应）
+		if n < 12 || binary.BigEndian.Uint16(buffer) != id {
+			continue
+		}
+		var header dnsmessage.Header
+		var parser dnsmessage.Parser
+		if header, err = parser.Start(buffer[:n]); err == nil && header.Truncated {
+			return (&tcpUpstream{address: u.address}).Exchange(ctx, query)
+		}
+		return buffer[:n], nil
+	}
+}
+
+// tcpUpstream TCP 上游，报文前带 2 字节长度
+type tcpUpstream struct {
+	address string
+}
+
+func (u *tcpUpstream) String() string {
+	return "tcp://" + u.address
+}
+
+func (u *tcpUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, query)
+}
+
+// tlsUpstream DNS over TLS 上游
+type tlsUpstream struct {
+	address string
+	config  *tls.Config
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.address
+}
+
+func (u *tlsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	dialer := tls.Dialer{Config: u.config}
+	conn, err := dialer.DialContext(ctx, "tcp", u.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return exchangeStream(ctx, conn, query)
+}
+
+func exchangeStream(ctx context.Context, conn net.Conn, query []byte) ([]byte, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	request := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(request, uint16(len(query)))
+	copy(request[2:], query)
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, length)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// httpsUpstream DNS over HTTPS 上游（RFC 8484，POST 方式）
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH 服务器返回状态码 %d", resp.StatusCode)
+	}
+	response, err := io.ReadAll(io.LimitReader(resp.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, errors.New("DoH 响应过短")
+	}
+	return response, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -12,26 +13,34 @@ import (
 // Handler fallback 处理器
 // 认证失败时将连接转发到正常网站，伪装为普通 HTTPS 流量
 type Handler struct {
-	target string // 目标地址，如 "127.0.0.1:80"
+	target atomic.Pointer[string] // 目标地址，如 "127.0.0.1:80"
 }
 
 // NewHandler 创建 fallback 处理器
 // target 为空时 Handle 会直接关闭连接
 func NewHandler(target string) *Handler {
-	return &Handler{target: target}
+	h := &Handler{}
+	h.SetTarget(target)
+	return h
+}
+
+// SetTarget 修改目标地址，只影响之后转发的连接
+func (h *Handler) SetTarget(target string) {
+	h.target.Store(&target)
 }
 
 // Handle 将连接转发到目标
 func (h *Handler) Handle(ctx context.Context, conn net.Conn) {
-	if h.target == "" {
+	target := *h.target.Load()
+	if target == "" {
 		conn.Close()
 		return
 	}
 
 	dialer := net.Dialer{Timeout: 5 * time.Second}
-	remote, err := dialer.DialContext(ctx, "tcp", h.target)
+	remote, err := dialer.DialContext(ctx, "tcp", target)
 	if err != nil {
-		logrus.WithField("target", h.target).Debug("fallback 拨号失败: ", err)
+		logrus.WithField("target", target).Debug("fallback 拨号失败: ", err)
 		conn.Close()
 		return
 	}
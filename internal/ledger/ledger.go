@@ -0,0 +1,226 @@
+package ledger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"anytls/util"
+)
+
+// DateLayout 账本中日期的格式，按本地时间划分
+const DateLayout = "2006-01-02"
+
+// Entry 某用户某天的流量，方向与上报面板的约定一致
+type Entry struct {
+	UserID   int    `json:"user_id"`
+	Date     string `json:"date"`
+	Upload   int64  `json:"upload"`
+	Download int64  `json:"download"`
+}
+
+// line 账本文件中的一行，Batch 为写入这行的流量批次 ID，合并后取最大值
+type line struct {
+	Entry
+	Batch uint64 `json:"batch,omitempty"`
+}
+
+// dayKey 用户和日期
+type dayKey struct {
+	userID int
+	date   string
+}
+
+// Ledger 按用户、按天记录流量的本地账本
+// 文件为追加写入的 JSON Lines，每行是一次写入的增量；打开时合并为每用户每天一行，
+// 崩溃时写了一半的最后一行在下次打开时丢弃；每行记录批次 ID，同一批次重复写入时只记一次
+type Ledger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	days map[dayKey]*line
+	// lastBatch 已记账的最大批次 ID
+	lastBatch uint64
+}
+
+// Open 打开账本文件用于记账，不存在时创建
+func Open(path string) (*Ledger, error) {
+	l, err := Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.compact(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("打开流量账本失败: %w", err)
+	}
+	l.file = file
+	return l, nil
+}
+
+// Load 以只读方式加载账本，用于在服务运行时查询，不整理也不写入文件
+func Load(path string) (*Ledger, error) {
+	l := &Ledger{path: path, days: make(map[dayKey]*line)}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// load 读取账本文件并累加每一行
+func (l *Ledger) load() error {
+	data, err := os.ReadFile(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取流量账本失败: %w", err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, raw := range lines {
+		if len(bytes.TrimSpace(raw)) == 0 {
+			continue
+		}
+		var e line
+		if err := json.Unmarshal(raw, &e); err != nil {
+			if i == len(lines)-1 {
+				// 最后一行没有换行符，是写入时崩溃留下的不完整记录
+				break
+			}
+			return fmt.Errorf("流量账本第 %d 行格式错误: %w", i+1, err)
+		}
+		if _, err := time.Parse(DateLayout, e.Date); err != nil {
+			return fmt.Errorf("流量账本第 %d 行日期错误: %s", i+1, e.Date)
+		}
+		l.add(e)
+	}
+	return nil
+}
+
+// add 累加一条记录，调用方需持有 mu 或尚未共享 Ledger
+func (l *Ledger) add(e line) {
+	l.lastBatch = max(l.lastBatch, e.Batch)
+	key := dayKey{e.UserID, e.Date}
+	if existing, ok := l.days[key]; ok {
+		existing.Upload += e.Upload
+		existing.Download += e.Download
+		existing.Batch = max(existing.Batch, e.Batch)
+		return
+	}
+	l.days[key] = &e
+}
+
+// compact 将合并后的记录写入临时文件再替换原文件
+func (l *Ledger) compact() error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range l.sorted(0, "", "") {
+		enc.Encode(l.days[dayKey{e.UserID, e.Date}])
+	}
+	if err := util.WriteFileAtomic(l.path, buf.Bytes(), 0600); err != nil {
+		return fmt.Errorf("整理流量账本失败: %w", err)
+	}
+	return nil
+}
+
+// Record 将批次 batch 的流量记入 at 所在的日期，traffic 格式与 traffic.Counter.Snapshot 相同
+// batch 不大于已记账的最大批次 ID 时视为重复写入并忽略，batch 为 0 时不去重
+// 写入并 fsync 成功后才计入内存，失败时调用方应保留这批流量
+func (l *Ledger) Record(at time.Time, batch uint64, traffic map[int][2]int64) error {
+	if len(traffic) == 0 {
+		return nil
+	}
+	date := at.Local().Format(DateLayout)
+	entries := make([]line, 0, len(traffic))
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for userID, t := range traffic {
+		e := line{Entry: Entry{UserID: userID, Date: date, Upload: t[0], Download: t[1]}, Batch: batch}
+		entries = append(entries, e)
+		enc.Encode(e)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("写入流量账本失败: 账本以只读方式加载")
+	}
+	if batch != 0 && batch <= l.lastBatch {
+		return nil
+	}
+	if _, err := l.file.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("写入流量账本失败: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("写入流量账本失败: %w", err)
+	}
+	for _, e := range entries {
+		l.add(e)
+	}
+	return nil
+}
+
+// Query 返回 [from, to] 日期范围内（闭区间，格式 DateLayout）的记录，userID 为 0 时返回所有用户
+// 结果按用户 ID、日期排序
+func (l *Ledger) Query(userID int, from, to string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sorted(userID, from, to)
+}
+
+// Total 返回用户在 [from, to] 日期范围内（闭区间，格式 DateLayout）的流量合计 [upload, download]
+// 按天查找，不遍历其他用户的记录，用于频繁的配额检查
+func (l *Ledger) Total(userID int, from, to string) [2]int64 {
+	start, err := time.ParseInLocation(DateLayout, from, time.Local)
+	if err != nil {
+		return [2]int64{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var total [2]int64
+	for day := start; day.Format(DateLayout) <= to; day = day.AddDate(0, 0, 1) {
+		if e, ok := l.days[dayKey{userID, day.Format(DateLayout)}]; ok {
+			total[0] += e.Upload
+			total[1] += e.Download
+		}
+	}
+	return total
+}
+
+// sorted 筛选并排序记录，调用方需持有 mu 或尚未共享 Ledger
+func (l *Ledger) sorted(userID int, from, to string) []Entry {
+	entries := make([]Entry, 0, len(l.days))
+	for key, e := range l.days {
+		if userID != 0 && key.userID != userID {
+			continue
+		}
+		// 固定格式的日期可以直接按字符串比较
+		if (from != "" && key.date < from) || (to != "" && key.date > to) {
+			continue
+		}
+		entries = append(entries, e.Entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].UserID != entries[j].UserID {
+			return entries[i].UserID < entries[j].UserID
+		}
+		return entries[i].Date < entries[j].Date
+	})
+	return entries
+}
+
+// Close 关闭账本文件
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
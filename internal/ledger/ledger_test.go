@@ -0,0 +1,137 @@
+package ledger
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	t, _ := time.ParseInLocation(DateLayout, s, time.Local)
+	return t.Add(12 * time.Hour)
+}
+
+func TestLedger_RecordAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	l.Record(day("2026-09-30"), 0, map[int][2]int64{1: {10, 20}})
+	l.Record(day("2026-10-01"), 0, map[int][2]int64{1: {1, 2}, 2: {100, 200}})
+	l.Record(day("2026-10-01"), 0, map[int][2]int64{1: {3, 4}})
+	l.Close()
+
+	// 模拟写入最后一行时崩溃
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	f.WriteString(`{"user_id":1,"date":"2026-10-0`)
+	f.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer l.Close()
+	want := []Entry{
+		{UserID: 1, Date: "2026-09-30", Upload: 10, Download: 20},
+		{UserID: 1, Date: "2026-10-01", Upload: 4, Download: 6},
+		{UserID: 2, Date: "2026-10-01", Upload: 100, Download: 200},
+	}
+	if got := l.Query(0, "", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query all = %+v, want %+v", got, want)
+	}
+	if got := l.Query(1, "2026-10-01", "2026-10-31"); !reflect.DeepEqual(got, want[1:2]) {
+		t.Errorf("Query user 1 in October = %+v, want %+v", got, want[1:2])
+	}
+	if got := Sum(l.Query(0, "", "")); got[1] != [2]int64{14, 26} || got[2] != [2]int64{100, 200} {
+		t.Errorf("Sum = %v", got)
+	}
+	if got := l.Total(1, "2026-09-01", "2026-09-30"); got != [2]int64{10, 20} {
+		t.Errorf("Total user 1 in September = %v, want [10 20]", got)
+	}
+	if got := l.Total(1, "2026-09-30", "2026-10-31"); got != [2]int64{14, 26} {
+		t.Errorf("Total user 1 across months = %v, want [14 26]", got)
+	}
+
+	// 重新打开时合并为每用户每天一行，不完整的行被丢弃
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("compacted file has %d lines, want 3:\n%s", lines, data)
+	}
+}
+
+func TestLedger_CorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	os.WriteFile(path, []byte("{bad}\n"+`{"user_id":1,"date":"2026-10-01","upload":1,"download":1}`+"\n"), 0600)
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "第 1 行") {
+		t.Errorf("Open error = %v, want line 1 error", err)
+	}
+}
+
+func TestPeriod(t *testing.T) {
+	cases := []struct {
+		now        string
+		resetDay   int
+		start, end string
+	}{
+		{"2026-10-16", 1, "2026-10-01", "2026-11-01"},
+		{"2026-10-16", 20, "2026-09-20", "2026-10-20"},
+		{"2026-10-20", 20, "2026-10-20", "2026-11-20"},
+		// 重置日超过当月天数时取最后一天
+		{"2026-02-28", 31, "2026-02-28", "2026-03-31"},
+		{"2026-02-27", 31, "2026-01-31", "2026-02-28"},
+		{"2026-01-05", 10, "2025-12-10", "2026-01-10"},
+		{"2026-10-16", 0, "2026-10-01", "2026-11-01"},
+	}
+	for _, c := range cases {
+		start, end := Period(day(c.now), c.resetDay)
+		if start.Format(DateLayout) != c.start || end.Format(DateLayout) != c.end {
+			t.Errorf("Period(%s, %d) = [%s, %s), want [%s, %s)", c.now, c.resetDay,
+				start.Format(DateLayout), end.Format(DateLayout), c.start, c.end)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	from, to, err := ParseRange("", "", day("2026-10-16"), 20)
+	if err != nil || from != "2026-09-20" || to != "2026-10-19" {
+		t.Errorf("default range = %s..%s (%v), want 2026-09-20..2026-10-19", from, to, err)
+	}
+	if _, _, err := ParseRange("2026-10-02", "2026-10-01", day("2026-10-16"), 1); err == nil {
+		t.Error("from after to should fail")
+	}
+	if _, _, err := ParseRange("10/01", "", day("2026-10-16"), 1); err == nil {
+		t.Error("invalid date should fail")
+	}
+}
+
+// TestLedger_DuplicateBatch 测试同一批次重复写入（例如记账成功但提交前崩溃）只记一次，重新打开后仍然有效
+func TestLedger_DuplicateBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.jsonl")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	l.Record(day("2026-10-01"), 1, map[int][2]int64{1: {1, 2}})
+	l.Record(day("2026-10-01"), 2, map[int][2]int64{1: {3, 4}})
+	l.Record(day("2026-10-01"), 2, map[int][2]int64{1: {3, 4}})
+	l.Close()
+
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer l.Close()
+	l.Record(day("2026-10-02"), 2, map[int][2]int64{1: {3, 4}})
+	l.Record(day("2026-10-02"), 3, map[int][2]int64{1: {5, 6}})
+	want := []Entry{
+		{UserID: 1, Date: "2026-10-01", Upload: 4, Download: 6},
+		{UserID: 1, Date: "2026-10-02", Upload: 5, Download: 6},
+	}
+	if got := l.Query(0, "", ""); !reflect.DeepEqual(got, want) {
+		t.Errorf("Query = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,56 @@
+package ledger
+
+import (
+	"fmt"
+	"time"
+)
+
+// Period 返回 now 所在的计费周期 [start, end)，每月 resetDay 日零点（本地时间）重置
+// resetDay 超过当月天数时取当月最后一天，<= 0 时按 1 处理
+func Period(now time.Time, resetDay int) (start, end time.Time) {
+	now = now.Local()
+	year, month, _ := now.Date()
+	start = resetAt(year, month, resetDay)
+	if now.Before(start) {
+		start = resetAt(year, month-1, resetDay)
+	}
+	year, month, _ = start.Date()
+	return start, resetAt(year, month+1, resetDay)
+}
+
+// resetAt 返回某月的重置时间，month 可以超出 1-12
+func resetAt(year int, month time.Month, resetDay int) time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.Local)
+	daysInMonth := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(max(resetDay, 1), daysInMonth)-1)
+}
+
+// ParseRange 解析查询的日期范围（闭区间，格式 DateLayout）
+// 未指定的起止日期取 now 所在计费周期的第一天和最后一天
+func ParseRange(from, to string, now time.Time, resetDay int) (string, string, error) {
+	start, end := Period(now, resetDay)
+	if from == "" {
+		from = start.Format(DateLayout)
+	} else if _, err := time.Parse(DateLayout, from); err != nil {
+		return "", "", fmt.Errorf("起始日期格式错误: %s", from)
+	}
+	if to == "" {
+		to = end.AddDate(0, 0, -1).Format(DateLayout)
+	} else if _, err := time.Parse(DateLayout, to); err != nil {
+		return "", "", fmt.Errorf("结束日期格式错误: %s", to)
+	}
+	if from > to {
+		return "", "", fmt.Errorf("起始日期 %s 晚于结束日期 %s", from, to)
+	}
+	return from, to, nil
+}
+
+// Sum 按用户汇总记录的流量
+func Sum(entries []Entry) map[int][2]int64 {
+	totals := make(map[int][2]int64)
+	for _, e := range entries {
+		t := totals[e.UserID]
+		totals[e.UserID] = [2]int64{t[0] + e.Upload, t[1] + e.Download}
+	}
+	return totals
+}
@@ -0,0 +1,378 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Registry 指标注册表，按 Prometheus 文本格式（0.0.4）输出全部指标
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// collector 一个指标族
+type collector interface {
+	writeTo(w *bufio.Writer)
+}
+
+// NewRegistry 创建指标注册表
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	r.collectors = append(r.collectors, c)
+	r.mu.Unlock()
+}
+
+// WriteTo 输出全部指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.writeTo(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// Handler 返回输出全部指标的 HTTP 处理器
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc 指标族描述
+type desc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.typ)
+}
+
+// writeSample 输出一个样本，labelValues 与 labels 一一对应，extra 为额外的 name/value 标签对
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, value float64, extra ...string) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(labelValues)+len(extra) > 0 {
+		w.WriteByte('{')
+		first := true
+		writeLabel := func(name, value string) {
+			if !first {
+				w.WriteByte(',')
+			}
+			first = false
+			w.WriteString(name)
+			w.WriteString(`="`)
+			w.WriteString(escapeLabel(value))
+			w.WriteByte('"')
+		}
+		for i, v := range labelValues {
+			writeLabel(d.labels[i], v)
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			writeLabel(extra[i], extra[i+1])
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string  { return helpReplacer.Replace(s) }
+func escapeLabel(s string) string { return labelReplacer.Replace(s) }
+
+// Counter 单调递增计数器
+type Counter struct {
+	desc
+	v atomic.Int64
+}
+
+// NewCounter 创建并注册计数器
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, typ: "counter"}}
+	r.register(c)
+	return c
+}
+
+// Inc 加 1
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Add 增加 n（n 应为非负数）
+func (c *Counter) Add(n int64) { c.v.Add(n) }
+
+// Value 当前值
+func (c *Counter) Value() int64 { return c.v.Load() }
+
+func (c *Counter) writeTo(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.writeSample(w, "", nil, float64(c.v.Load()))
+}
+
+// Gauge 可增可减的仪表
+type Gauge struct {
+	desc
+	v atomic.Int64
+}
+
+// NewGauge 创建并注册仪表
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{desc: desc{name: name, help: help, typ: "gauge"}}
+	r.register(g)
+	return g
+}
+
+// Inc 加 1
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec 减 1
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Set 设置当前值
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Value 当前值
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+func (g *Gauge) writeTo(w *bufio.Writer) {
+	g.writeHeader(w)
+	g.writeSample(w, "", nil, float64(g.v.Load()))
+}
+
+// CounterVec 带标签的计数器
+type CounterVec struct {
+	desc
+	mu     sync.RWMutex
+	values map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	labelValues []string
+	v           atomic.Int64
+}
+
+// NewCounterVec 创建并注册带标签的计数器
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		desc:   desc{name: name, help: help, typ: "counter", labels: labels},
+		values: make(map[string]*labeledCounter),
+	}
+	r.register(c)
+	return c
+}
+
+// Add 为指定标签值的计数器增加 n，标签值数量必须与标签数量一致
+func (c *CounterVec) Add(n int64, labelValues ...string) {
+	c.get(labelValues).v.Add(n)
+}
+
+// Inc 为指定标签值的计数器加 1
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Value 指定标签值的当前值
+func (c *CounterVec) Value(labelValues ...string) int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if lc, ok := c.values[labelKey(labelValues)]; ok {
+		return lc.v.Load()
+	}
+	return 0
+}
+
+func (c *CounterVec) get(labelValues []string) *labeledCounter {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("metrics: %s 需要 %d 个标签值，实际 %d 个", c.name, len(c.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	c.mu.RLock()
+	lc, ok := c.values[key]
+	c.mu.RUnlock()
+	if ok {
+		return lc
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if lc, ok = c.values[key]; !ok {
+		lc = &labeledCounter{labelValues: append([]string(nil), labelValues...)}
+		c.values[key] = lc
+	}
+	return lc
+}
+
+func (c *CounterVec) writeTo(w *bufio.Writer) {
+	c.mu.RLock()
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	entries := make([]*labeledCounter, len(keys))
+	for i, key := range keys {
+		entries[i] = c.values[key]
+	}
+	c.mu.RUnlock()
+
+	c.writeHeader(w)
+	for _, lc := range entries {
+		c.writeSample(w, "", lc.labelValues, float64(lc.v.Load()))
+	}
+}
+
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+// Sample 由回调函数在采集时产生的样本
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// funcCollector 采集时调用回调函数生成样本，用于已有数据源（如流量计数器）
+type funcCollector struct {
+	desc
+	fn func() []Sample
+}
+
+// NewCounterFunc 注册一个采集时计算的计数器族
+func (r *Registry) NewCounterFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.register(&funcCollector{desc: desc{name: name, help: help, typ: "counter", labels: labels}, fn: fn})
+}
+
+// NewGaugeFunc 注册一个采集时计算的仪表族
+func (r *Registry) NewGaugeFunc(name, help string, fn func() []Sample, labels ...string) {
+	r.register(&funcCollector{desc: desc{name: name, help: help, typ: "gauge", labels: labels}, fn: fn})
+}
+
+func (f *funcCollector) writeTo(w *bufio.Writer) {
+	samples := f.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return labelKey(samples[i].LabelValues) < labelKey(samples[j].LabelValues)
+	})
+	f.writeHeader(w)
+	for _, s := range samples {
+		f.writeSample(w, "", s.LabelValues, s.Value)
+	}
+}
+
+// HistogramVec 带标签的直方图
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64 // 每个桶的计数（非累积），最后一个为 +Inf
+	sum         float64
+	count       uint64
+}
+
+// NewHistogramVec 创建并注册带标签的直方图，buckets 为升序的桶上界
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe 记录一个观测值
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metrics: %s 需要 %d 个标签值，实际 %d 个", h.name, len(h.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{
+			labelValues: append([]string(nil), labelValues...),
+			counts:      make([]uint64, len(h.buckets)+1),
+		}
+		h.values[key] = hist
+	}
+	i := sort.SearchFloat64s(h.buckets, v)
+	hist.counts[i]++
+	hist.sum += v
+	hist.count++
+}
+
+func (h *HistogramVec) writeTo(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h.writeHeader(w)
+	for _, key := range keys {
+		hist := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += hist.counts[i]
+			h.writeSample(w, "_bucket", hist.labelValues, float64(cumulative), "le", formatFloat(upper))
+		}
+		h.writeSample(w, "_bucket", hist.labelValues, float64(hist.count), "le", "+Inf")
+		h.writeSample(w, "_sum", hist.labelValues, hist.sum)
+		h.writeSample(w, "_count", hist.labelValues, float64(hist.count))
+	}
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_TextFormat(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_events_total", "Events.")
+	g := r.NewGauge("test_active", "Active things.")
+	cv := r.NewCounterVec("test_errors_total", "Errors by reason.", "reason")
+	h := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "endpoint")
+	r.NewGaugeFunc("test_func", "Func gauge.", func() []Sample {
+		return []Sample{
+			{LabelValues: []string{"b"}, Value: 2},
+			{LabelValues: []string{"a\"\n\\"}, Value: 1.5},
+		}
+	}, "name")
+
+	c.Add(3)
+	c.Inc()
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	cv.Inc("timeout")
+	cv.Add(2, "refused")
+	cv.Inc("timeout")
+	h.Observe(0.05, "user")
+	h.Observe(0.1, "user")
+	h.Observe(0.5, "user")
+	h.Observe(3, "user")
+
+	var sb strings.Builder
+	if _, err := r.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_events_total Events.
+# TYPE test_events_total counter
+test_events_total 4
+# HELP test_active Active things.
+# TYPE test_active gauge
+test_active 1
+# HELP test_errors_total Errors by reason.
+# TYPE test_errors_total counter
+test_errors_total{reason="refused"} 2
+test_errors_total{reason="timeout"} 2
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{endpoint="user",le="0.1"} 2
+test_latency_seconds_bucket{endpoint="user",le="1"} 3
+test_latency_seconds_bucket{endpoint="user",le="+Inf"} 4
+test_latency_seconds_sum{endpoint="user"} 3.65
+test_latency_seconds_count{endpoint="user"} 4
+# HELP test_func Func gauge.
+# TYPE test_func gauge
+test_func{name="a\"\n\\"} 1.5
+test_func{name="b"} 2
+`
+	if got := sb.String(); got != want {
+		t.Errorf("unexpected output:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !strings.Contains(string(body), "test_total 1\n") {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestCounterVec_WrongLabelCount(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic for wrong label count")
+		}
+	}()
+	NewRegistry().NewCounterVec("test_total", "Test.", "a", "b").Inc("only-one")
+}
@@ -0,0 +1,21 @@
+package outbound
+
+import (
+	"context"
+	"net"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// Block 拒绝所有连接的出站
+type Block struct{}
+
+// DialContext 始终返回 ErrBlocked
+func (Block) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	return nil, ErrBlocked
+}
+
+// ListenPacket 始终返回 ErrBlocked
+func (Block) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, ErrBlocked
+}
@@ -0,0 +1,154 @@
+package outbound
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/internal/dns"
+
+	"github.com/sagernet/sing/common/buf"
+	"github.com/sagernet/sing/common/bufio"
+	"github.com/sagernet/sing/common/control"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const dialTimeout = 5 * time.Second
+
+// Direct 直连出站，可选绑定网卡或源 IP
+// 配置了 resolver 时，目标域名通过内置 DNS 解析，否则交给系统 DNS
+type Direct struct {
+	dialer       net.Dialer
+	listenConfig net.ListenConfig
+	sourceIP     net.IP
+	resolver     *dns.Resolver
+}
+
+// NewDirect 创建直连出站，source_ip 不是合法的 IP 地址时返回错误，避免从默认地址出站
+func NewDirect(c config.OutboundConfig, resolver *dns.Resolver) (*Direct, error) {
+	d := newDirect(resolver)
+	if c.BindInterface != "" {
+		bind := control.BindToInterface(control.NewDefaultInterfaceFinder(), c.BindInterface, -1)
+		d.dialer.Control = bind
+		d.listenConfig.Control = bind
+	}
+	if c.SourceIP != "" {
+		if d.sourceIP = net.ParseIP(c.SourceIP); d.sourceIP == nil {
+			return nil, fmt.Errorf("出站配置错误: %q 的 source_ip %q 不是合法的 IP 地址", c.Name, c.SourceIP)
+		}
+	}
+	return d, nil
+}
+
+// newDirect 创建不绑定网卡和源 IP 的直连出站
+func newDirect(resolver *dns.Resolver) *Direct {
+	return &Direct{
+		dialer:   net.Dialer{Timeout: dialTimeout},
+		resolver: resolver,
+	}
+}
+
+// DialContext 建立直连连接，域名解析出多个地址时依次尝试
+func (d *Direct) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	if d.resolver == nil || !destination.IsFqdn() {
+		return d.dial(ctx, network, destination.String())
+	}
+	addrs, err := d.resolver.Lookup(ctx, destination.Fqdn)
+	if err != nil {
+		return nil, err
+	}
+	var errs []error
+	for _, addr := range addrs {
+		conn, err := d.dial(ctx, network, M.SocksaddrFrom(addr, destination.Port).String())
+		if err == nil {
+			return conn, nil
+		}
+		errs = append(errs, err)
+	}
+	return nil, E.Errors(errs...)
+}
+
+func (d *Direct) dial(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := d.dialer
+	if d.sourceIP != nil {
+		switch N.NetworkName(network) {
+		case N.NetworkTCP:
+			dialer.LocalAddr = &net.TCPAddr{IP: d.sourceIP}
+		case N.NetworkUDP:
+			dialer.LocalAddr = &net.UDPAddr{IP: d.sourceIP}
+		}
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// ListenPacket 创建 UDP socket
+// 配置了 resolver 时，发往域名的数据包通过内置 DNS 解析
+func (d *Direct) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	var address string
+	if d.sourceIP != nil {
+		address = net.JoinHostPort(d.sourceIP.String(), "0")
+	}
+	pc, err := d.listenConfig.ListenPacket(ctx, N.NetworkUDP, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.resolver == nil {
+		return pc, nil
+	}
+	return &resolvePacketConn{
+		NetPacketConn: bufio.NewPacketConn(pc),
+		ctx:           ctx,
+		resolver:      d.resolver,
+		domains:       make(map[netip.AddrPort]string),
+	}, nil
+}
+
+// resolvePacketConn 发送时解析目标域名，并把来自已解析地址的响应还原为原始域名
+type resolvePacketConn struct {
+	N.NetPacketConn
+	ctx      context.Context
+	resolver *dns.Resolver
+
+	access  sync.RWMutex
+	domains map[netip.AddrPort]string
+}
+
+func (c *resolvePacketConn) WritePacket(buffer *buf.Buffer, destination M.Socksaddr) error {
+	if destination.IsFqdn() {
+		addrs, err := c.resolver.Lookup(c.ctx, destination.Fqdn)
+		if err != nil {
+			buffer.Release()
+			return err
+		}
+		fqdn := destination.Fqdn
+		destination = M.SocksaddrFrom(addrs[0], destination.Port)
+		c.access.Lock()
+		c.domains[destination.AddrPort()] = fqdn
+		c.access.Unlock()
+	}
+	return c.NetPacketConn.WritePacket(buffer, destination)
+}
+
+func (c *resolvePacketConn) ReadPacket(buffer *buf.Buffer) (M.Socksaddr, error) {
+	destination, err := c.NetPacketConn.ReadPacket(buffer)
+	if err != nil {
+		return destination, err
+	}
+	c.access.RLock()
+	fqdn, ok := c.domains[destination.AddrPort()]
+	c.access.RUnlock()
+	if ok {
+		destination = M.Socksaddr{Fqdn: fqdn, Port: destination.Port}
+	}
+	return destination, nil
+}
+
+func (c *resolvePacketConn) Upstream() any {
+	return c.NetPacketConn
+}
@@ -0,0 +1,144 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"anytls/internal/config"
+	"anytls/internal/dns"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// ErrBlocked block 出站拒绝连接时返回的错误
+var ErrBlocked = errors.New("blocked by outbound")
+
+// Outbound 出站接口
+// 与 sing 的 N.Dialer 一致，可以直接作为上游代理客户端的底层拨号器，实现出站链式代理
+type Outbound interface {
+	DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error)
+	ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error)
+}
+
+// 出站类型
+const (
+	TypeDirect = "direct"
+	TypeSOCKS5 = "socks5"
+	TypeHTTP   = "http"
+	TypeBlock  = "block"
+)
+
+// DefaultName 直连出站名称，未配置同名出站时自动创建
+const DefaultName = "direct"
+
+// Manager 出站管理器（创建后不可变，配置变更时整体替换）
+type Manager struct {
+	outbounds   map[string]Outbound
+	defaultName string
+	resolver    *dns.Resolver
+}
+
+// NewManager 根据配置创建全部出站
+// 列表中的第一个出站为默认出站；列表为空时使用名为 "direct" 的直连出站
+// resolver 为直连出站解析域名使用的 DNS 解析器，nil 时使用系统 DNS
+func NewManager(configs []config.OutboundConfig, resolver *dns.Resolver) (*Manager, error) {
+	m := &Manager{
+		outbounds: make(map[string]Outbound, len(configs)),
+		resolver:  resolver,
+	}
+	if len(configs) == 0 {
+		m.outbounds[DefaultName] = newDirect(m.resolver)
+		m.defaultName = DefaultName
+		return m, nil
+	}
+
+	byName := make(map[string]config.OutboundConfig, len(configs))
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("出站配置错误: name 不能为空")
+		}
+		if _, ok := byName[c.Name]; ok {
+			return nil, fmt.Errorf("出站配置错误: 重复的出站名称 %q", c.Name)
+		}
+		byName[c.Name] = c
+	}
+	for _, c := range configs {
+		if _, err := m.build(c.Name, byName, nil); err != nil {
+			return nil, err
+		}
+	}
+	m.defaultName = configs[0].Name
+	// 面板下发的 direct 路由依赖名为 "direct" 的出站，未配置时补充一个直连出站
+	if _, ok := m.outbounds[DefaultName]; !ok {
+		m.outbounds[DefaultName] = newDirect(m.resolver)
+	}
+	return m, nil
+}
+
+// build 创建出站，递归解析 detour，visiting 用于检测循环引用
+func (m *Manager) build(name string, byName map[string]config.OutboundConfig, visiting []string) (Outbound, error) {
+	if o, ok := m.outbounds[name]; ok {
+		return o, nil
+	}
+	c, ok := byName[name]
+	if !ok {
+		return nil, fmt.Errorf("出站配置错误: 未知的出站 %q", name)
+	}
+	for _, v := range visiting {
+		if v == name {
+			return nil, fmt.Errorf("出站配置错误: detour 循环引用 %q", name)
+		}
+	}
+
+	var detour Outbound
+	if c.Detour != "" {
+		var err error
+		detour, err = m.build(c.Detour, byName, append(visiting, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var o Outbound
+	switch c.Type {
+	case TypeDirect, "":
+		if c.Detour != "" {
+			return nil, fmt.Errorf("出站配置错误: %q 直连出站不支持 detour", name)
+		}
+		direct, err := NewDirect(c, m.resolver)
+		if err != nil {
+			return nil, err
+		}
+		o = direct
+	case TypeSOCKS5, TypeHTTP:
+		if c.Server == "" {
+			return nil, fmt.Errorf("出站配置错误: %q 缺少 server", name)
+		}
+		if detour == nil {
+			detour = newDirect(m.resolver)
+		}
+		if c.Type == TypeSOCKS5 {
+			o = newSOCKS5(c, detour)
+		} else {
+			o = newHTTP(c, detour)
+		}
+	case TypeBlock:
+		o = Block{}
+	default:
+		return nil, fmt.Errorf("出站配置错误: %q 未知的出站类型 %q", name, c.Type)
+	}
+	m.outbounds[name] = o
+	return o, nil
+}
+
+// Default 获取默认出站
+func (m *Manager) Default() Outbound {
+	return m.outbounds[m.defaultName]
+}
+
+// Get 根据名称获取出站，不存在时返回 nil
+func (m *Manager) Get(name string) Outbound {
+	return m.outbounds[name]
+}
@@ -0,0 +1,305 @@
+package outbound
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"anytls/internal/config"
+	"anytls/internal/dns"
+
+	"github.com/sagernet/sing/common/buf"
+	singbufio "github.com/sagernet/sing/common/bufio"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// startEchoServer 启动本地 TCP echo 服务
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startSOCKS5Server 启动仅支持无认证 CONNECT 的最小 SOCKS5 服务
+func startSOCKS5Server(t *testing.T, hits *atomic.Int32) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				hits.Add(1)
+				var greeting [2]byte
+				if _, err := io.ReadFull(c, greeting[:]); err != nil {
+					return
+				}
+				io.CopyN(io.Discard, c, int64(greeting[1]))
+				c.Write([]byte{5, 0})
+
+				var req [3]byte
+				if _, err := io.ReadFull(c, req[:]); err != nil {
+					return
+				}
+				destination, err := M.SocksaddrSerializer.ReadAddrPort(c)
+				if err != nil {
+					return
+				}
+				remote, err := net.Dial("tcp", destination.String())
+				if err != nil {
+					c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer remote.Close()
+				c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go io.Copy(remote, c)
+				io.Copy(c, remote)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startHTTPProxy 启动仅支持 CONNECT 的最小 HTTP 代理，上游经 dialer 拨号
+func startHTTPProxy(t *testing.T, hits *atomic.Int32) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				hits.Add(1)
+				reader := bufio.NewReader(c)
+				req, err := http.ReadRequest(reader)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					c.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer remote.Close()
+				c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go io.Copy(remote, reader)
+				io.Copy(c, remote)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// assertEcho 通过出站连接 echo 服务并校验数据
+func assertEcho(t *testing.T, o Outbound, echoAddr string) {
+	t.Helper()
+	c, err := o.DialContext(context.Background(), "tcp", M.ParseSocksaddr(echoAddr))
+	if err != nil {
+		t.Fatalf("DialContext failed: %v", err)
+	}
+	defer c.Close()
+	msg := []byte("hello outbound")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("echo = %q, want %q", got, msg)
+	}
+}
+
+func TestManager_DefaultDirect(t *testing.T) {
+	m, err := NewManager(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Get(DefaultName) == nil {
+		t.Fatal("expected implicit direct outbound")
+	}
+	assertEcho(t, m.Default(), startEchoServer(t))
+}
+
+func TestDirect_SourceIP(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	d, err := NewDirect(config.OutboundConfig{SourceIP: "127.0.0.1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, d, echoAddr)
+
+	pc, err := d.ListenPacket(context.Background(), M.ParseSocksaddr("127.0.0.1:53"))
+	if err != nil {
+		t.Fatalf("ListenPacket failed: %v", err)
+	}
+	defer pc.Close()
+	if ip := pc.LocalAddr().(*net.UDPAddr).IP; !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("local addr = %v, want 127.0.0.1", ip)
+	}
+}
+
+func TestDirect_InvalidSourceIP(t *testing.T) {
+	for _, ip := range []string{"203.0.113.300", "eth0", "2001:db8::zz"} {
+		if _, err := NewDirect(config.OutboundConfig{Name: "pinned", SourceIP: ip}, nil); err == nil {
+			t.Errorf("source_ip %q: expected error, got nil", ip)
+		}
+	}
+}
+
+func TestBlock(t *testing.T) {
+	m, err := NewManager([]config.OutboundConfig{{Name: "reject", Type: TypeBlock}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Default().DialContext(context.Background(), "tcp", M.ParseSocksaddr("127.0.0.1:80"))
+	if !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected ErrBlocked, got %v", err)
+	}
+	_, err = m.Default().ListenPacket(context.Background(), M.ParseSocksaddr("127.0.0.1:53"))
+	if !errors.Is(err, ErrBlocked) {
+		t.Errorf("expected ErrBlocked, got %v", err)
+	}
+}
+
+func TestSOCKS5AndHTTPUpstream(t *testing.T) {
+	echoAddr := startEchoServer(t)
+	var socksHits, httpHits atomic.Int32
+	socksAddr := startSOCKS5Server(t, &socksHits)
+	httpAddr := startHTTPProxy(t, &httpHits)
+
+	m, err := NewManager([]config.OutboundConfig{
+		{Name: "socks", Type: TypeSOCKS5, Server: socksAddr},
+		{Name: "http", Type: TypeHTTP, Server: httpAddr},
+		// http 代理经由 socks 代理连接，验证链式出站
+		{Name: "chain", Type: TypeHTTP, Server: httpAddr, Detour: "socks"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertEcho(t, m.Get("socks"), echoAddr)
+	if socksHits.Load() != 1 {
+		t.Errorf("socks hits = %d, want 1", socksHits.Load())
+	}
+
+	assertEcho(t, m.Get("http"), echoAddr)
+	if httpHits.Load() != 1 {
+		t.Errorf("http hits = %d, want 1", httpHits.Load())
+	}
+
+	assertEcho(t, m.Get("chain"), echoAddr)
+	if socksHits.Load() != 2 || httpHits.Load() != 2 {
+		t.Errorf("chain hits socks=%d http=%d, want 2/2", socksHits.Load(), httpHits.Load())
+	}
+}
+
+func TestManager_InvalidConfig(t *testing.T) {
+	cases := map[string][]config.OutboundConfig{
+		"empty name":     {{Type: TypeDirect}},
+		"duplicate name": {{Name: "a"}, {Name: "a"}},
+		"unknown type":   {{Name: "a", Type: "vmess"}},
+		"missing server": {{Name: "a", Type: TypeSOCKS5}},
+		"unknown detour": {{Name: "a", Type: TypeHTTP, Server: "127.0.0.1:1", Detour: "b"}},
+		"invalid source": {{Name: "a", Type: TypeDirect, SourceIP: "203.0.113.300"}},
+		"detour cycle": {
+			{Name: "a", Type: TypeHTTP, Server: "127.0.0.1:1", Detour: "b"},
+			{Name: "b", Type: TypeSOCKS5, Server: "127.0.0.1:1", Detour: "a"},
+		},
+	}
+	for name, configs := range cases {
+		if _, err := NewManager(configs, nil); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+func TestDirect_Resolver(t *testing.T) {
+	resolver, err := dns.NewResolver(config.DNSConfig{
+		Servers: []string{"127.0.0.1:1"},
+		Hosts:   map[string][]string{"echo.test": {"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewManager(nil, resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(startEchoServer(t))
+	assertEcho(t, m.Default(), net.JoinHostPort("echo.test", port))
+
+	// UDP：发往域名的数据包经内置 DNS 解析，响应的来源地址还原为域名
+	udpEcho, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buffer := make([]byte, 1500)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			udpEcho.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	destination := M.ParseSocksaddrHostPort("echo.test", uint16(udpEcho.LocalAddr().(*net.UDPAddr).Port))
+	pc, err := m.Default().ListenPacket(context.Background(), destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	conn := singbufio.NewPacketConn(pc)
+	if err := conn.WritePacket(buf.As([]byte("ping")), destination); err != nil {
+		t.Fatalf("WritePacket failed: %v", err)
+	}
+	buffer := buf.NewPacket()
+	defer buffer.Release()
+	source, err := conn.ReadPacket(buffer)
+	if err != nil {
+		t.Fatalf("ReadPacket failed: %v", err)
+	}
+	if string(buffer.Bytes()) != "ping" || source != destination {
+		t.Errorf("got %q from %v, want %q from %v", buffer.Bytes(), source, "ping", destination)
+	}
+}
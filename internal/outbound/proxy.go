@@ -0,0 +1,24 @@
+package outbound
+
+import (
+	"anytls/internal/config"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/http"
+	"github.com/sagernet/sing/protocol/socks"
+)
+
+// newSOCKS5 创建 SOCKS5 上游代理出站，支持 TCP 和 UDP ASSOCIATE
+func newSOCKS5(c config.OutboundConfig, detour Outbound) Outbound {
+	return socks.NewClient(detour, M.ParseSocksaddr(c.Server), socks.Version5, c.Username, c.Password)
+}
+
+// newHTTP 创建 HTTP CONNECT 上游代理出站（不支持 UDP）
+func newHTTP(c config.OutboundConfig, detour Outbound) Outbound {
+	return http.NewClient(http.Options{
+		Dialer:   detour,
+		Server:   M.ParseSocksaddr(c.Server),
+		Username: c.Username,
+		Password: c.Password,
+	})
+}
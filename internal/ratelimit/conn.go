@@ -5,11 +5,19 @@ import (
 	"time"
 )
 
-const (
-	maxFailures   = 10              // 60 秒内最大失败次数
-	failWindow    = 60 * time.Second // 失败计数窗口
-	banDuration   = 5 * time.Minute  // 封禁时长
-)
+// ConnLimits 认证失败封禁的阈值：窗口内失败次数超过 MaxFailures 时封禁 IP
+type ConnLimits struct {
+	MaxFailures int           // 窗口内最大失败次数
+	Window      time.Duration // 失败计数窗口
+	BanDuration time.Duration // 封禁时长
+}
+
+// DefaultConnLimits 默认阈值：60 秒内失败超过 10 次封禁 5 分钟
+var DefaultConnLimits = ConnLimits{
+	MaxFailures: 10,
+	Window:      60 * time.Second,
+	BanDuration: 5 * time.Minute,
+}
 
 type failureRecord struct {
 	count     int
@@ -20,18 +28,37 @@ type failureRecord struct {
 // ConnRateLimiter 连接速率限制器（防暴力破解）
 type ConnRateLimiter struct {
 	mu       sync.Mutex
+	limits   ConnLimits
 	failures map[string]*failureRecord
 }
 
-// NewConnRateLimiter 创建连接速率限制器
+// NewConnRateLimiter 创建使用默认阈值的连接速率限制器
 func NewConnRateLimiter() *ConnRateLimiter {
 	return &ConnRateLimiter{
+		limits:   DefaultConnLimits,
 		failures: make(map[string]*failureRecord),
 	}
 }
 
-// RecordFailure 记录认证失败
-func (r *ConnRateLimiter) RecordFailure(ip string) {
+// SetLimits 修改封禁阈值，<=0 的字段使用默认值
+// 新阈值对已有的失败计数和封禁立即生效，用于配置热重载
+func (r *ConnRateLimiter) SetLimits(limits ConnLimits) {
+	if limits.MaxFailures <= 0 {
+		limits.MaxFailures = DefaultConnLimits.MaxFailures
+	}
+	if limits.Window <= 0 {
+		limits.Window = DefaultConnLimits.Window
+	}
+	if limits.BanDuration <= 0 {
+		limits.BanDuration = DefaultConnLimits.BanDuration
+	}
+	r.mu.Lock()
+	r.limits = limits
+	r.mu.Unlock()
+}
+
+// RecordFailure 记录认证失败，返回该 IP 是否因本次失败被封禁
+func (r *ConnRateLimiter) RecordFailure(ip string) (banned bool) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -42,25 +69,70 @@ func (r *ConnRateLimiter) RecordFailure(ip string) {
 			count:     1,
 			firstFail: now,
 		}
-		return
+		return false
 	}
 
 	// 如果已被封禁，不再计数
 	if !rec.bannedAt.IsZero() {
-		return
+		return false
 	}
 
 	// 窗口过期，重置
-	if now.Sub(rec.firstFail) > failWindow {
+	if now.Sub(rec.firstFail) > r.limits.Window {
 		rec.count = 1
 		rec.firstFail = now
-		return
+		return false
 	}
 
 	rec.count++
-	if rec.count > maxFailures {
+	if rec.count > r.limits.MaxFailures {
 		rec.bannedAt = now
+		return true
+	}
+	return false
+}
+
+// BannedCount 返回当前处于封禁状态的 IP 数
+func (r *ConnRateLimiter) BannedCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	count := 0
+	for _, rec := range r.failures {
+		if !rec.bannedAt.IsZero() && now.Sub(rec.bannedAt) <= r.limits.BanDuration {
+			count++
+		}
+	}
+	return count
+}
+
+// Banned 返回当前处于封禁状态的 IP 及其解封时间
+func (r *ConnRateLimiter) Banned() map[string]time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	banned := make(map[string]time.Time)
+	for ip, rec := range r.failures {
+		if !rec.bannedAt.IsZero() && now.Sub(rec.bannedAt) <= r.limits.BanDuration {
+			banned[ip] = rec.bannedAt.Add(r.limits.BanDuration)
+		}
+	}
+	return banned
+}
+
+// Unban 解除 IP 封禁并清空其失败计数，返回该 IP 此前是否处于封禁状态
+func (r *ConnRateLimiter) Unban(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.failures[ip]
+	if !ok {
+		return false
 	}
+	delete(r.failures, ip)
+	return !rec.bannedAt.IsZero() && time.Since(rec.bannedAt) <= r.limits.BanDuration
 }
 
 // IsBanned 检查 IP 是否被封禁
@@ -78,7 +150,7 @@ func (r *ConnRateLimiter) IsBanned(ip string) bool {
 	}
 
 	// 封禁已过期
-	if time.Since(rec.bannedAt) > banDuration {
+	if time.Since(rec.bannedAt) > r.limits.BanDuration {
 		delete(r.failures, ip)
 		return false
 	}
@@ -95,12 +167,12 @@ func (r *ConnRateLimiter) Cleanup() {
 	for ip, rec := range r.failures {
 		if !rec.bannedAt.IsZero() {
 			// 封禁已过期
-			if now.Sub(rec.bannedAt) > banDuration {
+			if now.Sub(rec.bannedAt) > r.limits.BanDuration {
 				delete(r.failures, ip)
 			}
 		} else {
 			// 失败窗口已过期
-			if now.Sub(rec.firstFail) > failWindow {
+			if now.Sub(rec.firstFail) > r.limits.Window {
 				delete(r.failures, ip)
 			}
 		}
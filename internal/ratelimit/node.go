@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	rebalanceInterval = 500 * time.Millisecond // 重新分配份额的周期
+	idleRoundsToDrop  = 20                     // 连续多少个周期无流量后不再跟踪该用户
+	burstWindow       = 200 * time.Millisecond // 份额令牌桶 burst 对应的时长
+	minBurst          = 16 * 1024              // 最小 burst
+	saturatedRatio    = 0.9                    // 使用量达到份额的该比例时视为还需要更多带宽
+	demandHeadroom    = 1.5                    // 未饱和用户的需求按实际使用量放大该倍数估算
+)
+
+// NodeLimiter 节点总带宽限制
+// 每个方向一个总令牌桶作为硬上限，并按最近的使用量在活跃用户之间以注水算法（max-min fairness）分配份额：
+// 用量小的用户按需分配，剩余带宽由需要更多带宽的用户平分，空闲用户的份额自动流向活跃用户
+type NodeLimiter struct {
+	upload   *sharedBucket
+	download *sharedBucket
+}
+
+// NewNodeLimiter 创建节点总带宽限制，两个方向都不限速时返回 nil
+func NewNodeLimiter(limits Limits) *NodeLimiter {
+	if limits.Unlimited() {
+		return nil
+	}
+	return &NodeLimiter{
+		upload:   newSharedBucket(limits.Upload),
+		download: newSharedBucket(limits.Download),
+	}
+}
+
+func (n *NodeLimiter) bucket(dir Direction) *sharedBucket {
+	if dir == Upload {
+		return n.upload
+	}
+	return n.download
+}
+
+// Wait 为用户在 dir 方向传输 bytes 字节等待节点份额和总带宽
+func (n *NodeLimiter) Wait(ctx context.Context, userID int, dir Direction, bytes int) error {
+	if b := n.bucket(dir); b != nil {
+		return b.wait(ctx, userID, bytes)
+	}
+	return nil
+}
+
+// chunkSize 返回 dir 方向单次读写的最大长度
+func (n *NodeLimiter) chunkSize(dir Direction, size int) int {
+	if b := n.bucket(dir); b != nil {
+		return chunkSize(b.total, size)
+	}
+	return size
+}
+
+// Shares 返回 dir 方向当前分配给每个用户的速率（bytes/s），用于观察和测试
+func (n *NodeLimiter) Shares(dir Direction) map[int]float64 {
+	b := n.bucket(dir)
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	shares := make(map[int]float64, len(b.shares))
+	for userID, sh := range b.shares {
+		shares[userID] = float64(sh.limiter.Limit())
+	}
+	return shares
+}
+
+// sharedBucket 单个方向的总带宽及其在用户间的分配
+type sharedBucket struct {
+	rate     float64       // 总速率 bytes/s
+	total    *rate.Limiter // 总令牌桶，保证份额调整期间也不超过总带宽
+	interval time.Duration
+
+	mu            sync.Mutex
+	shares        map[int]*share
+	lastRebalance time.Time
+}
+
+// share 单个用户的份额
+type share struct {
+	limiter    *rate.Limiter
+	requested  int64 // 本周期请求的字节数
+	fresh      bool  // 本周期新加入，尚无使用量数据
+	idleRounds int
+}
+
+// newSharedBucket 创建单方向的共享令牌桶，mbps <= 0 时返回 nil
+func newSharedBucket(mbps int) *sharedBucket {
+	if mbps <= 0 {
+		return nil
+	}
+	r := float64(mbps) * float64(bytesPerMbit)
+	return &sharedBucket{
+		rate:          r,
+		total:         rate.NewLimiter(rate.Limit(r), shareBurst(r)),
+		interval:      rebalanceInterval,
+		shares:        make(map[int]*share),
+		lastRebalance: time.Now(),
+	}
+}
+
+// shareBurst 速率对应的 burst
+func shareBurst(r float64) int {
+	return max(int(r*burstWindow.Seconds()), minBurst)
+}
+
+func (b *sharedBucket) wait(ctx context.Context, userID int, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	if now.Sub(b.lastRebalance) >= b.interval {
+		b.rebalance(now)
+	}
+	sh, ok := b.shares[userID]
+	if !ok {
+		// 新用户先按平分的份额开始，下个周期再按使用量调整
+		r := b.rate / float64(b.activeCount()+1)
+		sh = &share{limiter: rate.NewLimiter(rate.Limit(r), shareBurst(r)), fresh: true}
+		b.shares[userID] = sh
+	}
+	sh.requested += int64(n)
+	limiter := sh.limiter
+	b.mu.Unlock()
+
+	if err := waitN(ctx, limiter, n); err != nil {
+		return err
+	}
+	return waitN(ctx, b.total, n)
+}
+
+// activeCount 返回当前周期内有流量或刚加入的用户数，调用方需持有 mu
+func (b *sharedBucket) activeCount() int {
+	count := 0
+	for _, sh := range b.shares {
+		if sh.requested > 0 || sh.fresh {
+			count++
+		}
+	}
+	return count
+}
+
+// rebalance 按上个周期的使用量重新分配份额，调用方需持有 mu
+func (b *sharedBucket) rebalance(now time.Time) {
+	elapsed := now.Sub(b.lastRebalance).Seconds()
+	b.lastRebalance = now
+
+	var active []*share
+	var demands []float64
+	for userID, sh := range b.shares {
+		if sh.requested == 0 && !sh.fresh {
+			sh.idleRounds++
+			if sh.idleRounds >= idleRoundsToDrop {
+				delete(b.shares, userID)
+			}
+			continue
+		}
+		used := float64(sh.requested) / elapsed
+		demand := math.Inf(1)
+		if !sh.fresh && used < saturatedRatio*float64(sh.limiter.Limit()) {
+			demand = used * demandHeadroom
+		}
+		active = append(active, sh)
+		demands = append(demands, demand)
+		sh.requested = 0
+		sh.fresh = false
+		sh.idleRounds = 0
+	}
+	if len(active) == 0 {
+		return
+	}
+
+	allocations := waterFill(b.rate, demands)
+	for i, sh := range active {
+		sh.limiter.SetLimitAt(now, rate.Limit(allocations[i]))
+		sh.limiter.SetBurstAt(now, shareBurst(allocations[i]))
+	}
+
+	// 空闲用户恢复活动时先使用平分的份额
+	idleRate := b.rate / float64(len(active)+1)
+	for _, sh := range b.shares {
+		if sh.idleRounds > 0 {
+			sh.limiter.SetLimitAt(now, rate.Limit(idleRate))
+			sh.limiter.SetBurstAt(now, shareBurst(idleRate))
+		}
+	}
+}
+
+// waterFill 按注水算法把 capacity 分给各需求：需求小于平均份额的按需分配，其余平分剩下的容量
+// 所有需求都满足后仍有剩余时，剩余部分平均加到每个人的份额上，方便用量增长
+func waterFill(capacity float64, demands []float64) []float64 {
+	order := make([]int, len(demands))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return demands[order[i]] < demands[order[j]] })
+
+	allocations := make([]float64, len(demands))
+	remaining := capacity
+	for k, i := range order {
+		allocations[i] = min(demands[i], remaining/float64(len(order)-k))
+		remaining -= allocations[i]
+	}
+	if remaining > 0 {
+		extra := remaining / float64(len(allocations))
+		for i := range allocations {
+			allocations[i] += extra
+		}
+	}
+	return allocations
+}
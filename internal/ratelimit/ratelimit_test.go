@@ -1,12 +1,17 @@
 package ratelimit
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
 	"github.com/leanovate/gopter/prop"
+	"golang.org/x/time/rate"
 )
 
 // Feature: anytls-xboard-integration, Property 6: 连接速率限制
@@ -19,7 +24,7 @@ func TestProperty6_ConnRateLimiter(t *testing.T) {
 	properties := gopter.NewProperties(parameters)
 
 	// Sub-property: failures <= 10 should NOT ban
-	properties.Property("IP with failures <= maxFailures is not banned", prop.ForAll(
+	properties.Property("IP with failures <= DefaultConnLimits.MaxFailures is not banned", prop.ForAll(
 		func(ipSuffix int, failCount int) bool {
 			limiter := NewConnRateLimiter()
 			ip := fmt.Sprintf("10.0.0.%d", ipSuffix%256)
@@ -32,11 +37,11 @@ func TestProperty6_ConnRateLimiter(t *testing.T) {
 			return !limiter.IsBanned(ip)
 		},
 		gen.IntRange(1, 255),
-		gen.IntRange(0, 10), // 0 to maxFailures (10)
+		gen.IntRange(0, 10), // 0 to DefaultConnLimits.MaxFailures (10)
 	))
 
 	// Sub-property: failures > 10 should ban
-	properties.Property("IP with failures > maxFailures is banned", prop.ForAll(
+	properties.Property("IP with failures > DefaultConnLimits.MaxFailures is banned", prop.ForAll(
 		func(ipSuffix int, extraFailures int) bool {
 			limiter := NewConnRateLimiter()
 			ip := fmt.Sprintf("10.0.0.%d", ipSuffix%256)
@@ -113,7 +118,7 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("GetLimiter returns nil when speedLimit is 0", prop.ForAll(
 		func(userID int) bool {
 			sl := NewSpeedLimiter()
-			limiter := sl.GetLimiter(userID, 0)
+			limiter := sl.GetLimiter(userID, Limits{})
 			return limiter == nil
 		},
 		gen.IntRange(1, 1000),
@@ -123,7 +128,7 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("GetLimiter returns non-nil when speedLimit > 0", prop.ForAll(
 		func(userID int, speedLimit int) bool {
 			sl := NewSpeedLimiter()
-			limiter := sl.GetLimiter(userID, speedLimit)
+			limiter := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
 			return limiter != nil
 		},
 		gen.IntRange(1, 1000),
@@ -134,17 +139,20 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("Limiter rate approximately equals speedLimit * bytesPerMbit", prop.ForAll(
 		func(userID int, speedLimit int) bool {
 			sl := NewSpeedLimiter()
-			limiter := sl.GetLimiter(userID, speedLimit)
+			limiter := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
 			if limiter == nil {
 				return false
 			}
 
 			expectedRate := float64(speedLimit) * float64(bytesPerMbit)
-			actualRate := float64(limiter.Limit())
-
-			// Allow small floating point tolerance
-			ratio := actualRate / expectedRate
-			return ratio > 0.99 && ratio < 1.01
+			for _, l := range []*rate.Limiter{limiter.Upload(), limiter.Download()} {
+				// Allow small floating point tolerance
+				ratio := float64(l.Limit()) / expectedRate
+				if ratio <= 0.99 || ratio >= 1.01 {
+					return false
+				}
+			}
+			return true
 		},
 		gen.IntRange(1, 100),
 		gen.IntRange(1, 100),
@@ -154,13 +162,13 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("Limiter burst equals speedLimit * burstMultiplier", prop.ForAll(
 		func(userID int, speedLimit int) bool {
 			sl := NewSpeedLimiter()
-			limiter := sl.GetLimiter(userID, speedLimit)
+			limiter := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
 			if limiter == nil {
 				return false
 			}
 
 			expectedBurst := speedLimit * burstMultiplier
-			return limiter.Burst() == expectedBurst
+			return limiter.Upload().Burst() == expectedBurst && limiter.Download().Burst() == expectedBurst
 		},
 		gen.IntRange(1, 100),
 		gen.IntRange(1, 100),
@@ -170,8 +178,8 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("Same userID returns same limiter on repeated calls", prop.ForAll(
 		func(userID int, speedLimit int) bool {
 			sl := NewSpeedLimiter()
-			l1 := sl.GetLimiter(userID, speedLimit)
-			l2 := sl.GetLimiter(userID, speedLimit)
+			l1 := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
+			l2 := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
 			return l1 == l2
 		},
 		gen.IntRange(1, 1000),
@@ -182,7 +190,7 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 	properties.Property("GetLimiter returns nil for negative speedLimit", prop.ForAll(
 		func(userID int, speedLimit int) bool {
 			sl := NewSpeedLimiter()
-			limiter := sl.GetLimiter(userID, speedLimit)
+			limiter := sl.GetLimiter(userID, Limits{Upload: speedLimit, Download: speedLimit})
 			return limiter == nil
 		},
 		gen.IntRange(1, 1000),
@@ -191,3 +199,228 @@ func TestProperty9_SpeedLimiterTokenBucket(t *testing.T) {
 
 	properties.TestingRun(t)
 }
+
+func TestConnRateLimiter_Unban(t *testing.T) {
+	r := NewConnRateLimiter()
+	for i := 0; i <= DefaultConnLimits.MaxFailures; i++ {
+		r.RecordFailure("10.0.0.1")
+	}
+	r.RecordFailure("10.0.0.2")
+
+	banned := r.Banned()
+	if len(banned) != 1 || banned["10.0.0.1"].IsZero() {
+		t.Fatalf("Banned() = %v, want only 10.0.0.1", banned)
+	}
+	if !r.Unban("10.0.0.1") {
+		t.Error("Unban should report a banned IP")
+	}
+	if r.IsBanned("10.0.0.1") || r.BannedCount() != 0 {
+		t.Error("IP still banned after Unban")
+	}
+	if r.Unban("10.0.0.2") {
+		t.Error("Unban should not report an IP that was not banned")
+	}
+	// 解封后失败计数重新开始
+	if r.RecordFailure("10.0.0.1") {
+		t.Error("failure count should restart after Unban")
+	}
+}
+
+func TestSpeedLimiter_UpdateLimit(t *testing.T) {
+	sl := NewSpeedLimiter()
+	if sl.Limiter(1) != nil {
+		t.Fatal("unknown user should have no limiter")
+	}
+
+	l := sl.GetLimiter(1, Limits{Upload: 10, Download: 10})
+	if sl.Limiter(1) != l {
+		t.Fatal("Limiter should return the limiter created by GetLimiter")
+	}
+
+	// 修改限速时原地更新，已有连接持有的是同一个 UserLimiter
+	sl.UpdateLimit(1, Limits{Upload: 20, Download: 5})
+	if sl.Limiter(1) != l {
+		t.Fatal("UpdateLimit should update the limiter in place")
+	}
+	if l.Upload().Limit() != 20*bytesPerMbit || l.Upload().Burst() != 20*burstMultiplier {
+		t.Errorf("upload limit = %v burst = %d, want 20 Mbps", l.Upload().Limit(), l.Upload().Burst())
+	}
+	if l.Download().Limit() != 5*bytesPerMbit || l.Download().Burst() != 5*burstMultiplier {
+		t.Errorf("download limit = %v burst = %d, want 5 Mbps", l.Download().Limit(), l.Download().Burst())
+	}
+
+	// 单个方向改为不限速
+	sl.UpdateLimit(1, Limits{Download: 5})
+	if l.Upload().Limit() != rate.Inf {
+		t.Errorf("upload limit = %v, want Inf", l.Upload().Limit())
+	}
+
+	// 两个方向都不限速时移除
+	sl.UpdateLimit(1, Limits{})
+	if sl.Limiter(1) != nil {
+		t.Error("Limiter should be nil after UpdateLimit with no limits")
+	}
+
+	// 从不限速改为限速时创建
+	sl.UpdateLimit(1, Limits{Upload: 5})
+	if l := sl.Limiter(1); l == nil || l.Upload().Limit() != 5*bytesPerMbit || l.Download().Limit() != rate.Inf {
+		t.Errorf("Limiter after UpdateLimit(upload=5) = %+v", l)
+	}
+
+	sl.RemoveUser(1)
+	if sl.Limiter(1) != nil {
+		t.Error("Limiter should be nil after RemoveUser")
+	}
+}
+
+func TestWaitN_LargerThanBurst(t *testing.T) {
+	// 2 Mbps 的 burst 为 256KB，等待 3 倍 burst 不应报错，耗时约 2 个 burst 的补充时间
+	l := newLimiter(2)
+	burst := l.Burst()
+	start := time.Now()
+	if err := waitN(context.Background(), l, 3*burst); err != nil {
+		t.Fatalf("waitN failed: %v", err)
+	}
+	want := time.Duration(float64(2*burst) / float64(l.Limit()) * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*8/10 || elapsed > want*15/10 {
+		t.Errorf("WaitN took %v, want about %v", elapsed, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := waitN(ctx, l, burst); err == nil {
+		t.Error("WaitN should fail when the context ends before tokens are available")
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("WaitN returned after %v, should honor context", elapsed)
+	}
+}
+
+func TestWaterFill(t *testing.T) {
+	inf := math.Inf(1)
+	cases := []struct {
+		demands []float64
+		want    []float64
+	}{
+		{[]float64{inf}, []float64{100}},
+		{[]float64{inf, inf}, []float64{50, 50}},
+		// 用量小的用户按需分配，其余平分剩余
+		{[]float64{10, inf, inf}, []float64{10, 45, 45}},
+		{[]float64{inf, 20, 70}, []float64{40, 20, 40}},
+		// 需求都满足后剩余部分平均加到每个人
+		{[]float64{10, 20}, []float64{45, 55}},
+	}
+	for _, c := range cases {
+		got := waterFill(100, c.demands)
+		for i := range got {
+			if math.Abs(got[i]-c.want[i]) > 1e-9 {
+				t.Errorf("waterFill(100, %v) = %v, want %v", c.demands, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+// consume 以 chunk 为单位持续为用户申请下载令牌，直到 stop 关闭，返回申请到的字节数
+func consume(n *NodeLimiter, userID int, chunk int, pause time.Duration, stop <-chan struct{}, total *atomic.Int64) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err := n.Wait(context.Background(), userID, Download, chunk); err != nil {
+			return
+		}
+		total.Add(int64(chunk))
+		if pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+}
+
+// TestNodeLimiter_FairShare 测试节点总带宽在活跃用户间公平分配，空闲用户的份额流向活跃用户
+func TestNodeLimiter_FairShare(t *testing.T) {
+	if NewNodeLimiter(Limits{}) != nil {
+		t.Fatal("unlimited node limiter should be nil")
+	}
+	// 16 Mbps = 2MB/s
+	n := NewNodeLimiter(Limits{Download: 16})
+	n.download.interval = 100 * time.Millisecond
+	const rate = 16 * bytesPerMbit
+	const chunk = 16 * 1024
+
+	var heavy1, heavy2, light atomic.Int64
+	stop1, stop2, stopLight := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	go consume(n, 1, chunk, 0, stop1, &heavy1)
+	go consume(n, 2, chunk, 0, stop2, &heavy2)
+	// 轻量用户约 160KB/s，远小于平均份额
+	go consume(n, 3, chunk, 100*time.Millisecond, stopLight, &light)
+
+	// 等份额收敛后测量 1 秒
+	time.Sleep(500 * time.Millisecond)
+	h1, h2, l := heavy1.Load(), heavy2.Load(), light.Load()
+	time.Sleep(time.Second)
+	h1, h2, l = heavy1.Load()-h1, heavy2.Load()-h2, light.Load()-l
+
+	if sum := h1 + h2 + l; sum > rate*11/10 {
+		t.Errorf("aggregate = %d B/s, exceeds node limit %d", sum, rate)
+	}
+	// 轻量用户的需求完全满足
+	if l < 100*1024 {
+		t.Errorf("light user got %d B/s, want its full demand", l)
+	}
+	// 两个重度用户平分剩余带宽
+	wantHeavy := (rate - l) / 2
+	for i, got := range []int64{h1, h2} {
+		if got < wantHeavy*7/10 || got > wantHeavy*13/10 {
+			t.Errorf("heavy user %d got %d B/s, want about %d", i+1, got, wantHeavy)
+		}
+	}
+
+	// 用户 2 和轻量用户停止后，用户 1 获得全部带宽
+	close(stop2)
+	close(stopLight)
+	time.Sleep(500 * time.Millisecond)
+	h1 = heavy1.Load()
+	time.Sleep(time.Second)
+	h1 = heavy1.Load() - h1
+	close(stop1)
+	if h1 < rate*8/10 || h1 > rate*11/10 {
+		t.Errorf("sole active user got %d B/s, want about %d", h1, rate)
+	}
+}
+
+// TestSpeedLimiter_NodeAndUserLimits 测试用户限速与节点总带宽同时生效，取较小者
+func TestSpeedLimiter_NodeAndUserLimits(t *testing.T) {
+	sl := NewSpeedLimiter()
+	sl.SetNodeLimit(Limits{Download: 16})
+	sl.GetLimiter(1, Limits{Download: 4})
+
+	// 用户限速 4 Mbps 的 burst 为 512KB，节点份额的 burst 更小，单次读写按较小者分段
+	if got := sl.ChunkSize(1, Download, 1<<20); got != shareBurst(16*bytesPerMbit) {
+		t.Errorf("ChunkSize = %d, want node burst %d", got, shareBurst(16*bytesPerMbit))
+	}
+	if got := sl.ChunkSize(1, Upload, 1<<20); got != 1<<20 {
+		t.Errorf("upload ChunkSize = %d, want unlimited", got)
+	}
+
+	// 跳过初始 burst 后测量：用户被自己的 4 Mbps 限速约束
+	ctx := context.Background()
+	sl.Wait(ctx, 1, Download, 4*burstMultiplier)
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		if err := sl.Wait(ctx, 1, Download, 4*bytesPerMbit/8); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 1300*time.Millisecond {
+		t.Errorf("transfer of 1s at user limit took %v", elapsed)
+	}
+
+	sl.SetNodeLimit(Limits{})
+	if got := sl.ChunkSize(1, Download, 1<<20); got != 4*burstMultiplier {
+		t.Errorf("ChunkSize without node limit = %d, want user burst", got)
+	}
+}
@@ -1,7 +1,9 @@
 package ratelimit
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/time/rate"
 )
@@ -9,23 +11,123 @@ import (
 const bytesPerMbit = 125000 // 1 Mbps = 125000 bytes/s
 const burstMultiplier = 128 * 1024 // burst = speed_limit * 128KB
 
+// Direction 限速方向
+type Direction int
+
+const (
+	Upload   Direction = iota // 客户端发往节点
+	Download                  // 节点发往客户端
+)
+
+// Limits 用户上传/下载限速（Mbps），<=0 表示该方向不限速
+// 上传指客户端发往节点的数据，下载指节点发往客户端的数据
+type Limits struct {
+	Upload   int
+	Download int
+}
+
+// Unlimited 两个方向都不限速
+func (l Limits) Unlimited() bool {
+	return l.Upload <= 0 && l.Download <= 0
+}
+
+// UserLimiter 单用户的上传/下载令牌桶，两个方向互不影响
+// 不限速的方向使用 rate.Inf，修改限速时原地更新，已有连接立即生效
+type UserLimiter struct {
+	upload   *rate.Limiter
+	download *rate.Limiter
+}
+
+func newUserLimiter(limits Limits) *UserLimiter {
+	return &UserLimiter{
+		upload:   newLimiter(limits.Upload),
+		download: newLimiter(limits.Download),
+	}
+}
+
+// newLimiter 创建令牌桶，初始令牌为满 burst
+func newLimiter(mbps int) *rate.Limiter {
+	if mbps <= 0 {
+		return rate.NewLimiter(rate.Inf, 0)
+	}
+	return rate.NewLimiter(rate.Limit(float64(mbps)*float64(bytesPerMbit)), mbps*burstMultiplier)
+}
+
+// set 原地更新两个方向的速率和 burst
+func (l *UserLimiter) set(limits Limits) {
+	setLimit(l.upload, limits.Upload)
+	setLimit(l.download, limits.Download)
+}
+
+func setLimit(l *rate.Limiter, mbps int) {
+	if mbps <= 0 {
+		l.SetLimit(rate.Inf)
+		return
+	}
+	l.SetLimit(rate.Limit(float64(mbps) * float64(bytesPerMbit)))
+	l.SetBurst(mbps * burstMultiplier)
+}
+
+// Upload 上传方向令牌桶
+func (l *UserLimiter) Upload() *rate.Limiter {
+	return l.upload
+}
+
+// Download 下载方向令牌桶
+func (l *UserLimiter) Download() *rate.Limiter {
+	return l.download
+}
+
+// Direction 返回指定方向的令牌桶
+func (l *UserLimiter) Direction(dir Direction) *rate.Limiter {
+	if dir == Upload {
+		return l.upload
+	}
+	return l.download
+}
+
+// chunkSize 返回单次读写不超过 burst 的长度
+func chunkSize(l *rate.Limiter, n int) int {
+	if l.Limit() == rate.Inf {
+		return n
+	}
+	if burst := l.Burst(); burst > 0 && n > burst {
+		return burst
+	}
+	return n
+}
+
+// waitN 等待 n 个令牌，n 超过 burst 时分段等待，ctx 取消时返回错误
+func waitN(ctx context.Context, l *rate.Limiter, n int) error {
+	for n > 0 {
+		chunk := chunkSize(l, n)
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
 // SpeedLimiter 用户限速器
+// 设置节点总带宽后，每次读写先经过用户自己的令牌桶，再经过节点在活跃用户间公平分配的份额
 type SpeedLimiter struct {
 	mu       sync.RWMutex
-	limiters map[int]*rate.Limiter
+	limiters map[int]*UserLimiter
+	node     atomic.Pointer[NodeLimiter]
 }
 
 // NewSpeedLimiter 创建用户限速器
 func NewSpeedLimiter() *SpeedLimiter {
 	return &SpeedLimiter{
-		limiters: make(map[int]*rate.Limiter),
+		limiters: make(map[int]*UserLimiter),
 	}
 }
 
-// GetLimiter 获取用户限速器
-// speedLimitMbps > 0 时返回对应 Limiter，= 0 时返回 nil（不限速）
-func (s *SpeedLimiter) GetLimiter(userID int, speedLimitMbps int) *rate.Limiter {
-	if speedLimitMbps <= 0 {
+// GetLimiter 获取用户限速器，不存在时按 limits 创建
+// 两个方向都不限速时返回 nil
+func (s *SpeedLimiter) GetLimiter(userID int, limits Limits) *UserLimiter {
+	if limits.Unlimited() {
 		return nil
 	}
 
@@ -36,36 +138,38 @@ func (s *SpeedLimiter) GetLimiter(userID int, speedLimitMbps int) *rate.Limiter
 		return l
 	}
 
-	// 创建新的限速器
-	bytesPerSec := rate.Limit(float64(speedLimitMbps) * float64(bytesPerMbit))
-	burst := speedLimitMbps * burstMultiplier
-	l = rate.NewLimiter(bytesPerSec, burst)
-
 	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.limiters[userID]; ok {
+		return l
+	}
+	l = newUserLimiter(limits)
 	s.limiters[userID] = l
-	s.mu.Unlock()
-
 	return l
 }
 
+// Limiter 返回用户当前的限速器，未限速时返回 nil
+// 连接在每次读写时调用，以便限速变更立即生效
+func (s *SpeedLimiter) Limiter(userID int) *UserLimiter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limiters[userID]
+}
+
 // UpdateLimit 更新用户限速参数
-func (s *SpeedLimiter) UpdateLimit(userID int, speedLimitMbps int) {
-	if speedLimitMbps <= 0 {
+func (s *SpeedLimiter) UpdateLimit(userID int, limits Limits) {
+	if limits.Unlimited() {
 		s.RemoveUser(userID)
 		return
 	}
 
-	bytesPerSec := rate.Limit(float64(speedLimitMbps) * float64(bytesPerMbit))
-	burst := speedLimitMbps * burstMultiplier
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if l, ok := s.limiters[userID]; ok {
-		l.SetLimit(bytesPerSec)
-		l.SetBurst(burst)
+		l.set(limits)
 	} else {
-		s.limiters[userID] = rate.NewLimiter(bytesPerSec, burst)
+		s.limiters[userID] = newUserLimiter(limits)
 	}
 }
 
@@ -75,3 +179,32 @@ func (s *SpeedLimiter) RemoveUser(userID int) {
 	delete(s.limiters, userID)
 	s.mu.Unlock()
 }
+
+// SetNodeLimit 设置节点总带宽，两个方向都不限速时取消节点限速
+func (s *SpeedLimiter) SetNodeLimit(limits Limits) {
+	s.node.Store(NewNodeLimiter(limits))
+}
+
+// ChunkSize 返回用户在 dir 方向单次读写的最大长度，保证每次等待不超过令牌桶的 burst
+func (s *SpeedLimiter) ChunkSize(userID int, dir Direction, n int) int {
+	if l := s.Limiter(userID); l != nil {
+		n = chunkSize(l.Direction(dir), n)
+	}
+	if node := s.node.Load(); node != nil {
+		n = node.chunkSize(dir, n)
+	}
+	return n
+}
+
+// Wait 为用户在 dir 方向传输 n 字节等待令牌：先等待用户限速，再等待节点份额
+func (s *SpeedLimiter) Wait(ctx context.Context, userID int, dir Direction, n int) error {
+	if l := s.Limiter(userID); l != nil {
+		if err := waitN(ctx, l.Direction(dir), n); err != nil {
+			return err
+		}
+	}
+	if node := s.node.Load(); node != nil {
+		return node.Wait(ctx, userID, dir, n)
+	}
+	return nil
+}
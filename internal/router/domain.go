@@ -0,0 +1,72 @@
+package router
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DomainMatcher 域名匹配器
+// 完整域名、后缀、关键字、正则任一命中即视为匹配
+type DomainMatcher struct {
+	domain  map[string]struct{}
+	suffix  []string
+	keyword []string
+	regex   []*regexp.Regexp
+}
+
+// NewDomainMatcher 创建域名匹配器，四类条件均为空时返回 nil
+func NewDomainMatcher(domain, suffix, keyword, regex []string) (*DomainMatcher, error) {
+	if len(domain) == 0 && len(suffix) == 0 && len(keyword) == 0 && len(regex) == 0 {
+		return nil, nil
+	}
+	m := &DomainMatcher{}
+	if len(domain) > 0 {
+		m.domain = make(map[string]struct{}, len(domain))
+		for _, d := range domain {
+			m.domain[normalizeDomain(d)] = struct{}{}
+		}
+	}
+	for _, d := range suffix {
+		m.suffix = append(m.suffix, strings.TrimPrefix(normalizeDomain(d), "."))
+	}
+	for _, k := range keyword {
+		m.keyword = append(m.keyword, strings.ToLower(k))
+	}
+	for _, expr := range regex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("无效的域名正则 %q: %w", expr, err)
+		}
+		m.regex = append(m.regex, re)
+	}
+	return m, nil
+}
+
+// Match 判断域名是否命中
+func (m *DomainMatcher) Match(domain string) bool {
+	domain = normalizeDomain(domain)
+	if _, ok := m.domain[domain]; ok {
+		return true
+	}
+	for _, suffix := range m.suffix {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range m.keyword {
+		if strings.Contains(domain, keyword) {
+			return true
+		}
+	}
+	for _, re := range m.regex {
+		if re.MatchString(domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
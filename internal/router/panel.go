@@ -0,0 +1,147 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"anytls/internal/api"
+	"anytls/internal/config"
+)
+
+// 面板路由动作
+const (
+	PanelActionBlock  = "block"
+	PanelActionDirect = "direct"
+	PanelActionDNS    = "dns"
+)
+
+// PanelDirectOutbound 面板 direct 动作使用的出站名称
+const PanelDirectOutbound = "direct"
+
+// PanelRoutes 面板路由转换结果
+type PanelRoutes struct {
+	Rules []config.RouteRule   // block/direct 动作转换的路由规则
+	DNS   []config.DNSOverride // dns 动作转换的按域名上游配置
+}
+
+// ConvertPanelRoutes 将面板下发的路由转换为路由规则和 DNS 覆盖配置
+// 匹配条件支持以下前缀，无前缀时按 IP/CIDR 或正则解析：
+// regexp:（域名正则）、domain:（域名后缀）、full:（完整域名）、keyword:（域名关键字）、port:（端口或端口范围）、ip:（IP/CIDR）
+// dns 动作只支持域名类条件，action_value 为上游 DNS 地址
+// 无法识别的条件和动作会被跳过，并通过 warnings 返回原因
+func ConvertPanelRoutes(routes []api.Route) (result PanelRoutes, warnings []string) {
+	for _, route := range routes {
+		var outbound string
+		switch strings.ToLower(route.Action) {
+		case PanelActionBlock:
+			outbound = OutboundReject
+		case PanelActionDirect:
+			outbound = PanelDirectOutbound
+		case PanelActionDNS:
+		default:
+			warnings = append(warnings, fmt.Sprintf("路由 %d: 不支持的动作 %q，已忽略", route.ID, route.Action))
+			continue
+		}
+
+		// 目标地址条件与端口条件分成两条规则，保持面板中各条件之间的"或"关系
+		destination := config.RouteRule{Outbound: outbound}
+		ports := config.RouteRule{Outbound: outbound}
+		for _, item := range route.Match {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if err := addPanelMatch(&destination, &ports, item); err != nil {
+				warnings = append(warnings, fmt.Sprintf("路由 %d: %v，已忽略", route.ID, err))
+			}
+		}
+
+		if strings.ToLower(route.Action) == PanelActionDNS {
+			if len(ports.Port) > 0 || len(destination.IPCIDR) > 0 {
+				warnings = append(warnings, fmt.Sprintf("路由 %d: dns 动作不支持端口和 IP 条件，已忽略这些条件", route.ID))
+			}
+			if route.ActionValue == "" {
+				warnings = append(warnings, fmt.Sprintf("路由 %d: dns 动作缺少 DNS 服务器地址，已忽略", route.ID))
+				continue
+			}
+			if len(destination.Domain)+len(destination.DomainSuffix)+len(destination.DomainKeyword)+len(destination.DomainRegex) == 0 {
+				continue
+			}
+			result.DNS = append(result.DNS, config.DNSOverride{
+				Domain:        destination.Domain,
+				DomainSuffix:  destination.DomainSuffix,
+				DomainKeyword: destination.DomainKeyword,
+				DomainRegex:   destination.DomainRegex,
+				Servers:       []string{route.ActionValue},
+			})
+			continue
+		}
+
+		if hasDestination(destination) {
+			result.Rules = append(result.Rules, destination)
+		}
+		if len(ports.Port) > 0 {
+			result.Rules = append(result.Rules, ports)
+		}
+	}
+	return result, warnings
+}
+
+func addPanelMatch(destination, ports *config.RouteRule, item string) error {
+	prefix, value, hasPrefix := strings.Cut(item, ":")
+	if !hasPrefix || isIPOrPrefix(item) {
+		prefix, value = "", item
+	}
+	switch strings.ToLower(prefix) {
+	case "regexp":
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("无效的正则 %q", value)
+		}
+		destination.DomainRegex = append(destination.DomainRegex, value)
+	case "domain":
+		destination.DomainSuffix = append(destination.DomainSuffix, value)
+	case "full":
+		destination.Domain = append(destination.Domain, value)
+	case "keyword":
+		destination.DomainKeyword = append(destination.DomainKeyword, value)
+	case "port":
+		for _, p := range strings.Split(value, ",") {
+			if _, err := parsePortRange(p); err != nil {
+				return fmt.Errorf("无效的端口 %q", p)
+			}
+			ports.Port = append(ports.Port, strings.TrimSpace(p))
+		}
+	case "ip":
+		if !isIPOrPrefix(value) {
+			return fmt.Errorf("无效的 IP %q", value)
+		}
+		destination.IPCIDR = append(destination.IPCIDR, value)
+	case "":
+		if isIPOrPrefix(value) {
+			destination.IPCIDR = append(destination.IPCIDR, value)
+			return nil
+		}
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("无效的正则 %q", value)
+		}
+		destination.DomainRegex = append(destination.DomainRegex, value)
+	default:
+		return fmt.Errorf("不支持的匹配条件 %q", item)
+	}
+	return nil
+}
+
+func isIPOrPrefix(s string) bool {
+	if _, err := netip.ParseAddr(s); err == nil {
+		return true
+	}
+	_, err := netip.ParsePrefix(s)
+	return err == nil
+}
+
+func hasDestination(r config.RouteRule) bool {
+	return len(r.Domain) > 0 || len(r.DomainSuffix) > 0 || len(r.DomainKeyword) > 0 ||
+		len(r.DomainRegex) > 0 || len(r.IPCIDR) > 0
+}
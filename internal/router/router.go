@@ -0,0 +1,65 @@
+package router
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"anytls/internal/config"
+)
+
+// OutboundReject 保留的出站名称，命中后拒绝连接
+const OutboundReject = "reject"
+
+// ErrRejected 路由规则拒绝连接时返回的错误
+var ErrRejected = errors.New("rejected by route rule")
+
+// Router 路由器
+// 面板下发的规则优先于本地配置的规则；每组规则按顺序匹配，第一条命中的规则生效
+// 两组规则可在运行时分别整体替换
+type Router struct {
+	rules      atomic.Pointer[[]*Rule]
+	panelRules atomic.Pointer[[]*Rule]
+}
+
+// NewRouter 创建路由器
+func NewRouter(rules []*Rule) *Router {
+	r := &Router{}
+	r.Update(rules)
+	r.UpdatePanel(nil)
+	return r
+}
+
+// ParseRules 根据配置创建规则列表
+func ParseRules(configs []config.RouteRule) ([]*Rule, error) {
+	rules := make([]*Rule, 0, len(configs))
+	for _, c := range configs {
+		rule, err := NewRule(c)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Update 原子替换本地规则集，正在进行的匹配不受影响
+func (r *Router) Update(rules []*Rule) {
+	r.rules.Store(&rules)
+}
+
+// UpdatePanel 原子替换面板下发的规则集
+func (r *Router) UpdatePanel(rules []*Rule) {
+	r.panelRules.Store(&rules)
+}
+
+// Match 返回第一条命中规则的出站名称，未命中时 matched 为 false
+func (r *Router) Match(m *Metadata) (outbound string, matched bool) {
+	for _, rules := range [...]*[]*Rule{r.panelRules.Load(), r.rules.Load()} {
+		for _, rule := range *rules {
+			if rule.Match(m) {
+				return rule.outbound, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,238 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"anytls/internal/api"
+	"anytls/internal/config"
+
+	"github.com/leanovate/gopter"
+	"github.com/leanovate/gopter/gen"
+	"github.com/leanovate/gopter/prop"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func mustRouter(t *testing.T, configs ...config.RouteRule) *Router {
+	t.Helper()
+	rules, err := ParseRules(configs)
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	return NewRouter(rules)
+}
+
+func TestRouter_Match(t *testing.T) {
+	r := mustRouter(t,
+		config.RouteRule{Port: []string{"25", "465-587"}, Network: "tcp", Outbound: OutboundReject},
+		config.RouteRule{Domain: []string{"exact.example.com"}, Outbound: "full"},
+		config.RouteRule{DomainSuffix: []string{".example.org"}, Outbound: "suffix"},
+		config.RouteRule{DomainKeyword: []string{"tracker"}, Outbound: OutboundReject},
+		config.RouteRule{DomainRegex: []string{`^ads?\d*\.`}, Outbound: "regex"},
+		config.RouteRule{IPCIDR: []string{"10.0.0.0/8", "2001:db8::/32", "1.1.1.1"}, Outbound: "cidr"},
+		config.RouteRule{UserID: []int{7}, Network: "udp", Outbound: "user7"},
+	)
+
+	cases := []struct {
+		network     string
+		destination string
+		userID      int
+		want        string
+	}{
+		{"tcp", "smtp.example.net:25", 1, OutboundReject},
+		{"tcp", "1.2.3.4:500", 1, OutboundReject},
+		{"udp", "1.2.3.4:500", 1, ""},
+		{"tcp", "EXACT.example.com.:443", 1, "full"},
+		{"tcp", "sub.exact.example.com:443", 1, ""},
+		{"tcp", "example.org:443", 1, "suffix"},
+		{"tcp", "a.b.example.org:443", 1, "suffix"},
+		{"tcp", "notexample.org:443", 1, ""},
+		{"tcp", "bt-tracker.net:80", 1, OutboundReject},
+		{"tcp", "ad3.foo.com:80", 1, "regex"},
+		{"tcp", "10.2.3.4:80", 1, "cidr"},
+		{"tcp", "[2001:db8::1]:80", 1, "cidr"},
+		{"tcp", "[::ffff:10.0.0.1]:80", 1, "cidr"},
+		{"tcp", "1.1.1.1:53", 1, "cidr"},
+		{"tcp", "1.1.1.2:53", 1, ""},
+		{"udp", "8.8.8.8:53", 7, "user7"},
+		{"tcp", "8.8.8.8:53", 7, ""},
+	}
+	for _, c := range cases {
+		got, matched := r.Match(&Metadata{
+			Network:     c.network,
+			Destination: M.ParseSocksaddr(c.destination),
+			UserID:      c.userID,
+		})
+		if matched != (c.want != "") || got != c.want {
+			t.Errorf("%s %s user=%d: got (%q, %v), want %q", c.network, c.destination, c.userID, got, matched, c.want)
+		}
+	}
+}
+
+func TestRouter_Update(t *testing.T) {
+	r := mustRouter(t, config.RouteRule{Port: []string{"25"}, Outbound: OutboundReject})
+	m := &Metadata{Network: "tcp", Destination: M.ParseSocksaddr("1.2.3.4:25")}
+	if _, matched := r.Match(m); !matched {
+		t.Fatal("expected rule to match before update")
+	}
+	r.Update(nil)
+	if _, matched := r.Match(m); matched {
+		t.Fatal("expected no match after update")
+	}
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	cases := map[string]config.RouteRule{
+		"missing outbound": {Port: []string{"25"}},
+		"bad regex":        {DomainRegex: []string{"("}, Outbound: "x"},
+		"bad cidr":         {IPCIDR: []string{"10.0.0.0/99"}, Outbound: "x"},
+		"bad port":         {Port: []string{"70000"}, Outbound: "x"},
+		"reversed range":   {Port: []string{"200-100"}, Outbound: "x"},
+		"bad network":      {Network: "icmp", Outbound: "x"},
+	}
+	for name, c := range cases {
+		if _, err := ParseRules([]config.RouteRule{c}); err == nil {
+			t.Errorf("%s: expected error, got nil", name)
+		}
+	}
+}
+
+// Feature: anytls-routing, Property 1: 端口范围匹配
+// 端口规则命中当且仅当目标端口位于范围内
+
+func TestProperty1_PortRangeMatch(t *testing.T) {
+	parameters := gopter.DefaultTestParameters()
+	parameters.MinSuccessfulTests = 100
+
+	properties := gopter.NewProperties(parameters)
+
+	properties.Property("port rule matches iff port is within range", prop.ForAll(
+		func(a, b, port uint16) bool {
+			start, end := min(a, b), max(a, b)
+			r, err := NewRule(config.RouteRule{
+				Port:     []string{fmt.Sprintf("%d-%d", start, end)},
+				Outbound: OutboundReject,
+			})
+			if err != nil {
+				return false
+			}
+			m := &Metadata{Network: "tcp", Destination: M.ParseSocksaddrHostPort("1.2.3.4", port)}
+			return r.Match(m) == (port >= start && port <= end)
+		},
+		gen.UInt16(),
+		gen.UInt16(),
+		gen.UInt16(),
+	))
+
+	properties.TestingRun(t)
+}
+
+func TestConvertPanelRoutes(t *testing.T) {
+	converted, warnings := ConvertPanelRoutes([]api.Route{
+		{ID: 1, Action: "block", Match: api.RouteMatch{`(^|\.)tracker\.`, "port:25,465-587", "10.0.0.0/8", "protocol:bittorrent"}},
+		{ID: 2, Action: "direct", Match: api.RouteMatch{"domain:example.com", "full:exact.example.net", "keyword:cdn"}},
+		{ID: 3, Action: "route", Match: api.RouteMatch{"domain:example.org"}},
+		{ID: 4, Action: "block", Match: api.RouteMatch{"regexp:("}},
+		{ID: 5, Action: "dns", ActionValue: "tls://1.1.1.1", Match: api.RouteMatch{"domain:example.net", "port:53"}},
+		{ID: 6, Action: "dns", Match: api.RouteMatch{"domain:example.net"}},
+	})
+	if len(warnings) != 5 {
+		t.Errorf("warnings = %q, want 5 entries", warnings)
+	}
+	if len(converted.DNS) != 1 || converted.DNS[0].DomainSuffix[0] != "example.net" || converted.DNS[0].Servers[0] != "tls://1.1.1.1" {
+		t.Errorf("DNS = %+v", converted.DNS)
+	}
+	rules, err := ParseRules(converted.Rules)
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	r := NewRouter(nil)
+	r.UpdatePanel(rules)
+
+	cases := []struct {
+		destination string
+		want        string
+	}{
+		{"bt.tracker.example:80", OutboundReject},
+		{"smtp.example.net:25", OutboundReject},
+		{"8.8.8.8:500", OutboundReject},
+		{"10.1.2.3:443", OutboundReject},
+		{"www.example.com:443", PanelDirectOutbound},
+		{"exact.example.net:443", PanelDirectOutbound},
+		{"mycdn.net:443", PanelDirectOutbound},
+		{"example.org:443", ""},
+	}
+	for _, c := range cases {
+		got, _ := r.Match(&Metadata{Network: "tcp", Destination: M.ParseSocksaddr(c.destination)})
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.destination, got, c.want)
+		}
+	}
+}
+
+// TestConvertPanelRoutes_LegacyMatch verifies that values following a typed item in the
+// legacy comma-separated form inherit its prefix instead of becoming regex rules.
+func TestConvertPanelRoutes_LegacyMatch(t *testing.T) {
+	var routes []api.Route
+	data := `[
+		{"id": 1, "match": "port:25,465,587", "action": "block"},
+		{"id": 2, "match": "domain:a.com,b.com", "action": "direct"}
+	]`
+	if err := json.Unmarshal([]byte(data), &routes); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	converted, warnings := ConvertPanelRoutes(routes)
+	if len(warnings) != 0 {
+		t.Errorf("warnings = %q", warnings)
+	}
+	if len(converted.Rules) != 2 {
+		t.Fatalf("Rules = %+v, want 2 rules", converted.Rules)
+	}
+	if got := converted.Rules[0]; fmt.Sprint(got.Port) != "[25 465 587]" || hasDestination(got) {
+		t.Errorf("Rules[0] = %+v", got)
+	}
+	if got := converted.Rules[1]; fmt.Sprint(got.DomainSuffix) != "[a.com b.com]" || len(got.DomainRegex) != 0 {
+		t.Errorf("Rules[1] = %+v", got)
+	}
+
+	rules, err := ParseRules(converted.Rules)
+	if err != nil {
+		t.Fatalf("ParseRules failed: %v", err)
+	}
+	r := NewRouter(nil)
+	r.UpdatePanel(rules)
+	cases := []struct {
+		destination string
+		want        string
+	}{
+		{"smtp.example.net:465", OutboundReject},
+		{"mail.example.net:587", OutboundReject},
+		{"cdn465.example.net:443", ""},
+		{"www.b.com:443", PanelDirectOutbound},
+		{"a.com:443", PanelDirectOutbound},
+	}
+	for _, c := range cases {
+		got, _ := r.Match(&Metadata{Network: "tcp", Destination: M.ParseSocksaddr(c.destination)})
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.destination, got, c.want)
+		}
+	}
+}
+
+func TestRouter_PanelRulesFirst(t *testing.T) {
+	r := mustRouter(t, config.RouteRule{Port: []string{"443"}, Outbound: "local"})
+	panel, err := ParseRules([]config.RouteRule{{Port: []string{"443"}, Outbound: "panel"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.UpdatePanel(panel)
+	m := &Metadata{Network: "tcp", Destination: M.ParseSocksaddr("1.2.3.4:443")}
+	if got, _ := r.Match(m); got != "panel" {
+		t.Errorf("got %q, want panel", got)
+	}
+	r.UpdatePanel(nil)
+	if got, _ := r.Match(m); got != "local" {
+		t.Errorf("got %q, want local", got)
+	}
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"anytls/internal/config"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+// Metadata 一次出站请求的路由信息
+type Metadata struct {
+	Network     string // tcp 或 udp
+	Destination M.Socksaddr
+	UserID      int
+}
+
+// Rule 单条路由规则
+// 同一字段内的多个条件为"或"关系，不同字段之间为"与"关系，未配置的字段不参与匹配
+type Rule struct {
+	domain  *DomainMatcher
+	ipCIDR  []netip.Prefix
+	ports   []portRange
+	network string
+	userIDs map[int]struct{}
+
+	outbound string
+}
+
+type portRange struct {
+	start, end uint16
+}
+
+// NewRule 根据配置创建路由规则
+func NewRule(c config.RouteRule) (*Rule, error) {
+	if c.Outbound == "" {
+		return nil, fmt.Errorf("路由规则错误: outbound 不能为空")
+	}
+	r := &Rule{outbound: c.Outbound}
+
+	domain, err := NewDomainMatcher(c.Domain, c.DomainSuffix, c.DomainKeyword, c.DomainRegex)
+	if err != nil {
+		return nil, fmt.Errorf("路由规则错误: %w", err)
+	}
+	r.domain = domain
+	for _, cidr := range c.IPCIDR {
+		prefix, err := parsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("路由规则错误: 无效的 ip_cidr %q: %w", cidr, err)
+		}
+		r.ipCIDR = append(r.ipCIDR, prefix)
+	}
+	for _, p := range c.Port {
+		pr, err := parsePortRange(p)
+		if err != nil {
+			return nil, fmt.Errorf("路由规则错误: 无效的 port %q: %w", p, err)
+		}
+		r.ports = append(r.ports, pr)
+	}
+	switch strings.ToLower(c.Network) {
+	case "":
+	case N.NetworkTCP, N.NetworkUDP:
+		r.network = strings.ToLower(c.Network)
+	default:
+		return nil, fmt.Errorf("路由规则错误: 未知的 network %q", c.Network)
+	}
+	if len(c.UserID) > 0 {
+		r.userIDs = make(map[int]struct{}, len(c.UserID))
+		for _, id := range c.UserID {
+			r.userIDs[id] = struct{}{}
+		}
+	}
+	return r, nil
+}
+
+// Outbound 规则命中后使用的出站名称
+func (r *Rule) Outbound() string {
+	return r.outbound
+}
+
+// Match 判断请求是否命中规则
+func (r *Rule) Match(m *Metadata) bool {
+	if r.network != "" && r.network != m.Network {
+		return false
+	}
+	if r.userIDs != nil {
+		if _, ok := r.userIDs[m.UserID]; !ok {
+			return false
+		}
+	}
+	if len(r.ports) > 0 && !r.matchPort(m.Destination.Port) {
+		return false
+	}
+	if r.hasDestinationCondition() && !r.matchDestination(m.Destination) {
+		return false
+	}
+	return true
+}
+
+func (r *Rule) hasDestinationCondition() bool {
+	return r.domain != nil || len(r.ipCIDR) > 0
+}
+
+// matchDestination 域名条件只匹配域名目标，IP 条件只匹配 IP 目标（不做 DNS 解析）
+func (r *Rule) matchDestination(destination M.Socksaddr) bool {
+	if destination.IsIP() {
+		addr := destination.Addr.Unmap()
+		for _, prefix := range r.ipCIDR {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	if !destination.IsFqdn() || r.domain == nil {
+		return false
+	}
+	return r.domain.Match(destination.Fqdn)
+}
+
+func (r *Rule) matchPort(port uint16) bool {
+	for _, pr := range r.ports {
+		if port >= pr.start && port <= pr.end {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix 解析 CIDR，也接受不带掩码的单个 IP
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// parsePortRange 解析 "443" 或 "1000-2000"
+func parsePortRange(s string) (portRange, error) {
+	startStr, endStr, isRange := strings.Cut(strings.TrimSpace(s), "-")
+	start, err := strconv.ParseUint(strings.TrimSpace(startStr), 10, 16)
+	if err != nil {
+		return portRange{}, err
+	}
+	end := start
+	if isRange {
+		end, err = strconv.ParseUint(strings.TrimSpace(endStr), 10, 16)
+		if err != nil {
+			return portRange{}, err
+		}
+	}
+	if start > end {
+		return portRange{}, fmt.Errorf("起始端口大于结束端口")
+	}
+	return portRange{start: uint16(start), end: uint16(end)}, nil
+}
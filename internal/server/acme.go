@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/util"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeCheckInterval 检查 ACME 证书的间隔：申请失败后重试，并让握手使用 autocert 续期后的证书
+const acmeCheckInterval = time.Hour
+
+// acmeChallengePath HTTP-01 验证请求的路径前缀
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// acmeClient 内置 ACME 客户端，由 autocert 完成验证、保存和续期
+// 握手只使用已经取得的证书，申请在后台进行，不会让客户端的握手等待证书签发
+type acmeClient struct {
+	manager *autocert.Manager
+	domains []string
+	issued  sync.Map // 已取得证书的域名（小写）
+}
+
+// newACMEClient 根据 tls.acme 创建 ACME 客户端，未配置域名时返回 nil
+func newACMEClient(cfg config.ACMEConfig) *acmeClient {
+	if len(cfg.Domains) == 0 {
+		return nil
+	}
+	directory := cfg.DirectoryURL
+	if directory == "" {
+		directory = autocert.DefaultACMEDirectory
+	}
+	domains := make([]string, len(cfg.Domains))
+	for i, domain := range cfg.Domains {
+		domains[i] = strings.ToLower(domain)
+	}
+	return &acmeClient{
+		manager: &autocert.Manager{
+			Prompt:      autocert.AcceptTOS,
+			Cache:       autocert.DirCache(cfg.Dir),
+			HostPolicy:  autocert.HostWhitelist(domains...),
+			RenewBefore: time.Duration(cfg.RenewBefore) * 24 * time.Hour,
+			Email:       cfg.Email,
+			Client:      &acme.Client{DirectoryURL: directory},
+		},
+		domains: domains,
+	}
+}
+
+// isChallenge 判断是否为 ACME 服务器发起的 TLS-ALPN-01 验证握手
+func isChallenge(hello *tls.ClientHelloInfo) bool {
+	return slices.Contains(hello.SupportedProtos, acme.ALPNProto)
+}
+
+// challengeConfig 返回 TLS-ALPN-01 验证握手使用的 TLS 配置
+func (a *acmeClient) challengeConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{acme.ALPNProto},
+		GetCertificate: a.manager.GetCertificate,
+	}
+}
+
+// getCertificate 返回 serverName 的 ACME 证书，域名未配置或尚未取得证书时返回 nil
+func (a *acmeClient) getCertificate(hello *tls.ClientHelloInfo) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if _, ok := a.issued.Load(name); !ok {
+		return nil
+	}
+	// autocert 不接受末尾带点的域名
+	normalized := *hello
+	normalized.ServerName = name
+	cert, err := a.manager.GetCertificate(&normalized)
+	if err != nil {
+		return nil
+	}
+	return cert
+}
+
+// obtain 从证书目录加载或向 ACME 服务申请所有域名的证书
+// autocert 在取得证书后按 renew_before 自动续期
+func (a *acmeClient) obtain() error {
+	var errs []error
+	for _, domain := range a.domains {
+		_, err := a.manager.GetCertificate(&tls.ClientHelloInfo{
+			ServerName: domain,
+			// 申请 ECDSA 证书，与支持 ECDSA 的客户端握手时使用的证书一致
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", domain, err))
+			continue
+		}
+		a.issued.Store(domain, struct{}{})
+	}
+	return errors.Join(errs...)
+}
+
+// watchACME 在后台取得 ACME 证书，失败时每隔 acmeCheckInterval 重试
+func (s *Server) watchACME(ctx context.Context) {
+	client := s.certs.acme
+	obtain := func() error {
+		err := client.obtain()
+		if err != nil {
+			s.logger.WithError(err).Error("取得 ACME 证书失败，暂时使用本地证书")
+		}
+		return err
+	}
+	go func() {
+		if obtain() == nil {
+			s.logger.WithField("domains", strings.Join(client.domains, ",")).Info("已取得 ACME 证书")
+		}
+	}()
+	util.StartRoutine(ctx, acmeCheckInterval, func() { obtain() })
+}
+
+// startACMEHTTP 在 tls.acme.http_listen 上响应 HTTP-01 验证，其他请求转发到 fallback
+// 未启用 ACME 或 http_listen 为 "off" 时不启动
+func (s *Server) startACMEHTTP() error {
+	if s.certs.acme == nil {
+		return nil
+	}
+	addr := s.config().TLS.ACME.HTTPListen
+	if addr == config.ACMEDisabled {
+		return nil
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	challenge := s.certs.acme.manager.HTTPHandler(s.fallbackHTTPHandler())
+	s.acmeServer = &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// 域名白名单按不带端口的 Host 匹配
+			if host, _, err := net.SplitHostPort(r.Host); err == nil && strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+				r.Host = host
+			}
+			challenge.ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go s.acmeServer.Serve(ln)
+	s.logger.WithField("addr", ln.Addr().String()).Info("ACME HTTP-01 验证端口已启动")
+	return nil
+}
+
+// fallbackHTTPHandler 将 HTTP 端口上的普通请求反向代理到 fallback 目标，未配置 fallback 时返回 404
+func (s *Server) fallbackHTTPHandler() http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(&url.URL{Scheme: "http", Host: s.config().Fallback})
+			r.Out.Host = r.In.Host
+			r.SetXForwarded()
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.config().Fallback == "" {
+			http.NotFound(w, r)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,236 @@
+//go:build acme
+
+package server
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"anytls/internal/config"
+
+	"github.com/letsencrypt/pebble/v2/ca"
+	"github.com/letsencrypt/pebble/v2/db"
+	"github.com/letsencrypt/pebble/v2/va"
+	"github.com/letsencrypt/pebble/v2/wfe"
+	"github.com/miekg/dns"
+)
+
+// ACME 集成测试在内嵌的 pebble 上申请证书，依赖 pebble 和 miekg/dns，默认不编译：
+//
+//	go test -tags acme ./internal/server
+//
+// 不需要 ACME 服务的单元测试见 acme_test.go
+
+// acmeTestDomain ACME 测试申请证书的域名，由 startPebble 的 DNS 服务解析到 127.0.0.1
+const acmeTestDomain = "acme.anytls.test"
+
+// startPebble 启动内嵌的 pebble ACME 测试服务，所有域名解析到 127.0.0.1，
+// HTTP-01 和 TLS-ALPN-01 验证分别连接 httpPort 和 tlsPort；validity 为签发证书的有效期（秒），0 为 pebble 默认值
+// 返回目录地址和信任 pebble 的 HTTP 客户端
+func startPebble(t *testing.T, httpPort, tlsPort int, validity uint64) (string, *http.Client) {
+	t.Helper()
+	t.Setenv("PEBBLE_VA_NOSLEEP", "1")
+
+	dnsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dnsServer := &dns.Server{Listener: dnsLn, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if q := r.Question[0]; q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.IPv4(127, 0, 0, 1),
+			})
+		}
+		w.WriteMsg(m)
+	})}
+	go dnsServer.ActivateAndServe()
+	t.Cleanup(func() { dnsServer.Shutdown() })
+
+	logger := log.New(io.Discard, "", 0)
+	store := db.NewMemoryStore()
+	authority := ca.New(logger, store, "", "ecdsa", 0, 1, map[string]ca.Profile{
+		"default": {Description: "test", ValidityPeriod: validity},
+	})
+	validator := va.New(logger, httpPort, tlsPort, false, dnsLn.Addr().String(), store)
+	frontend := wfe.New(logger, store, validator, authority, []string{"pebble.letsencrypt.org"}, false, false, 0, 0)
+	handler := frontend.Handler()
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// pebble 的 finalize 响应没有 Location，autocert 依赖它轮询订单状态
+		if id, ok := strings.CutPrefix(r.URL.Path, "/finalize-order/"); ok {
+			w.Header().Set("Location", "https://"+r.Host+"/my-order/"+id)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+	return ts.URL + wfe.DirectoryPath, ts.Client()
+}
+
+// freePort 返回一个当前未被占用的本地端口
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// startACMEServer 以 acme 配置启动独立模式服务，ACME 请求发往 directory，返回服务地址
+// ln 为服务端口的 listener，ACME 服务的 TLS-ALPN-01 验证连接到这里
+func startACMEServer(t *testing.T, ln net.Listener, acmeCfg config.ACMEConfig, client *http.Client) *Server {
+	t.Helper()
+	srv, err := NewServer(&config.Config{
+		Standalone: true,
+		Password:   "unused",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+		TLS:        config.TLSConfig{ACME: acmeCfg},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.certs.acme.manager.Client.HTTPClient = client
+	srv.listener = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		srv.Shutdown(context.Background())
+	})
+	return srv
+}
+
+// waitForIssued 等待服务对 acmeTestDomain 使用 pebble 签发的证书
+func waitForIssued(t *testing.T, addr string) *x509.Certificate {
+	t.Helper()
+	var cert *x509.Certificate
+	waitForDuration(t, "certificate issued by pebble", time.Minute, func() bool {
+		cert = servedCertificate(t, addr, acmeTestDomain)
+		return strings.HasPrefix(cert.Issuer.CommonName, "Pebble")
+	})
+	return cert
+}
+
+// TestACME_TLSALPN01 测试在服务端口上完成 TLS-ALPN-01 验证取得证书，证书保存在目录中，重启后直接使用
+func TestACME_TLSALPN01(t *testing.T) {
+	dir := t.TempDir()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	directory, client := startPebble(t, freePort(t), ln.Addr().(*net.TCPAddr).Port, 0)
+	acmeCfg := config.ACMEConfig{
+		Domains:      []string{acmeTestDomain},
+		Dir:          dir,
+		DirectoryURL: directory,
+		HTTPListen:   config.ACMEDisabled,
+		RenewBefore:  30,
+	}
+	startACMEServer(t, ln, acmeCfg, client)
+
+	issued := waitForIssued(t, addr)
+	if len(issued.DNSNames) != 1 || issued.DNSNames[0] != acmeTestDomain {
+		t.Errorf("DNSNames = %v, want [%s]", issued.DNSNames, acmeTestDomain)
+	}
+	// 其他域名和带 ALPN 的普通客户端不受影响
+	if cert := servedCertificate(t, addr, "other.test"); strings.HasPrefix(cert.Issuer.CommonName, "Pebble") {
+		t.Error("names outside tls.acme.domains should not be served the ACME certificate")
+	}
+	if cert := servedCertificate(t, addr, acmeTestDomain, "h2", "http/1.1"); cert.SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Error("clients offering ALPN should be served the ACME certificate")
+	}
+	if _, err := os.Stat(filepath.Join(dir, acmeTestDomain)); err != nil {
+		t.Errorf("certificate was not saved in tls.acme.dir: %v", err)
+	}
+
+	// 使用同一目录的新实例：ACME 服务不可用时从目录加载已保存的证书
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acmeCfg.DirectoryURL = "https://127.0.0.1:1/dir"
+	startACMEServer(t, ln, acmeCfg, client)
+	if cert := waitForIssued(t, ln.Addr().String()); cert.SerialNumber.Cmp(issued.SerialNumber) != 0 {
+		t.Error("restarted server should reuse the saved certificate")
+	}
+}
+
+// TestACME_HTTP01 测试 TLS-ALPN-01 无法完成时在 HTTP 端口上完成 HTTP-01 验证，其他 HTTP 请求转发到 fallback
+func TestACME_HTTP01(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "fallback %s %s", r.Host, r.URL.Path)
+	}))
+	defer web.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpPort := freePort(t)
+	// TLS-ALPN-01 连接到没有监听的端口，验证失败
+	directory, client := startPebble(t, httpPort, freePort(t), 0)
+	srv := startACMEServer(t, ln, config.ACMEConfig{
+		Domains:      []string{acmeTestDomain},
+		Dir:          t.TempDir(),
+		DirectoryURL: directory,
+		HTTPListen:   "127.0.0.1:" + strconv.Itoa(httpPort),
+		RenewBefore:  30,
+	}, client)
+	cfg := *srv.config()
+	cfg.Fallback = strings.TrimPrefix(web.URL, "http://")
+	srv.cfg.Store(&cfg)
+
+	waitForIssued(t, ln.Addr().String())
+
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:"+strconv.Itoa(httpPort)+"/index.html", nil)
+	req.Host = "www.example.com"
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request to HTTP port failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "fallback www.example.com /index.html" {
+		t.Errorf("HTTP port served %q, want the fallback site", body)
+	}
+}
+
+// TestACME_Renewal 测试证书进入续期时间后自动续期，新的握手使用续期后的证书，不需要重启
+func TestACME_Renewal(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	// 有效期 10 天，早于 renew_before 的 30 天，取得证书后立即续期
+	directory, client := startPebble(t, freePort(t), ln.Addr().(*net.TCPAddr).Port, 10*24*3600)
+	startACMEServer(t, ln, config.ACMEConfig{
+		Domains:      []string{acmeTestDomain},
+		Dir:          t.TempDir(),
+		DirectoryURL: directory,
+		HTTPListen:   config.ACMEDisabled,
+		RenewBefore:  30,
+	}, client)
+
+	first := waitForIssued(t, addr)
+	waitForDuration(t, "renewed certificate", time.Minute, func() bool {
+		return servedCertificate(t, addr, acmeTestDomain).SerialNumber.Cmp(first.SerialNumber) != 0
+	})
+}
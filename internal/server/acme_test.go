@@ -0,0 +1,151 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/util"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// 不需要 ACME 服务的单元测试；在 pebble 上申请证书的集成测试见 acme_integration_test.go
+
+// TestACMEClient_Config 测试 tls.acme 到 autocert 的映射：未配置域名时不启用，域名按小写匹配，
+// renew_before 按天换算为续期提前量，未配置目录地址时使用 Let's Encrypt
+func TestACMEClient_Config(t *testing.T) {
+	if newACMEClient(config.ACMEConfig{Dir: t.TempDir()}) != nil {
+		t.Error("ACME client should be disabled without domains")
+	}
+	client := newACMEClient(config.ACMEConfig{
+		Domains:     []string{"Node.Example.com"},
+		Dir:         t.TempDir(),
+		RenewBefore: 30,
+	})
+	if client.manager.RenewBefore != 30*24*time.Hour {
+		t.Errorf("RenewBefore = %v, want 720h", client.manager.RenewBefore)
+	}
+	if client.manager.Client.DirectoryURL != autocert.DefaultACMEDirectory {
+		t.Errorf("DirectoryURL = %q, want Let's Encrypt", client.manager.Client.DirectoryURL)
+	}
+	if err := client.manager.HostPolicy(context.Background(), "node.example.com"); err != nil {
+		t.Errorf("configured domain rejected: %v", err)
+	}
+	if err := client.manager.HostPolicy(context.Background(), "other.example.com"); err == nil {
+		t.Error("domain outside tls.acme.domains should be rejected")
+	}
+}
+
+// TestACMEClient_LoadsSavedCertificate 测试从证书目录加载已保存的证书，不需要访问 ACME 服务；
+// 取得证书之前以及不在 domains 中的域名不使用 ACME 证书
+func TestACMEClient_LoadsSavedCertificate(t *testing.T) {
+	dir := t.TempDir()
+	cert, err := util.GenerateKeyPair(time.Now, 90*24*time.Hour, "node.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// autocert 的缓存格式：私钥在前，证书链在后，ECDSA 证书以域名为文件名
+	saved := append(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})...)
+	if err := os.WriteFile(filepath.Join(dir, "node.test"), saved, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newACMEClient(config.ACMEConfig{
+		Domains:      []string{"node.test"},
+		Dir:          dir,
+		DirectoryURL: "https://127.0.0.1:1/dir",
+		RenewBefore:  30,
+	})
+	hello := &tls.ClientHelloInfo{ServerName: "node.test", CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	if client.getCertificate(hello) != nil {
+		t.Error("certificate should not be served before obtain")
+	}
+	if err := client.obtain(); err != nil {
+		t.Fatalf("obtain from the certificate directory failed: %v", err)
+	}
+	got := client.getCertificate(&tls.ClientHelloInfo{ServerName: "NODE.test.", CipherSuites: hello.CipherSuites})
+	if got == nil || got.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatalf("served certificate = %v, want the saved one", got)
+	}
+	if client.getCertificate(&tls.ClientHelloInfo{ServerName: "other.test"}) != nil {
+		t.Error("names outside tls.acme.domains should not get an ACME certificate")
+	}
+}
+
+// TestACMEHTTP_Fallback 测试 HTTP-01 端口：验证路径交给 autocert，其他请求转发到 fallback，
+// 未配置 fallback 时返回 404，http_listen 为 "off" 时不监听
+func TestACMEHTTP_Fallback(t *testing.T) {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "fallback %s %s", r.Host, r.URL.Path)
+	}))
+	defer web.Close()
+
+	newServer := func(httpListen string) *Server {
+		t.Helper()
+		srv, err := NewServer(&config.Config{
+			Standalone: true,
+			Password:   "unused",
+			NodeType:   "anytls",
+			Log:        config.LogConfig{Level: "error"},
+			TLS: config.TLSConfig{ACME: config.ACMEConfig{
+				Domains:      []string{"node.test"},
+				Dir:          t.TempDir(),
+				DirectoryURL: "https://127.0.0.1:1/dir",
+				HTTPListen:   httpListen,
+			}},
+		})
+		if err != nil {
+			t.Fatalf("NewServer failed: %v", err)
+		}
+		if err := srv.startACMEHTTP(); err != nil {
+			t.Fatalf("startACMEHTTP failed: %v", err)
+		}
+		if srv.acmeServer != nil {
+			t.Cleanup(func() { srv.acmeServer.Close() })
+		}
+		return srv
+	}
+	get := func(srv *Server, host, path string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		rec := httptest.NewRecorder()
+		srv.acmeServer.Handler.ServeHTTP(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	if srv := newServer(config.ACMEDisabled); srv.acmeServer != nil {
+		t.Error("http_listen off should not start the HTTP-01 listener")
+	}
+
+	srv := newServer("127.0.0.1:0")
+	if code, _ := get(srv, "www.example.com", "/index.html"); code != http.StatusNotFound {
+		t.Errorf("without fallback: status = %d, want 404", code)
+	}
+	cfg := *srv.config()
+	cfg.Fallback = strings.TrimPrefix(web.URL, "http://")
+	srv.cfg.Store(&cfg)
+	if code, body := get(srv, "www.example.com", "/index.html"); code != http.StatusOK || body != "fallback www.example.com /index.html" {
+		t.Errorf("fallback request = %d %q, want the fallback site", code, body)
+	}
+	// 未知的验证令牌由 autocert 处理，不转发到 fallback
+	if _, body := get(srv, "node.test:80", "/.well-known/acme-challenge/unknown"); strings.HasPrefix(body, "fallback") {
+		t.Errorf("challenge request forwarded to fallback: %q", body)
+	}
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"anytls/internal/admin"
+	"anytls/internal/ledger"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminBackend 将 Server 适配为管理接口的 Backend
+type adminBackend struct {
+	s *Server
+}
+
+func (b adminBackend) OnlineUsers() []admin.OnlineUser {
+	sessions := b.s.sessions.count()
+	online := b.s.aliveTracker.Online()
+	users := make([]admin.OnlineUser, 0, len(online))
+	for userID, ips := range online {
+		users = append(users, admin.OnlineUser{
+			UserID:   userID,
+			IPs:      ips,
+			Sessions: sessions[userID],
+		})
+	}
+	return users
+}
+
+func (b adminBackend) KickUser(userID int) int {
+	closed := b.s.sessions.closeUser(userID, "")
+	b.s.logger.WithFields(logrus.Fields{
+		"user_id":  userID,
+		"sessions": closed,
+	}).Info("管理接口断开用户")
+	return closed
+}
+
+func (b adminBackend) BannedIPs() []admin.BannedIP {
+	banned := b.s.connLimiter.Banned()
+	list := make([]admin.BannedIP, 0, len(banned))
+	for ip, expiresAt := range banned {
+		list = append(list, admin.BannedIP{IP: ip, ExpiresAt: expiresAt})
+	}
+	return list
+}
+
+func (b adminBackend) Unban(ip string) bool {
+	ok := b.s.connLimiter.Unban(ip)
+	if ok {
+		b.s.logger.WithField("ip", ip).Info("管理接口解除封禁")
+	}
+	return ok
+}
+
+func (b adminBackend) Traffic() []admin.UserTraffic {
+	// 待上报流量包括计数器中的流量和已取出但尚未确认的批次
+	pending := b.s.trafficCounter.Pending()
+	for userID, traffic := range b.s.outbox.Pending() {
+		p := pending[userID]
+		pending[userID] = [2]int64{p[0] + traffic[0], p[1] + traffic[1]}
+	}
+	totals := b.s.trafficCounter.Totals()
+	list := make([]admin.UserTraffic, 0, len(totals))
+	for userID, total := range totals {
+		list = append(list, admin.UserTraffic{
+			UserID:          userID,
+			PendingUpload:   pending[userID][0],
+			PendingDownload: pending[userID][1],
+			TotalUpload:     total[0],
+			TotalDownload:   total[1],
+		})
+	}
+	// 从持久化文件恢复、尚无新流量的用户
+	for userID, traffic := range pending {
+		if _, ok := totals[userID]; !ok {
+			list = append(list, admin.UserTraffic{
+				UserID:          userID,
+				PendingUpload:   traffic[0],
+				PendingDownload: traffic[1],
+			})
+		}
+	}
+	return list
+}
+
+func (b adminBackend) Ledger(userID int, from, to string) (admin.LedgerReport, error) {
+	if b.s.ledger == nil {
+		return admin.LedgerReport{}, admin.ErrUnavailable
+	}
+	from, to, entries, err := b.s.queryLedger(userID, from, to)
+	if err != nil {
+		return admin.LedgerReport{}, err
+	}
+	report := admin.LedgerReport{
+		From:    from,
+		To:      to,
+		Entries: make([]admin.LedgerEntry, 0, len(entries)),
+		Totals:  []admin.LedgerTotal{},
+	}
+	for _, e := range entries {
+		report.Entries = append(report.Entries, admin.LedgerEntry(e))
+	}
+	for uid, total := range ledger.Sum(entries) {
+		report.Totals = append(report.Totals, admin.LedgerTotal{UserID: uid, Upload: total[0], Download: total[1]})
+	}
+	sort.Slice(report.Totals, func(i, j int) bool { return report.Totals[i].UserID < report.Totals[j].UserID })
+	return report, nil
+}
+
+func (b adminBackend) Pull() error {
+	if b.s.apiClient == nil {
+		return admin.ErrUnavailable
+	}
+	return b.s.doPull()
+}
+
+func (b adminBackend) Push() error {
+	if b.s.apiClient == nil {
+		return admin.ErrUnavailable
+	}
+	return b.s.doPush()
+}
+
+func (b adminBackend) LogLevel() string {
+	return b.s.logger.GetLevel().String()
+}
+
+func (b adminBackend) SetLogLevel(level string) error {
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("日志级别无效: %s", level)
+	}
+	// handler 中部分调试日志使用 logrus 全局 logger，一并调整
+	b.s.logger.SetLevel(parsed)
+	logrus.SetLevel(parsed)
+	b.s.logger.WithField("level", parsed.String()).Info("管理接口修改日志级别")
+	return nil
+}
+
+// startAdmin 启动管理接口，未配置 admin.listen 时不启动
+func (s *Server) startAdmin() error {
+	cfg := s.config().Admin
+	if cfg.Listen == "" {
+		return nil
+	}
+	ln, err := admin.Listen(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	s.adminServer = &http.Server{
+		Handler:           admin.NewHandler(adminBackend{s}, cfg.Token),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go s.adminServer.Serve(ln)
+	s.logger.WithField("addr", cfg.Listen).Info("管理接口已启动")
+	return nil
+}
@@ -7,9 +7,10 @@ import (
 	"net"
 	"runtime/debug"
 	"strings"
+	"time"
 
+	"anytls/internal/config"
 	"anytls/internal/conn"
-	"anytls/proxy"
 	"anytls/proxy/padding"
 	"anytls/proxy/session"
 
@@ -23,7 +24,7 @@ import (
 )
 
 // handleConnection 处理单个 TLS 连接
-// 流程：IP 封禁检查 → TLS 握手 → 读取密码哈希 → 多用户认证 → 设备限制检查 → 创建 TrafficConn → 建立 Session
+// 流程：IP 封禁检查 → TLS 握手 → 读取密码哈希 → 多用户认证 → 设备限制检查并追踪在线 → 创建 TrafficConn → 建立 Session
 func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 	defer func() {
 		if r := recover(); r != nil {
@@ -38,7 +39,15 @@ func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 		return
 	}
 
-	// 2. TLS 握手
+	// 整个连接使用同一份配置，中途热重载只影响之后的新连接
+	cfg := s.config()
+
+	// 2. TLS 握手，wire 计费模式在 TLS 之下统计，认证成功后再归属到用户
+	var wireConn *conn.CountConn
+	if cfg.Traffic.Accounting == config.AccountingWire {
+		wireConn = conn.NewCountConn(c, 0, s.trafficCounter)
+		c = wireConn
+	}
 	tlsConn := tls.Server(c, s.tlsConfig)
 	defer tlsConn.Close()
 
@@ -57,17 +66,25 @@ func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 	passwordHash, err := b.ReadBytes(32)
 	if err != nil {
 		b.Resize(0, n)
-		s.connLimiter.RecordFailure(remoteIP)
-		s.fallback.Handle(ctx, cachedConn)
+		s.recordAuthFailure(remoteIP)
+		s.handleFallback(ctx, cachedConn)
 		return
 	}
 
 	userEntry := s.userManager.Authenticate(passwordHash)
 	if userEntry == nil {
 		b.Resize(0, n)
-		s.connLimiter.RecordFailure(remoteIP)
+		s.recordAuthFailure(remoteIP)
 		s.logger.WithField("ip", remoteIP).Debug("认证失败")
-		s.fallback.Handle(ctx, cachedConn)
+		s.handleFallback(ctx, cachedConn)
+		return
+	}
+	if s.quotaExceeded(userEntry.ID) {
+		// 流量配额已用完，与认证失败一样交给 fallback，但不计入封禁
+		b.Resize(0, n)
+		s.metrics.auth.Inc("quota_exceeded")
+		s.logger.WithField("user_id", userEntry.ID).Debug("流量配额已用完，拒绝认证")
+		s.handleFallback(ctx, cachedConn)
 		return
 	}
 
@@ -75,8 +92,8 @@ func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 	paddingLenBytes, err := b.ReadBytes(2)
 	if err != nil {
 		b.Resize(0, n)
-		s.connLimiter.RecordFailure(remoteIP)
-		s.fallback.Handle(ctx, cachedConn)
+		s.recordAuthFailure(remoteIP)
+		s.handleFallback(ctx, cachedConn)
 		return
 	}
 	paddingLen := binary.BigEndian.Uint16(paddingLenBytes)
@@ -84,40 +101,42 @@ func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 		_, err = b.ReadBytes(int(paddingLen))
 		if err != nil {
 			b.Resize(0, n)
-			s.connLimiter.RecordFailure(remoteIP)
-			s.fallback.Handle(ctx, cachedConn)
+			s.recordAuthFailure(remoteIP)
+			s.handleFallback(ctx, cachedConn)
 			return
 		}
 	}
 
-	// 6. 检查设备限制（仅 Xboard 模式）
-	if userEntry.DeviceLimit > 0 && s.apiClient != nil {
-		aliveList, err := s.apiClient.FetchAliveList()
-		if err != nil {
-			s.logger.WithError(err).Warn("获取在线设备数失败，跳过设备限制检查")
-		} else if !s.aliveTracker.CheckDeviceLimit(userEntry.ID, userEntry.DeviceLimit, aliveList) {
-			s.logger.WithFields(logrus.Fields{
-				"user_id":      userEntry.ID,
-				"device_limit": userEntry.DeviceLimit,
-			}).Info("设备数超限，拒绝连接")
-			return
-		}
+	// 6. 检查设备限制并追踪在线设备：其他节点的设备按 pull 周期缓存的面板在线数计算，本节点按实时在线 IP 计算
+	if !s.aliveTracker.Acquire(userEntry.ID, userEntry.DeviceLimit, remoteIP) {
+		s.logger.WithFields(logrus.Fields{
+			"user_id":      userEntry.ID,
+			"device_limit": userEntry.DeviceLimit,
+		}).Info("设备数超限，拒绝连接")
+		return
 	}
-
-	// 7. 获取限速器并创建 TrafficConn
-	limiter := s.speedLimiter.GetLimiter(userEntry.ID, userEntry.SpeedLimit)
-	trafficConn := conn.NewTrafficConn(cachedConn, userEntry.ID, s.trafficCounter, limiter)
-
-	// 8. 追踪在线设备
-	s.aliveTracker.Track(userEntry.ID, remoteIP)
 	defer s.aliveTracker.Remove(userEntry.ID, remoteIP)
 
+	// 7. 确保用户限速器存在并创建 TrafficConn，TrafficConn 每次读写时查询当前限速器
+	// 默认的 tls_plaintext 模式由 TrafficConn 统计流量，其他模式只用它限速
+	s.speedLimiter.GetLimiter(userEntry.ID, userEntry.Limits)
+	counter := s.trafficCounter
+	switch cfg.Traffic.Accounting {
+	case config.AccountingWire:
+		wireConn.Bind(userEntry.ID)
+		counter = nil
+	case config.AccountingPayload:
+		counter = nil
+	}
+	trafficConn := conn.NewTrafficConn(ctx, cachedConn, userEntry.ID, counter, s.speedLimiter)
+
+	s.metrics.auth.Inc("success")
 	s.logger.WithFields(logrus.Fields{
 		"user_id": userEntry.ID,
 		"ip":      remoteIP,
 	}).Debug("认证成功，建立会话")
 
-	// 9. 创建并运行 Session
+	// 8. 创建并运行 Session
 	sess := session.NewServerSession(trafficConn, func(stream *session.Stream) {
 		defer func() {
 			if r := recover(); r != nil {
@@ -125,27 +144,87 @@ func (s *Server) handleConnection(ctx context.Context, c net.Conn) {
 			}
 		}()
 		defer stream.Close()
+		s.metrics.streams.Inc()
+		defer s.metrics.streams.Dec()
+
+		// payload 计费模式只统计流中的数据，不含会话帧头和 padding
+		var streamConn net.Conn = stream
+		if cfg.Traffic.Accounting == config.AccountingPayload {
+			streamConn = conn.NewCountConn(stream, userEntry.ID, s.trafficCounter)
+		}
 
-		destination, err := M.SocksaddrSerializer.ReadAddrPort(stream)
+		destination, err := M.SocksaddrSerializer.ReadAddrPort(streamConn)
 		if err != nil {
 			s.logger.Debugln("ReadAddrPort:", err)
 			return
 		}
 
 		if strings.Contains(destination.String(), "udp-over-tcp.arpa") {
-			proxyOutboundUoT(ctx, stream, destination)
+			s.proxyOutboundUoT(ctx, streamConn, userEntry.ID)
 		} else {
-			proxyOutboundTCP(ctx, stream, destination)
+			s.proxyOutboundTCP(ctx, streamConn, destination, userEntry.ID)
 		}
-	}, &padding.DefaultPaddingFactory)
+	}, &padding.DefaultPaddingFactory, sessionOptions(cfg)...)
+	s.metrics.sessions.Inc()
+	defer s.metrics.sessions.Dec()
+	s.sessions.add(userEntry.ID, sess, tlsConn)
+	defer s.sessions.remove(userEntry.ID, sess)
+	// 认证到登记之间用户表可能已更新，登记后再确认一次，避免漏踢
+	if current := s.userManager.GetUser(userEntry.ID); current == nil || current.UUID != userEntry.UUID {
+		return
+	}
 	sess.Run()
 	sess.Close()
 }
 
+// recordAuthFailure 记录认证失败，失败次数超限的 IP 会被封禁
+func (s *Server) recordAuthFailure(remoteIP string) {
+	s.metrics.auth.Inc("failure")
+	if s.connLimiter.RecordFailure(remoteIP) {
+		s.metrics.bans.Inc()
+		s.logger.WithField("ip", remoteIP).Info("认证失败次数过多，已封禁")
+	}
+}
+
+// handleFallback 将认证失败的连接交给 fallback 处理
+func (s *Server) handleFallback(ctx context.Context, c net.Conn) {
+	s.metrics.fallbacks.Inc()
+	s.fallback.Handle(ctx, c)
+}
+
+// sessionOptions 根据配置生成会话选项
+func sessionOptions(cfg *config.Config) []session.Option {
+	var opts []session.Option
+	// stream_window 已在加载配置时校验范围
+	switch {
+	case cfg.StreamWindow == config.StreamWindowDisabled:
+		opts = append(opts, session.WithStreamWindow(0))
+	case cfg.StreamWindow > 0:
+		opts = append(opts, session.WithStreamWindow(uint32(cfg.StreamWindow)))
+	}
+	if cfg.Heartbeat.Interval > 0 {
+		opts = append(opts, session.WithHeartbeat(
+			time.Duration(cfg.Heartbeat.Interval)*time.Second,
+			cfg.Heartbeat.MaxMiss,
+		))
+	}
+	return opts
+}
+
 // proxyOutboundTCP 代理 TCP 出站连接
-func proxyOutboundTCP(ctx context.Context, c net.Conn, destination M.Socksaddr) error {
-	outbound, err := proxy.SystemDialer.DialContext(ctx, "tcp", destination.String())
+func (s *Server) proxyOutboundTCP(ctx context.Context, c net.Conn, destination M.Socksaddr, userID int) error {
+	dialer, err := s.route(N.NetworkTCP, destination, userID)
 	if err != nil {
+		s.metrics.outboundError.Inc(dialErrorReason(err))
+		s.logger.WithFields(logrus.Fields{
+			"user_id":     userID,
+			"destination": destination.String(),
+		}).Debug("路由规则拒绝连接")
+		return E.Errors(err, N.ReportHandshakeFailure(c, err))
+	}
+	outbound, err := dialer.DialContext(ctx, N.NetworkTCP, destination)
+	if err != nil {
+		s.metrics.outboundError.Inc(dialErrorReason(err))
 		logrus.Debugln("proxyOutboundTCP DialContext:", err)
 		err = E.Errors(err, N.ReportHandshakeFailure(c, err))
 		return err
@@ -158,14 +237,25 @@ func proxyOutboundTCP(ctx context.Context, c net.Conn, destination M.Socksaddr)
 }
 
 // proxyOutboundUoT 代理 UDP-over-TCP 出站连接
-func proxyOutboundUoT(ctx context.Context, c net.Conn, destination M.Socksaddr) error {
+// 路由按 UoT 请求中的目标地址匹配
+func (s *Server) proxyOutboundUoT(ctx context.Context, c net.Conn, userID int) error {
 	request, err := uot.ReadRequest(c)
 	if err != nil {
 		logrus.Debugln("proxyOutboundUoT ReadRequest:", err)
 		return err
 	}
-	pc, err := net.ListenPacket("udp", "")
+	dialer, err := s.route(N.NetworkUDP, request.Destination, userID)
+	if err != nil {
+		s.metrics.outboundError.Inc(dialErrorReason(err))
+		s.logger.WithFields(logrus.Fields{
+			"user_id":     userID,
+			"destination": request.Destination.String(),
+		}).Debug("路由规则拒绝连接")
+		return E.Errors(err, N.ReportHandshakeFailure(c, err))
+	}
+	pc, err := dialer.ListenPacket(ctx, request.Destination)
 	if err != nil {
+		s.metrics.outboundError.Inc(dialErrorReason(err))
 		logrus.Debugln("proxyOutboundUoT ListenPacket:", err)
 		err = E.Errors(err, N.ReportHandshakeFailure(c, err))
 		return err
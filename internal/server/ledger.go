@@ -0,0 +1,43 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"anytls/internal/ledger"
+	"anytls/internal/traffic"
+	"anytls/util"
+)
+
+// defaultLedgerFlushInterval 未配置 ledger.flush_interval 时写入账本的间隔
+const defaultLedgerFlushInterval = 60 * time.Second
+
+// recordLedger 将尚未记账的流量写入账本，失败的批次保留待下次写入
+// 独立模式没有面板消费流量，由账本代替 push 周期
+func (s *Server) recordLedger() error {
+	return s.flushOutbox(func(batch traffic.Batch) error {
+		return s.ledger.Record(time.Now(), batch.ID, batch.Data)
+	})
+}
+
+// watchLedger 定期写入流量账本
+func (s *Server) watchLedger(ctx context.Context) {
+	interval := time.Duration(s.config().Ledger.FlushInterval) * time.Second
+	if interval <= 0 {
+		interval = defaultLedgerFlushInterval
+	}
+	util.StartRoutine(ctx, interval, func() {
+		if err := s.recordLedger(); err != nil {
+			s.logger.WithError(err).Error("写入流量账本失败，保留数据待下次写入")
+		}
+	})
+}
+
+// queryLedger 查询账本，未指定的起止日期取当前计费周期
+func (s *Server) queryLedger(userID int, from, to string) (string, string, []ledger.Entry, error) {
+	from, to, err := ledger.ParseRange(from, to, time.Now(), s.config().Ledger.ResetDay)
+	if err != nil {
+		return "", "", nil, err
+	}
+	return from, to, s.ledger.Query(userID, from, to), nil
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"anytls/internal/dns"
+	"anytls/internal/metrics"
+	"anytls/internal/outbound"
+	"anytls/internal/router"
+)
+
+// apiLatencyBuckets 面板 API 请求耗时直方图的桶（秒）
+var apiLatencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// serverMetrics 服务端运行指标
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	sessions      *metrics.Gauge
+	streams       *metrics.Gauge
+	auth          *metrics.CounterVec // result: success, failure, quota_exceeded
+	bans          *metrics.Counter
+	fallbacks     *metrics.Counter
+	outboundError *metrics.CounterVec // reason
+	apiRequests   *metrics.CounterVec // endpoint, result
+	apiLatency    *metrics.HistogramVec
+}
+
+// newServerMetrics 创建指标，流量和封禁数在采集时从计数器读取
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:      r,
+		sessions:      r.NewGauge("anytls_sessions_active", "Number of active sessions."),
+		streams:       r.NewGauge("anytls_streams_active", "Number of active streams."),
+		auth:          r.NewCounterVec("anytls_auth_total", "Authentication attempts by result.", "result"),
+		bans:          r.NewCounter("anytls_bans_total", "Number of IPs banned for repeated authentication failures."),
+		fallbacks:     r.NewCounter("anytls_fallback_total", "Connections handed to the fallback handler."),
+		outboundError: r.NewCounterVec("anytls_outbound_errors_total", "Outbound dial errors by reason.", "reason"),
+		apiRequests:   r.NewCounterVec("anytls_api_requests_total", "Xboard API requests by endpoint and result.", "endpoint", "result"),
+		apiLatency:    r.NewHistogramVec("anytls_api_request_duration_seconds", "Xboard API request latency.", apiLatencyBuckets, "endpoint"),
+	}
+	r.NewGaugeFunc("anytls_banned_ips", "Number of currently banned IPs.", func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(s.connLimiter.BannedCount())}}
+	})
+	r.NewCounterFunc("anytls_user_traffic_bytes_total", "Per-user traffic since process start, same direction convention as reported to the panel.", func() []metrics.Sample {
+		totals := s.trafficCounter.Totals()
+		samples := make([]metrics.Sample, 0, len(totals)*2)
+		for uid, traffic := range totals {
+			id := strconv.Itoa(uid)
+			samples = append(samples,
+				metrics.Sample{LabelValues: []string{id, "upload"}, Value: float64(traffic[0])},
+				metrics.Sample{LabelValues: []string{id, "download"}, Value: float64(traffic[1])},
+			)
+		}
+		return samples
+	}, "user_id", "direction")
+	r.NewGaugeFunc("anytls_traffic_outbox_batches", "Traffic batches waiting to be acknowledged by the panel.", func() []metrics.Sample {
+		batches, _, _ := s.outbox.Stats()
+		return []metrics.Sample{{Value: float64(batches)}}
+	})
+	r.NewGaugeFunc("anytls_traffic_outbox_oldest_age_seconds", "Age of the oldest unacknowledged traffic batch, 0 when the outbox is empty.", func() []metrics.Sample {
+		_, oldest, _ := s.outbox.Stats()
+		if oldest.IsZero() {
+			return []metrics.Sample{{Value: 0}}
+		}
+		return []metrics.Sample{{Value: time.Since(oldest).Seconds()}}
+	})
+	r.NewCounterFunc("anytls_traffic_outbox_coalesced_total", "Traffic batches merged because the outbox exceeded traffic.outbox_max_batches.", func() []metrics.Sample {
+		_, _, coalesced := s.outbox.Stats()
+		return []metrics.Sample{{Value: float64(coalesced)}}
+	})
+	return m
+}
+
+// observeAPIRequest 记录一次面板 API 请求
+func (m *serverMetrics) observeAPIRequest(endpoint string, statusCode int, duration time.Duration, err error) {
+	result := "success"
+	switch {
+	case err != nil:
+		result = "network_error"
+	case statusCode >= 400:
+		result = "http_error"
+	}
+	m.apiRequests.Inc(endpoint, result)
+	m.apiLatency.Observe(duration.Seconds(), endpoint)
+}
+
+// dialErrorReason 将出站错误归类为指标标签
+func dialErrorReason(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, router.ErrRejected):
+		return "rejected"
+	case errors.Is(err, outbound.ErrBlocked):
+		return "blocked"
+	case errors.Is(err, dns.ErrNotFound), errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return "unreachable"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	default:
+		return "other"
+	}
+}
+
+// startMetrics 启动 /metrics HTTP 监听，未配置 metrics.listen 时不启动
+func (s *Server) startMetrics() error {
+	cfg := s.config().Metrics
+	if cfg.Listen == "" {
+		return nil
+	}
+	path := cfg.Path
+	if path == "" {
+		path = "/metrics"
+	}
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(path, s.metrics.registry.Handler())
+	s.metricsServer = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go s.metricsServer.Serve(ln)
+	s.logger.WithField("addr", ln.Addr().String()+path).Info("指标接口已启动")
+	return nil
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"anytls/internal/ledger"
+	"anytls/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// quotaCheckInterval 检查在线用户是否超出流量配额的周期
+const quotaCheckInterval = 5 * time.Second
+
+// alertQuotaExceeded 因超出流量配额断开会话时发送给客户端的 alert 内容
+const alertQuotaExceeded = "traffic quota exceeded"
+
+// quotaState 单个用户的配额
+type quotaState struct {
+	limit    int64 // 可用字节数
+	local    bool  // quota.users 中本地配置的配额，按计费周期累计
+	baseline int64 // 面板下发的配额：设定配额时面板已确认的累计流量
+}
+
+// quotaTracker 节点本地流量配额
+// 面板下发的剩余流量已扣除面板确认过的上报，用量为之后确认的流量加上尚未确认上报的流量；
+// 配额值变化时以当时已确认的累计流量为基线重新累计，配额不变时持续累计
+type quotaTracker struct {
+	mu     sync.Mutex
+	states map[int]quotaState
+	acked  map[int]int64 // 进程启动以来面板已确认的流量（上传 + 下载）
+}
+
+func newQuotaTracker() *quotaTracker {
+	return &quotaTracker{states: make(map[int]quotaState), acked: make(map[int]int64)}
+}
+
+// acknowledge 记录面板已确认的一批流量
+func (q *quotaTracker) acknowledge(data map[int][2]int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for uid, traffic := range data {
+		q.acked[uid] += traffic[0] + traffic[1]
+	}
+}
+
+// acknowledgeTraffic 记录对端已确认的一批流量
+// 计入面板配额的用量；面板模式下同时计入本计费周期的用量文件，供本地配额使用
+func (s *Server) acknowledgeTraffic(data map[int][2]int64) {
+	s.quotas.acknowledge(data)
+	if s.usage == nil {
+		return
+	}
+	period, _ := s.quotaPeriod()
+	if err := s.usage.Add(period, data); err != nil {
+		s.logger.WithError(err).Error("保存配额用量失败")
+	}
+}
+
+// quotaPeriod 返回当前计费周期（ledger.reset_day）的第一天和最后一天，格式为 ledger.DateLayout
+func (s *Server) quotaPeriod() (string, string) {
+	start, end := ledger.Period(time.Now(), s.config().Ledger.ResetDay)
+	return start.Format(ledger.DateLayout), end.AddDate(0, 0, -1).Format(ledger.DateLayout)
+}
+
+// used 返回用户在配额下的用量（上传 + 下载），调用方需持有 s.quotas.mu
+// 都包括尚未确认上报（或尚未记账）的流量，其中含有重启后从持久化文件恢复的流量；
+// 本地配额再加上本计费周期内独立模式已记入账本、面板模式已确认上报的流量，
+// 面板配额再加上设定配额之后面板确认的流量
+func (s *Server) used(userID int, state quotaState) int64 {
+	unreported := s.outbox.Unreported(userID)
+	used := unreported[0] + unreported[1]
+	if !state.local {
+		return used + s.quotas.acked[userID] - state.baseline
+	}
+	from, to := s.quotaPeriod()
+	switch {
+	case s.ledger != nil:
+		total := s.ledger.Total(userID, from, to)
+		used += total[0] + total[1]
+	case s.usage != nil:
+		used += s.usage.Used(from, userID)
+	}
+	return used
+}
+
+// syncQuotas 按当前用户表更新配额，本地配置的配额优先于面板下发的剩余流量
+func (s *Server) syncQuotas() {
+	cfg := s.config()
+	if !cfg.Quota.Enabled {
+		return
+	}
+	users := s.userManager.Users()
+	states := make(map[int]quotaState, len(users))
+
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	for _, entry := range users {
+		if limit, ok := cfg.Quota.Users[entry.ID]; ok {
+			states[entry.ID] = quotaState{limit: limit, local: true}
+			continue
+		}
+		if entry.Quota == nil {
+			continue
+		}
+		limit := *entry.Quota
+		if old, ok := s.quotas.states[entry.ID]; ok && !old.local && old.limit == limit {
+			states[entry.ID] = old
+			continue
+		}
+		states[entry.ID] = quotaState{limit: limit, baseline: s.quotas.acked[entry.ID]}
+	}
+	s.quotas.states = states
+}
+
+// quotaExceeded 判断用户是否已用完流量配额
+func (s *Server) quotaExceeded(userID int) bool {
+	s.quotas.mu.Lock()
+	defer s.quotas.mu.Unlock()
+	state, ok := s.quotas.states[userID]
+	return ok && s.used(userID, state) >= state.limit
+}
+
+// enforceQuotas 断开已用完流量配额的用户的所有会话
+func (s *Server) enforceQuotas() {
+	for userID, sessions := range s.sessions.count() {
+		if sessions == 0 || !s.quotaExceeded(userID) {
+			continue
+		}
+		closed := s.sessions.closeUser(userID, alertQuotaExceeded)
+		s.logger.WithFields(logrus.Fields{
+			"user_id":  userID,
+			"sessions": closed,
+		}).Info("用户流量配额已用完，断开会话")
+	}
+}
+
+// watchQuotas 定期检查在线用户的流量配额
+func (s *Server) watchQuotas(ctx context.Context) {
+	util.StartRoutine(ctx, quotaCheckInterval, s.enforceQuotas)
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"anytls/internal/config"
+	"anytls/internal/ratelimit"
+	"anytls/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// configWatchInterval 检查配置文件变更的间隔
+const configWatchInterval = 5 * time.Second
+
+// reloadState 配置热重载的状态
+type reloadState struct {
+	mu   sync.Mutex // 串行化 ReloadConfig
+	load func() (*config.Config, error)
+}
+
+// SetConfigLoader 设置热重载时读取配置的函数，用于保留命令行参数对配置的覆盖
+// 未设置时重新读取启动时的配置文件
+func (s *Server) SetConfigLoader(load func() (*config.Config, error)) {
+	s.reload.mu.Lock()
+	defer s.reload.mu.Unlock()
+	s.reload.load = load
+}
+
+// ReloadConfig 重新读取并校验配置文件，在不断开现有会话的情况下应用可以热更新的配置：
+// 日志、fallback、TLS 证书、节点带宽、认证失败封禁阈值、流量配额、会话参数和路由规则
+// 需要重新监听或重建状态的配置项发生变化时拒绝整个重新加载，保留当前配置
+func (s *Server) ReloadConfig() error {
+	s.reload.mu.Lock()
+	defer s.reload.mu.Unlock()
+
+	old := s.config()
+	if old.Path == "" && s.reload.load == nil {
+		return fmt.Errorf("未使用配置文件启动，无法重新加载")
+	}
+	var cfg *config.Config
+	var err error
+	if s.reload.load != nil {
+		cfg, err = s.reload.load()
+	} else {
+		cfg, err = config.LoadConfig(old.Path)
+	}
+	if err != nil {
+		return err
+	}
+	if fields := restartOnlyChanges(old, cfg); len(fields) > 0 {
+		return fmt.Errorf("配置项 %s 需要重启服务才能生效（涉及重新监听或重建状态），已拒绝本次重新加载", strings.Join(fields, "、"))
+	}
+
+	// 先准备所有可能失败的部分，任何一步失败都不修改当前配置
+	rules, err := loadRouteRules(cfg.Route.Rules, s.outbounds)
+	if err != nil {
+		return err
+	}
+	var certs *certSet
+	if !reflect.DeepEqual(cfg.TLS, old.TLS) {
+		if certs, err = loadCertSet(cfg.TLS, true, nil); err != nil {
+			return err
+		}
+	}
+	if cfg.Log != old.Log {
+		if err := config.ConfigureLogger(s.logger, cfg.Log); err != nil {
+			return fmt.Errorf("重新配置日志失败: %w", err)
+		}
+		// 与管理接口修改日志级别一致，一并调整 logrus 全局 logger
+		logrus.SetLevel(s.logger.GetLevel())
+	}
+
+	s.cfg.Store(cfg)
+	if certs != nil {
+		s.certs.set.Store(certs)
+	}
+	s.fallback.SetTarget(cfg.Fallback)
+	s.router.Update(rules)
+	if cfg.Bandwidth != old.Bandwidth {
+		s.speedLimiter.SetNodeLimit(ratelimit.Limits{
+			Upload:   cfg.Bandwidth.Upload,
+			Download: cfg.Bandwidth.Download,
+		})
+	}
+	if cfg.AuthBan != old.AuthBan {
+		s.connLimiter.SetLimits(connLimits(cfg.AuthBan))
+	}
+	s.syncQuotas()
+
+	s.logger.WithFields(logrus.Fields{
+		"path":    cfg.Path,
+		"changed": strings.Join(liveChanges(old, cfg), ","),
+	}).Info("配置文件已重新加载")
+	return nil
+}
+
+// connLimits 将认证失败封禁配置转换为限制器阈值
+func connLimits(cfg config.AuthBanConfig) ratelimit.ConnLimits {
+	return ratelimit.ConnLimits{
+		MaxFailures: cfg.MaxFailures,
+		Window:      time.Duration(cfg.Window) * time.Second,
+		BanDuration: time.Duration(cfg.Duration) * time.Second,
+	}
+}
+
+// configField 配置项名称及其在两份配置中是否不同
+type configField struct {
+	name    string
+	changed func(a, b *config.Config) bool
+}
+
+// field 按值比较配置项
+func field[T any](name string, get func(c *config.Config) T) configField {
+	return configField{name, func(a, b *config.Config) bool {
+		return !reflect.DeepEqual(get(a), get(b))
+	}}
+}
+
+// restartOnlyFields 需要重启服务才能生效的配置项
+var restartOnlyFields = []configField{
+	field("listen", func(c *config.Config) string { return c.Listen }),
+	field("metrics", func(c *config.Config) config.MetricsConfig { return c.Metrics }),
+	field("admin", func(c *config.Config) config.AdminConfig { return c.Admin }),
+	field("tls.acme", func(c *config.Config) config.ACMEConfig { return c.TLS.ACME }),
+	field("standalone", func(c *config.Config) bool { return c.Standalone }),
+	field("api_host", func(c *config.Config) string { return c.APIHost }),
+	field("api_token", func(c *config.Config) string { return c.APIToken }),
+	field("node_id", func(c *config.Config) int { return c.NodeID }),
+	field("node_type", func(c *config.Config) string { return c.NodeType }),
+	field("password", func(c *config.Config) string { return c.Password }),
+	field("users_file", func(c *config.Config) string { return c.UsersFile }),
+	field("outbounds", func(c *config.Config) []config.OutboundConfig { return c.Outbounds }),
+	field("dns", func(c *config.Config) config.DNSConfig { return c.DNS }),
+	field("quota.enabled", func(c *config.Config) bool { return c.Quota.Enabled }),
+	field("ledger.path", func(c *config.Config) string { return c.Ledger.Path }),
+	field("ledger.flush_interval", func(c *config.Config) int { return c.Ledger.FlushInterval }),
+	field("traffic.persist_path", func(c *config.Config) string { return c.Traffic.PersistPath }),
+	field("traffic.outbox_max_batches", func(c *config.Config) int { return c.Traffic.OutboxMaxBatches }),
+}
+
+// liveFields 可以热更新的配置项，用于记录本次重新加载修改了哪些配置
+var liveFields = []configField{
+	field("log", func(c *config.Config) config.LogConfig { return c.Log }),
+	field("fallback", func(c *config.Config) string { return c.Fallback }),
+	field("tls", func(c *config.Config) config.TLSConfig { return c.TLS }),
+	field("heartbeat", func(c *config.Config) config.HeartbeatConfig { return c.Heartbeat }),
+	field("kick_alert", func(c *config.Config) bool { return c.KickAlert }),
+	field("stream_window", func(c *config.Config) int { return c.StreamWindow }),
+	field("route", func(c *config.Config) config.RouteConfig { return c.Route }),
+	field("bandwidth", func(c *config.Config) config.BandwidthConfig { return c.Bandwidth }),
+	field("auth_ban", func(c *config.Config) config.AuthBanConfig { return c.AuthBan }),
+	field("quota.users", func(c *config.Config) map[int]int64 { return c.Quota.Users }),
+	field("ledger.reset_day", func(c *config.Config) int { return c.Ledger.ResetDay }),
+	field("traffic.accounting", func(c *config.Config) string { return c.Traffic.Accounting }),
+}
+
+// restartOnlyChanges 返回发生变化的需要重启的配置项
+func restartOnlyChanges(old, cfg *config.Config) []string {
+	return changedFields(restartOnlyFields, old, cfg)
+}
+
+// liveChanges 返回发生变化的可热更新配置项
+func liveChanges(old, cfg *config.Config) []string {
+	return changedFields(liveFields, old, cfg)
+}
+
+func changedFields(fields []configField, old, cfg *config.Config) []string {
+	var names []string
+	for _, f := range fields {
+		if f.changed(old, cfg) {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
+
+// watchConfig 监视配置文件，修改后重新加载，配置文件无效时保留当前配置
+func (s *Server) watchConfig(ctx context.Context) {
+	path := s.config().Path
+	info, err := os.Stat(path)
+	if err != nil {
+		s.logger.WithError(err).Warn("无法监视配置文件，修改后需要发送 SIGHUP 重新加载")
+		return
+	}
+	lastModTime := info.ModTime()
+
+	util.StartRoutine(ctx, configWatchInterval, func() {
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(lastModTime) {
+			return
+		}
+		lastModTime = info.ModTime()
+		if err := s.ReloadConfig(); err != nil {
+			s.logger.WithError(err).Error("重新加载配置文件失败，保留当前配置")
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+
+	"anytls/internal/api"
+	"anytls/internal/config"
+	"anytls/internal/outbound"
+	"anytls/internal/router"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+)
+
+// loadRouteRules 解析路由规则并检查引用的出站是否存在
+func loadRouteRules(configs []config.RouteRule, outbounds *outbound.Manager) ([]*router.Rule, error) {
+	rules, err := router.ParseRules(configs)
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		name := rule.Outbound()
+		if name != router.OutboundReject && outbounds.Get(name) == nil {
+			return nil, fmt.Errorf("路由规则错误: 未知的出站 %q", name)
+		}
+	}
+	return rules, nil
+}
+
+// route 根据路由规则选择出站，未命中时使用默认出站
+func (s *Server) route(network string, destination M.Socksaddr, userID int) (outbound.Outbound, error) {
+	name, matched := s.router.Match(&router.Metadata{
+		Network:     network,
+		Destination: destination,
+		UserID:      userID,
+	})
+	if !matched {
+		return s.outbounds.Default(), nil
+	}
+	if name == router.OutboundReject {
+		return nil, router.ErrRejected
+	}
+	return s.outbounds.Get(name), nil
+}
+
+// applyPanelRoutes 应用面板下发的路由规则，内容未变化时跳过
+func (s *Server) applyPanelRoutes(routes []api.Route) {
+	if s.panelRoutes != nil && reflect.DeepEqual(routes, s.panelRoutes) {
+		return
+	}
+
+	converted, warnings := router.ConvertPanelRoutes(routes)
+	for _, w := range warnings {
+		s.logger.Warn("面板路由: " + w)
+	}
+	rules, err := loadRouteRules(converted.Rules, s.outbounds)
+	if err != nil {
+		s.logger.WithError(err).Error("面板路由规则无效，保留当前规则")
+		return
+	}
+	if s.resolver != nil {
+		if err := s.resolver.UpdatePanelOverrides(converted.DNS); err != nil {
+			s.logger.WithError(err).Error("面板 DNS 路由无效，保留当前规则")
+			return
+		}
+	} else if len(converted.DNS) > 0 {
+		s.logger.Warn("面板路由: 未配置 dns.servers，内置 DNS 未启用，dns 动作已忽略")
+	}
+	s.router.UpdatePanel(rules)
+	s.panelRoutes = routes
+	if s.panelRoutes == nil {
+		s.panelRoutes = []api.Route{}
+	}
+	s.logger.WithFields(logrus.Fields{
+		"routes": len(routes),
+		"rules":  len(rules),
+	}).Info("面板路由规则已更新")
+}
@@ -5,68 +5,164 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 
 	"anytls/internal/alive"
 	"anytls/internal/api"
 	"anytls/internal/config"
+	"anytls/internal/dns"
 	"anytls/internal/fallback"
+	"anytls/internal/ledger"
+	"anytls/internal/outbound"
 	"anytls/internal/ratelimit"
+	"anytls/internal/router"
 	"anytls/internal/traffic"
 	"anytls/internal/user"
+	"anytls/util"
 
 	"github.com/sirupsen/logrus"
 )
 
-const trafficPersistPath = "/tmp/anytls-traffic.json"
+// legacyTrafficPersistPath 旧版本固定使用的流量持久化文件，启动时迁移到 traffic.persist_path
+const legacyTrafficPersistPath = "/tmp/anytls-traffic.json"
 
 // Server 主服务
 type Server struct {
-	config         *config.Config
+	// cfg 当前生效的配置，热重载时整体替换，通过 config() 读取
+	cfg            atomic.Pointer[config.Config]
 	apiClient      *api.Client
 	userManager    *user.Manager
 	trafficCounter *traffic.Counter
+	outbox         *traffic.Outbox // 待上报流量的发件箱，持久化在 traffic.persist_path
+	usage          *traffic.Usage  // Xboard 模式下本计费周期已确认上报的流量，保存在 <traffic.persist_path>.quota
 	speedLimiter   *ratelimit.SpeedLimiter
 	connLimiter    *ratelimit.ConnRateLimiter
 	aliveTracker   *alive.Tracker
 	fallback       *fallback.Handler
+	outbounds      *outbound.Manager
+	router         *router.Router
+	resolver       *dns.Resolver  // 内置 DNS，未配置时为 nil（使用系统 DNS）
+	ledger         *ledger.Ledger // 独立模式的流量账本，未配置时为 nil
 	tlsConfig      *tls.Config
+	certs          *certStore // tlsConfig 使用的证书，热重载时整体替换
 	listener       net.Listener
 	logger         *logrus.Logger
+	metrics        *serverMetrics
+	metricsServer  *http.Server
+	adminServer    *http.Server
+	acmeServer     *http.Server // ACME HTTP-01 验证端口，未启用时为 nil
+	sessions       *sessionRegistry
+	quotas         *quotaTracker
+	usersFile      usersFileState
+	reload         reloadState
+	background     backgroundState
+	handoff        *Handoff // 平滑升级时从旧进程继承的状态，不是由升级启动时为 nil
 
 	// nodeConfig stores the config fetched from API (server_port, intervals, etc.)
 	nodeConfig *api.NodeConfig
+	// panelRoutes 最近一次应用的面板路由，由 syncMu 保护
+	panelRoutes []api.Route
+	// syncMu 串行化 doPull/doPush（syncLoop 与管理接口可能同时触发）
+	syncMu sync.Mutex
 
 	wg sync.WaitGroup // tracks active connections
 }
 
+// config 返回当前生效的配置，调用方不应修改返回值
+// 同一个连接或周期内多次读取时应先保存返回值，避免中途热重载导致前后不一致
+func (s *Server) config() *config.Config {
+	return s.cfg.Load()
+}
+
 // NewServer 创建服务实例
 func NewServer(cfg *config.Config) (*Server, error) {
 	logger, err := config.SetupLogger(cfg.Log)
 	if err != nil {
 		return nil, fmt.Errorf("初始化日志失败: %w", err)
 	}
+	// handler 和 session 中部分调试日志使用 logrus 全局 logger，与 s.logger 保持同一级别
+	logrus.SetLevel(logger.GetLevel())
 
-	tlsCfg, err := LoadTLSConfig(cfg)
+	tlsCfg, certs, err := newCertStore(cfg.TLS)
 	if err != nil {
 		return nil, fmt.Errorf("加载 TLS 配置失败: %w", err)
 	}
 
+	resolver, err := dns.NewResolver(cfg.DNS)
+	if err != nil {
+		return nil, err
+	}
+
+	outbounds, err := outbound.NewManager(cfg.Outbounds, resolver)
+	if err != nil {
+		return nil, err
+	}
+
+	rules, err := loadRouteRules(cfg.Route.Rules, outbounds)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &Server{
-		config:         cfg,
 		userManager:    user.NewManager(),
 		trafficCounter: traffic.NewCounter(),
 		speedLimiter:   ratelimit.NewSpeedLimiter(),
 		connLimiter:    ratelimit.NewConnRateLimiter(),
 		aliveTracker:   alive.NewTracker(cfg.NodeID),
 		fallback:       fallback.NewHandler(cfg.Fallback),
+		outbounds:      outbounds,
+		router:         router.NewRouter(rules),
+		resolver:       resolver,
 		tlsConfig:      tlsCfg,
+		certs:          certs,
 		logger:         logger,
+		sessions:       newSessionRegistry(),
+		quotas:         newQuotaTracker(),
+	}
+
+	s.cfg.Store(cfg)
+
+	// 恢复未上报的流量和未确认的批次
+	if s.outbox, err = traffic.OpenOutbox(cfg.Traffic.PersistPath, s.trafficCounter, cfg.Traffic.OutboxMaxBatches); err != nil {
+		return nil, err
+	}
+	s.migrateLegacyTraffic()
+	// Xboard 模式下本地配额的用量；独立模式使用流量账本
+	if !cfg.Standalone {
+		usagePath := ""
+		if cfg.Traffic.PersistPath != "" {
+			usagePath = cfg.Traffic.PersistPath + ".quota"
+		}
+		if s.usage, err = traffic.OpenUsage(usagePath); err != nil {
+			return nil, err
+		}
+	}
+
+	s.speedLimiter.SetNodeLimit(ratelimit.Limits{
+		Upload:   cfg.Bandwidth.Upload,
+		Download: cfg.Bandwidth.Download,
+	})
+	s.connLimiter.SetLimits(connLimits(cfg.AuthBan))
+	s.metrics = newServerMetrics(s)
+
+	// 独立模式的流量账本；Xboard 模式下流量由面板记账
+	if cfg.Ledger.Path != "" {
+		if cfg.Standalone {
+			if s.ledger, err = ledger.Open(cfg.Ledger.Path); err != nil {
+				return nil, err
+			}
+		} else {
+			logger.Warn("ledger 仅在独立模式下生效，已忽略")
+		}
 	}
 
 	// Xboard 模式才创建 API 客户端
 	if !cfg.Standalone {
 		s.apiClient = api.NewClient(cfg.APIHost, cfg.APIToken, cfg.NodeID, cfg.NodeType, logger)
+		s.apiClient.SetRequestObserver(s.metrics.observeAPIRequest)
 	}
 
 	return s, nil
@@ -74,16 +170,24 @@ func NewServer(cfg *config.Config) (*Server, error) {
 
 // Start 启动服务
 // Xboard 模式：FetchConfig → FetchUsers → 启动 listener → 启动 syncLoop → accept loop
-// Standalone 模式：加载本地密码用户 → 启动 listener → accept loop
+// Standalone 模式：加载用户文件或本地密码用户 → 启动 listener → accept loop
 func (s *Server) Start(ctx context.Context) error {
-	listenAddr := s.config.Listen
-
-	if s.config.Standalone {
-		// 独立模式：用本地密码创建单用户
-		s.userManager.UpdateUsers([]api.User{
-			{ID: 1, UUID: s.config.Password},
-		})
-		s.logger.Info("独立模式启动，已加载本地密码用户")
+	listenAddr := s.config().Listen
+
+	if s.config().Standalone {
+		if s.config().UsersFile != "" {
+			// 独立模式：从本地用户文件加载多用户
+			if err := s.ReloadUsers(); err != nil {
+				return fmt.Errorf("加载用户文件失败: %w", err)
+			}
+			s.logger.Info("独立模式启动，已加载用户文件")
+		} else {
+			// 独立模式：用本地密码创建单用户
+			s.applyUsers([]api.User{
+				{ID: 1, UUID: s.config().Password},
+			})
+			s.logger.Info("独立模式启动，已加载本地密码用户")
+		}
 	} else {
 		// Xboard 模式：从 API 获取配置和用户
 		nodeConfig, err := s.apiClient.FetchConfig()
@@ -96,15 +200,17 @@ func (s *Server) Start(ctx context.Context) error {
 			"push_interval": nodeConfig.BaseConfig.PushInterval,
 			"pull_interval": nodeConfig.BaseConfig.PullInterval,
 		}).Info("节点配置已加载")
+		s.applyPanelRoutes(nodeConfig.Routes)
 
 		users, err := s.apiClient.FetchUsers()
 		if err != nil {
 			return fmt.Errorf("拉取用户列表失败: %w", err)
 		}
 		if users != nil {
-			s.userManager.UpdateUsers(users)
+			s.applyUsers(users)
 			s.logger.WithField("count", len(users)).Info("用户列表已加载")
 		}
+		s.fetchAliveList()
 
 		// API 返回的 server_port 优先
 		if nodeConfig.ServerPort > 0 {
@@ -118,21 +224,37 @@ func (s *Server) Start(ctx context.Context) error {
 		}
 	}
 
-	// 启动 TCP listener
-	ln, err := net.Listen("tcp", listenAddr)
-	if err != nil {
-		return fmt.Errorf("监听 %s 失败: %w", listenAddr, err)
+	if err := s.startMetrics(); err != nil {
+		return fmt.Errorf("启动指标接口失败: %w", err)
+	}
+	if err := s.startAdmin(); err != nil {
+		return fmt.Errorf("启动管理接口失败: %w", err)
+	}
+	if err := s.startACMEHTTP(); err != nil {
+		return fmt.Errorf("启动 ACME HTTP-01 验证端口失败: %w", err)
 	}
-	s.listener = ln
-	s.logger.WithField("addr", listenAddr).Info("服务已启动")
 
-	// Xboard 模式启动 syncLoop
-	if !s.config.Standalone {
-		s.wg.Add(1)
-		go func() {
-			defer s.wg.Done()
-			s.syncLoop(ctx)
-		}()
+	// 启动 TCP listener，平滑升级时使用从旧进程继承的 listener
+	ln := s.listener
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", listenAddr); err != nil {
+			return fmt.Errorf("监听 %s 失败: %w", listenAddr, err)
+		}
+		s.listener = ln
+		s.logger.WithField("addr", listenAddr).Info("服务已启动")
+	} else {
+		s.logger.WithField("addr", ln.Addr().String()).Info("服务已启动，已接管旧进程的 listener")
+	}
+
+	s.startBackground(ctx)
+
+	if s.handoff != nil {
+		go s.finishHandoff(s.handoff)
+	}
+	// Type=notify 的 systemd 服务：通知已就绪，升级时同时把主进程切换为当前进程
+	if err := util.SdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid())); err != nil {
+		s.logger.WithError(err).Warn("通知 systemd 失败")
 	}
 
 	// Accept loop
@@ -158,9 +280,70 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
-// LoadTrafficData 从持久化文件加载流量数据
-func (s *Server) LoadTrafficData(path string) error {
-	return s.trafficCounter.LoadFromFile(path)
+// startBackground 启动周期任务，平滑升级交出状态时通过 stopBackground 停止
+func (s *Server) startBackground(parent context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	s.background.mu.Lock()
+	s.background.parent, s.background.cancel = parent, cancel
+	s.background.mu.Unlock()
+
+	// Xboard 模式启动 syncLoop
+	if !s.config().Standalone {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.syncLoop(ctx)
+		}()
+	}
+
+	// 在线用户超出流量配额时断开会话，新连接在认证时拒绝
+	if s.config().Quota.Enabled {
+		s.watchQuotas(ctx)
+	}
+
+	// 用户文件热重载
+	if s.config().Standalone && s.config().UsersFile != "" {
+		s.watchUsersFile(ctx)
+	}
+
+	// 独立模式定期写入流量账本
+	if s.ledger != nil {
+		s.watchLedger(ctx)
+	}
+
+	// 配置文件热重载
+	if s.config().Path != "" {
+		s.watchConfig(ctx)
+	}
+
+	// 证书文件修改后（如 acme.sh 续期）自动重新加载
+	s.watchCertificates(ctx)
+
+	// 内置 ACME 客户端申请证书，续期由 autocert 完成
+	if s.certs.acme != nil {
+		s.watchACME(ctx)
+	}
+}
+
+// migrateLegacyTraffic 将旧版本 /tmp 下的流量持久化文件合并到当前持久化文件
+func (s *Server) migrateLegacyTraffic() {
+	path := s.config().Traffic.PersistPath
+	if path == "" || path == legacyTrafficPersistPath {
+		return
+	}
+	if _, err := os.Stat(legacyTrafficPersistPath); err != nil {
+		return
+	}
+	if err := s.trafficCounter.LoadFromFile(legacyTrafficPersistPath); err != nil {
+		s.logger.WithError(err).Warn("加载旧版流量持久化文件失败")
+		return
+	}
+	if err := s.outbox.Save(); err != nil {
+		s.logger.WithError(err).Warn("迁移旧版流量持久化文件失败")
+		return
+	}
+	os.Remove(legacyTrafficPersistPath)
+	s.logger.WithField("path", path).Info("已迁移旧版流量持久化文件")
 }
 
 // Shutdown 优雅关闭
@@ -171,24 +354,40 @@ func (s *Server) Shutdown(ctx context.Context) error {
 	if s.listener != nil {
 		s.listener.Close()
 	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if s.acmeServer != nil {
+		s.acmeServer.Close()
+	}
 
-	// 2. Xboard 模式：快照流量并上报
-	if !s.config.Standalone {
-		snapshot := s.trafficCounter.Snapshot()
-		if len(snapshot) > 0 {
-			if err := s.apiClient.PushTraffic(snapshot); err != nil {
-				s.logger.WithError(err).Error("关闭时上报流量失败")
-				s.trafficCounter.Merge(snapshot)
-			} else {
-				s.logger.WithField("users", len(snapshot)).Info("关闭时流量已上报")
-			}
+	// 2. Xboard 模式：上报流量，失败的批次保留在预写日志中，下次启动后上报
+	if !s.config().Standalone {
+		if err := s.flushOutbox(s.pushTrafficBatch); err != nil {
+			s.logger.WithError(err).Error("关闭时上报流量失败")
+		} else {
+			s.logger.Info("关闭时流量已上报")
 		}
 	}
 
-	// 3. 持久化未上报的流量数据
-	if err := s.trafficCounter.SaveToFile(trafficPersistPath); err != nil {
+	// 独立模式：写入流量账本
+	if s.ledger != nil {
+		if err := s.recordLedger(); err != nil {
+			s.logger.WithError(err).Error("关闭时写入流量账本失败")
+		}
+	}
+
+	// 3. 持久化未上报（或未记账）的流量数据
+	if err := s.outbox.Save(); err != nil {
 		s.logger.WithError(err).Error("持久化流量数据失败")
 	}
+	s.outbox.Close()
+	if s.ledger != nil {
+		s.ledger.Close()
+	}
 
 	// 4. 等待现有连接完成（受 ctx 超时控制）
 	done := make(chan struct{})
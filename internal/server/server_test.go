@@ -2,17 +2,42 @@ package server
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"anytls/internal/admin"
 	"anytls/internal/api"
 	"anytls/internal/config"
+	"anytls/internal/ledger"
+	"anytls/internal/ratelimit"
+	"anytls/internal/traffic"
+	"anytls/proxy/padding"
+	"anytls/proxy/session"
+	"anytls/util"
+
+	M "github.com/sagernet/sing/common/metadata"
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
 )
 
 // Feature: anytls-xboard-integration, 11.6 集成测试
@@ -30,6 +55,7 @@ type mockXboard struct {
 	lastTraffic    map[string][2]int64
 	lastAlive      map[string][]string
 	users          []api.User
+	alive          map[string]int // alivelist 返回的全局在线设备数
 }
 
 func newMockXboard(users []api.User) *mockXboard {
@@ -75,8 +101,12 @@ func (m *mockXboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	case path == "/api/v1/server/UniProxy/alivelist" && r.Method == "GET":
 		m.aliveListCalls++
+		alive := m.alive
+		if alive == nil {
+			alive = map[string]int{}
+		}
 		json.NewEncoder(w).Encode(map[string]interface{}{
-			"alive": map[string]int{},
+			"alive": alive,
 		})
 
 	case path == "/api/v1/server/UniProxy/status" && r.Method == "POST":
@@ -454,3 +484,1177 @@ func TestIntegration_SyncLoopPullPush(t *testing.T) {
 
 	fmt.Println("syncLoop integration test passed")
 }
+
+// TestIntegration_MetricsEndpoint 测试指标接口：启动后可以抓取到会话、API 请求和流量指标
+func TestIntegration_MetricsEndpoint(t *testing.T) {
+	mock := newMockXboard(nil)
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	cfg := &config.Config{
+		Listen:   "127.0.0.1:0",
+		APIHost:  ts.URL,
+		APIToken: "test-token",
+		NodeID:   1,
+		NodeType: "anytls",
+		Log:      config.LogConfig{Level: "error"},
+		Metrics:  config.MetricsConfig{Listen: "127.0.0.1:0"},
+	}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	if err := srv.startMetrics(); err != nil {
+		t.Fatalf("startMetrics failed: %v", err)
+	}
+	defer srv.metricsServer.Close()
+
+	if _, err := srv.apiClient.FetchConfig(); err != nil {
+		t.Fatalf("FetchConfig failed: %v", err)
+	}
+	if _, err := srv.apiClient.FetchUsers(); err != nil {
+		t.Fatalf("FetchUsers failed: %v", err)
+	}
+	srv.trafficCounter.Add(7, 100, 200)
+	srv.recordAuthFailure("192.0.2.1")
+
+	body := scrapeMetrics(t, srv)
+	for _, want := range []string{
+		"anytls_sessions_active 0\n",
+		`anytls_auth_total{result="failure"} 1`,
+		`anytls_api_requests_total{endpoint="config",result="success"} 1`,
+		`anytls_api_request_duration_seconds_count{endpoint="user"} 1`,
+		`anytls_user_traffic_bytes_total{user_id="7",direction="download"} 200`,
+		"anytls_banned_ips 0\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
+
+// scrapeMetrics 通过 HTTP 抓取指标
+func scrapeMetrics(t *testing.T, srv *Server) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	srv.metricsServer.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("metrics status = %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+// newStandaloneServer 创建独立模式服务并加载给定用户，连接直接交给 handleConnection 处理
+// 返回服务实例和监听地址
+func newStandaloneServer(t *testing.T, users []api.User) (*Server, string) {
+	t.Helper()
+	srv, err := NewServer(&config.Config{
+		Listen:     "127.0.0.1:0",
+		Standalone: true,
+		Password:   "unused",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.userManager.UpdateUsers(users)
+	return srv, serveConnections(t, srv)
+}
+
+// serveConnections 在本地端口接受连接并直接交给 handleConnection 处理，返回监听地址
+func serveConnections(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		ln.Close()
+	})
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handleConnection(ctx, c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialSession 使用密码认证并建立客户端会话
+func dialSession(t *testing.T, addr, password string) *session.Session {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("tls.Dial failed: %v", err)
+	}
+	sum := sha256.Sum256([]byte(password))
+	// 密码哈希 + 长度为 0 的 padding
+	if _, err := c.Write(append(sum[:], 0, 0)); err != nil {
+		t.Fatalf("write auth failed: %v", err)
+	}
+	sess := session.NewClientSession(c, &padding.DefaultPaddingFactory)
+	sess.Run()
+	t.Cleanup(func() { sess.Close() })
+	return sess
+}
+
+// waitFor 轮询等待条件成立
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	waitForDuration(t, what, 5*time.Second, cond)
+}
+
+// waitForDuration 轮询等待条件成立，最多等待 timeout
+func waitForDuration(t *testing.T, what string, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestAdmin_KickUser 测试管理接口断开用户：只关闭该用户的会话
+func TestAdmin_KickUser(t *testing.T) {
+	srv, addr := newStandaloneServer(t, []api.User{
+		{ID: 1, UUID: "kick-user-1"},
+		{ID: 2, UUID: "kick-user-2"},
+	})
+	a := dialSession(t, addr, "kick-user-1")
+	b := dialSession(t, addr, "kick-user-1")
+	c := dialSession(t, addr, "kick-user-2")
+	waitFor(t, "sessions registered", func() bool {
+		counts := srv.sessions.count()
+		return counts[1] == 2 && counts[2] == 1
+	})
+
+	users := adminBackend{srv}.OnlineUsers()
+	if len(users) != 2 {
+		t.Fatalf("online users = %+v, want 2 users", users)
+	}
+
+	if closed := (adminBackend{srv}).KickUser(1); closed != 2 {
+		t.Errorf("KickUser closed %d sessions, want 2", closed)
+	}
+	waitFor(t, "client sessions closed", func() bool {
+		return a.IsClosed() && b.IsClosed()
+	})
+	waitFor(t, "sessions unregistered", func() bool {
+		_, ok := srv.sessions.count()[1]
+		return !ok
+	})
+	if c.IsClosed() || srv.sessions.count()[2] != 1 {
+		t.Error("session of user 2 should stay open")
+	}
+}
+
+// TestApplyUsers_KickRemovedAndChanged 测试用户同步后断开已移除和 UUID 变更用户的会话
+func TestApplyUsers_KickRemovedAndChanged(t *testing.T) {
+	alerts := logtest.NewGlobal()
+	defer alerts.Reset()
+
+	srv, addr := newStandaloneServer(t, []api.User{
+		{ID: 1, UUID: "sync-user-1"},
+		{ID: 2, UUID: "sync-user-2"},
+		{ID: 3, UUID: "sync-user-3"},
+	})
+	srv.config().KickAlert = true
+
+	removed := dialSession(t, addr, "sync-user-1")
+	changed := dialSession(t, addr, "sync-user-2")
+	kept := dialSession(t, addr, "sync-user-3")
+	waitFor(t, "sessions registered", func() bool {
+		return len(srv.sessions.count()) == 3
+	})
+
+	srv.applyUsers([]api.User{
+		{ID: 2, UUID: "sync-user-2-reset"},
+		{ID: 3, UUID: "sync-user-3"},
+	})
+	waitFor(t, "sessions of removed and changed users closed", func() bool {
+		return removed.IsClosed() && changed.IsClosed()
+	})
+	waitFor(t, "sessions unregistered", func() bool {
+		return len(srv.sessions.count()) == 1
+	})
+	if kept.IsClosed() {
+		t.Error("session of unchanged user should stay open")
+	}
+
+	var messages []string
+	for _, entry := range alerts.AllEntries() {
+		messages = append(messages, entry.Message)
+	}
+	for _, want := range []string{alertUserRemoved, alertUserUUIDChanged} {
+		if !strings.Contains(strings.Join(messages, "\n"), want) {
+			t.Errorf("client did not receive alert %q, got %q", want, messages)
+		}
+	}
+
+	// 旧 UUID 不能再认证
+	reconnect := dialSession(t, addr, "sync-user-2")
+	stream, err := reconnect.OpenStream()
+	if err == nil {
+		stream.Write([]byte{0})
+	}
+	waitFor(t, "old UUID rejected", reconnect.IsClosed)
+}
+
+// TestApplyUsers_SpeedLimit 测试用户同步后限速变更立即生效、已移除用户释放限速器
+func TestApplyUsers_SpeedLimit(t *testing.T) {
+	srv, addr := newStandaloneServer(t, nil)
+	ten, twenty, zero := 10, 20, 0
+	srv.applyUsers([]api.User{
+		{ID: 1, UUID: "limit-user-1", SpeedLimit: &ten},
+		{ID: 2, UUID: "limit-user-2", SpeedLimit: &ten},
+		{ID: 3, UUID: "limit-user-3", SpeedLimit: &zero},
+	})
+	sess := dialSession(t, addr, "limit-user-1")
+	waitFor(t, "session registered", func() bool {
+		return srv.sessions.count()[1] == 1
+	})
+	limiter := srv.speedLimiter.Limiter(1)
+	if limiter == nil {
+		t.Fatal("expected limiter for user 1 after connect")
+	}
+
+	srv.applyUsers([]api.User{
+		{ID: 1, UUID: "limit-user-1", SpeedLimit: &twenty},
+		{ID: 3, UUID: "limit-user-3", SpeedLimit: &ten},
+	})
+	// 已有会话使用的限速器被原地更新
+	if srv.speedLimiter.Limiter(1) != limiter || limiter.Download().Limit() != 20*125000 {
+		t.Errorf("user 1 limit = %v, want 20 Mbps", limiter.Download().Limit())
+	}
+	if sess.IsClosed() {
+		t.Error("speed limit change should not close the session")
+	}
+	if srv.speedLimiter.Limiter(2) != nil {
+		t.Error("limiter of removed user 2 should be released")
+	}
+	if l := srv.speedLimiter.Limiter(3); l == nil || l.Upload().Limit() != 10*125000 {
+		t.Errorf("user 3 limiter = %+v, want 10 Mbps", l)
+	}
+}
+
+// TestQuota_RefuseAndKick 测试流量配额：用完后断开在线会话、拒绝新认证，面板更新剩余流量后恢复
+func TestQuota_RefuseAndKick(t *testing.T) {
+	srv, addr := newStandaloneServer(t, nil)
+	srv.config().Quota = config.QuotaConfig{Enabled: true, Users: map[int]int64{2: 500}}
+	transfer, used := int64(3000), int64(1000)
+	srv.applyUsers([]api.User{
+		{ID: 1, UUID: "quota-user-1", TransferEnable: &transfer, U: &used},
+		{ID: 2, UUID: "quota-user-2"},
+		{ID: 3, UUID: "quota-user-3"},
+	})
+	a := dialSession(t, addr, "quota-user-1")
+	b := dialSession(t, addr, "quota-user-2")
+	c := dialSession(t, addr, "quota-user-3")
+	waitFor(t, "sessions registered", func() bool {
+		counts := srv.sessions.count()
+		return counts[1] == 1 && counts[2] == 1 && counts[3] == 1
+	})
+
+	// 用户 1 剩余 2000 字节，用户 2 本地配额 500 字节，用户 3 不限
+	srv.trafficCounter.Add(1, 1000, 500)
+	srv.trafficCounter.Add(2, 300, 300)
+	srv.trafficCounter.Add(3, 1<<30, 1<<30)
+	srv.enforceQuotas()
+	waitFor(t, "session of user 2 closed", b.IsClosed)
+	if a.IsClosed() || c.IsClosed() {
+		t.Error("sessions of users within quota should stay open")
+	}
+
+	srv.trafficCounter.Add(1, 500, 0)
+	srv.enforceQuotas()
+	waitFor(t, "session of user 1 closed", a.IsClosed)
+
+	// 新连接交给 fallback，不建立会话
+	dialSession(t, addr, "quota-user-1")
+	waitFor(t, "quota refusal counted", func() bool {
+		return srv.metrics.auth.Value("quota_exceeded") == 1
+	})
+	if srv.sessions.count()[1] != 0 {
+		t.Error("user 1 should not get a session after exhausting the quota")
+	}
+
+	// 面板扣除已上报流量并增加总流量后，按新的剩余流量重新计算
+	transfer, used = 10000, 3000
+	srv.applyUsers([]api.User{
+		{ID: 1, UUID: "quota-user-1", TransferEnable: &transfer, U: &used},
+		{ID: 2, UUID: "quota-user-2"},
+		{ID: 3, UUID: "quota-user-3"},
+	})
+	if srv.quotaExceeded(1) {
+		t.Error("user 1 should be within the new quota")
+	}
+	if !srv.quotaExceeded(2) {
+		t.Error("local quota of user 2 should keep accumulating across user syncs")
+	}
+}
+
+// TestQuota_UnpushedTrafficCounts 测试面板扣除已上报流量后，上报之后产生、尚未上报的流量仍计入配额
+func TestQuota_UnpushedTrafficCounts(t *testing.T) {
+	srv, _ := newStandaloneServer(t, nil)
+	srv.config().Quota = config.QuotaConfig{Enabled: true}
+	pull := func(remaining int64) {
+		t.Helper()
+		transfer, used := int64(20000), 20000-remaining
+		srv.applyUsers([]api.User{{ID: 1, UUID: "quota-user", TransferEnable: &transfer, U: &used}})
+	}
+	push := func() {
+		t.Helper()
+		if err := srv.flushOutbox(func(traffic.Batch) error { return nil }); err != nil {
+			t.Fatalf("flushOutbox failed: %v", err)
+		}
+	}
+
+	pull(10000)
+	srv.trafficCounter.Add(1, 3000, 0)
+	push()
+	// 上报之后继续产生流量，面板在下一次 pull 时只扣除已上报的 3000 字节
+	srv.trafficCounter.Add(1, 4000, 0)
+	pull(7000)
+	if srv.quotaExceeded(1) {
+		t.Fatal("4000 of 7000 bytes used, quota should not be exceeded yet")
+	}
+	srv.trafficCounter.Add(1, 0, 3000)
+	if !srv.quotaExceeded(1) {
+		t.Error("traffic counted before the pull but not yet pushed should still count against the quota")
+	}
+
+	// 上报后面板尚未扣除时，剩余流量不变，用量不会因上报而减少
+	push()
+	if !srv.quotaExceeded(1) {
+		t.Error("pushing should not forgive usage before the panel subtracts it")
+	}
+	pull(0)
+	if !srv.quotaExceeded(1) {
+		t.Error("quota should stay exceeded once the panel subtracts the usage")
+	}
+}
+
+// TestQuota_LocalPersistsAcrossRestart 测试本地配额的用量在重启后保留：独立模式来自流量账本，
+// Xboard 模式来自 traffic.persist_path 旁的用量文件；上一个计费周期的流量不计入
+func TestQuota_LocalPersistsAcrossRestart(t *testing.T) {
+	for _, standalone := range []bool{true, false} {
+		name := "xboard"
+		if standalone {
+			name = "standalone"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := config.Config{
+				Standalone: standalone,
+				Password:   "unused",
+				APIHost:    "http://127.0.0.1:1",
+				APIToken:   "token",
+				NodeID:     1,
+				NodeType:   "anytls",
+				Log:        config.LogConfig{Level: "error"},
+				Quota:      config.QuotaConfig{Enabled: true, Users: map[int]int64{1: 1000}},
+				Traffic:    config.TrafficConfig{PersistPath: filepath.Join(dir, "traffic.json")},
+			}
+			if standalone {
+				cfg.Ledger.Path = filepath.Join(dir, "ledger.jsonl")
+				// 上个计费周期的流量
+				l, err := ledger.Open(cfg.Ledger.Path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				start, _ := ledger.Period(time.Now(), 1)
+				l.Record(start.AddDate(0, 0, -1), 0, map[int][2]int64{1: {5000, 0}})
+				l.Close()
+			}
+			start := func() *Server {
+				t.Helper()
+				c := cfg
+				srv, err := NewServer(&c)
+				if err != nil {
+					t.Fatalf("NewServer failed: %v", err)
+				}
+				srv.applyUsers([]api.User{{ID: 1, UUID: "quota-user"}})
+				return srv
+			}
+			stop := func(srv *Server) {
+				srv.outbox.Save()
+				srv.outbox.Close()
+				if srv.ledger != nil {
+					srv.ledger.Close()
+				}
+			}
+
+			srv := start()
+			if srv.quotaExceeded(1) {
+				t.Fatal("traffic of the previous period should not count")
+			}
+			srv.trafficCounter.Add(1, 400, 300)
+			if err := srv.flushOutbox(func(batch traffic.Batch) error {
+				if srv.ledger != nil {
+					return srv.ledger.Record(time.Now(), batch.ID, batch.Data)
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("flushOutbox failed: %v", err)
+			}
+			// 尚未上报的流量保存在持久化文件中
+			srv.trafficCounter.Add(1, 100, 0)
+			stop(srv)
+
+			srv = start()
+			defer stop(srv)
+			if srv.quotaExceeded(1) {
+				t.Fatal("800 of 1000 bytes used, quota should not be exceeded yet")
+			}
+			srv.trafficCounter.Add(1, 0, 200)
+			if !srv.quotaExceeded(1) {
+				t.Error("usage before the restart should still count against the local quota")
+			}
+		})
+	}
+}
+
+// TestUsersFile_Reload 测试独立模式用户文件：加载多用户、修改后重新加载、到期用户被移除
+func TestUsersFile_Reload(t *testing.T) {
+	srv, addr := newStandaloneServer(t, nil)
+	path := filepath.Join(t.TempDir(), "users.yaml")
+	writeUsers := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiresAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	writeUsers(`
+users:
+  - {id: 1, name: alice, password: file-user-1, speed_limit: 10}
+  - {id: 2, name: bob, password: file-user-2, expires_at: "` + expiresAt + `"}
+`)
+	srv.config().UsersFile = path
+	if err := srv.ReloadUsers(); err != nil {
+		t.Fatalf("ReloadUsers failed: %v", err)
+	}
+	if srv.userManager.GetUserCount() != 2 {
+		t.Fatalf("user count = %d, want 2", srv.userManager.GetUserCount())
+	}
+	bob := dialSession(t, addr, "file-user-2")
+	waitFor(t, "session registered", func() bool {
+		return srv.sessions.count()[2] == 1
+	})
+
+	// 用户 2 到期后重新应用用户列表，断开其会话
+	srv.usersFile.mu.Lock()
+	srv.applyFileUsers(time.Now().Add(2 * time.Hour))
+	srv.usersFile.mu.Unlock()
+	waitFor(t, "expired user disconnected", bob.IsClosed)
+	if srv.userManager.GetUser(2) != nil {
+		t.Error("expired user 2 should be removed")
+	}
+
+	// 无效文件保留当前用户
+	writeUsers("users:\n  - {id: 1}\n")
+	if err := srv.ReloadUsers(); err == nil {
+		t.Error("ReloadUsers should fail on an invalid file")
+	}
+	if srv.userManager.GetUser(1) == nil {
+		t.Error("user 1 should be kept after a failed reload")
+	}
+
+	writeUsers("users:\n  - {id: 3, password: file-user-3, speed_limit: 20}\n")
+	if err := srv.ReloadUsers(); err != nil {
+		t.Fatalf("ReloadUsers failed: %v", err)
+	}
+	if srv.userManager.GetUser(1) != nil || srv.userManager.GetUser(3) == nil {
+		t.Error("reload should replace user 1 with user 3")
+	}
+}
+
+// TestStandalone_LocalDeviceLimit 测试独立模式按本节点在线 IP 执行设备限制
+func TestStandalone_LocalDeviceLimit(t *testing.T) {
+	one := 1
+	srv, addr := newStandaloneServer(t, []api.User{{ID: 1, UUID: "device-user", DeviceLimit: &one}})
+	// 模拟另一个 IP 已在线
+	srv.aliveTracker.Track(1, "192.0.2.1")
+
+	sess := dialSession(t, addr, "device-user")
+	waitFor(t, "second device rejected", sess.IsClosed)
+
+	srv.aliveTracker.Remove(1, "192.0.2.1")
+	dialSession(t, addr, "device-user")
+	waitFor(t, "session registered", func() bool {
+		return srv.sessions.count()[1] == 1
+	})
+}
+
+// TestLedger_Standalone 测试独立模式将流量写入账本，并通过管理接口按计费周期查询
+func TestLedger_Standalone(t *testing.T) {
+	srv, _ := newStandaloneServer(t, nil)
+	if _, err := (adminBackend{srv}).Ledger(0, "", ""); !errors.Is(err, admin.ErrUnavailable) {
+		t.Errorf("Ledger without a ledger: err = %v, want ErrUnavailable", err)
+	}
+
+	l, err := ledger.Open(filepath.Join(t.TempDir(), "ledger.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	srv.ledger = l
+	srv.trafficCounter.Add(1, 100, 200)
+	srv.trafficCounter.Add(2, 5, 5)
+	if err := srv.recordLedger(); err != nil {
+		t.Fatalf("recordLedger failed: %v", err)
+	}
+	srv.trafficCounter.Add(1, 1, 1)
+	if err := srv.recordLedger(); err != nil {
+		t.Fatalf("recordLedger failed: %v", err)
+	}
+	if pending := srv.trafficCounter.Pending(); len(pending) != 0 {
+		t.Errorf("pending after recording = %v, want empty", pending)
+	}
+
+	report, err := adminBackend{srv}.Ledger(1, "", "")
+	if err != nil {
+		t.Fatalf("Ledger failed: %v", err)
+	}
+	today := time.Now().Format(ledger.DateLayout)
+	if report.From > today || report.To < today {
+		t.Errorf("default range %s..%s should include today %s", report.From, report.To, today)
+	}
+	want := []admin.LedgerTotal{{UserID: 1, Upload: 101, Download: 201}}
+	if len(report.Entries) != 1 || !reflect.DeepEqual(report.Totals, want) {
+		t.Errorf("report = %+v, want one entry and totals %+v", report, want)
+	}
+	if _, err := (adminBackend{srv}).Ledger(0, "2026-13-01", ""); err == nil {
+		t.Error("invalid date should fail")
+	}
+}
+
+// TestOutbox_RetriesFailedBatch 测试发送失败的批次保留并在下次按原样重发，不与新流量合并
+func TestOutbox_RetriesFailedBatch(t *testing.T) {
+	srv, _ := newStandaloneServer(t, nil)
+	var sent []map[int][2]int64
+	fail := true
+	send := func(batch traffic.Batch) error {
+		if fail {
+			return errors.New("panel unavailable")
+		}
+		sent = append(sent, batch.Data)
+		return nil
+	}
+
+	srv.trafficCounter.Add(1, 10, 20)
+	if err := srv.outbox.Flush(send); err == nil {
+		t.Fatal("Flush should report the send failure")
+	}
+	if got := (adminBackend{srv}).Traffic(); len(got) != 1 || got[0].PendingUpload != 10 {
+		t.Errorf("traffic = %+v, failed batch should still count as pending", got)
+	}
+
+	srv.trafficCounter.Add(1, 1, 2)
+	fail = false
+	if err := srv.outbox.Flush(send); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	want := []map[int][2]int64{{1: {10, 20}}, {1: {1, 2}}}
+	if !reflect.DeepEqual(sent, want) {
+		t.Errorf("sent = %v, want %v", sent, want)
+	}
+	if len(srv.outbox.Outstanding()) != 0 || len(srv.trafficCounter.Pending()) != 0 {
+		t.Error("nothing should be pending after a successful flush")
+	}
+}
+
+// startEchoServer 启动回显数据的 TCP 服务，返回其地址
+func startEchoServer(t *testing.T) M.Socksaddr {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return M.SocksaddrFromNet(echo.Addr())
+}
+
+// TestAccountingModes 测试三种计费模式：payload 只计流中的数据，tls_plaintext 另含帧头和 padding，wire 另含 TLS 开销
+func TestAccountingModes(t *testing.T) {
+	destination := startEchoServer(t)
+	const size = 64 * 1024
+
+	totals := make(map[string]int64)
+	for _, mode := range []string{config.AccountingPayload, config.AccountingTLSPlaintext, config.AccountingWire} {
+		srv, addr := newStandaloneServer(t, []api.User{{ID: 1, UUID: "accounting-user"}})
+		cfg := *srv.config()
+		cfg.Traffic.Accounting = mode
+		srv.cfg.Store(&cfg)
+		sess := dialSession(t, addr, "accounting-user")
+		stream, err := sess.OpenStream()
+		if err != nil {
+			t.Fatalf("%s: OpenStream failed: %v", mode, err)
+		}
+		if err := M.SocksaddrSerializer.WriteAddrPort(stream, destination); err != nil {
+			t.Fatalf("%s: write destination failed: %v", mode, err)
+		}
+		if _, err := stream.Write(make([]byte, size)); err != nil {
+			t.Fatalf("%s: write failed: %v", mode, err)
+		}
+		if _, err := io.ReadFull(stream, make([]byte, size)); err != nil {
+			t.Fatalf("%s: read echo failed: %v", mode, err)
+		}
+		sess.Close()
+
+		// 计数方向与面板的 u/d 一致（客户端视角）：节点读到的计入上传，写出的计入下载
+		addrLen := int64(M.SocksaddrSerializer.AddrPortLen(destination))
+		waitFor(t, mode+" traffic counted", func() bool {
+			got := srv.trafficCounter.Total(1)
+			if mode == config.AccountingPayload {
+				return got == [2]int64{size + addrLen, size}
+			}
+			return got[0] > size+addrLen && got[1] > size
+		})
+		time.Sleep(50 * time.Millisecond)
+		got := srv.trafficCounter.Total(1)
+		totals[mode] = got[0] + got[1]
+	}
+	if !(totals[config.AccountingPayload] < totals[config.AccountingTLSPlaintext] && totals[config.AccountingTLSPlaintext] < totals[config.AccountingWire]) {
+		t.Errorf("totals = %v, want payload < tls_plaintext < wire", totals)
+	}
+}
+
+// TestDeviceLimit_CachedAliveList 测试 Xboard 模式按 pull 周期缓存面板在线数，建立连接时不再请求面板
+func TestDeviceLimit_CachedAliveList(t *testing.T) {
+	two := 2
+	mock := newMockXboard([]api.User{{ID: 1, UUID: "device-user", DeviceLimit: &two}})
+	mock.alive = map[string]int{"1": 1}
+	ts := httptest.NewServer(mock)
+	defer ts.Close()
+
+	srv, err := NewServer(&config.Config{
+		Listen:   "127.0.0.1:0",
+		APIHost:  ts.URL,
+		APIToken: "test-token",
+		NodeID:   42,
+		NodeType: "anytls",
+		Log:      config.LogConfig{Level: "error"},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := srv.doPull(); err != nil {
+		t.Fatalf("doPull failed: %v", err)
+	}
+	addr := serveConnections(t, srv)
+
+	// 其他节点 1 个设备 + 本节点 1 个设备，未超过 2；同一 IP 的更多会话总是允许
+	dialSession(t, addr, "device-user")
+	dialSession(t, addr, "device-user")
+	waitFor(t, "both sessions registered", func() bool {
+		return srv.sessions.count()[1] == 2
+	})
+	mock.mu.Lock()
+	aliveListCalls := mock.aliveListCalls
+	mock.mu.Unlock()
+	if aliveListCalls != 1 {
+		t.Errorf("alivelist called %d times, want once per pull", aliveListCalls)
+	}
+	if srv.aliveTracker.CheckDeviceLimit(1, 2, "192.0.2.1") {
+		t.Error("a third device should be rejected")
+	}
+}
+
+// TestReloadConfig 测试热重载应用可热更新的配置且不断开现有会话，需要重新监听的配置变化时拒绝整个重新加载
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := `
+listen: "127.0.0.1:0"
+standalone: true
+password: "reload-user"
+`
+	write(base + `
+log:
+  level: error
+`)
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	cfg.Traffic.PersistPath = ""
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.SetConfigLoader(func() (*config.Config, error) {
+		reloaded, err := config.LoadConfig(path)
+		if err == nil {
+			reloaded.Traffic.PersistPath = ""
+		}
+		return reloaded, err
+	})
+	srv.applyUsers([]api.User{{ID: 1, UUID: "reload-user"}})
+	sess := dialSession(t, serveConnections(t, srv), "reload-user")
+	waitFor(t, "session registered", func() bool {
+		return srv.sessions.count()[1] == 1
+	})
+
+	level := logrus.GetLevel()
+	t.Cleanup(func() { logrus.SetLevel(level) })
+	write(base + `
+log:
+  level: warn
+  file_path: ` + filepath.Join(filepath.Dir(path), "anytls.log") + `
+fallback: "127.0.0.1:8080"
+bandwidth:
+  upload: 10
+auth_ban:
+  max_failures: 1
+route:
+  rules:
+    - domain_suffix: ["example.com"]
+      outbound: reject
+`)
+	if err := srv.ReloadConfig(); err != nil {
+		t.Fatalf("ReloadConfig failed: %v", err)
+	}
+	if got := srv.config().Fallback; got != "127.0.0.1:8080" {
+		t.Errorf("fallback = %q after reload", got)
+	}
+	if srv.speedLimiter.ChunkSize(1, ratelimit.Upload, 1<<30) == 1<<30 {
+		t.Error("bandwidth limit not applied")
+	}
+	if _, err := srv.route("tcp", M.ParseSocksaddr("www.example.com:443"), 1); err == nil {
+		t.Error("reloaded route rule not applied")
+	}
+	if srv.logger.GetLevel() != logrus.WarnLevel || logrus.GetLevel() != logrus.WarnLevel {
+		t.Errorf("log level = %v (global %v) after reload, want warn for both", srv.logger.GetLevel(), logrus.GetLevel())
+	}
+	if srv.connLimiter.RecordFailure("192.0.2.1") || !srv.connLimiter.RecordFailure("192.0.2.1") {
+		t.Error("auth_ban.max_failures not applied")
+	}
+	if sess.IsClosed() {
+		t.Error("existing session closed by reload")
+	}
+
+	// 需要重新监听的配置变化：拒绝整个重新加载，fallback 也不修改
+	write(base + `
+log:
+  level: error
+fallback: "127.0.0.1:9090"
+metrics:
+  listen: "127.0.0.1:9100"
+`)
+	if err := srv.ReloadConfig(); err == nil || !strings.Contains(err.Error(), "metrics") {
+		t.Errorf("ReloadConfig error = %v, want metrics rejected", err)
+	}
+	if got := srv.config().Fallback; got != "127.0.0.1:8080" {
+		t.Errorf("fallback = %q after rejected reload, want unchanged", got)
+	}
+
+	write("listen: [")
+	if err := srv.ReloadConfig(); err == nil {
+		t.Error("invalid YAML should be rejected")
+	}
+}
+
+// upgradeTestConfig 平滑升级测试中新旧两个进程共用的配置，持久化文件放在 dir 下
+func upgradeTestConfig(dir string) *config.Config {
+	return &config.Config{
+		Standalone: true,
+		Password:   "upgrade-user",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+		Traffic: config.TrafficConfig{
+			Accounting:  config.AccountingPayload,
+			PersistPath: filepath.Join(dir, "traffic.json"),
+		},
+	}
+}
+
+// upgradeTestDirEnv 把测试的临时目录传给作为新进程的测试二进制
+const upgradeTestDirEnv = "ANYTLS_TEST_UPGRADE_DIR"
+
+// TestUpgradeHelperProcess 由 TestUpgrade 通过 Upgrade 作为新进程启动，单独运行时跳过
+func TestUpgradeHelperProcess(t *testing.T) {
+	dir := os.Getenv(upgradeTestDirEnv)
+	if os.Getenv(upgradeEnv) == "" || dir == "" {
+		t.Skip("由 TestUpgrade 启动")
+	}
+	if err := os.WriteFile(filepath.Join(dir, "child.pid"), []byte(strconv.Itoa(os.Getpid())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	h, err := InheritedHandoff()
+	if err != nil || h == nil {
+		t.Fatalf("InheritedHandoff = %v, %v", h, err)
+	}
+	cfg := upgradeTestConfig(dir)
+	cfg.Admin = config.AdminConfig{Listen: "unix:" + filepath.Join(dir, "admin.sock"), Token: "upgrade-token"}
+	srv, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	srv.Inherit(h)
+	go srv.Start(context.Background())
+	// 由 TestUpgrade 结束时杀掉，父进程异常退出时也不会一直运行
+	time.Sleep(30 * time.Second)
+}
+
+// TestUpgrade 端到端测试平滑升级：新进程接管 listener 和流量状态，旧进程的现有会话在排空期间正常工作，
+// 排空期间的流量最终交给新进程，新进程的待上报流量和累计流量等于两个进程的合计
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("平滑升级依赖 Linux 的文件描述符继承")
+	}
+	dir := t.TempDir()
+	t.Setenv(upgradeTestDirEnv, dir)
+	t.Cleanup(func() {
+		if data, err := os.ReadFile(filepath.Join(dir, "child.pid")); err == nil {
+			if pid, err := strconv.Atoi(string(data)); err == nil {
+				syscall.Kill(pid, syscall.SIGKILL)
+			}
+		}
+	})
+	destination := startEchoServer(t)
+	addrLen := int64(M.SocksaddrSerializer.AddrPortLen(destination))
+	echo := func(stream net.Conn, size int) {
+		t.Helper()
+		if _, err := stream.Write(make([]byte, size)); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if _, err := io.ReadFull(stream, make([]byte, size)); err != nil {
+			t.Fatalf("read echo failed: %v", err)
+		}
+	}
+	openStream := func(sess *session.Session) net.Conn {
+		t.Helper()
+		stream, err := sess.OpenStream()
+		if err != nil {
+			t.Fatalf("OpenStream failed: %v", err)
+		}
+		if err := M.SocksaddrSerializer.WriteAddrPort(stream, destination); err != nil {
+			t.Fatalf("write destination failed: %v", err)
+		}
+		return stream
+	}
+
+	// 旧进程：本测试进程中的服务
+	srv, err := NewServer(upgradeTestConfig(dir))
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.listener = ln
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go srv.Start(ctx)
+	addr := ln.Addr().String()
+
+	oldSess := dialSession(t, addr, "upgrade-user")
+	oldStream := openStream(oldSess)
+	echo(oldStream, 1000)
+
+	drainCtx, drainCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer drainCancel()
+	upgraded := make(chan error, 1)
+	go func() {
+		upgraded <- srv.Upgrade(drainCtx, os.Args[0], "-test.run=^TestUpgradeHelperProcess$")
+	}()
+
+	// 新进程的管理接口可用时已接收旧进程交出的状态
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", filepath.Join(dir, "admin.sock"))
+		},
+	}}
+	childTraffic := func() ([]admin.UserTraffic, error) {
+		req, _ := http.NewRequest(http.MethodGet, "http://admin/traffic", nil)
+		req.Header.Set("Authorization", "Bearer upgrade-token")
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		var traffic []admin.UserTraffic
+		return traffic, json.NewDecoder(resp.Body).Decode(&traffic)
+	}
+	waitFor(t, "new process started", func() bool {
+		_, err := childTraffic()
+		return err == nil
+	})
+
+	// 排空期间旧会话不受影响，关闭后旧进程退出升级流程
+	echo(oldStream, 500)
+	oldSess.Close()
+	select {
+	case err := <-upgraded:
+		if err != nil {
+			t.Fatalf("Upgrade failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Upgrade did not return after the old session closed")
+	}
+	if pending := srv.trafficCounter.Pending(); len(pending) != 0 {
+		t.Errorf("old process pending = %v, want everything handed off", pending)
+	}
+
+	// 旧进程已停止接受连接，新连接由新进程处理
+	newSess := dialSession(t, addr, "upgrade-user")
+	echo(openStream(newSess), 100)
+
+	want := admin.UserTraffic{
+		UserID:          1,
+		PendingUpload:   1600 + 2*addrLen,
+		PendingDownload: 1600,
+		TotalUpload:     1600 + 2*addrLen,
+		TotalDownload:   1600,
+	}
+	waitFor(t, "traffic of both processes in the new process", func() bool {
+		got, _ := childTraffic()
+		return len(got) == 1 && got[0] == want
+	})
+}
+
+// writeTestCertificate 生成 name 的自签名证书并写入 dir，返回证书和私钥路径
+func writeTestCertificate(t *testing.T, dir, file, name string) config.CertificateConfig {
+	t.Helper()
+	cert, err := util.GenerateKeyPair(time.Now, time.Hour, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := config.CertificateConfig{
+		CertFile: filepath.Join(dir, file+".crt"),
+		KeyFile:  filepath.Join(dir, file+".key"),
+	}
+	if err := os.WriteFile(pair.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pair.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair
+}
+
+// TestCertificates_SNIAndReload 测试按 SNI 选择证书（含通配符）以及证书文件修改后重新加载
+func TestCertificates_SNIAndReload(t *testing.T) {
+	dir := t.TempDir()
+	def := writeTestCertificate(t, dir, "default", "default.test")
+	exact := writeTestCertificate(t, dir, "exact", "a.example.com")
+	wildcard := writeTestCertificate(t, dir, "wildcard", "*.example.com")
+	srv, err := NewServer(&config.Config{
+		Standalone: true,
+		Password:   "unused",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+		TLS: config.TLSConfig{
+			CertFile:     def.CertFile,
+			KeyFile:      def.KeyFile,
+			Certificates: []config.CertificateConfig{exact, wildcard},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	addr := serveConnections(t, srv)
+	served := func(serverName string) *x509.Certificate {
+		t.Helper()
+		c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: serverName})
+		if err != nil {
+			t.Fatalf("tls.Dial(%q) failed: %v", serverName, err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0]
+	}
+
+	for serverName, want := range map[string]string{
+		"a.example.com":   "a.example.com",
+		"A.Example.com.":  "a.example.com",
+		"b.example.com":   "*.example.com",
+		"x.b.example.com": "default.test", // 通配符只匹配一级
+		"other.test":      "default.test",
+		"":                "default.test",
+	} {
+		if got := served(serverName).DNSNames[0]; got != want {
+			t.Errorf("SNI %q served %s, want %s", serverName, got, want)
+		}
+	}
+
+	// 续期：证书文件被替换后重新加载，不需要重启
+	before := served("a.example.com").SerialNumber
+	writeTestCertificate(t, dir, "exact", "a.example.com")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(exact.CertFile, future, future)
+	if err := srv.reloadChangedCertificates(); err != nil {
+		t.Fatalf("reloadChangedCertificates failed: %v", err)
+	}
+	renewed := served("a.example.com").SerialNumber
+	if renewed.Cmp(before) == 0 {
+		t.Error("renewed certificate was not picked up")
+	}
+
+	// 写了一半的证书：保留当前证书，修复后再次加载
+	if err := os.WriteFile(exact.KeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.reloadChangedCertificates(); err == nil {
+		t.Error("reloading a broken key should fail")
+	}
+	if got := served("a.example.com").SerialNumber; got.Cmp(renewed) != 0 {
+		t.Error("current certificate should be kept when the new files are invalid")
+	}
+}
+
+// TestCertificates_AppearLater 测试启动时证书文件尚不存在（使用自签名证书），文件出现后被热重载加载
+func TestCertificates_AppearLater(t *testing.T) {
+	dir := t.TempDir()
+	pair := config.CertificateConfig{
+		CertFile: filepath.Join(dir, "node.crt"),
+		KeyFile:  filepath.Join(dir, "node.key"),
+	}
+	srv, err := NewServer(&config.Config{
+		Standalone: true,
+		Password:   "unused",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+		TLS:        config.TLSConfig{CertFile: pair.CertFile, KeyFile: pair.KeyFile},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	addr := serveConnections(t, srv)
+	if srv.SelfSignedFingerprint() == "" {
+		t.Fatal("expected the self-signed fallback while the certificate is missing")
+	}
+	if err := srv.reloadChangedCertificates(); err != nil {
+		t.Fatalf("reloadChangedCertificates failed: %v", err)
+	}
+
+	// 例如 acme.sh 首次签发后写入证书
+	writeTestCertificate(t, dir, "node", "node.example.com")
+	if err := srv.reloadChangedCertificates(); err != nil {
+		t.Fatalf("reloadChangedCertificates failed: %v", err)
+	}
+	if got := servedCertificate(t, addr, "node.example.com").DNSNames; len(got) != 1 || got[0] != "node.example.com" {
+		t.Errorf("served %v, want node.example.com", got)
+	}
+	if srv.SelfSignedFingerprint() != "" {
+		t.Error("self-signed certificate still in use after the configured one appeared")
+	}
+}
+
+// servedCertificate 以 serverName 握手，返回服务端的证书
+func servedCertificate(t *testing.T, addr, serverName string, nextProtos ...string) *x509.Certificate {
+	t.Helper()
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, ServerName: serverName, NextProtos: nextProtos})
+	if err != nil {
+		t.Fatalf("tls.Dial(%q) failed: %v", serverName, err)
+	}
+	defer c.Close()
+	return c.ConnectionState().PeerCertificates[0]
+}
+
+// TestSelfSigned_Persisted 测试自签名证书：ECDSA、按配置写入 SAN、有效期多年，
+// 保存后再次启动使用同一证书（指纹不变），修改 names 后重新生成
+func TestSelfSigned_Persisted(t *testing.T) {
+	dir := t.TempDir()
+	selfSigned := config.SelfSignedConfig{
+		Names:    []string{"node.test", "192.0.2.1"},
+		CertFile: filepath.Join(dir, "tls", "self-signed.crt"),
+		KeyFile:  filepath.Join(dir, "tls", "self-signed.key"),
+		Validity: config.DefaultSelfSignedValidity,
+	}
+	newServer := func() *Server {
+		t.Helper()
+		srv, err := NewServer(&config.Config{
+			Standalone: true,
+			Password:   "unused",
+			NodeType:   "anytls",
+			Log:        config.LogConfig{Level: "error"},
+			TLS:        config.TLSConfig{SelfSigned: selfSigned},
+		})
+		if err != nil {
+			t.Fatalf("NewServer failed: %v", err)
+		}
+		return srv
+	}
+
+	srv := newServer()
+	fingerprint := srv.SelfSignedFingerprint()
+	if len(fingerprint) != 64 {
+		t.Fatalf("SelfSignedFingerprint = %q, want a hex SHA-256", fingerprint)
+	}
+	served := servedCertificate(t, serveConnections(t, srv), "node.test")
+	if got := util.CertificateFingerprint(served.Raw); got != fingerprint {
+		t.Errorf("served certificate fingerprint = %s, want %s", got, fingerprint)
+	}
+	if served.PublicKeyAlgorithm != x509.ECDSA {
+		t.Errorf("PublicKeyAlgorithm = %v, want ECDSA", served.PublicKeyAlgorithm)
+	}
+	if served.Subject.CommonName != "node.test" || !reflect.DeepEqual(served.DNSNames, []string{"node.test"}) ||
+		len(served.IPAddresses) != 1 || served.IPAddresses[0].String() != "192.0.2.1" {
+		t.Errorf("names = %q %v %v, want node.test and 192.0.2.1", served.Subject.CommonName, served.DNSNames, served.IPAddresses)
+	}
+	if validity := served.NotAfter.Sub(time.Now()); validity < 9*365*24*time.Hour {
+		t.Errorf("certificate expires in %v, want years", validity)
+	}
+	if info, err := os.Stat(selfSigned.KeyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("private key file = %v, %v, want mode 0600", info, err)
+	}
+
+	// 再次启动：使用保存的证书
+	if got := newServer().SelfSignedFingerprint(); got != fingerprint {
+		t.Errorf("fingerprint after restart = %s, want %s", got, fingerprint)
+	}
+
+	// 修改 names：重新生成
+	selfSigned.Names = []string{"other.test"}
+	if got := newServer().SelfSignedFingerprint(); got == fingerprint {
+		t.Error("certificate should be regenerated when names change")
+	}
+
+	// 使用配置的证书时没有自签名证书指纹
+	pair := writeTestCertificate(t, dir, "configured", "configured.test")
+	configured, err := NewServer(&config.Config{
+		Standalone: true,
+		Password:   "unused",
+		NodeType:   "anytls",
+		Log:        config.LogConfig{Level: "error"},
+		TLS:        config.TLSConfig{CertFile: pair.CertFile, KeyFile: pair.KeyFile, SelfSigned: selfSigned},
+	})
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if got := configured.SelfSignedFingerprint(); got != "" {
+		t.Errorf("SelfSignedFingerprint with a configured certificate = %q, want empty", got)
+	}
+}
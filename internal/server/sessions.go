@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"anytls/proxy/session"
+)
+
+// sessionRegistry 按用户 ID 记录活跃会话，用于主动断开用户
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[int]map[*session.Session]net.Conn // user_id -> {会话 -> TLS 连接}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: make(map[int]map[*session.Session]net.Conn),
+	}
+}
+
+// add 登记会话，conn 为会话底层的 TLS 连接
+func (r *sessionRegistry) add(userID int, sess *session.Session, conn net.Conn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[userID] == nil {
+		r.sessions[userID] = make(map[*session.Session]net.Conn)
+	}
+	r.sessions[userID][sess] = conn
+}
+
+// remove 注销会话
+func (r *sessionRegistry) remove(userID int, sess *session.Session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sessions := r.sessions[userID]
+	if sessions == nil {
+		return
+	}
+	delete(sessions, sess)
+	if len(sessions) == 0 {
+		delete(r.sessions, userID)
+	}
+}
+
+// count 返回每个用户的活跃会话数
+func (r *sessionRegistry) count() map[int]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[int]int, len(r.sessions))
+	for userID, sessions := range r.sessions {
+		counts[userID] = len(sessions)
+	}
+	return counts
+}
+
+// closeUser 关闭用户的所有会话，返回关闭的会话数
+// alert 非空时先向客户端发送 cmdAlert 说明原因
+// 只关闭底层 TLS 连接（并发安全），会话的读循环随之退出，由 handleConnection 完成清理和注销
+func (r *sessionRegistry) closeUser(userID int, alert string) int {
+	r.mu.Lock()
+	sessions := make(map[*session.Session]net.Conn, len(r.sessions[userID]))
+	for sess, conn := range r.sessions[userID] {
+		sessions[sess] = conn
+	}
+	r.mu.Unlock()
+
+	for sess, conn := range sessions {
+		if alert == "" {
+			conn.Close()
+			continue
+		}
+		// 发送 alert 可能因客户端不读取而阻塞到写超时，不阻塞调用方
+		go func() {
+			sess.Alert(alert)
+			conn.Close()
+		}()
+	}
+	return len(sessions)
+}
+
+// closeAll 关闭所有用户的会话，不发送 alert，返回关闭的会话数
+func (r *sessionRegistry) closeAll() int {
+	closed := 0
+	for userID := range r.count() {
+		closed += r.closeUser(userID, "")
+	}
+	return closed
+}
@@ -2,16 +2,19 @@ package server
 
 import (
 	"anytls/internal/api"
+	"anytls/internal/traffic"
 	"anytls/proxy/padding"
 	"context"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 // syncLoop 定期同步用户和上报数据
-// pull 周期：FetchUsers（ETag）→ UpdateUsers；FetchConfig → 更新 padding；Cleanup 过期封禁
-// push 周期：Snapshot 流量 → PushTraffic（失败回滚）；Snapshot alive → PushAlive；PushStatus；SaveToFile
+// pull 周期：FetchUsers（ETag）→ UpdateUsers；FetchConfig → 更新 padding 和面板路由；FetchAliveList → 缓存全局在线数；Cleanup 过期封禁
+// push 周期：流量取出为批次 → 按顺序 PushTrafficBatch（失败的批次保留重试）；Snapshot alive → PushAlive；PushStatus；保存持久化文件
 func (s *Server) syncLoop(ctx context.Context) {
 	pullInterval := time.Duration(s.nodeConfig.BaseConfig.PullInterval) * time.Second
 	pushInterval := time.Duration(s.nodeConfig.BaseConfig.PushInterval) * time.Second
@@ -43,21 +46,29 @@ func (s *Server) syncLoop(ctx context.Context) {
 	}
 }
 
-// doPull 执行一次 pull 周期
-func (s *Server) doPull() {
+// doPull 执行一次 pull 周期，返回各步骤的错误
+// syncLoop 和管理接口都会调用，由 syncMu 串行化
+func (s *Server) doPull() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	var errs []error
+
 	// 1. 拉取用户列表（支持 ETag，304 时返回 nil,nil）
 	users, err := s.apiClient.FetchUsers()
 	if err != nil {
 		s.logger.WithError(err).Error("拉取用户列表失败")
+		errs = append(errs, fmt.Errorf("拉取用户列表失败: %w", err))
 	} else if users != nil {
-		s.userManager.UpdateUsers(users)
+		s.applyUsers(users)
 		s.logger.WithField("count", len(users)).Info("用户列表已同步")
 	}
 
-	// 2. 拉取节点配置并更新 padding
+	// 2. 拉取节点配置并更新 padding 和面板路由
 	nodeConfig, err := s.apiClient.FetchConfig()
 	if err != nil {
 		s.logger.WithError(err).Error("拉取节点配置失败")
+		errs = append(errs, fmt.Errorf("拉取节点配置失败: %w", err))
 	} else {
 		s.nodeConfig = nodeConfig
 		if len(nodeConfig.PaddingScheme) > 0 {
@@ -66,32 +77,117 @@ func (s *Server) doPull() {
 				s.logger.Warn("padding scheme 更新失败，格式可能不正确")
 			}
 		}
+		s.applyPanelRoutes(nodeConfig.Routes)
+	}
+
+	// 3. 拉取全局在线设备数，缓存到下一个 pull 周期供设备限制检查使用
+	if err := s.fetchAliveList(); err != nil {
+		errs = append(errs, err)
 	}
 
-	// 3. 清理过期封禁记录
+	// 4. 清理过期封禁记录
 	s.connLimiter.Cleanup()
+	return errors.Join(errs...)
 }
 
-// doPush 执行一次 push 周期
-func (s *Server) doPush() {
-	// 1. 快照流量并上报
-	trafficSnapshot := s.trafficCounter.Snapshot()
-	if len(trafficSnapshot) > 0 {
-		if err := s.apiClient.PushTraffic(trafficSnapshot); err != nil {
-			s.logger.WithError(err).Error("上报流量失败，保留数据待下次上报")
-			// 上报失败，合并回计数器
-			s.trafficCounter.Merge(trafficSnapshot)
-		} else {
-			s.logger.WithField("users", len(trafficSnapshot)).Debug("流量数据已上报")
+// fetchAliveList 拉取面板的全局在线设备数，失败时保留上一次的数据
+func (s *Server) fetchAliveList() error {
+	aliveList, err := s.apiClient.FetchAliveList()
+	if err != nil {
+		s.logger.WithError(err).Warn("拉取在线设备数失败，设备限制继续使用上一次的数据")
+		return fmt.Errorf("拉取在线设备数失败: %w", err)
+	}
+	s.aliveTracker.SetRemote(aliveList)
+	return nil
+}
+
+// 断开会话时发送给客户端的 alert 内容
+const (
+	alertUserRemoved     = "user is no longer allowed on this node"
+	alertUserUUIDChanged = "user credentials have changed"
+)
+
+// applyUsers 更新用户表，断开已被移除或 UUID 变更用户的现有会话，并同步限速和流量配额变更
+func (s *Server) applyUsers(users []api.User) {
+	diff := s.userManager.UpdateUsers(users)
+	s.kickUsers(diff.Removed, alertUserRemoved, "用户已被移除，断开会话")
+	s.kickUsers(diff.UUIDChanged, alertUserUUIDChanged, "用户 UUID 已变更，断开会话")
+
+	// 限速变更对已有连接立即生效，已移除用户释放限速器
+	for _, userID := range diff.Removed {
+		s.speedLimiter.RemoveUser(userID)
+	}
+	for _, entry := range diff.SpeedLimitChanged {
+		s.speedLimiter.UpdateLimit(entry.ID, entry.Limits)
+		s.logger.WithFields(logrus.Fields{
+			"user_id":        entry.ID,
+			"upload_limit":   entry.Limits.Upload,
+			"download_limit": entry.Limits.Download,
+		}).Info("用户限速已更新")
+	}
+	s.syncQuotas()
+}
+
+// kickUsers 断开用户的所有会话，未开启 kick_alert 时不发送 alert
+func (s *Server) kickUsers(userIDs []int, alert, msg string) {
+	if !s.config().KickAlert {
+		alert = ""
+	}
+	for _, userID := range userIDs {
+		if closed := s.sessions.closeUser(userID, alert); closed > 0 {
+			s.logger.WithFields(logrus.Fields{
+				"user_id":  userID,
+				"sessions": closed,
+			}).Info(msg)
 		}
 	}
+}
+
+// pushTrafficBatch 上报一批流量，批次 ID 作为 Idempotency-Key，原版 Xboard 不据此去重
+func (s *Server) pushTrafficBatch(batch traffic.Batch) error {
+	return s.apiClient.PushTrafficBatch(batch.Key(), batch.Data)
+}
+
+// flushOutbox 按顺序发送发件箱中的流量批次，发送成功的批次确认后计入配额用量
+func (s *Server) flushOutbox(send func(traffic.Batch) error) error {
+	var acked []map[int][2]int64
+	err := s.outbox.Flush(func(batch traffic.Batch) error {
+		if err := send(batch); err != nil {
+			return err
+		}
+		acked = append(acked, batch.Data)
+		return nil
+	})
+	// Flush 返回时批次已从发件箱移除，之后再计入，用量不会把同一批次算两次
+	for _, data := range acked {
+		s.acknowledgeTraffic(data)
+	}
+	return err
+}
+
+// doPush 执行一次 push 周期，返回各步骤的错误
+func (s *Server) doPush() error {
+	s.syncMu.Lock()
+	defer s.syncMu.Unlock()
+
+	var errs []error
+
+	// 1. 取出流量写入预写日志并上报，失败的批次保留待下次上报
+	if err := s.flushOutbox(s.pushTrafficBatch); err != nil {
+		s.logger.WithError(err).Error("上报流量失败，保留数据待下次上报")
+		errs = append(errs, fmt.Errorf("上报流量失败: %w", err))
+	} else {
+		s.logger.Debug("流量数据已上报")
+	}
 
 	// 2. 快照在线用户并上报
 	aliveSnapshot := s.aliveTracker.Snapshot()
 	if len(aliveSnapshot) > 0 {
 		if err := s.apiClient.PushAlive(aliveSnapshot); err != nil {
 			s.logger.WithError(err).Error("上报在线数据失败")
+			errs = append(errs, fmt.Errorf("上报在线数据失败: %w", err))
 		} else {
+			s.aliveTracker.MarkReported(aliveSnapshot)
 			s.logger.WithFields(logrus.Fields{
 				"users": len(aliveSnapshot),
 			}).Debug("在线数据已上报")
@@ -102,16 +198,20 @@ func (s *Server) doPush() {
 	nodeStatus, err := collectSystemInfo()
 	if err != nil {
 		s.logger.WithError(err).Error("收集系统信息失败")
+		errs = append(errs, fmt.Errorf("收集系统信息失败: %w", err))
 	} else {
 		if err := s.apiClient.PushStatus(nodeStatus); err != nil {
 			s.logger.WithError(err).Error("上报节点状态失败")
+			errs = append(errs, fmt.Errorf("上报节点状态失败: %w", err))
 		} else {
 			s.logger.Debug("节点状态已上报")
 		}
 	}
 
 	// 4. 持久化流量数据
-	if err := s.trafficCounter.SaveToFile(trafficPersistPath); err != nil {
+	if err := s.outbox.Save(); err != nil {
 		s.logger.WithError(err).Error("持久化流量数据失败")
+		errs = append(errs, fmt.Errorf("持久化流量数据失败: %w", err))
 	}
+	return errors.Join(errs...)
 }
@@ -3,46 +3,333 @@ package server
 import (
 	"anytls/internal/config"
 	"anytls/util"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
-// LoadTLSConfig loads TLS configuration from the config.
-// If external cert/key files are specified and valid, they are used.
-// Otherwise, falls back to a self-signed certificate via util.GenerateKeyPair.
-// MinVersion is always set to TLS 1.2.
-func LoadTLSConfig(cfg *config.Config) (*tls.Config, error) {
-	var cert *tls.Certificate
+// certWatchInterval is how often certificate files are checked for changes,
+// so certificates renewed by an external tool (acme.sh, certbot) are picked up without a restart.
+const certWatchInterval = 10 * time.Second
 
-	if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
-		loaded, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
-		if err != nil {
-			logrus.Warnf("failed to load TLS certificate from %s and %s: %v, falling back to self-signed certificate",
-				cfg.TLS.CertFile, cfg.TLS.KeyFile, err)
-		} else {
-			cert = &loaded
-			logrus.Infof("loaded TLS certificate from %s", cfg.TLS.CertFile)
+// certSource is a configured certificate/key pair on disk and the modification times it was loaded at.
+// A missing file has a zero modification time, so its first appearance is seen as a change.
+type certSource struct {
+	config.CertificateConfig
+	certMod, keyMod time.Time
+	loaded          bool // whether the pair was usable, i.e. is part of the set's certs
+}
+
+// changed reports whether either file has been modified, created or removed since it was loaded.
+func (c certSource) changed() bool {
+	return !modTime(c.CertFile).Equal(c.certMod) || !modTime(c.KeyFile).Equal(c.keyMod)
+}
+
+// modTime returns the modification time of file, or the zero time when it can't be stat'ed.
+func modTime(file string) time.Time {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// loadedBefore reports whether pair was loaded successfully into the set.
+func (c *certSet) loadedBefore(pair config.CertificateConfig) bool {
+	for _, source := range c.sources {
+		if source.CertificateConfig == pair {
+			return source.loaded
 		}
 	}
+	return false
+}
 
-	if cert == nil {
-		generated, err := util.GenerateKeyPair(time.Now, "")
+// certSet is an immutable set of certificates indexed by the names they are valid for.
+type certSet struct {
+	config  config.TLSConfig            // the configuration the set was loaded from
+	certs   []*tls.Certificate          // in configuration order; the first one is the default
+	names   map[string]*tls.Certificate // lower-case DNS names, including wildcards like "*.example.com"
+	sources []certSource                // every configured pair, including those that failed to load
+	// selfSigned is the self-signed certificate used when no configured certificate could be loaded
+	selfSigned *tls.Certificate
+}
+
+// newCertSet indexes certs by their DNS names (or common name when there are none).
+// When several certificates cover the same name, the first one wins.
+func newCertSet(cfg config.TLSConfig, certs []*tls.Certificate, sources []certSource) (*certSet, error) {
+	set := &certSet{config: cfg, certs: certs, names: make(map[string]*tls.Certificate), sources: sources}
+	for _, cert := range certs {
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return nil, err
+			}
+		}
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if _, ok := set.names[name]; !ok {
+				set.names[name] = cert
+			}
+		}
+	}
+	return set, nil
+}
+
+// match returns the certificate for the SNI serverName: an exact name first,
+// then a wildcard covering its first label, then the default certificate.
+func (c *certSet) match(serverName string) *tls.Certificate {
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if cert, ok := c.names[name]; ok {
+		return cert
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := c.names["*"+name[i:]]; ok {
+			return cert
+		}
+	}
+	return c.certs[0]
+}
+
+// changed reports whether any of the files the set was loaded from has been modified.
+func (c *certSet) changed() bool {
+	for _, source := range c.sources {
+		if source.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+// certStore serves certificates from a certSet that is swapped atomically on reload;
+// handshakes in progress keep the certificate they already selected.
+// Names managed by the built-in ACME client are served its certificates once they have been obtained.
+type certStore struct {
+	set  atomic.Pointer[certSet]
+	acme *acmeClient // nil unless tls.acme.domains is set
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if s.acme != nil {
+		if cert := s.acme.getCertificate(hello); cert != nil {
+			return cert, nil
+		}
+	}
+	return s.set.Load().match(hello.ServerName), nil
+}
+
+// loadCertSet loads every configured certificate.
+// In strict mode an invalid certificate is an error, unless previous is set and could not load it either;
+// otherwise it is skipped with a warning. Skipped pairs are still watched, so they are loaded once they appear.
+// Without any usable certificate the persisted self-signed certificate is used, see loadSelfSigned.
+func loadCertSet(cfg config.TLSConfig, strict bool, previous *certSet) (*certSet, error) {
+	var certs []*tls.Certificate
+	var sources []certSource
+	for _, pair := range cfg.Pairs() {
+		cert, source, err := loadCertificate(pair)
+		sources = append(sources, source)
 		if err != nil {
+			if strict && (previous == nil || previous.loadedBefore(pair)) {
+				return nil, fmt.Errorf("加载 TLS 证书失败: %w", err)
+			}
+			logrus.Warnf("failed to load TLS certificate from %s and %s: %v, skipping it", pair.CertFile, pair.KeyFile, err)
+			continue
+		}
+		logrus.Infof("loaded TLS certificate from %s", pair.CertFile)
+		certs = append(certs, cert)
+	}
+
+	var selfSigned *tls.Certificate
+	if len(certs) == 0 {
+		if len(cfg.Pairs()) > 0 {
+			logrus.Warn("no TLS certificate could be loaded, falling back to self-signed certificate")
+		}
+		var err error
+		if selfSigned, err = loadSelfSigned(cfg.SelfSigned); err != nil {
 			return nil, err
 		}
-		cert = generated
-		logrus.Warn("using self-signed certificate")
+		certs = append(certs, selfSigned)
+		logrus.WithField("sha256", util.CertificateFingerprint(selfSigned.Certificate[0])).Warn("using self-signed certificate")
 	}
 
-	tlsCert := cert
-	tlsConfig := &tls.Config{
-		MinVersion: tls.VersionTLS12,
-		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-			return tlsCert, nil
-		},
+	set, err := newCertSet(cfg, certs, sources)
+	if err != nil {
+		return nil, err
 	}
+	set.selfSigned = selfSigned
+	return set, nil
+}
 
-	return tlsConfig, nil
+// loadSelfSigned returns the self-signed certificate saved in cfg.CertFile and cfg.KeyFile,
+// so its fingerprint stays the same across restarts and clients can pin it.
+// A new certificate is generated and saved when the files are missing or invalid,
+// the certificate has expired, or cfg.Names no longer matches its names.
+// Without file paths, or when saving fails, the certificate is only kept in memory.
+func loadSelfSigned(cfg config.SelfSignedConfig) (*tls.Certificate, error) {
+	persist := cfg.CertFile != "" && cfg.KeyFile != ""
+	if persist {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		switch {
+		case err == nil && time.Now().After(cert.Leaf.NotAfter):
+			logrus.Warnf("self-signed certificate %s has expired, generating a new one", cfg.CertFile)
+		case err == nil && len(cfg.Names) > 0 && !sameNames(cert.Leaf, cfg.Names):
+			logrus.Warnf("names of self-signed certificate %s differ from tls.self_signed.names, generating a new one", cfg.CertFile)
+		case err == nil:
+			return &cert, nil
+		case !errors.Is(err, fs.ErrNotExist):
+			logrus.Warnf("failed to load self-signed certificate from %s: %v, generating a new one", cfg.CertFile, err)
+		}
+	}
+
+	validity := cfg.Validity
+	if validity <= 0 {
+		validity = config.DefaultSelfSignedValidity
+	}
+	cert, err := util.GenerateKeyPair(time.Now, time.Duration(validity)*24*time.Hour, cfg.Names...)
+	if err != nil {
+		return nil, fmt.Errorf("生成自签名证书失败: %w", err)
+	}
+	if persist {
+		if err := saveKeyPair(cert, cfg.CertFile, cfg.KeyFile); err != nil {
+			logrus.Warnf("failed to save self-signed certificate: %v, a new one will be generated on next start", err)
+		} else {
+			logrus.Infof("saved self-signed certificate to %s", cfg.CertFile)
+		}
+	}
+	return cert, nil
+}
+
+// sameNames reports whether the certificate's DNS names and IP addresses are exactly names, ignoring order and case.
+func sameNames(leaf *x509.Certificate, names []string) bool {
+	var have, want []string
+	for _, name := range leaf.DNSNames {
+		have = append(have, strings.ToLower(name))
+	}
+	for _, ip := range leaf.IPAddresses {
+		have = append(have, ip.String())
+	}
+	for _, name := range names {
+		if ip := net.ParseIP(name); ip != nil {
+			want = append(want, ip.String())
+		} else {
+			want = append(want, strings.ToLower(name))
+		}
+	}
+	slices.Sort(have)
+	slices.Sort(want)
+	return slices.Equal(have, want)
+}
+
+// saveKeyPair writes the certificate and its private key as PEM files, the key readable only by the owner.
+func saveKeyPair(cert *tls.Certificate, certFile, keyFile string) error {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+	}
+	if err := util.WriteFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0644)
+}
+
+// loadCertificate loads a certificate/key pair and records the modification times of both files,
+// also when loading fails. The times are taken before reading, so a write racing with the load
+// is seen as a change on the next check.
+func loadCertificate(pair config.CertificateConfig) (*tls.Certificate, certSource, error) {
+	source := certSource{CertificateConfig: pair, certMod: modTime(pair.CertFile), keyMod: modTime(pair.KeyFile)}
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		return nil, source, err
+	}
+	source.loaded = true
+	return &cert, source, nil
+}
+
+// newCertStore loads the configured certificates into a store and returns a TLS configuration serving from it.
+// Certificates that fail to load are skipped; if none is usable, falls back to the self-signed certificate.
+// With tls.acme enabled, TLS-ALPN-01 challenge handshakes are answered by the ACME client.
+// MinVersion is always set to TLS 1.2.
+func newCertStore(cfg config.TLSConfig) (*tls.Config, *certStore, error) {
+	set, err := loadCertSet(cfg, false, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	store := &certStore{acme: newACMEClient(cfg.ACME)}
+	store.set.Store(set)
+	tlsCfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: store.getCertificate,
+	}
+	if store.acme != nil {
+		// acme-tls/1 is only offered to challenge handshakes, so clients sending other ALPN values are unaffected
+		challenge := store.acme.challengeConfig()
+		tlsCfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			if isChallenge(hello) {
+				return challenge, nil
+			}
+			return nil, nil
+		}
+	}
+	return tlsCfg, store, nil
+}
+
+// SelfSignedFingerprint returns the SHA-256 fingerprint of the self-signed certificate in use,
+// or "" when configured certificates or ACME certificates are served instead.
+func (s *Server) SelfSignedFingerprint() string {
+	set := s.certs.set.Load()
+	if set.selfSigned == nil || s.certs.acme != nil {
+		return ""
+	}
+	return util.CertificateFingerprint(set.selfSigned.Certificate[0])
+}
+
+// reloadChangedCertificates reloads the certificates if any certificate file has been modified or has appeared.
+// The current certificates are kept when a certificate that was in use fails to load.
+func (s *Server) reloadChangedCertificates() error {
+	current := s.certs.set.Load()
+	if !current.changed() {
+		return nil
+	}
+	set, err := loadCertSet(current.config, true, current)
+	if err != nil {
+		return err
+	}
+	// 期间配置热重载已替换证书时以新配置为准
+	if !s.certs.set.CompareAndSwap(current, set) {
+		return nil
+	}
+	s.logger.WithField("certificates", len(set.certs)).Info("TLS 证书文件已修改，已重新加载")
+	return nil
+}
+
+// watchCertificates periodically reloads certificate files that have been modified.
+func (s *Server) watchCertificates(ctx context.Context) {
+	util.StartRoutine(ctx, certWatchInterval, func() {
+		if err := s.reloadChangedCertificates(); err != nil {
+			s.logger.WithError(err).Error("重新加载 TLS 证书失败，继续使用当前证书")
+		}
+	})
 }
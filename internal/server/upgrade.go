@@ -0,0 +1,300 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"anytls/internal/ledger"
+	"anytls/internal/traffic"
+)
+
+// upgradeEnv 平滑升级时设置在新进程的环境变量中，新进程据此从继承的文件描述符接管 listener 和流量状态
+const upgradeEnv = "ANYTLS_UPGRADE"
+
+// 新进程继承的文件描述符，与 exec.Cmd.ExtraFiles 的顺序对应
+const (
+	upgradeListenerFD = 3 + iota // 服务端口的 listener
+	upgradeStateFD               // 旧进程写入 handoffState
+	upgradeReadyFD               // 新进程开始接受连接后写入一个字节
+)
+
+// upgradeReadyTimeout 等待新进程开始接受连接的最长时间，超时视为新进程启动失败
+const upgradeReadyTimeout = 30 * time.Second
+
+// upgradeCloseGrace 排空超时、强制关闭剩余会话后，等待连接清理完成的时间
+const upgradeCloseGrace = 5 * time.Second
+
+// handoffState 旧进程交给新进程的流量计数器状态，共发送两次：
+// 新进程启动时发送当时的状态，旧进程排空现有连接后发送排空期间新增的流量
+type handoffState struct {
+	Pending map[int][2]int64 `json:"pending,omitempty"` // 尚未取出上报（或记账）的流量
+	Totals  map[int][2]int64 `json:"totals,omitempty"`  // 累计流量，用于本地流量配额
+}
+
+// backgroundState 周期任务的运行状态，平滑升级交出状态时停止，新进程启动失败时恢复
+type backgroundState struct {
+	mu     sync.Mutex
+	parent context.Context // Start 的 ctx
+	cancel context.CancelFunc
+}
+
+// stopBackground 停止周期任务，返回启动时的 ctx 用于恢复
+func (s *Server) stopBackground() context.Context {
+	s.background.mu.Lock()
+	defer s.background.mu.Unlock()
+	if s.background.cancel != nil {
+		s.background.cancel()
+	}
+	return s.background.parent
+}
+
+// Handoff 平滑升级时新进程从旧进程继承的 listener 和流量状态
+type Handoff struct {
+	listener net.Listener
+	state    *os.File // 旧进程写入 handoffState
+	decoder  *json.Decoder
+	ready    *os.File // 开始接受连接后通知旧进程
+	initial  handoffState
+}
+
+// InheritedHandoff 读取旧进程交出的 listener 和流量状态，当前进程不是由平滑升级启动时返回 nil, nil
+// 在旧进程交出流量持久化文件之前阻塞，需在 NewServer 之前调用
+func InheritedHandoff() (*Handoff, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	// 之后再次升级时由 Upgrade 重新设置
+	os.Unsetenv(upgradeEnv)
+
+	state := os.NewFile(upgradeStateFD, "upgrade-state")
+	ready := os.NewFile(upgradeReadyFD, "upgrade-ready")
+	lnFile := os.NewFile(upgradeListenerFD, "upgrade-listener")
+	ln, err := net.FileListener(lnFile)
+	lnFile.Close()
+	if err != nil {
+		state.Close()
+		ready.Close()
+		return nil, fmt.Errorf("接管旧进程的 listener 失败: %w", err)
+	}
+	h := &Handoff{listener: ln, state: state, decoder: json.NewDecoder(state), ready: ready}
+	if err := h.decoder.Decode(&h.initial); err != nil {
+		ln.Close()
+		state.Close()
+		ready.Close()
+		return nil, fmt.Errorf("读取旧进程交出的流量状态失败: %w", err)
+	}
+	return h, nil
+}
+
+// Inherit 使用旧进程交出的 listener 和流量状态，需在 Start 之前调用
+// Start 开始接受连接后通知旧进程停止接受新连接，并在后台接收旧进程排空期间的流量
+func (s *Server) Inherit(h *Handoff) {
+	s.listener = h.listener
+	s.handoff = h
+	s.applyHandoff(h.initial)
+}
+
+// applyHandoff 将旧进程交出的流量计入计数器
+func (s *Server) applyHandoff(state handoffState) {
+	s.trafficCounter.Merge(state.Pending)
+	s.trafficCounter.AddTotals(state.Totals)
+}
+
+// finishHandoff 通知旧进程已开始接受连接，再接收旧进程排空现有连接期间的流量
+func (s *Server) finishHandoff(h *Handoff) {
+	defer h.state.Close()
+	_, err := h.ready.Write([]byte{1})
+	h.ready.Close()
+	if err != nil {
+		s.logger.WithError(err).Error("通知旧进程失败")
+		return
+	}
+	var final handoffState
+	if err := h.decoder.Decode(&final); err != nil {
+		s.logger.WithError(err).Error("接收旧进程排空期间的流量失败")
+		return
+	}
+	s.applyHandoff(final)
+	s.logger.WithField("users", len(final.Totals)).Info("平滑升级完成，已接收旧进程排空期间的流量")
+}
+
+// Upgrade 平滑升级：以 name 和 args 启动新进程，交出服务端口的 listener 和流量计数器状态；
+// 新进程开始接受连接后停止接受新连接，等待现有连接结束（ctx 结束时强制关闭剩余会话），
+// 最后把排空期间的流量交给新进程。
+// 新进程启动失败时恢复运行并返回错误；返回 nil 后调用方应直接退出，不再调用 Shutdown
+func (s *Server) Upgrade(ctx context.Context, name string, args ...string) error {
+	tcpLn, ok := s.listener.(*net.TCPListener)
+	if !ok {
+		return errors.New("服务尚未开始监听")
+	}
+	lnFile, err := tcpLn.File()
+	if err != nil {
+		return fmt.Errorf("复制 listener 失败: %w", err)
+	}
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		lnFile.Close()
+		return err
+	}
+	defer stateW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		lnFile.Close()
+		stateR.Close()
+		return err
+	}
+	defer readyR.Close()
+
+	cmd := exec.Command(name, args...)
+	cmd.Env = append(os.Environ(), upgradeEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{lnFile, stateR, readyW}
+	err = cmd.Start()
+	// 新进程持有自己的副本
+	lnFile.Close()
+	stateR.Close()
+	readyW.Close()
+	if err != nil {
+		return fmt.Errorf("启动新进程失败: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	s.logger.WithField("pid", cmd.Process.Pid).Info("平滑升级：新进程已启动")
+
+	// 交出持久化状态：停止周期任务，关闭流量发件箱、账本和监听的辅助端口，由新进程重新打开
+	parent := s.stopBackground()
+	pending, err := s.outbox.Handoff()
+	if err != nil {
+		cmd.Process.Kill()
+		s.startBackground(parent)
+		return fmt.Errorf("交出流量状态失败: %w", err)
+	}
+	s.closeAuxiliary()
+	totals := s.trafficCounter.Totals()
+
+	// 等待新进程开始接受连接；新进程退出时管道的写端全部关闭，读取返回 EOF
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	err = json.NewEncoder(stateW).Encode(handoffState{Pending: pending, Totals: totals})
+	if err == nil {
+		select {
+		case err = <-ready:
+			if errors.Is(err, io.EOF) {
+				err = errors.New("新进程未开始接受连接即退出")
+			}
+		case <-time.After(upgradeReadyTimeout):
+			err = errors.New("等待新进程开始接受连接超时")
+		}
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		<-exited
+		s.resume(parent, pending)
+		return fmt.Errorf("平滑升级失败，已恢复运行: %w", err)
+	}
+
+	s.logger.Info("平滑升级：新进程已开始接受连接，停止接受新连接并等待现有连接结束")
+	s.listener.Close()
+	s.drain(ctx)
+
+	final := handoffState{
+		Pending: s.trafficCounter.Snapshot(),
+		Totals:  trafficDelta(s.trafficCounter.Totals(), totals),
+	}
+	if err := json.NewEncoder(stateW).Encode(final); err != nil {
+		s.logger.WithError(err).Error("交出排空期间的流量失败")
+	}
+	return nil
+}
+
+// closeAuxiliary 关闭账本和指标、管理接口、ACME HTTP-01 验证端口，交给新进程重新打开
+func (s *Server) closeAuxiliary() {
+	if s.ledger != nil {
+		s.ledger.Close()
+	}
+	if s.metricsServer != nil {
+		s.metricsServer.Close()
+	}
+	if s.adminServer != nil {
+		s.adminServer.Close()
+	}
+	if s.acmeServer != nil {
+		s.acmeServer.Close()
+	}
+}
+
+// resume 新进程启动失败时收回交出的状态，重新打开持久化文件并恢复周期任务
+func (s *Server) resume(parent context.Context, pending map[int][2]int64) {
+	cfg := s.config()
+	s.trafficCounter.Merge(pending)
+	outbox, err := traffic.OpenOutbox(cfg.Traffic.PersistPath, s.trafficCounter, cfg.Traffic.OutboxMaxBatches)
+	if err != nil {
+		s.logger.WithError(err).Error("重新打开流量持久化文件失败，待上报流量只保存在内存中")
+		outbox, _ = traffic.OpenOutbox("", s.trafficCounter, cfg.Traffic.OutboxMaxBatches)
+	}
+	s.outbox = outbox
+
+	if s.ledger != nil {
+		if s.ledger, err = ledger.Open(cfg.Ledger.Path); err != nil {
+			s.logger.WithError(err).Error("重新打开流量账本失败，停止记账")
+			s.ledger = nil
+		}
+	}
+	if err := s.startMetrics(); err != nil {
+		s.logger.WithError(err).Error("重新启动指标接口失败")
+	}
+	if err := s.startAdmin(); err != nil {
+		s.logger.WithError(err).Error("重新启动管理接口失败")
+	}
+	if err := s.startACMEHTTP(); err != nil {
+		s.logger.WithError(err).Error("重新启动 ACME HTTP-01 验证端口失败")
+	}
+	s.startBackground(parent)
+}
+
+// drain 等待现有连接结束，ctx 结束时强制关闭剩余会话
+func (s *Server) drain(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		s.logger.Info("所有连接已关闭")
+		return
+	case <-ctx.Done():
+	}
+	closed := s.sessions.closeAll()
+	s.logger.WithField("sessions", closed).Warn("等待连接关闭超时，强制关闭剩余会话")
+	select {
+	case <-done:
+	case <-time.After(upgradeCloseGrace):
+	}
+}
+
+// trafficDelta 返回 after 相对 before 增加的流量
+func trafficDelta(after, before map[int][2]int64) map[int][2]int64 {
+	delta := make(map[int][2]int64)
+	for userID, t := range after {
+		b := before[userID]
+		if d := [2]int64{t[0] - b[0], t[1] - b[1]}; d != [2]int64{} {
+			delta[userID] = d
+		}
+	}
+	return delta
+}
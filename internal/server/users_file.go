@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"anytls/internal/user"
+	"anytls/util"
+
+	"github.com/sirupsen/logrus"
+)
+
+// usersFileState 独立模式用户文件的加载状态
+type usersFileState struct {
+	mu         sync.Mutex
+	modTime    time.Time
+	users      []user.FileUser
+	nextExpiry time.Time // 当前用户中最早的到期时间，到期后重新应用用户列表
+}
+
+// ReloadUsers 重新加载独立模式的用户文件，文件无效时保留当前用户
+// 未配置 users_file 时不做任何事
+func (s *Server) ReloadUsers() error {
+	path := s.config().UsersFile
+	if path == "" {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	users, err := user.LoadFile(path)
+	if err != nil {
+		return err
+	}
+
+	s.usersFile.mu.Lock()
+	defer s.usersFile.mu.Unlock()
+	s.usersFile.modTime = info.ModTime()
+	s.usersFile.users = users
+	count := s.applyFileUsers(time.Now())
+	s.logger.WithFields(logrus.Fields{
+		"path":   path,
+		"users":  len(users),
+		"active": count,
+	}).Info("用户文件已加载")
+	return nil
+}
+
+// applyFileUsers 应用用户文件中未过期的用户，返回应用的用户数，调用方需持有 usersFile.mu
+func (s *Server) applyFileUsers(now time.Time) int {
+	active, nextExpiry := user.ActiveUsers(s.usersFile.users, now)
+	s.usersFile.nextExpiry = nextExpiry
+	s.applyUsers(active)
+	return len(active)
+}
+
+// watchUsersFile 监视用户文件，修改后重新加载；有用户到期时重新应用用户列表并断开其会话
+func (s *Server) watchUsersFile(ctx context.Context) {
+	path := s.config().UsersFile
+	util.StartRoutine(ctx, configWatchInterval, func() {
+		s.usersFile.mu.Lock()
+		modTime, nextExpiry := s.usersFile.modTime, s.usersFile.nextExpiry
+		now := time.Now()
+		if !nextExpiry.IsZero() && !now.Before(nextExpiry) {
+			count := s.applyFileUsers(now)
+			s.logger.WithField("active", count).Info("有用户已到期，用户列表已更新")
+		}
+		s.usersFile.mu.Unlock()
+
+		info, err := os.Stat(path)
+		if err != nil || info.ModTime().Equal(modTime) {
+			return
+		}
+		if err := s.ReloadUsers(); err != nil {
+			s.logger.WithError(err).Error("重新加载用户文件失败，保留当前用户")
+		}
+	})
+}
@@ -15,27 +15,96 @@ type UserTraffic struct {
 type Counter struct {
 	mu       sync.Mutex
 	counters map[int]*UserTraffic
+	totals   map[int]*UserTraffic // 进程启动以来的累计流量，不随 Snapshot 清零
 }
 
 // NewCounter 创建流量计数器
 func NewCounter() *Counter {
 	return &Counter{
 		counters: make(map[int]*UserTraffic),
+		totals:   make(map[int]*UserTraffic),
 	}
 }
 
 // Add 累加流量
 func (c *Counter) Add(userID int, upload, download int64) {
+	c.add(userID, upload, download, true)
+}
+
+// add 累加待上报流量，countTotal 为 true 时同时累加累计流量
+func (c *Counter) add(userID int, upload, download int64, countTotal bool) {
 	c.mu.Lock()
 	ut, ok := c.counters[userID]
 	if !ok {
 		ut = &UserTraffic{}
 		c.counters[userID] = ut
 	}
+	var total *UserTraffic
+	if countTotal {
+		total, ok = c.totals[userID]
+		if !ok {
+			total = &UserTraffic{}
+			c.totals[userID] = total
+		}
+	}
 	c.mu.Unlock()
 
 	ut.Upload.Add(upload)
 	ut.Download.Add(download)
+	if total != nil {
+		total.Upload.Add(upload)
+		total.Download.Add(download)
+	}
+}
+
+// Totals 返回每个用户进程启动以来的累计流量 [upload, download]
+// 回滚和从文件恢复的流量不计入累计值
+func (c *Counter) Totals() map[int][2]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	totals := make(map[int][2]int64, len(c.totals))
+	for uid, ut := range c.totals {
+		totals[uid] = [2]int64{ut.Upload.Load(), ut.Download.Load()}
+	}
+	return totals
+}
+
+// Total 返回单个用户进程启动以来的累计流量 [upload, download]
+func (c *Counter) Total(userID int) [2]int64 {
+	c.mu.Lock()
+	ut, ok := c.totals[userID]
+	c.mu.Unlock()
+	if !ok {
+		return [2]int64{}
+	}
+	return [2]int64{ut.Upload.Load(), ut.Download.Load()}
+}
+
+// Pending 返回每个用户尚未上报的流量 [upload, download]，不清零
+func (c *Counter) Pending() map[int][2]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	pending := make(map[int][2]int64, len(c.counters))
+	for uid, ut := range c.counters {
+		up, down := ut.Upload.Load(), ut.Download.Load()
+		if up > 0 || down > 0 {
+			pending[uid] = [2]int64{up, down}
+		}
+	}
+	return pending
+}
+
+// UserPending 返回单个用户尚未上报的流量 [upload, download]，不清零
+func (c *Counter) UserPending(userID int) [2]int64 {
+	c.mu.Lock()
+	ut, ok := c.counters[userID]
+	c.mu.Unlock()
+	if !ok {
+		return [2]int64{}
+	}
+	return [2]int64{ut.Upload.Load(), ut.Download.Load()}
 }
 
 // Snapshot 获取快照并清零已快照的数据
@@ -66,6 +135,21 @@ func (c *Counter) Snapshot() map[int][2]int64 {
 // Merge 合并流量数据（用于从持久化文件恢复）
 func (c *Counter) Merge(data map[int][2]int64) {
 	for uid, traffic := range data {
-		c.Add(uid, traffic[0], traffic[1])
+		c.add(uid, traffic[0], traffic[1], false)
+	}
+}
+
+// AddTotals 累加累计流量，不计入待上报流量（用于升级时继承旧进程的累计值）
+func (c *Counter) AddTotals(data map[int][2]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for uid, traffic := range data {
+		total, ok := c.totals[uid]
+		if !ok {
+			total = &UserTraffic{}
+			c.totals[uid] = total
+		}
+		total.Upload.Add(traffic[0])
+		total.Download.Add(traffic[1])
 	}
 }
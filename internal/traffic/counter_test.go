@@ -285,3 +285,27 @@ func TestProperty8_PersistenceRoundTrip(t *testing.T) {
 
 	properties.TestingRun(t)
 }
+
+func TestCounter_Totals(t *testing.T) {
+	c := NewCounter()
+	c.Add(1, 100, 200)
+	c.Add(2, 10, 20)
+
+	// Snapshot 清零待上报流量，但不影响累计值
+	snap := c.Snapshot()
+	c.Add(1, 1, 2)
+
+	// 上报失败回滚和从文件恢复的流量不重复计入累计值
+	c.Merge(snap)
+
+	totals := c.Totals()
+	if totals[1] != [2]int64{101, 202} {
+		t.Errorf("user 1 totals = %v, want [101 202]", totals[1])
+	}
+	if totals[2] != [2]int64{10, 20} {
+		t.Errorf("user 2 totals = %v, want [10 20]", totals[2])
+	}
+	if pending := c.Snapshot(); pending[1] != [2]int64{101, 202} {
+		t.Errorf("user 1 pending = %v, want [101 202]", pending[1])
+	}
+}
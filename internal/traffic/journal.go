@@ -0,0 +1,416 @@
+package traffic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"anytls/util"
+)
+
+// ErrClosed 流量持久化已关闭或已交给其他进程
+var ErrClosed = errors.New("流量持久化已关闭")
+
+// Batch 一批已从计数器取出、等待上报确认的流量
+type Batch struct {
+	ID        uint64
+	CreatedAt time.Time // 批次中最早的流量取出的时间
+	Data      map[int][2]int64
+	// Attempted 批次至少发送过一次，对端可能已经收到，不能再与其他批次合并
+	Attempted bool
+}
+
+// Key 批次的幂等键
+func (b Batch) Key() string {
+	return strconv.FormatUint(b.ID, 10)
+}
+
+// walRecord 预写日志中的一行
+type walRecord struct {
+	Op   string              `json:"op"`
+	ID   uint64              `json:"id"`
+	Time int64               `json:"ts,omitempty"`   // 批次创建时间（UnixNano）
+	From []uint64            `json:"from,omitempty"` // coalesce: 被合并的批次
+	Data map[string][2]int64 `json:"data,omitempty"`
+}
+
+const (
+	walBegin    = "begin"    // 取出新批次
+	walAttempt  = "attempt"  // 即将发送批次
+	walCommit   = "commit"   // 批次已确认
+	walCoalesce = "coalesce" // 多个从未发送的批次合并为新批次
+)
+
+// Journal 流量持久化
+// 状态文件保存计数器中尚未取出的流量，预写日志（<path>.wal）保存已取出、等待上报确认的批次。
+// 取出批次时先写日志再保存状态文件，状态文件记录保存时最后一个已取出的批次 ID；
+// 恢复时如果日志中有比该 ID 更新的批次，说明保存状态文件前发生了崩溃，
+// 状态文件中的流量已全部包含在该批次中，不再重复恢复
+type Journal struct {
+	mu      sync.Mutex
+	counter *Counter
+	path    string   // 状态文件路径，为空时批次只保存在内存中
+	wal     *os.File // 预写日志，追加写入
+	lastID  uint64
+	savedID uint64  // 最近一次成功保存状态文件时的 lastID
+	batches []Batch // 未确认的批次，按 ID 升序
+	closed  bool    // 关闭或交出后不再读写文件
+}
+
+// OpenJournal 打开流量持久化文件，恢复未上报的流量和未确认的批次
+// path 为空时不读写文件
+func OpenJournal(path string, counter *Counter) (*Journal, error) {
+	j := &Journal{counter: counter, path: path}
+	if path == "" {
+		return j, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("创建流量持久化目录失败: %w", err)
+	}
+
+	pending, stateBatch, err := readState(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.readWAL(); err != nil {
+		return nil, err
+	}
+	// 日志中出现过（包括已确认的）比状态文件更新的批次时，状态文件中的流量已包含在批次中
+	if j.lastID <= stateBatch {
+		counter.Merge(pending)
+	}
+	j.lastID = max(j.lastID, stateBatch)
+	if err := j.saveLocked(); err != nil {
+		return nil, err
+	}
+
+	// 状态文件已与日志一致，日志只保留未确认的批次
+	var buf bytes.Buffer
+	for _, batch := range j.batches {
+		writeRecord(&buf, beginRecord(batch))
+		if batch.Attempted {
+			writeRecord(&buf, walRecord{Op: walAttempt, ID: batch.ID})
+		}
+	}
+	if err := util.WriteFileAtomic(j.walPath(), buf.Bytes(), 0600); err != nil {
+		return nil, fmt.Errorf("整理流量预写日志失败: %w", err)
+	}
+	if j.wal, err = os.OpenFile(j.walPath(), os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return nil, fmt.Errorf("打开流量预写日志失败: %w", err)
+	}
+	return j, nil
+}
+
+func (j *Journal) walPath() string {
+	return j.path + ".wal"
+}
+
+// readWAL 读取预写日志中未确认的批次，容忍写入时崩溃留下的不完整最后一行
+func (j *Journal) readWAL() error {
+	data, err := os.ReadFile(j.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("读取流量预写日志失败: %w", err)
+	}
+	lines := bytes.Split(data, []byte("\n"))
+	for i, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var rec walRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if i == len(lines)-1 {
+				break
+			}
+			return fmt.Errorf("流量预写日志第 %d 行格式错误: %w", i+1, err)
+		}
+		j.lastID = max(j.lastID, rec.ID)
+		switch rec.Op {
+		case walBegin:
+			j.batches = append(j.batches, Batch{ID: rec.ID, CreatedAt: time.Unix(0, rec.Time), Data: decodeData(rec.Data)})
+		case walAttempt:
+			if i := j.index(rec.ID); i >= 0 {
+				j.batches[i].Attempted = true
+			}
+		case walCommit:
+			j.remove(rec.ID)
+		case walCoalesce:
+			for _, id := range rec.From {
+				j.remove(id)
+			}
+			j.batches = append(j.batches, Batch{ID: rec.ID, CreatedAt: time.Unix(0, rec.Time), Data: decodeData(rec.Data)})
+		}
+	}
+	return nil
+}
+
+// Begin 从计数器取出当前流量作为新批次，写入预写日志后保存状态文件
+// 没有流量时不创建批次；写入日志失败时流量合并回计数器
+func (j *Journal) Begin() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return ErrClosed
+	}
+
+	snapshot := j.counter.Snapshot()
+	if len(snapshot) == 0 {
+		return nil
+	}
+	now := time.Now()
+	batch := Batch{ID: j.nextID(now), CreatedAt: now, Data: snapshot}
+	if err := j.append(beginRecord(batch)); err != nil {
+		j.counter.Merge(snapshot)
+		return err
+	}
+	j.lastID = batch.ID
+	j.batches = append(j.batches, batch)
+	return j.saveLocked()
+}
+
+// nextID 返回新批次的 ID，单调递增，并以时间为下限，重启后清空日志也不会与之前的批次重复
+func (j *Journal) nextID(now time.Time) uint64 {
+	return max(j.lastID+1, uint64(now.UnixNano()))
+}
+
+// Coalesce 将所有从未发送过的批次合并为一个新批次，返回被合并的批次数
+// 发送过的批次对端可能已经收到，合并后换了 ID 会导致重复计费，因此保持不变
+func (j *Journal) Coalesce() (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return 0, ErrClosed
+	}
+
+	now := time.Now()
+	var from []uint64
+	merged := Batch{ID: j.nextID(now), CreatedAt: now, Data: make(map[int][2]int64)}
+	kept := make([]Batch, 0, len(j.batches))
+	for _, batch := range j.batches {
+		if batch.Attempted {
+			kept = append(kept, batch)
+			continue
+		}
+		from = append(from, batch.ID)
+		if batch.CreatedAt.Before(merged.CreatedAt) {
+			merged.CreatedAt = batch.CreatedAt
+		}
+		for uid, traffic := range batch.Data {
+			m := merged.Data[uid]
+			merged.Data[uid] = [2]int64{m[0] + traffic[0], m[1] + traffic[1]}
+		}
+	}
+	if len(from) < 2 {
+		return 0, nil
+	}
+	rec := beginRecord(merged)
+	rec.Op, rec.From = walCoalesce, from
+	if err := j.append(rec); err != nil {
+		return 0, err
+	}
+	j.lastID = merged.ID
+	j.batches = append(kept, merged)
+	return len(from), j.saveLocked()
+}
+
+// Outstanding 返回所有未确认的批次，按 ID 升序
+func (j *Journal) Outstanding() []Batch {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return append([]Batch(nil), j.batches...)
+}
+
+// Pending 返回未确认批次中每个用户的流量合计
+func (j *Journal) Pending() map[int][2]int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	pending := make(map[int][2]int64)
+	for _, batch := range j.batches {
+		for uid, traffic := range batch.Data {
+			p := pending[uid]
+			pending[uid] = [2]int64{p[0] + traffic[0], p[1] + traffic[1]}
+		}
+	}
+	return pending
+}
+
+// Unreported 返回用户尚未确认上报的流量 [upload, download]：计数器中尚未取出的流量加上未确认的批次
+func (j *Journal) Unreported(userID int) [2]int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// 持有 mu 时 Begin 不会把计数器中的流量移入批次，两部分不会重复或遗漏
+	unreported := j.counter.UserPending(userID)
+	for _, batch := range j.batches {
+		traffic := batch.Data[userID]
+		unreported = [2]int64{unreported[0] + traffic[0], unreported[1] + traffic[1]}
+	}
+	return unreported
+}
+
+// Attempt 记录批次即将发送，此后该批次不再参与合并
+func (j *Journal) Attempt(id uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	i := j.index(id)
+	if i < 0 || j.batches[i].Attempted {
+		return nil
+	}
+	if err := j.append(walRecord{Op: walAttempt, ID: id}); err != nil {
+		return err
+	}
+	j.batches[i].Attempted = true
+	return nil
+}
+
+// Commit 确认批次已上报，所有批次都确认后清空预写日志
+func (j *Journal) Commit(id uint64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.append(walRecord{Op: walCommit, ID: id}); err != nil {
+		return err
+	}
+	j.remove(id)
+	// 状态文件落后于日志时保留日志，恢复时据此丢弃过期的状态文件
+	if len(j.batches) == 0 && j.wal != nil && j.savedID == j.lastID {
+		if err := j.wal.Truncate(0); err != nil {
+			return fmt.Errorf("清空流量预写日志失败: %w", err)
+		}
+	}
+	return nil
+}
+
+// Save 将计数器中尚未取出的流量保存到状态文件
+func (j *Journal) Save() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return ErrClosed
+	}
+	return j.saveLocked()
+}
+
+func (j *Journal) saveLocked() error {
+	if j.path == "" {
+		return nil
+	}
+	if err := writeState(j.path, j.counter.Pending(), j.lastID); err != nil {
+		return err
+	}
+	j.savedID = j.lastID
+	return nil
+}
+
+// Close 关闭预写日志，之后 Begin 和 Save 返回 ErrClosed
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.closeLocked()
+}
+
+func (j *Journal) closeLocked() error {
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	if j.wal == nil {
+		return nil
+	}
+	return j.wal.Close()
+}
+
+// Handoff 关闭持久化文件，取出计数器中尚未取出的流量交给调用方，用于平滑升级时交给新进程
+// 状态文件中不再保留这部分流量；未确认的批次留在预写日志中，由新进程打开同一路径后继续发送。
+// 没有持久化文件时未确认的批次只在内存中，一并并入返回值
+func (j *Journal) Handoff() (map[int][2]int64, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.closed {
+		return nil, ErrClosed
+	}
+
+	pending := j.counter.Snapshot()
+	if j.path == "" {
+		for _, batch := range j.batches {
+			for uid, traffic := range batch.Data {
+				p := pending[uid]
+				pending[uid] = [2]int64{p[0] + traffic[0], p[1] + traffic[1]}
+			}
+		}
+		j.batches = nil
+	} else if err := writeState(j.path, nil, j.lastID); err != nil {
+		j.counter.Merge(pending)
+		return nil, err
+	}
+	// 日志每次写入都已 fsync，关闭失败不影响新进程读取
+	j.closeLocked()
+	return pending, nil
+}
+
+// append 写入一行日志并 fsync，调用方需持有 mu
+func (j *Journal) append(rec walRecord) error {
+	if j.wal == nil {
+		return nil
+	}
+	var buf bytes.Buffer
+	writeRecord(&buf, rec)
+	if _, err := j.wal.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("写入流量预写日志失败: %w", err)
+	}
+	if err := j.wal.Sync(); err != nil {
+		return fmt.Errorf("写入流量预写日志失败: %w", err)
+	}
+	return nil
+}
+
+// index 返回批次在 batches 中的位置，不存在时返回 -1
+func (j *Journal) index(id uint64) int {
+	for i, batch := range j.batches {
+		if batch.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// remove 移除批次，调用方需持有 mu 或尚未共享 Journal
+func (j *Journal) remove(id uint64) {
+	if i := j.index(id); i >= 0 {
+		j.batches = append(j.batches[:i], j.batches[i+1:]...)
+	}
+}
+
+func beginRecord(batch Batch) walRecord {
+	return walRecord{Op: walBegin, ID: batch.ID, Time: batch.CreatedAt.UnixNano(), Data: encodeData(batch.Data)}
+}
+
+func writeRecord(buf *bytes.Buffer, rec walRecord) {
+	json.NewEncoder(buf).Encode(rec)
+}
+
+func encodeData(data map[int][2]int64) map[string][2]int64 {
+	encoded := make(map[string][2]int64, len(data))
+	for uid, traffic := range data {
+		encoded[strconv.Itoa(uid)] = traffic
+	}
+	return encoded
+}
+
+func decodeData(data map[string][2]int64) map[int][2]int64 {
+	decoded := make(map[int][2]int64, len(data))
+	for uidStr, traffic := range data {
+		uid, err := strconv.Atoi(uidStr)
+		if err != nil {
+			continue
+		}
+		decoded[uid] = traffic
+	}
+	return decoded
+}
@@ -0,0 +1,183 @@
+package traffic
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// TestJournal_PushCycle 测试正常的取出、确认流程，以及确认前崩溃后的恢复
+func TestJournal_PushCycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	c := NewCounter()
+	j, err := OpenJournal(path, c)
+	if err != nil {
+		t.Fatalf("OpenJournal failed: %v", err)
+	}
+	c.Add(1, 100, 200)
+	if err := j.Begin(); err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	c.Add(1, 1, 2)
+	if err := j.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+	batches := j.Outstanding()
+	if len(batches) != 1 || batches[0].Data[1] != [2]int64{100, 200} {
+		t.Fatalf("outstanding = %+v, want one batch of [100 200]", batches)
+	}
+	j.Close()
+
+	// 上报确认前崩溃：批次仍待上报，状态文件中只有批次之后的流量
+	c2 := NewCounter()
+	j2, err := OpenJournal(path, c2)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if got := j2.Outstanding(); len(got) != 1 || got[0].ID != batches[0].ID || !got[0].CreatedAt.Equal(batches[0].CreatedAt) || !reflect.DeepEqual(got[0].Data, batches[0].Data) {
+		t.Errorf("recovered batches = %+v, want %+v", got, batches)
+	}
+	if got := c2.Pending(); !reflect.DeepEqual(got, map[int][2]int64{1: {1, 2}}) {
+		t.Errorf("recovered pending = %v, want [1 2]", got)
+	}
+
+	if err := j2.Commit(batches[0].ID); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	if info, _ := os.Stat(path + ".wal"); info.Size() != 0 {
+		t.Errorf("wal size = %d after all batches committed, want 0", info.Size())
+	}
+	j2.Close()
+
+	// 确认后重启：已上报的批次不再出现
+	c3 := NewCounter()
+	j3, err := OpenJournal(path, c3)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j3.Close()
+	if len(j3.Outstanding()) != 0 {
+		t.Errorf("committed batch recovered again: %+v", j3.Outstanding())
+	}
+	if got := c3.Pending(); !reflect.DeepEqual(got, map[int][2]int64{1: {1, 2}}) {
+		t.Errorf("recovered pending = %v, want [1 2]", got)
+	}
+}
+
+// TestJournal_CrashBeforeStateSave 测试写入日志后、保存状态文件前崩溃：状态文件中的流量不重复恢复
+func TestJournal_CrashBeforeStateSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	c := NewCounter()
+	c.Add(1, 100, 200)
+	// 上一次保存的状态文件
+	if err := writeState(path, c.Pending(), 3); err != nil {
+		t.Fatal(err)
+	}
+	// 崩溃前写入的批次包含状态文件中的流量，最后一行写了一半
+	wal := `{"op":"begin","id":3,"data":{"2":[1,1]}}` + "\n" +
+		`{"op":"commit","id":3}` + "\n" +
+		`{"op":"begin","id":4,"data":{"1":[150,250]}}` + "\n" +
+		`{"op":"commit","id":4`
+	if err := os.WriteFile(path+".wal", []byte(wal), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c2 := NewCounter()
+	j, err := OpenJournal(path, c2)
+	if err != nil {
+		t.Fatalf("OpenJournal failed: %v", err)
+	}
+	defer j.Close()
+	if pending := c2.Pending(); len(pending) != 0 {
+		t.Errorf("pending = %v, stale state file should be discarded", pending)
+	}
+	batches := j.Outstanding()
+	if len(batches) != 1 || batches[0].ID != 4 || batches[0].Data[1] != [2]int64{150, 250} {
+		t.Errorf("outstanding = %+v, want batch 4", batches)
+	}
+
+	// 新批次的 ID 大于已有批次
+	c2.Add(1, 1, 1)
+	j.Begin()
+	if batches := j.Outstanding(); len(batches) != 2 || batches[1].ID <= 4 {
+		t.Errorf("outstanding = %+v, want a new batch after 4", batches)
+	}
+}
+
+// TestJournal_InMemory 测试未配置路径时只在内存中保存批次
+func TestJournal_InMemory(t *testing.T) {
+	c := NewCounter()
+	j, err := OpenJournal("", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Add(1, 1, 2)
+	j.Begin()
+	c.Add(1, 3, 4)
+	j.Begin()
+	if got := j.Pending(); got[1] != [2]int64{4, 6} {
+		t.Errorf("pending = %v, want [4 6]", got)
+	}
+	c.Add(1, 5, 5)
+	if got := j.Unreported(1); got != [2]int64{9, 11} {
+		t.Errorf("unreported = %v, want batches plus counter [9 11]", got)
+	}
+	for _, batch := range j.Outstanding() {
+		j.Commit(batch.ID)
+	}
+	if len(j.Outstanding()) != 0 {
+		t.Error("all batches should be committed")
+	}
+	if got := j.Unreported(1); got != [2]int64{5, 5} {
+		t.Errorf("unreported after commit = %v, want [5 5]", got)
+	}
+}
+
+// TestJournal_Handoff 测试交出持久化文件：计数器中的流量交给调用方，未确认的批次留给重新打开的 Journal
+func TestJournal_Handoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	c := NewCounter()
+	j, err := OpenJournal(path, c)
+	if err != nil {
+		t.Fatalf("OpenJournal failed: %v", err)
+	}
+	c.Add(1, 100, 200)
+	if err := j.Begin(); err != nil {
+		t.Fatalf("Begin failed: %v", err)
+	}
+	c.Add(1, 1, 2)
+	if err := j.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	pending, err := j.Handoff()
+	if err != nil {
+		t.Fatalf("Handoff failed: %v", err)
+	}
+	if !reflect.DeepEqual(pending, map[int][2]int64{1: {1, 2}}) {
+		t.Errorf("handed off pending = %v, want [1 2]", pending)
+	}
+	c.Add(1, 5, 5)
+	if err := j.Begin(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Begin after handoff: err = %v, want ErrClosed", err)
+	}
+	if err := j.Save(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Save after handoff: err = %v, want ErrClosed", err)
+	}
+
+	// 新进程打开同一路径：只恢复未确认的批次，交出的流量不会重复恢复
+	c2 := NewCounter()
+	j2, err := OpenJournal(path, c2)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer j2.Close()
+	if got := j2.Outstanding(); len(got) != 1 || got[0].Data[1] != [2]int64{100, 200} {
+		t.Errorf("outstanding = %+v, want one batch of [100 200]", got)
+	}
+	if got := c2.Pending(); len(got) != 0 {
+		t.Errorf("recovered pending = %v, want empty", got)
+	}
+}
@@ -0,0 +1,95 @@
+package traffic
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxBatches 未确认批次数超过该值时合并从未发送过的批次
+const DefaultMaxBatches = 60
+
+// Outbox 待上报流量的发件箱，在 Journal 的预写日志之上按顺序发送批次
+// 每个批次有唯一且递增的 ID，按顺序发送直到确认，重试时使用相同的 ID 作为幂等键；
+// 对端长时间不可用时，将从未发送过的批次合并，避免日志无限增长
+type Outbox struct {
+	*Journal
+	flushMu    sync.Mutex // 串行化 Flush，同一批次不会被并发发送
+	maxBatches int
+	coalesced  atomic.Int64 // 累计合并的批次数
+}
+
+// OpenOutbox 打开流量持久化文件，恢复未上报的流量和未确认的批次
+// path 为空时不读写文件；maxBatches <= 0 时使用 DefaultMaxBatches
+func OpenOutbox(path string, counter *Counter, maxBatches int) (*Outbox, error) {
+	if maxBatches <= 0 {
+		maxBatches = DefaultMaxBatches
+	}
+	j, err := OpenJournal(path, counter)
+	if err != nil {
+		return nil, err
+	}
+	return &Outbox{Journal: j, maxBatches: maxBatches}, nil
+}
+
+// Begin 从计数器取出当前流量作为新批次，见 Journal.Begin
+// 未确认的批次超过上限时，将所有从未发送过的批次合并为一个
+func (o *Outbox) Begin() error {
+	if err := o.Journal.Begin(); err != nil {
+		return err
+	}
+	if len(o.Outstanding()) <= o.maxBatches {
+		return nil
+	}
+	n, err := o.Coalesce()
+	o.coalesced.Add(int64(n))
+	return err
+}
+
+// Stats 返回未确认的批次数、最早的未确认流量的取出时间（没有批次时为零值）和累计合并的批次数
+func (o *Outbox) Stats() (batches int, oldest time.Time, coalesced int64) {
+	outstanding := o.Outstanding()
+	for _, batch := range outstanding {
+		if oldest.IsZero() || batch.CreatedAt.Before(oldest) {
+			oldest = batch.CreatedAt
+		}
+	}
+	return len(outstanding), oldest, o.coalesced.Load()
+}
+
+// Flush 取出计数器中的流量作为新批次，再按顺序发送所有未确认的批次
+// 发送成功的批次被确认；遇到发送失败时停止，保留剩余批次待下次发送
+func (o *Outbox) Flush(send func(Batch) error) error {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+
+	var errs []error
+	if err := o.Begin(); errors.Is(err, ErrClosed) {
+		return err
+	} else if err != nil {
+		errs = append(errs, err)
+	}
+	for _, batch := range o.Outstanding() {
+		if err := o.Attempt(batch.ID); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := send(batch); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if err := o.Commit(batch.ID); err != nil {
+			errs = append(errs, err)
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Handoff 等待正在进行的 Flush 结束后交出持久化文件，见 Journal.Handoff
+func (o *Outbox) Handoff() (map[int][2]int64, error) {
+	o.flushMu.Lock()
+	defer o.flushMu.Unlock()
+	return o.Journal.Handoff()
+}
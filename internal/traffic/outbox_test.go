@@ -0,0 +1,78 @@
+package traffic
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// TestOutbox_CoalesceWhenBacklogged 测试未确认批次超过上限时合并从未发送的批次，发送过的批次保持原 ID
+func TestOutbox_CoalesceWhenBacklogged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json")
+	c := NewCounter()
+	o, err := OpenOutbox(path, c, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := errors.New("panel unavailable")
+	var attempted []uint64
+	send := func(b Batch) error {
+		attempted = append(attempted, b.ID)
+		return down
+	}
+
+	for i := 0; i < 5; i++ {
+		c.Add(1, 1, 10)
+		if err := o.Flush(send); !errors.Is(err, down) {
+			t.Fatalf("Flush error = %v, want send failure", err)
+		}
+	}
+	batches := o.Outstanding()
+	// 第一个批次发送过，始终按原 ID 重试；其余批次在超过上限时合并
+	if len(batches) > 3 {
+		t.Fatalf("outstanding = %d batches, want at most 3", len(batches))
+	}
+	first := batches[0]
+	if !first.Attempted || first.Data[1] != [2]int64{1, 10} {
+		t.Errorf("first batch = %+v, want the attempted batch with its own traffic", first)
+	}
+	for _, id := range attempted {
+		if id != first.ID {
+			t.Errorf("attempted batch %d, only the first batch should be sent while the panel is down", id)
+		}
+	}
+	total := o.Pending()[1]
+	if total != [2]int64{5, 50} {
+		t.Errorf("pending = %v, want [5 50]", total)
+	}
+	n, oldest, coalesced := o.Stats()
+	if n != len(batches) || !oldest.Equal(first.CreatedAt) || coalesced == 0 {
+		t.Errorf("Stats = %d, %v, %d", n, oldest, coalesced)
+	}
+	o.Close()
+
+	// 重启后合并结果和发送状态都能恢复
+	o2, err := OpenOutbox(path, NewCounter(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o2.Close()
+	recovered := o2.Outstanding()
+	if len(recovered) != len(batches) || !recovered[0].Attempted || recovered[0].ID != first.ID || o2.Pending()[1] != total {
+		t.Errorf("recovered = %+v, want %+v", recovered, batches)
+	}
+
+	// 对端恢复后按 ID 顺序发送
+	var sent []uint64
+	if err := o2.Flush(func(b Batch) error { sent = append(sent, b.ID); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(sent); i++ {
+		if sent[i] <= sent[i-1] {
+			t.Errorf("sent out of order: %v", sent)
+		}
+	}
+	if len(o2.Outstanding()) != 0 {
+		t.Error("all batches should be committed")
+	}
+}
@@ -6,62 +6,77 @@ import (
 	"os"
 	"strconv"
 	"time"
+
+	"anytls/util"
 )
 
 // persistedData 持久化文件格式
 type persistedData struct {
-	Timestamp int64                `json:"timestamp"`
-	Data      map[string][2]int64  `json:"data"`
+	Timestamp int64               `json:"timestamp"`
+	Data      map[string][2]int64 `json:"data"`
+	Batch     uint64              `json:"batch,omitempty"` // 保存时最后一个已取出的批次 ID，见 Journal
 }
 
-// SaveToFile 将当前流量数据写入 JSON 文件
+// SaveToFile 将当前流量数据原子写入 JSON 文件
 func (c *Counter) SaveToFile(path string) error {
-	c.mu.Lock()
-	data := make(map[string][2]int64)
-	for uid, ut := range c.counters {
-		up := ut.Upload.Load()
-		down := ut.Download.Load()
-		if up > 0 || down > 0 {
-			data[strconv.Itoa(uid)] = [2]int64{up, down}
-		}
-	}
-	c.mu.Unlock()
+	return writeState(path, c.Pending(), 0)
+}
 
-	if len(data) == 0 {
-		// 无数据时删除文件
-		os.Remove(path)
+// writeState 原子写入持久化文件，无数据时删除文件
+func writeState(path string, pending map[int][2]int64, batch uint64) error {
+	if len(pending) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("删除流量持久化文件失败: %w", err)
+		}
 		return nil
 	}
 
+	data := make(map[string][2]int64, len(pending))
+	for uid, traffic := range pending {
+		data[strconv.Itoa(uid)] = traffic
+	}
 	pd := persistedData{
 		Timestamp: time.Now().Unix(),
 		Data:      data,
+		Batch:     batch,
 	}
 
 	b, err := json.MarshalIndent(pd, "", "  ")
 	if err != nil {
 		return fmt.Errorf("序列化流量数据失败: %w", err)
 	}
-
-	return os.WriteFile(path, b, 0644)
+	if err := util.WriteFileAtomic(path, b, 0600); err != nil {
+		return fmt.Errorf("写入流量持久化文件失败: %w", err)
+	}
+	return nil
 }
 
 // LoadFromFile 从 JSON 文件恢复流量数据并合并到当前计数器
 func (c *Counter) LoadFromFile(path string) error {
+	data, _, err := readState(path)
+	if err != nil {
+		return err
+	}
+	c.Merge(data)
+	return nil
+}
+
+// readState 读取持久化文件，返回流量数据和保存时的批次 ID，文件不存在时返回空数据
+func readState(path string) (map[int][2]int64, uint64, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // 文件不存在，正常情况
+			return nil, 0, nil // 文件不存在，正常情况
 		}
-		return fmt.Errorf("读取流量持久化文件失败: %w", err)
+		return nil, 0, fmt.Errorf("读取流量持久化文件失败: %w", err)
 	}
 
 	var pd persistedData
 	if err := json.Unmarshal(data, &pd); err != nil {
-		return fmt.Errorf("解析流量持久化文件失败: %w", err)
+		return nil, 0, fmt.Errorf("解析流量持久化文件失败: %w", err)
 	}
 
-	// 转换 string key 为 int 并合并
+	// 转换 string key 为 int
 	merged := make(map[int][2]int64, len(pd.Data))
 	for uidStr, traffic := range pd.Data {
 		uid, err := strconv.Atoi(uidStr)
@@ -70,9 +85,7 @@ func (c *Counter) LoadFromFile(path string) error {
 		}
 		merged[uid] = traffic
 	}
-
-	c.Merge(merged)
-	return nil
+	return merged, pd.Batch, nil
 }
 
 // DeleteFile 删除持久化文件
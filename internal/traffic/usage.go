@@ -0,0 +1,94 @@
+package traffic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"anytls/util"
+)
+
+// usageFile 用量文件格式
+type usageFile struct {
+	Period string           `json:"period"`
+	Users  map[string]int64 `json:"users"`
+}
+
+// Usage 按计费周期累计的已确认流量（上传 + 下载），每次累加后写入文件，重启后继续累计
+// 周期由调用方以字符串标识（如周期第一天的日期），与已保存的周期不同时从零开始
+type Usage struct {
+	mu     sync.Mutex
+	path   string // 为空时只保存在内存中
+	period string
+	totals map[int]int64
+}
+
+// OpenUsage 打开用量文件，不存在时从零开始；path 为空时不读写文件
+func OpenUsage(path string) (*Usage, error) {
+	u := &Usage{path: path, totals: make(map[int]int64)}
+	if path == "" {
+		return u, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("读取流量用量文件失败: %w", err)
+	}
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("流量用量文件格式错误: %w", err)
+	}
+	u.period = f.Period
+	for uidStr, total := range f.Users {
+		if uid, err := strconv.Atoi(uidStr); err == nil {
+			u.totals[uid] = total
+		}
+	}
+	return u, nil
+}
+
+// Add 将已确认的流量计入 period 并写入文件，traffic 格式与 Counter.Snapshot 相同
+// 写入失败时内存中的用量仍然累加
+func (u *Usage) Add(period string, traffic map[int][2]int64) error {
+	if len(traffic) == 0 {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.period != period {
+		u.period = period
+		u.totals = make(map[int]int64)
+	}
+	for uid, t := range traffic {
+		u.totals[uid] += t[0] + t[1]
+	}
+	if u.path == "" {
+		return nil
+	}
+	users := make(map[string]int64, len(u.totals))
+	for uid, total := range u.totals {
+		users[strconv.Itoa(uid)] = total
+	}
+	data, err := json.Marshal(usageFile{Period: u.period, Users: users})
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(u.path, data, 0600); err != nil {
+		return fmt.Errorf("保存流量用量失败: %w", err)
+	}
+	return nil
+}
+
+// Used 返回用户在 period 内已确认的流量
+func (u *Usage) Used(period string, userID int) int64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.period != period {
+		return 0
+	}
+	return u.totals[userID]
+}
@@ -0,0 +1,35 @@
+package traffic
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestUsage_PersistAndReset 测试用量写入文件后重新打开继续累计，进入新的周期后从零开始
+func TestUsage_PersistAndReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traffic.json.quota")
+	u, err := OpenUsage(path)
+	if err != nil {
+		t.Fatalf("OpenUsage failed: %v", err)
+	}
+	if err := u.Add("2026-10-01", map[int][2]int64{1: {100, 200}, 2: {1, 1}}); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	u.Add("2026-10-01", map[int][2]int64{1: {10, 0}})
+
+	u, err = OpenUsage(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if got := u.Used("2026-10-01", 1); got != 310 {
+		t.Errorf("Used after reopen = %d, want 310", got)
+	}
+	if got := u.Used("2026-11-01", 1); got != 0 {
+		t.Errorf("Used in another period = %d, want 0", got)
+	}
+
+	u.Add("2026-11-01", map[int][2]int64{2: {5, 5}})
+	if got, old := u.Used("2026-11-01", 2), u.Used("2026-10-01", 1); got != 10 || old != 0 {
+		t.Errorf("Used after period change = %d, previous period = %d, want 10 and 0", got, old)
+	}
+}
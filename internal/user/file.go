@@ -0,0 +1,115 @@
+package user
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"anytls/internal/api"
+
+	"gopkg.in/yaml.v3"
+)
+
+// expiresAtLayouts 用户文件中 expires_at 支持的时间格式，不带时区的按本地时间解析
+var expiresAtLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02"}
+
+// FileUser 本地用户文件中的用户，用于独立模式
+type FileUser struct {
+	ID            int    `yaml:"id"`
+	Name          string `yaml:"name"`
+	Password      string `yaml:"password"`
+	SpeedLimit    int    `yaml:"speed_limit"`    // Mbps, 0=不限
+	UploadLimit   *int   `yaml:"upload_limit"`   // Mbps，覆盖 speed_limit 的上传方向
+	DownloadLimit *int   `yaml:"download_limit"` // Mbps，覆盖 speed_limit 的下载方向
+	DeviceLimit   int    `yaml:"device_limit"`   // 0=不限
+	ExpiresAt     string `yaml:"expires_at"`     // 到期时间，为空表示永不过期
+
+	expiresAt time.Time
+}
+
+// usersFile 用户文件结构，JSON 是 YAML 的子集，两种格式都可以直接解析
+type usersFile struct {
+	Users []FileUser `yaml:"users"`
+}
+
+// LoadFile 读取并校验本地用户文件
+func LoadFile(path string) ([]FileUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取用户文件失败: %w", err)
+	}
+	var file usersFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("解析用户文件失败: %w", err)
+	}
+
+	ids := make(map[int]bool, len(file.Users))
+	passwords := make(map[string]bool, len(file.Users))
+	for i := range file.Users {
+		u := &file.Users[i]
+		if u.ID <= 0 {
+			return nil, fmt.Errorf("用户文件错误: 第 %d 个用户的 id 必须大于 0", i+1)
+		}
+		if ids[u.ID] {
+			return nil, fmt.Errorf("用户文件错误: 用户 id %d 重复", u.ID)
+		}
+		ids[u.ID] = true
+		if u.Password == "" {
+			return nil, fmt.Errorf("用户文件错误: 用户 %d 的 password 不能为空", u.ID)
+		}
+		if passwords[u.Password] {
+			return nil, fmt.Errorf("用户文件错误: 用户 %d 的 password 与其他用户重复", u.ID)
+		}
+		passwords[u.Password] = true
+		if u.ExpiresAt != "" {
+			if u.expiresAt, err = parseExpiresAt(u.ExpiresAt); err != nil {
+				return nil, fmt.Errorf("用户文件错误: 用户 %d 的 expires_at 无效: %s", u.ID, u.ExpiresAt)
+			}
+		}
+	}
+	return file.Users, nil
+}
+
+func parseExpiresAt(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	var err error
+	for _, layout := range expiresAtLayouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+// Expired 判断用户在 now 时是否已过期
+func (u *FileUser) Expired(now time.Time) bool {
+	return !u.expiresAt.IsZero() && !now.Before(u.expiresAt)
+}
+
+// ActiveUsers 将未过期的用户转换为 UpdateUsers 使用的用户列表，密码作为 UUID
+// 同时返回未过期用户中最早的到期时间，没有待到期用户时为零值
+func ActiveUsers(users []FileUser, now time.Time) ([]api.User, time.Time) {
+	active := make([]api.User, 0, len(users))
+	var nextExpiry time.Time
+	for i := range users {
+		u := &users[i]
+		if u.Expired(now) {
+			continue
+		}
+		if !u.expiresAt.IsZero() && (nextExpiry.IsZero() || u.expiresAt.Before(nextExpiry)) {
+			nextExpiry = u.expiresAt
+		}
+		speedLimit, deviceLimit := u.SpeedLimit, u.DeviceLimit
+		active = append(active, api.User{
+			ID:            u.ID,
+			UUID:          u.Password,
+			SpeedLimit:    &speedLimit,
+			UploadLimit:   u.UploadLimit,
+			DownloadLimit: u.DownloadLimit,
+			DeviceLimit:   &deviceLimit,
+		})
+	}
+	return active, nextExpiry
+}
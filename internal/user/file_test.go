@@ -0,0 +1,78 @@
+package user
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeUsersFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile_YAMLAndJSON(t *testing.T) {
+	yamlPath := writeUsersFile(t, `
+users:
+  - id: 1
+    name: alice
+    password: "pass-1"
+    speed_limit: 50
+    download_limit: 100
+    device_limit: 2
+  - id: 2
+    name: bob
+    password: "pass-2"
+    expires_at: "2030-01-02"
+`)
+	jsonPath := writeUsersFile(t, `{"users": [
+  {"id": 1, "name": "alice", "password": "pass-1", "speed_limit": 50, "download_limit": 100, "device_limit": 2},
+  {"id": 2, "name": "bob", "password": "pass-2", "expires_at": "2030-01-02"}
+]}`)
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		users, err := LoadFile(path)
+		if err != nil {
+			t.Fatalf("LoadFile failed: %v", err)
+		}
+		active, nextExpiry := ActiveUsers(users, time.Date(2029, 1, 1, 0, 0, 0, 0, time.Local))
+		if len(active) != 2 {
+			t.Fatalf("active users = %d, want 2", len(active))
+		}
+		alice := active[0]
+		if alice.ID != 1 || alice.UUID != "pass-1" || *alice.SpeedLimit != 50 || *alice.DownloadLimit != 100 || alice.UploadLimit != nil || *alice.DeviceLimit != 2 {
+			t.Errorf("alice = %+v", alice)
+		}
+		if want := time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local); !nextExpiry.Equal(want) {
+			t.Errorf("next expiry = %v, want %v", nextExpiry, want)
+		}
+
+		active, nextExpiry = ActiveUsers(users, time.Date(2030, 1, 2, 0, 0, 0, 0, time.Local))
+		if len(active) != 1 || active[0].ID != 1 || !nextExpiry.IsZero() {
+			t.Errorf("after expiry: active = %+v, next expiry = %v", active, nextExpiry)
+		}
+	}
+}
+
+func TestLoadFile_Invalid(t *testing.T) {
+	cases := map[string]string{
+		"id 必须大于 0":     "users:\n  - {id: 0, password: a}\n",
+		"id 2 重复":       "users:\n  - {id: 2, password: a}\n  - {id: 2, password: b}\n",
+		"password 不能为空": "users:\n  - {id: 1}\n",
+		"与其他用户重复":       "users:\n  - {id: 1, password: a}\n  - {id: 2, password: a}\n",
+		"expires_at 无效": "users:\n  - {id: 1, password: a, expires_at: tomorrow}\n",
+		"解析用户文件失败":      "users: [",
+	}
+	for want, content := range cases {
+		_, err := LoadFile(writeUsersFile(t, content))
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadFile(%q) error = %v, want containing %q", content, err, want)
+		}
+	}
+}
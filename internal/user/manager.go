@@ -5,14 +5,17 @@ import (
 	"sync/atomic"
 
 	"anytls/internal/api"
+	"anytls/internal/ratelimit"
 )
 
 // UserEntry 用户条目
 type UserEntry struct {
 	ID           int
 	UUID         string
-	SpeedLimit   int // Mbps, 0=不限
-	DeviceLimit  int // 0=不限
+	SpeedLimit   int              // Mbps, 0=不限
+	Limits       ratelimit.Limits // 上传/下载限速，未单独设置的方向使用 SpeedLimit
+	DeviceLimit  int              // 0=不限
+	Quota        *int64           // 面板下发的剩余流量（字节），nil=不限
 	PasswordHash [32]byte
 }
 
@@ -22,6 +25,14 @@ type UserTable struct {
 	byID           map[int]*UserEntry
 }
 
+// Diff 用户表更新前后的差异
+type Diff struct {
+	Removed     []int // 已从用户表移除的用户 ID
+	UUIDChanged []int // UUID 发生变化的用户 ID，旧 UUID 建立的会话应断开
+	// SpeedLimitChanged 限速发生变化的用户（新表中的条目）
+	SpeedLimitChanged []*UserEntry
+}
+
 // Manager 用户管理器
 type Manager struct {
 	users atomic.Value // *UserTable
@@ -49,9 +60,9 @@ func (m *Manager) Authenticate(passwordHash []byte) *UserEntry {
 	return table.byPasswordHash[hash]
 }
 
-// UpdateUsers 原子替换用户表
+// UpdateUsers 原子替换用户表，返回与旧表的差异
 // 从 API 用户列表构建新 UserTable，预计算 SHA256 哈希
-func (m *Manager) UpdateUsers(users []api.User) {
+func (m *Manager) UpdateUsers(users []api.User) Diff {
 	table := &UserTable{
 		byPasswordHash: make(map[[32]byte]*UserEntry, len(users)),
 		byID:           make(map[int]*UserEntry, len(users)),
@@ -67,14 +78,46 @@ func (m *Manager) UpdateUsers(users []api.User) {
 		if u.SpeedLimit != nil {
 			entry.SpeedLimit = *u.SpeedLimit
 		}
+		entry.Limits = ratelimit.Limits{Upload: entry.SpeedLimit, Download: entry.SpeedLimit}
+		if u.UploadLimit != nil {
+			entry.Limits.Upload = *u.UploadLimit
+		}
+		if u.DownloadLimit != nil {
+			entry.Limits.Download = *u.DownloadLimit
+		}
 		if u.DeviceLimit != nil {
 			entry.DeviceLimit = *u.DeviceLimit
 		}
+		if u.TransferEnable != nil && *u.TransferEnable > 0 {
+			remaining := *u.TransferEnable
+			if u.U != nil {
+				remaining -= *u.U
+			}
+			if u.D != nil {
+				remaining -= *u.D
+			}
+			entry.Quota = &remaining
+		}
 		table.byPasswordHash[hash] = entry
 		table.byID[u.ID] = entry
 	}
 
-	m.users.Store(table)
+	old := m.users.Swap(table).(*UserTable)
+	var diff Diff
+	for id, oldEntry := range old.byID {
+		entry, ok := table.byID[id]
+		if !ok {
+			diff.Removed = append(diff.Removed, id)
+			continue
+		}
+		if entry.UUID != oldEntry.UUID {
+			diff.UUIDChanged = append(diff.UUIDChanged, id)
+		}
+		if entry.Limits != oldEntry.Limits {
+			diff.SpeedLimitChanged = append(diff.SpeedLimitChanged, entry)
+		}
+	}
+	return diff
 }
 
 // GetUser 根据 ID 获取用户
@@ -83,6 +126,16 @@ func (m *Manager) GetUser(id int) *UserEntry {
 	return table.byID[id]
 }
 
+// Users 返回当前用户表中的全部用户
+func (m *Manager) Users() []*UserEntry {
+	table := m.users.Load().(*UserTable)
+	users := make([]*UserEntry, 0, len(table.byID))
+	for _, entry := range table.byID {
+		users = append(users, entry)
+	}
+	return users
+}
+
 // GetUserCount 获取当前用户数量
 func (m *Manager) GetUserCount() int {
 	table := m.users.Load().(*UserTable)
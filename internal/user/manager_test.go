@@ -201,3 +201,57 @@ func TestProperty2_ConcurrentSafety(t *testing.T) {
 
 	properties.TestingRun(t)
 }
+
+func TestUpdateUsers_Diff(t *testing.T) {
+	m := NewManager()
+	ten, twenty := 10, 20
+	diff := m.UpdateUsers([]api.User{
+		{ID: 1, UUID: "uuid-1", SpeedLimit: &ten},
+		{ID: 2, UUID: "uuid-2"},
+		{ID: 3, UUID: "uuid-3", SpeedLimit: &ten},
+	})
+	if len(diff.Removed) != 0 || len(diff.UUIDChanged) != 0 {
+		t.Errorf("first update diff = %+v, want empty", diff)
+	}
+
+	diff = m.UpdateUsers([]api.User{
+		{ID: 1, UUID: "uuid-1", SpeedLimit: &twenty},
+		{ID: 3, UUID: "uuid-3-reset", SpeedLimit: &ten},
+		{ID: 4, UUID: "uuid-4"},
+	})
+	if !reflect.DeepEqual(diff.Removed, []int{2}) {
+		t.Errorf("Removed = %v, want [2]", diff.Removed)
+	}
+	if !reflect.DeepEqual(diff.UUIDChanged, []int{3}) {
+		t.Errorf("UUIDChanged = %v, want [3]", diff.UUIDChanged)
+	}
+	if len(diff.SpeedLimitChanged) != 1 || diff.SpeedLimitChanged[0].ID != 1 || diff.SpeedLimitChanged[0].SpeedLimit != 20 {
+		t.Errorf("SpeedLimitChanged = %+v, want user 1 with 20", diff.SpeedLimitChanged)
+	}
+	if m.Authenticate(sha256Of("uuid-3")) != nil {
+		t.Error("old UUID of user 3 should no longer authenticate")
+	}
+}
+
+func sha256Of(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
+
+func TestUpdateUsers_Quota(t *testing.T) {
+	m := NewManager()
+	transfer, up, down, zero := int64(1000), int64(300), int64(200), int64(0)
+	m.UpdateUsers([]api.User{
+		{ID: 1, UUID: "uuid-1", TransferEnable: &transfer, U: &up, D: &down},
+		{ID: 2, UUID: "uuid-2", TransferEnable: &zero},
+		{ID: 3, UUID: "uuid-3"},
+	})
+	if q := m.GetUser(1).Quota; q == nil || *q != 500 {
+		t.Errorf("user 1 quota = %v, want 500", q)
+	}
+	for _, id := range []int{2, 3} {
+		if q := m.GetUser(id).Quota; q != nil {
+			t.Errorf("user %d quota = %d, want unlimited", id, *q)
+		}
+	}
+}
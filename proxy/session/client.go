@@ -38,10 +38,13 @@ type Client struct {
 
 	idleSessionTimeout time.Duration
 	minIdleSession     int
+
+	sessionOptions []Option
 }
 
 func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 	_padding *atomic.TypedValue[*padding.PaddingFactory], idleSessionCheckInterval, idleSessionTimeout time.Duration, minIdleSession int,
+	sessionOptions ...Option,
 ) *Client {
 	c := &Client{
 		sessions:           make(map[uint64]*Session),
@@ -49,6 +52,7 @@ func NewClient(ctx context.Context, dialOut util.DialOutFunc,
 		padding:            _padding,
 		idleSessionTimeout: idleSessionTimeout,
 		minIdleSession:     minIdleSession,
+		sessionOptions:     sessionOptions,
 	}
 	if idleSessionCheckInterval <= time.Second*5 {
 		idleSessionCheckInterval = time.Second * 30
@@ -142,7 +146,7 @@ func (c *Client) createSession(ctx context.Context) (*Session, error) {
 		return nil, err
 	}
 
-	session := NewClientSession(underlying, &padding.DefaultPaddingFactory)
+	session := NewClientSession(underlying, &padding.DefaultPaddingFactory, c.sessionOptions...)
 	session.seq = c.sessionCounter.Add(1)
 	session.dieHook = func() {
 		if clientDebugSessionPool {
@@ -2,6 +2,7 @@ package session
 
 import (
 	"encoding/binary"
+	"time"
 )
 
 const ( // cmds
@@ -17,10 +18,23 @@ const ( // cmds
 	cmdHeartRequest   = 8  // Keep alive command
 	cmdHeartResponse  = 9  // Keep alive command
 	cmdServerSettings = 10 // Settings (Server send to client)
+	// Since version 3
+	cmdUpdateWindow = 11 // Grants the peer more send window for a stream
 )
 
 const (
 	headerOverHeadSize = 1 + 4 + 2
+	maxFrameDataSize   = 65535
+)
+
+const (
+	// defaultStreamWindow is the per-stream receive window assumed until the peer announces its own
+	defaultStreamWindow = 256 * 1024
+	minStreamWindow     = 16 * 1024
+	// maxStreamWindow caps the buffered bytes a single stream may hold
+	maxStreamWindow = 16 * 1024 * 1024
+	// settleTimeout is how long the client waits for cmdServerSettings before assuming a v1 server
+	settleTimeout = time.Second * 3
 )
 
 // frame defines a packet from or to be multiplexed into a single connection
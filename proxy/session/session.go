@@ -5,6 +5,7 @@ import (
 	"anytls/util"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -44,6 +45,19 @@ type Session struct {
 
 	peerVersion byte
 
+	// keepalive
+	heartbeatInterval time.Duration
+	heartbeatMaxMiss  int
+	heartbeatOnce     sync.Once
+	framesReceived    atomic.Uint64 // any frame from the peer proves the session is alive
+
+	// flow control, since version 3
+	flowControl atomic.Bool
+	recvWindow  uint32        // per-stream receive window announced to the peer, 0 disables version 3
+	peerWindow  atomic.Int64  // per-stream receive window announced by the peer
+	settled     chan struct{} // closed once the peer's version is known
+	settleOnce  sync.Once
+
 	// client
 	isClient    bool
 	sendPadding bool
@@ -55,26 +69,71 @@ type Session struct {
 	onNewStream func(stream *Stream)
 }
 
-func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.PaddingFactory]) *Session {
+// Option configures optional behaviors of a Session
+type Option func(s *Session)
+
+// WithHeartbeat enables active keepalive checking. Once the peer is known to be v2 or later,
+// a cmdHeartRequest is sent every interval, and the session is closed when nothing at all has
+// been received from the peer for maxMiss intervals in a row. Any frame counts as an answer,
+// since a busy peer may be slow to reply behind queued data. A zero interval disables it.
+func WithHeartbeat(interval time.Duration, maxMiss int) Option {
+	return func(s *Session) {
+		if maxMiss <= 0 {
+			maxMiss = 3
+		}
+		s.heartbeatInterval = interval
+		s.heartbeatMaxMiss = maxMiss
+	}
+}
+
+// WithStreamWindow sets the per-stream receive window announced to the peer.
+// When both sides are v3 or later, a stream may only have this many unconsumed bytes in flight,
+// so a slow reader no longer blocks the other streams of the session. A zero size disables
+// flow control and the session falls back to version 2. Non-zero sizes are clamped to
+// [16KiB, 16MiB].
+func WithStreamWindow(size uint32) Option {
+	return func(s *Session) {
+		if size > 0 {
+			size = min(max(size, minStreamWindow), maxStreamWindow)
+		}
+		s.recvWindow = size
+	}
+}
+
+func NewClientSession(conn net.Conn, _padding *atomic.TypedValue[*padding.PaddingFactory], opts ...Option) *Session {
 	s := &Session{
 		conn:        conn,
 		isClient:    true,
 		sendPadding: true,
 		padding:     _padding,
+		recvWindow:  defaultStreamWindow,
 	}
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.peerWindow.Store(defaultStreamWindow)
+	s.settled = make(chan struct{})
+	for _, opt := range opts {
+		opt(s)
+	}
 	return s
 }
 
-func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding *atomic.TypedValue[*padding.PaddingFactory]) *Session {
+func NewServerSession(conn net.Conn, onNewStream func(stream *Stream), _padding *atomic.TypedValue[*padding.PaddingFactory], opts ...Option) *Session {
 	s := &Session{
 		conn:        conn,
 		onNewStream: onNewStream,
 		padding:     _padding,
+		recvWindow:  defaultStreamWindow,
 	}
 	s.die = make(chan struct{})
 	s.streams = make(map[uint32]*Stream)
+	s.peerWindow.Store(defaultStreamWindow)
+	// streams only exist after the client's settings, so the server always knows the peer's version
+	s.settled = make(chan struct{})
+	s.settle()
+	for _, opt := range opts {
+		opt(s)
+	}
 	return s
 }
 
@@ -85,15 +144,21 @@ func (s *Session) Run() {
 	}
 
 	settings := util.StringMap{
-		"v":           "2",
+		"v":           strconv.Itoa(int(s.localVersion())),
 		"client":      util.ProgramVersionName,
 		"padding-md5": s.padding.Load().Md5,
 	}
+	if s.recvWindow > 0 {
+		settings["stream-window"] = strconv.FormatUint(uint64(s.recvWindow), 10)
+	}
 	f := newFrame(cmdSettings, 0)
 	f.data = settings.ToBytes()
 	s.buffering = true
 	s.writeControlFrame(f)
 
+	// v1 servers never send cmdServerSettings
+	time.AfterFunc(settleTimeout, s.settle)
+
 	go s.recvLoop()
 }
 
@@ -131,6 +196,18 @@ func (s *Session) Close() error {
 	}
 }
 
+// Alert sends a cmdAlert with message to the client, which logs it and closes the session.
+// It is used by the SERVER before dropping a session on purpose.
+func (s *Session) Alert(message string) error {
+	if s.isClient {
+		return errors.New("alert can only be sent by the server")
+	}
+	f := newFrame(cmdAlert, 0)
+	f.data = []byte(message)
+	_, err := s.writeControlFrame(f)
+	return err
+}
+
 // OpenStream is used to create a new stream for CLIENT
 func (s *Session) OpenStream() (*Stream, error) {
 	if s.IsClosed() {
@@ -165,6 +242,8 @@ func (s *Session) OpenStream() (*Stream, error) {
 	case <-s.die:
 		return nil, io.ErrClosedPipe
 	default:
+		// initialized under streamLock so that a concurrent setPeerWindow can't miss it
+		stream.sendWindow.Store(s.peerWindow.Load())
 		s.streams[sid] = stream
 		return stream, nil
 	}
@@ -187,6 +266,7 @@ func (s *Session) recvLoop() error {
 		}
 		// read header first
 		if _, err := io.ReadFull(s.conn, hdr[:]); err == nil {
+			s.framesReceived.Add(1)
 			sid := hdr.StreamID()
 			switch hdr.Cmd() {
 			case cmdPSH:
@@ -196,10 +276,15 @@ func (s *Session) recvLoop() error {
 						s.streamLock.RLock()
 						stream, ok := s.streams[sid]
 						s.streamLock.RUnlock()
-						if ok {
-							stream.pipeW.Write(buffer)
+						if ok && s.flowControl.Load() {
+							// the stream takes ownership of buffer
+							stream.pushData(buffer)
+						} else {
+							if ok {
+								stream.pipeW.Write(buffer)
+							}
+							buf.Put(buffer)
 						}
-						buf.Put(buffer)
 					} else {
 						buf.Put(buffer)
 						return err
@@ -215,6 +300,7 @@ func (s *Session) recvLoop() error {
 				s.streamLock.Lock()
 				if _, ok := s.streams[sid]; !ok {
 					stream := newStream(sid, s)
+					stream.sendWindow.Store(s.peerWindow.Load())
 					s.streams[sid] = stream
 					go func() {
 						if s.onNewStream != nil {
@@ -253,7 +339,7 @@ func (s *Session) recvLoop() error {
 				delete(s.streams, sid)
 				s.streamLock.Unlock()
 				if ok {
-					stream.closeLocally()
+					stream.remoteClose()
 				}
 				//logrus.Debugln("stream fin", sid, s.streams)
 			case cmdWaste:
@@ -288,17 +374,24 @@ func (s *Session) recvLoop() error {
 						}
 						// check client's version
 						if v, err := strconv.Atoi(m["v"]); err == nil && v >= 2 {
-							s.peerVersion = byte(v)
+							s.peerVersion = min(byte(v), s.localVersion())
+							serverSettings := util.StringMap{
+								"v": strconv.Itoa(int(s.localVersion())),
+							}
+							if s.peerVersion >= 3 {
+								serverSettings["stream-window"] = strconv.FormatUint(uint64(s.recvWindow), 10)
+								s.peerWindow.Store(parseStreamWindow(m["stream-window"]))
+								s.flowControl.Store(true)
+							}
 							// send cmdServerSettings
 							f := newFrame(cmdServerSettings, 0)
-							f.data = util.StringMap{
-								"v": "2",
-							}.ToBytes()
+							f.data = serverSettings.ToBytes()
 							_, err = s.writeControlFrame(f)
 							if err != nil {
 								buf.Put(buffer)
 								return err
 							}
+							s.startHeartbeat()
 						}
 					}
 					buf.Put(buffer)
@@ -336,8 +429,7 @@ func (s *Session) recvLoop() error {
 					return err
 				}
 			case cmdHeartResponse:
-				// Active keepalive checking is not implemented yet
-				break
+				// counted in framesReceived like any other frame
 			case cmdServerSettings:
 				if hdr.Length() > 0 {
 					buffer := buf.Get(int(hdr.Length()))
@@ -349,7 +441,32 @@ func (s *Session) recvLoop() error {
 						// check server's version
 						m := util.StringMapFromBytes(buffer)
 						if v, err := strconv.Atoi(m["v"]); err == nil {
-							s.peerVersion = byte(v)
+							s.peerVersion = min(byte(v), s.localVersion())
+							if s.peerVersion >= 2 {
+								s.startHeartbeat()
+							}
+							if s.peerVersion >= 3 {
+								s.setPeerWindow(parseStreamWindow(m["stream-window"]))
+								s.flowControl.Store(true)
+							}
+						}
+						s.settle()
+					}
+					buf.Put(buffer)
+				}
+			case cmdUpdateWindow:
+				if hdr.Length() > 0 {
+					buffer := buf.Get(int(hdr.Length()))
+					if _, err := io.ReadFull(s.conn, buffer); err != nil {
+						buf.Put(buffer)
+						return err
+					}
+					if len(buffer) >= 4 {
+						s.streamLock.RLock()
+						stream, ok := s.streams[sid]
+						s.streamLock.RUnlock()
+						if ok {
+							stream.growSendWindow(int64(binary.BigEndian.Uint32(buffer)))
 						}
 					}
 					buf.Put(buffer)
@@ -363,6 +480,83 @@ func (s *Session) recvLoop() error {
 	}
 }
 
+// localVersion is the protocol version this session announces
+func (s *Session) localVersion() byte {
+	if s.recvWindow > 0 {
+		return 3
+	}
+	return 2
+}
+
+// setPeerWindow applies a newly announced peer window to the streams opened before it was known
+func (s *Session) setPeerWindow(window int64) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+	delta := window - s.peerWindow.Swap(window)
+	for _, stream := range s.streams {
+		stream.growSendWindow(delta)
+	}
+}
+
+func (s *Session) settle() {
+	s.settleOnce.Do(func() {
+		close(s.settled)
+	})
+}
+
+func (s *Session) isSettled() bool {
+	select {
+	case <-s.settled:
+		return true
+	default:
+		return false
+	}
+}
+
+func parseStreamWindow(value string) int64 {
+	if window, err := strconv.ParseUint(value, 10, 32); err == nil && window > 0 {
+		return int64(window)
+	}
+	return defaultStreamWindow
+}
+
+// startHeartbeat starts the keepalive loop once the peer is known to support cmdHeartRequest
+func (s *Session) startHeartbeat() {
+	if s.heartbeatInterval <= 0 {
+		return
+	}
+	s.heartbeatOnce.Do(func() {
+		go s.heartbeatLoop()
+	})
+}
+
+func (s *Session) heartbeatLoop() {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	var missed int
+	lastSeen := s.framesReceived.Load()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+		}
+		// a heartbeat only counts as missed if no frame at all arrived since it was sent
+		if seen := s.framesReceived.Load(); seen != lastSeen {
+			lastSeen = seen
+			missed = 0
+		} else if missed >= s.heartbeatMaxMiss {
+			logrus.Debugln("session heartbeat timeout:", s.seq, missed)
+			s.Close()
+			return
+		}
+		missed++
+		if _, err := s.writeControlFrame(newFrame(cmdHeartRequest, 0)); err != nil {
+			return
+		}
+	}
+}
+
 func (s *Session) streamClosed(sid uint32) error {
 	if s.IsClosed() {
 		return io.ErrClosedPipe
@@ -391,6 +585,13 @@ func (s *Session) writeDataFrame(sid uint32, data []byte) (int, error) {
 	return dataLen, nil
 }
 
+func (s *Session) writeWindowUpdate(sid uint32, increment uint32) error {
+	f := newFrame(cmdUpdateWindow, sid)
+	f.data = binary.BigEndian.AppendUint32(nil, increment)
+	_, err := s.writeControlFrame(f)
+	return err
+}
+
 func (s *Session) writeControlFrame(frame frame) (int, error) {
 	dataLen := len(frame.data)
 
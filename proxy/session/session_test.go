@@ -0,0 +1,309 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"anytls/proxy/padding"
+	"anytls/util"
+)
+
+// newSessionPair connects a client and a server session over net.Pipe.
+// Every stream accepted by the server is acknowledged and sent to the returned channel.
+func newSessionPair(t *testing.T, clientOpts, serverOpts []Option) (*Session, *Session, <-chan *Stream) {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	accepted := make(chan *Stream, 16)
+	server := NewServerSession(serverConn, func(stream *Stream) {
+		stream.HandshakeSuccess()
+		accepted <- stream
+	}, &padding.DefaultPaddingFactory, serverOpts...)
+	go server.Run()
+	client := NewClientSession(clientConn, &padding.DefaultPaddingFactory, clientOpts...)
+	client.Run()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server, accepted
+}
+
+func acceptStream(t *testing.T, accepted <-chan *Stream) *Stream {
+	t.Helper()
+	select {
+	case stream := <-accepted:
+		return stream
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the server to accept a stream")
+		return nil
+	}
+}
+
+func randomPayload(t *testing.T, size int) []byte {
+	t.Helper()
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// eventually polls cond until it holds or the timeout expires
+func eventually(t *testing.T, timeout time.Duration, cond func() bool, msg string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestSession_SlowReaderDoesNotStallOtherStreams verifies that with flow control a stream
+// whose reader stops consuming only blocks its own writer, and that reading it later restores
+// the window.
+func TestSession_SlowReaderDoesNotStallOtherStreams(t *testing.T) {
+	client, _, accepted := newSessionPair(t, nil, nil)
+
+	slow, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := randomPayload(t, 4*defaultStreamWindow)
+	written := make(chan error, 1)
+	go func() {
+		_, err := slow.Write(payload)
+		written <- err
+	}()
+	slowRemote := acceptStream(t, accepted)
+
+	// the writer must block once the window is used up instead of flooding the session
+	eventually(t, 5*time.Second, func() bool { return slow.sendWindow.Load() <= 0 }, "slow stream never exhausted its window")
+	select {
+	case err := <-written:
+		t.Fatalf("write to an unread stream finished early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !client.flowControl.Load() {
+		t.Fatal("flow control not negotiated between two v3 sessions")
+	}
+
+	fast, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fast.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	fastRemote := acceptStream(t, accepted)
+	fastRemote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(fastRemote, got); err != nil {
+		t.Fatalf("second stream stalled behind the slow one: %v", err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("got %q, want ping", got)
+	}
+
+	slowRemote.SetReadDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(payload))
+	if _, err := io.ReadFull(slowRemote, received); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatal("slow stream payload corrupted")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	// window updates are batched by half a window, anything less is still owed to the writer
+	eventually(t, 5*time.Second, func() bool {
+		return slow.sendWindow.Load() > client.peerWindow.Load()/2
+	}, "send window not restored after the reader caught up")
+}
+
+// TestSession_FINDrainsQueuedData verifies that data queued before a cmdFIN is still
+// delivered to the reader, and that closing the stream frees its receive queue.
+func TestSession_FINDrainsQueuedData(t *testing.T) {
+	client, server, accepted := newSessionPair(t, nil, nil)
+
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := randomPayload(t, defaultStreamWindow)
+	if _, err := stream.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	remote := acceptStream(t, accepted)
+	stream.Close()
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	// a remote close surfaces as net.ErrClosed once the queued data has been read
+	var received []byte
+	chunk := make([]byte, maxFrameDataSize)
+	for {
+		n, err := remote.Read(chunk)
+		received = append(received, chunk[:n]...)
+		if err != nil {
+			if os.IsTimeout(err) {
+				t.Fatal(err)
+			}
+			break
+		}
+	}
+	if !bytes.Equal(received, payload) {
+		t.Fatalf("received %d bytes, want %d", len(received), len(payload))
+	}
+	eventually(t, 5*time.Second, func() bool {
+		server.streamLock.RLock()
+		defer server.streamLock.RUnlock()
+		return len(server.streams) == 0
+	}, "server kept the closed stream")
+	remote.recvLock.Lock()
+	queued := remote.recvQueued
+	remote.recvLock.Unlock()
+	if queued != 0 {
+		t.Fatalf("%d bytes still queued after close", queued)
+	}
+}
+
+// TestSession_MixedVersions verifies that a v3 peer falls back to version 2 behavior
+// when the other side does not support flow control.
+func TestSession_MixedVersions(t *testing.T) {
+	cases := []struct {
+		name       string
+		clientOpts []Option
+		serverOpts []Option
+	}{
+		{"v3 client, v2 server", nil, []Option{WithStreamWindow(0)}},
+		{"v2 client, v3 server", []Option{WithStreamWindow(0)}, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			client, server, accepted := newSessionPair(t, c.clientOpts, c.serverOpts)
+
+			stream, err := client.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := randomPayload(t, 4*defaultStreamWindow)
+			written := make(chan error, 1)
+			go func() {
+				_, err := stream.Write(payload)
+				written <- err
+			}()
+			remote := acceptStream(t, accepted)
+			go io.Copy(remote, remote)
+
+			stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+			echoed := make([]byte, len(payload))
+			if _, err := io.ReadFull(stream, echoed); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echoed, payload) {
+				t.Fatal("echoed payload corrupted")
+			}
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+			if client.flowControl.Load() || server.flowControl.Load() {
+				t.Fatal("flow control enabled against a v2 peer")
+			}
+			if client.peerVersion != 2 || server.peerVersion != 2 {
+				t.Fatalf("peer versions = %d/%d, want 2/2", client.peerVersion, server.peerVersion)
+			}
+		})
+	}
+}
+
+// fakePeer answers a client session over net.Pipe with a v2 cmdServerSettings, then drains
+// everything the client sends without ever replying to cmdHeartRequest.
+func fakePeer(t *testing.T, peer net.Conn) {
+	t.Helper()
+	go io.Copy(io.Discard, peer)
+	f := newFrame(cmdServerSettings, 0)
+	f.data = util.StringMap{"v": "2"}.ToBytes()
+	if err := writeRawFrame(peer, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeRawFrame(conn net.Conn, f frame) error {
+	b := make([]byte, headerOverHeadSize, headerOverHeadSize+len(f.data))
+	b[0] = f.cmd
+	binary.BigEndian.PutUint32(b[1:5], f.sid)
+	binary.BigEndian.PutUint16(b[5:7], uint16(len(f.data)))
+	_, err := conn.Write(append(b, f.data...))
+	return err
+}
+
+func newHeartbeatClient(t *testing.T) (*Session, net.Conn) {
+	t.Helper()
+	clientConn, peerConn := net.Pipe()
+	client := NewClientSession(clientConn, &padding.DefaultPaddingFactory, WithHeartbeat(20*time.Millisecond, 3))
+	client.Run()
+	t.Cleanup(func() {
+		client.Close()
+		peerConn.Close()
+	})
+	fakePeer(t, peerConn)
+	// flush the buffered settings so that heartbeats reach the wire
+	stream, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	return client, peerConn
+}
+
+// TestSession_HeartbeatClosesDeadSession verifies that a session whose peer has gone silent
+// is closed after maxMiss unanswered heartbeats.
+func TestSession_HeartbeatClosesDeadSession(t *testing.T) {
+	client, _ := newHeartbeatClient(t)
+	eventually(t, 2*time.Second, client.IsClosed, "session not closed after the peer went silent")
+}
+
+// TestSession_HeartbeatBusyPeer verifies that a peer which keeps sending frames is not
+// declared dead even if its heartbeat replies are delayed.
+func TestSession_HeartbeatBusyPeer(t *testing.T) {
+	client, peer := newHeartbeatClient(t)
+
+	busyUntil := time.Now().Add(300 * time.Millisecond)
+	for time.Now().Before(busyUntil) {
+		f := newFrame(cmdWaste, 0)
+		f.data = make([]byte, 16)
+		if err := writeRawFrame(peer, f); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if client.IsClosed() {
+		t.Fatal("busy session closed by heartbeat")
+	}
+	eventually(t, 2*time.Second, client.IsClosed, "session not closed after the peer went silent")
+}
+
+func TestWithStreamWindow_Clamp(t *testing.T) {
+	for _, tc := range []struct{ size, want uint32 }{
+		{0, 0},
+		{1, minStreamWindow},
+		{defaultStreamWindow, defaultStreamWindow},
+		{1 << 31, maxStreamWindow},
+	} {
+		s := &Session{}
+		WithStreamWindow(tc.size)(s)
+		if s.recvWindow != tc.want {
+			t.Errorf("WithStreamWindow(%d): recvWindow = %d, want %d", tc.size, s.recvWindow, tc.want)
+		}
+	}
+}
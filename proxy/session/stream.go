@@ -7,6 +7,9 @@ import (
 	"os"
 	"sync"
 	"time"
+
+	"github.com/sagernet/sing/common/atomic"
+	"github.com/sagernet/sing/common/buf"
 )
 
 // Stream implements net.Conn
@@ -20,10 +23,22 @@ type Stream struct {
 	writeDeadline pipe.PipeDeadline
 
 	dieOnce sync.Once
+	die     chan struct{}
 	dieHook func()
 	dieErr  error
 
 	reportOnce sync.Once
+
+	// flow control, since version 3
+	sendWindow atomic.Int64
+	sendNotify chan struct{}
+
+	recvLock    sync.Mutex
+	recvQueue   [][]byte // nil element marks the remote FIN
+	recvQueued  int
+	recvNotify  chan struct{}
+	recvDrained chan struct{}
+	recvPumping bool
 }
 
 // newStream initiates a Stream struct
@@ -33,6 +48,10 @@ func newStream(id uint32, sess *Session) *Stream {
 	s.sess = sess
 	s.pipeR, s.pipeW = pipe.Pipe()
 	s.writeDeadline = pipe.MakePipeDeadline()
+	s.die = make(chan struct{})
+	s.sendNotify = make(chan struct{}, 1)
+	s.recvNotify = make(chan struct{}, 1)
+	s.recvDrained = make(chan struct{}, 1)
 	return s
 }
 
@@ -55,10 +74,169 @@ func (s *Stream) Write(b []byte) (n int, err error) {
 	if s.dieErr != nil {
 		return 0, s.dieErr
 	}
-	n, err = s.sess.writeDataFrame(s.id, b)
+	if len(b) == 0 {
+		return s.sess.writeDataFrame(s.id, b)
+	}
+	for len(b) > 0 {
+		chunk := b[:min(len(b), maxFrameDataSize)]
+		window, err := s.waitSendWindow()
+		if err != nil {
+			return n, err
+		}
+		chunk = chunk[:min(int64(len(chunk)), window)]
+		// always accounted, flow control may be enabled by a later cmdServerSettings
+		s.sendWindow.Add(-int64(len(chunk)))
+		nw, err := s.sess.writeDataFrame(s.id, chunk)
+		n += nw
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
 	return
 }
 
+// waitSendWindow blocks until the peer allows us to send more data on this stream.
+// Until the peer's version is known, the default window is respected as well.
+func (s *Stream) waitSendWindow() (int64, error) {
+	for {
+		if window := s.sendWindow.Load(); window > 0 {
+			return window, nil
+		}
+		settled := s.sess.settled
+		if s.sess.isSettled() {
+			if !s.sess.flowControl.Load() {
+				return maxFrameDataSize, nil
+			}
+			settled = nil
+		}
+		select {
+		case <-s.sendNotify:
+		case <-settled:
+		case <-s.die:
+			return 0, s.dieErr
+		case <-s.sess.die:
+			return 0, io.ErrClosedPipe
+		case <-s.writeDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (s *Stream) growSendWindow(delta int64) {
+	s.sendWindow.Add(delta)
+	notify(s.sendNotify)
+}
+
+// pushData queues data received from the peer without blocking the session's recvLoop.
+// If the peer overruns the window (e.g. data sent before it learned our settings),
+// it falls back to back-pressuring the recvLoop like version 2 does.
+// The stream takes ownership of b.
+func (s *Stream) pushData(b []byte) {
+	limit := int(s.sess.recvWindow) + defaultStreamWindow
+	s.recvLock.Lock()
+	for s.recvQueued > 0 && s.recvQueued+len(b) > limit {
+		s.recvLock.Unlock()
+		select {
+		case <-s.recvDrained:
+		case <-s.die:
+			buf.Put(b)
+			return
+		}
+		s.recvLock.Lock()
+	}
+	select {
+	case <-s.die:
+		s.recvLock.Unlock()
+		buf.Put(b)
+		return
+	default:
+	}
+	s.recvQueue = append(s.recvQueue, b)
+	s.recvQueued += len(b)
+	if !s.recvPumping {
+		s.recvPumping = true
+		go s.recvPump()
+	}
+	s.recvLock.Unlock()
+	notify(s.recvNotify)
+}
+
+// remoteClose handles cmdFIN, data queued before it is still delivered to the reader
+func (s *Stream) remoteClose() {
+	s.recvLock.Lock()
+	if s.recvPumping {
+		s.recvQueue = append(s.recvQueue, nil)
+		s.recvLock.Unlock()
+		notify(s.recvNotify)
+		return
+	}
+	s.recvLock.Unlock()
+	s.closeLocally()
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// recvPump hands queued data to the reader and returns the consumed window to the peer
+func (s *Stream) recvPump() {
+	defer s.dropRecvQueue()
+
+	var consumed uint32
+	threshold := max(s.sess.recvWindow/2, 1)
+	for {
+		s.recvLock.Lock()
+		if len(s.recvQueue) == 0 {
+			s.recvLock.Unlock()
+			select {
+			case <-s.recvNotify:
+				continue
+			case <-s.die:
+				return
+			}
+		}
+		b := s.recvQueue[0]
+		s.recvQueue[0] = nil
+		s.recvQueue = s.recvQueue[1:]
+		s.recvQueued -= len(b)
+		s.recvLock.Unlock()
+		notify(s.recvDrained)
+
+		if b == nil {
+			s.closeLocally()
+			return
+		}
+		n, err := s.pipeW.Write(b)
+		buf.Put(b)
+		if err != nil {
+			return
+		}
+		consumed += uint32(n)
+		if consumed >= threshold {
+			if s.sess.writeWindowUpdate(s.id, consumed) != nil {
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+func (s *Stream) dropRecvQueue() {
+	s.recvLock.Lock()
+	for _, b := range s.recvQueue {
+		if b != nil {
+			buf.Put(b)
+		}
+	}
+	s.recvQueue = nil
+	s.recvQueued = 0
+	s.recvLock.Unlock()
+}
+
 // Close implements net.Conn
 func (s *Stream) Close() error {
 	return s.closeWithError(io.ErrClosedPipe)
@@ -70,6 +248,7 @@ func (s *Stream) closeLocally() {
 	s.dieOnce.Do(func() {
 		s.dieErr = net.ErrClosed
 		s.pipeR.Close()
+		close(s.die)
 		once = true
 	})
 	if once {
@@ -85,6 +264,7 @@ func (s *Stream) closeWithError(err error) error {
 	s.dieOnce.Do(func() {
 		s.dieErr = err
 		s.pipeR.Close()
+		close(s.die)
 		once = true
 	})
 	if once {
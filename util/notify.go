@@ -0,0 +1,26 @@
+package util
+
+import (
+	"net"
+	"os"
+)
+
+// SdNotify 向 systemd 发送服务状态通知（sd_notify 协议），如 "READY=1"
+// 不是由 Type=notify 的 systemd 服务启动（没有 NOTIFY_SOCKET）时什么也不做
+func SdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// 以 @ 开头表示抽象命名空间的 socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}